@@ -0,0 +1,346 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ecommerce/notify"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// AbandonedCart records a user's cart that went untouched for longer than
+// the idle window. AbandonedAt is when the cart was last changed; changing
+// it again starts a new record the next time it goes idle. Items counts the
+// cart's lines. A record is open until the user places an order
+// (RecoveredAt) or the cart expires.
+type AbandonedCart struct {
+	ID            string     `json:"id"`
+	UserID        string     `json:"user_id"`
+	AbandonedAt   time.Time  `json:"abandoned_at"`
+	Items         int        `json:"items"`
+	Total         float64    `json:"total"`
+	RemindersSent int        `json:"reminders_sent"`
+	OrderID       string     `json:"order_id,omitempty"`
+	RecoveredAt   *time.Time `json:"recovered_at,omitempty"`
+	ExpiredAt     *time.Time `json:"expired_at,omitempty"`
+}
+
+func (a AbandonedCart) open() bool {
+	return a.RecoveredAt == nil && a.ExpiredAt == nil
+}
+
+// AbandonedCartConfig controls when carts count as abandoned, when
+// reminders go out and when carts are thrown away
+type AbandonedCartConfig struct {
+	// IdleAfter is how long a cart must go untouched to count as abandoned
+	IdleAfter time.Duration
+	// Reminders are the delays after a cart was last changed at which
+	// reminders are sent, shortest first
+	Reminders []time.Duration
+	// Channel is how reminders are sent: ChannelEmail to the account's
+	// address, or ChannelSMS to the phone on the user's latest order
+	Channel string
+	// ExpireAfter is how long a cart may go untouched before it is deleted.
+	// Guest carts expire too but are never reminded.
+	ExpireAfter time.Duration
+}
+
+// DefaultAbandonedCartConfig reminds customers an hour and a day after
+// they last touched their cart, by email, and deletes carts after 30 days
+var DefaultAbandonedCartConfig = AbandonedCartConfig{
+	IdleAfter:   time.Hour,
+	Reminders:   []time.Duration{time.Hour, 24 * time.Hour},
+	Channel:     ChannelEmail,
+	ExpireAfter: 30 * 24 * time.Hour,
+}
+
+var abandonedCartConfig = DefaultAbandonedCartConfig
+
+// SetAbandonedCartConfig replaces the abandoned cart settings
+func SetAbandonedCartConfig(cfg AbandonedCartConfig) error {
+	if cfg.IdleAfter <= 0 || cfg.ExpireAfter <= cfg.IdleAfter {
+		return errors.New("carts must expire after they go idle")
+	}
+	if cfg.Channel != ChannelEmail && cfg.Channel != ChannelSMS {
+		return fmt.Errorf("unknown reminder channel %q", cfg.Channel)
+	}
+	last := cfg.IdleAfter
+	for _, d := range cfg.Reminders {
+		if d < last || d >= cfg.ExpireAfter {
+			return errors.New("reminders must be in order, between going idle and expiring")
+		}
+		last = d
+	}
+	abandonedCartConfig = cfg
+	return nil
+}
+
+// RunAbandonedCarts processes idle carts every interval until ctx is done
+func RunAbandonedCarts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := ProcessAbandonedCarts(ctx, now)
+			if err != nil {
+				AppLogger.Error.Printf("Error processing abandoned carts: %v", err)
+			} else if n > 0 {
+				AppLogger.Info.Printf("Sent %d abandoned cart reminder(s)", n)
+			}
+		}
+	}
+}
+
+// remindersDue returns how many reminders are due on a cart idle for idle
+func remindersDue(cfg AbandonedCartConfig, idle time.Duration) int {
+	n := 0
+	for _, d := range cfg.Reminders {
+		if idle >= d {
+			n++
+		}
+	}
+	return n
+}
+
+// ProcessAbandonedCarts records the carts that have been idle since before
+// the idle window, sends each the reminder now due, and deletes carts idle
+// past expiry. Reminders that fell due while the job was not running are
+// not sent in a burst: only the latest is. Like subscription alerts, each
+// reminder is claimed before sending and released if sending fails. It
+// returns the number of reminders sent.
+func ProcessAbandonedCarts(ctx context.Context, now time.Time) (int, error) {
+	cfg := abandonedCartConfig
+	carts, err := store.Carts.ListIdle(ctx, now.Add(-cfg.IdleAfter))
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, cart := range carts {
+		guest := strings.HasPrefix(cart.UserID, guestCartPrefix)
+		idle := now.Sub(cart.UpdatedAt)
+		if idle >= cfg.ExpireAfter {
+			if err := expireCart(ctx, cart, guest, now); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if guest || len(cart.Items) == 0 {
+			continue
+		}
+
+		record, err := store.AbandonedCarts.Open(ctx, AbandonedCart{
+			ID:          uuid.New().String(),
+			UserID:      cart.UserID,
+			AbandonedAt: cart.UpdatedAt,
+			Items:       len(cart.Items),
+			Total:       cart.Total,
+		})
+		if err != nil {
+			return sent, err
+		}
+		due := remindersDue(cfg, idle)
+		if !record.open() || record.RemindersSent >= due {
+			continue
+		}
+
+		ok, err := sendCartReminder(ctx, cfg, &cart, record, due)
+		if err != nil {
+			return sent, err
+		}
+		if ok {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// expireCart deletes a cart idle past expiry and closes its record. Carts
+// changed since they were listed are left alone.
+func expireCart(ctx context.Context, cart Cart, guest bool, now time.Time) error {
+	err := store.Carts.Expire(ctx, cart.UserID, cart.UpdatedAt)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil || guest {
+		return err
+	}
+	err = store.AbandonedCarts.Expire(ctx, cart.UserID, cart.UpdatedAt, now)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// reminderDestination returns where the user's reminders go on the channel,
+// or "" if there is nowhere to send them
+func reminderDestination(ctx context.Context, channel, userID string) (string, error) {
+	if channel == ChannelEmail {
+		user, err := store.Users.Get(ctx, userID)
+		if errors.Is(err, ErrNotFound) {
+			return "", nil
+		}
+		return user.Email, err
+	}
+
+	orders, err := store.Orders.ListByUser(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	var latest *Order
+	for i := range orders {
+		if orders[i].DeliveryDetails.Phone != "" && (latest == nil || orders[i].CreatedAt.After(latest.CreatedAt)) {
+			latest = &orders[i]
+		}
+	}
+	if latest == nil {
+		return "", nil
+	}
+	return latest.DeliveryDetails.Phone, nil
+}
+
+// cartReminderMessage lists what is in the cart at today's prices
+func cartReminderMessage(cart *Cart, to string, n int) notify.Message {
+	msg := notify.Message{To: []string{to}, Subject: "You left something in your cart"}
+	if n > 1 {
+		msg.Subject = "Your cart is still waiting"
+	}
+	var b strings.Builder
+	b.WriteString("Your cart at The Dot Liquor Store is saved:\n\n")
+	for _, item := range cart.Items {
+		fmt.Fprintf(&b, "  %d x %s  KES %.2f\n", item.Quantity, item.Name, item.Price*float64(item.Quantity))
+	}
+	fmt.Fprintf(&b, "\nTotal: KES %.2f\nComplete your order at /cart.", cart.Total)
+	msg.Body = b.String()
+	return msg
+}
+
+// sendCartReminder sends the due reminder about a cart. It reports false
+// without sending if the user has nowhere to send it or another run claimed
+// it first.
+func sendCartReminder(ctx context.Context, cfg AbandonedCartConfig, cart *Cart, record AbandonedCart, due int) (bool, error) {
+	to, err := reminderDestination(ctx, cfg.Channel, cart.UserID)
+	if err != nil || to == "" {
+		return false, err
+	}
+	if err := repriceCart(ctx, cart); err != nil {
+		return false, err
+	}
+
+	claimed, err := store.AbandonedCarts.ClaimReminder(ctx, record.ID, record.RemindersSent, due)
+	if err != nil || !claimed {
+		return false, err
+	}
+	if err := channelSender(cfg.Channel).Send(ctx, cartReminderMessage(cart, to, due)); err != nil {
+		AppLogger.Error.Printf("Error sending cart reminder %s: %v", record.ID, err)
+		if err := store.AbandonedCarts.ReleaseReminder(ctx, record.ID, record.RemindersSent, due); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// recoverAbandonedCart credits an order to the user's latest abandoned cart
+func recoverAbandonedCart(ctx context.Context, order Order) {
+	if err := store.AbandonedCarts.Recover(ctx, order.UserID, order.ID, order.CreatedAt); err != nil {
+		AppLogger.Error.Printf("Error recording cart recovery for order %s: %v", order.ID, err)
+	}
+}
+
+// AbandonedCartReport sums up carts abandoned over the last Days days.
+// AbandonmentRate is the share of shopping that stalled: abandoned carts
+// over abandoned carts plus orders that did not come from one.
+// RecoveryRate is the share of abandoned carts that became orders, and
+// ReminderRecoveryRate the share of reminded carts that did.
+type AbandonedCartReport struct {
+	Days                   int     `json:"days"`
+	Abandoned              int     `json:"abandoned"`
+	Reminded               int     `json:"reminded"`
+	RemindersSent          int     `json:"reminders_sent"`
+	Recovered              int     `json:"recovered"`
+	RecoveredAfterReminder int     `json:"recovered_after_reminder"`
+	Expired                int     `json:"expired"`
+	Orders                 int     `json:"orders"`
+	AbandonedValue         float64 `json:"abandoned_value"`
+	RecoveredValue         float64 `json:"recovered_value"`
+	AbandonmentRate        float64 `json:"abandonment_rate"`
+	RecoveryRate           float64 `json:"recovery_rate"`
+	ReminderRecoveryRate   float64 `json:"reminder_recovery_rate"`
+}
+
+// rate returns n/d rounded to four places, or 0 when d is 0
+func rate(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return math.Round(float64(n)/float64(d)*10000) / 10000
+}
+
+// abandonedCartReport builds the report from the carts abandoned and the
+// orders placed in the window
+func abandonedCartReport(carts []AbandonedCart, orders, days int) AbandonedCartReport {
+	report := AbandonedCartReport{Days: days, Abandoned: len(carts), Orders: orders}
+	for _, cart := range carts {
+		report.AbandonedValue += cart.Total
+		report.RemindersSent += cart.RemindersSent
+		if cart.RemindersSent > 0 {
+			report.Reminded++
+		}
+		switch {
+		case cart.RecoveredAt != nil:
+			report.Recovered++
+			report.RecoveredValue += cart.Total
+			if cart.RemindersSent > 0 {
+				report.RecoveredAfterReminder++
+			}
+		case cart.ExpiredAt != nil:
+			report.Expired++
+		}
+	}
+	report.AbandonedValue = roundCents(report.AbandonedValue)
+	report.RecoveredValue = roundCents(report.RecoveredValue)
+	report.AbandonmentRate = rate(report.Abandoned, report.Abandoned+orders-report.Recovered)
+	report.RecoveryRate = rate(report.Recovered, report.Abandoned)
+	report.ReminderRecoveryRate = rate(report.RecoveredAfterReminder, report.Reminded)
+	return report
+}
+
+// AdminAbandonedCarts reports abandonment and recovery over the last
+// ?days= (default 30)
+func AdminAbandonedCarts(c *gin.Context) {
+	days := defaultSalesWindow
+	if v := c.Query("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 365"})
+			return
+		}
+		days = n
+	}
+
+	ctx := c.Request.Context()
+	since := time.Now().AddDate(0, 0, -days)
+	carts, err := store.AbandonedCarts.ListSince(ctx, since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load abandoned carts"})
+		return
+	}
+	orders, err := store.Orders.ListSince(ctx, since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load orders"})
+		return
+	}
+	c.JSON(http.StatusOK, abandonedCartReport(carts, len(orders), days))
+}
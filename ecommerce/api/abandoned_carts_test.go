@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCheckedOutCartIsNotReminded(t *testing.T) {
+	r := newTestServer(t)
+	seedProduct(t, Product{ID: "vodka", Name: "Grey Goose", Price: 49.99, Stock: 10})
+	sender := &countingSender{}
+	SetChannel(ChannelEmail, sender)
+	t.Cleanup(func() { SetChannel(ChannelEmail, nil) })
+
+	err := store.Users.Create(context.Background(), User{ID: "user-1", Email: "user@example.com", Name: "User"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []CartItemRequest{{ProductID: "whisky", Quantity: 2}, {ProductID: "vodka", Quantity: 1}} {
+		code, err := do(r, "user-1", http.MethodPost, "/api/v1/cart/add", item, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Fatalf("add to cart returned %d", code)
+		}
+	}
+
+	// Ordering part of the cart leaves the rest
+	order := func(item OrderItem) {
+		t.Helper()
+		req := OrderRequest{
+			Items: []OrderItem{item},
+			DeliveryDetails: DeliveryDetails{
+				Name: "Test", Address: "1 Moi Avenue", City: "Nairobi", Phone: "0712345678",
+			},
+			PaymentMethod: "mpesa",
+		}
+		code, err := do(r, "user-1", http.MethodPost, "/api/v1/orders", req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusCreated {
+			t.Fatalf("order returned %d", code)
+		}
+	}
+	order(OrderItem{ID: "whisky", Quantity: 1})
+	var cart Cart
+	if _, err := do(r, "user-1", http.MethodGet, "/api/v1/cart", nil, &cart); err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 2 || cart.Items[0].Quantity != 1 || cart.Items[1].Quantity != 1 {
+		t.Fatalf("expected one whisky and one vodka left, got %+v", cart.Items)
+	}
+
+	order(OrderItem{ID: "whisky", Quantity: 1})
+	order(OrderItem{ID: "vodka", Quantity: 1})
+	if _, err := do(r, "user-1", http.MethodGet, "/api/v1/cart", nil, &cart); err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 0 {
+		t.Fatalf("expected an empty cart after checkout, got %+v", cart.Items)
+	}
+
+	n, err := ProcessAbandonedCarts(context.Background(), time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || sender.sent.Load() != 0 {
+		t.Fatalf("sent %d reminder(s) about a cart that was checked out", sender.sent.Load())
+	}
+}
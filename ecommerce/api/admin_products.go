@@ -0,0 +1,212 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProductUpdate is a partial product update; nil fields are left unchanged
+type ProductUpdate struct {
+	Name         *string  `json:"name"`
+	Description  *string  `json:"description"`
+	Price        *float64 `json:"price"`
+	Stock        *int     `json:"stock"`
+	Image        *string  `json:"image"`
+	Category     *string  `json:"category"`
+	ReorderLevel *int     `json:"reorder_level"`
+	// Attributes replaces all of the product's attributes when set
+	Attributes *Attributes `json:"attributes"`
+	// Variants replaces the product's full variant list when set
+	Variants *[]Variant `json:"variants"`
+	// Bundle replaces the bundle's contents when set; an empty list turns
+	// the bundle into an ordinary product
+	Bundle *[]BundleItem `json:"bundle"`
+	// Reason is recorded in the stock ledger if the update changes stock
+	Reason string `json:"reason"`
+}
+
+// RestockRequest adds units to a product's stock. SKU selects the variant
+// for products sold in several sizes. Reference names the delivery, such as
+// a purchase order number.
+type RestockRequest struct {
+	SKU       string `json:"sku"`
+	Quantity  int    `json:"quantity" binding:"required,gt=0"`
+	Reason    string `json:"reason"`
+	Reference string `json:"reference"`
+}
+
+// apply copies the set fields onto the product
+func (u ProductUpdate) apply(p *Product) error {
+	if u.Variants != nil {
+		p.Variants = *u.Variants
+	}
+	if len(p.Variants) > 0 && (u.Price != nil || u.Stock != nil) {
+		return errors.New("price and stock are set per variant for products with variants")
+	}
+	if u.Bundle != nil {
+		p.Bundle = *u.Bundle
+	}
+	if p.IsBundle() && u.Stock != nil {
+		return ErrBundleStock
+	}
+
+	if u.Name != nil {
+		p.Name = *u.Name
+	}
+	if u.Description != nil {
+		p.Description = *u.Description
+	}
+	if u.Price != nil {
+		p.Price = *u.Price
+	}
+	if u.Stock != nil {
+		p.Stock = *u.Stock
+	}
+	if u.Image != nil && *u.Image != p.Image {
+		// An image set by URL has no generated thumbnail
+		p.Image = *u.Image
+		p.Thumbnail = ""
+	}
+	if u.Category != nil {
+		p.Category = *u.Category
+	}
+	if u.ReorderLevel != nil {
+		p.ReorderLevel = *u.ReorderLevel
+	}
+	if u.Attributes != nil {
+		p.Attributes = *u.Attributes
+	}
+	return nil
+}
+
+// validationError marks errors caused by invalid input rather than storage failures
+type validationError struct {
+	err error
+}
+
+func (e validationError) Error() string { return e.err.Error() }
+
+// AdminListProducts lists the catalog including archived products. It takes
+// the same query parameters as GetProducts and always responds with a
+// ProductPage.
+func AdminListProducts(c *gin.Context) {
+	q, err := parseProductQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.IncludeArchived = true
+	searchProducts(c, q, true)
+}
+
+// UpdateProduct applies a partial update to a product
+func UpdateProduct(c *gin.Context) {
+	var update ProductUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := WithMovement(c.Request.Context(), MovementSource{
+		Type:   MovementAdjustment,
+		Actor:  GetUserFromContext(c),
+		Reason: update.Reason,
+	})
+	// The catalog is loaded up front as the store is locked while fn runs
+	var catalog []Product
+	if update.Bundle != nil || update.Variants != nil {
+		var err error
+		if catalog, err = store.Products.List(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load products"})
+			return
+		}
+	}
+	product, err := store.Products.Update(ctx, c.Param("id"), func(p *Product) error {
+		if err := update.apply(p); err != nil {
+			return validationError{err}
+		}
+		// Validate the merged product against the same binding rules used on create
+		if err := ValidateProduct(p); err != nil {
+			return validationError{err}
+		}
+		if update.Category != nil {
+			if err := checkCategory(ctx, p.Category); errors.Is(err, ErrUnknownCategory) {
+				return validationError{err}
+			} else if err != nil {
+				return err
+			}
+		}
+		if catalog != nil {
+			if err := ValidateBundle(catalog, *p); err != nil {
+				return validationError{err}
+			}
+		}
+		if update.Attributes != nil || update.Category != nil {
+			return checkAttributes(ctx, *p)
+		}
+		return nil
+	})
+	respondProduct(c, product, err)
+}
+
+// ArchiveProduct soft-deletes a product, hiding it from the storefront
+func ArchiveProduct(c *gin.Context) {
+	product, err := store.Products.Update(c.Request.Context(), c.Param("id"), func(p *Product) error {
+		if p.ArchivedAt == nil {
+			now := time.Now()
+			p.ArchivedAt = &now
+		}
+		return nil
+	})
+	respondProduct(c, product, err)
+}
+
+// RestoreProduct makes an archived product visible again
+func RestoreProduct(c *gin.Context) {
+	product, err := store.Products.Update(c.Request.Context(), c.Param("id"), func(p *Product) error {
+		p.ArchivedAt = nil
+		return nil
+	})
+	respondProduct(c, product, err)
+}
+
+// RestockProduct adds delivered units to a product's stock
+func RestockProduct(c *gin.Context) {
+	var req RestockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := WithMovement(c.Request.Context(), MovementSource{
+		Type:      MovementRestock,
+		Actor:     GetUserFromContext(c),
+		Reason:    req.Reason,
+		Reference: req.Reference,
+	})
+	product, err := store.Products.AdjustStock(ctx, c.Param("id"), req.SKU, req.Quantity)
+	respondProduct(c, product, err)
+}
+
+// respondProduct writes the result of an admin product mutation
+func respondProduct(c *gin.Context, product Product, err error) {
+	var invalid validationError
+	switch {
+	case err == nil:
+		notifySubscribers(product.ID)
+		c.JSON(http.StatusOK, product)
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+	case errors.As(err, &invalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": invalid.Error()})
+	case errors.Is(err, ErrUnknownSKU), errors.Is(err, ErrSKURequired), errors.Is(err, ErrBundleStock):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrDuplicateSKU):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product"})
+	}
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newAdminServer installs a fresh in-memory store holding one product and an
+// admin user, and returns the application's router
+func newAdminServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	r := newTestServer(t)
+	err := store.Users.Create(context.Background(), User{ID: "admin", Email: "admin@example.com", Role: RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	r := newAdminServer(t)
+	err := store.Users.Create(context.Background(), User{ID: "customer", Email: "c@example.com", Role: RoleCustomer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A valid token for an account that no longer exists is refused too
+	for user, want := range map[string]int{
+		"admin":    http.StatusOK,
+		"customer": http.StatusForbidden,
+		"deleted":  http.StatusForbidden,
+	} {
+		code, err := do(r, user, http.MethodGet, "/api/v1/admin/products", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Errorf("%s listing products returned %d, want %d", user, code, want)
+		}
+	}
+}
+
+func TestCreateProduct(t *testing.T) {
+	r := newAdminServer(t)
+
+	// The ID and archive state come from the server, not the request
+	var created Product
+	code, err := do(r, "admin", http.MethodPost, "/api/v1/admin/products", map[string]interface{}{
+		"id": "whisky", "name": "Gin", "price": 39.99, "archived_at": "2024-01-01T00:00:00Z",
+	}, &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusCreated {
+		t.Fatalf("create returned %d", code)
+	}
+	if created.ID == "whisky" || created.ArchivedAt != nil || created.Stock != 0 || created.Image == "" {
+		t.Fatalf("unexpected product %+v", created)
+	}
+
+	for name, body := range map[string]map[string]interface{}{
+		"missing name":   {"price": 39.99, "stock": 3},
+		"zero price":     {"name": "Gin", "price": 0, "stock": 3},
+		"negative stock": {"name": "Gin", "price": 39.99, "stock": -1},
+	} {
+		code, err := do(r, "admin", http.MethodPost, "/api/v1/admin/products", body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusBadRequest {
+			t.Errorf("%s returned %d, want %d", name, code, http.StatusBadRequest)
+		}
+	}
+	products, err := store.Products.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 {
+		t.Fatalf("store holds %d products, want 2", len(products))
+	}
+}
+
+func TestUpdateProduct(t *testing.T) {
+	r := newAdminServer(t)
+
+	var updated Product
+	code, err := do(r, "admin", http.MethodPatch, "/api/v1/admin/products/whisky", map[string]interface{}{"price": 279.99}, &updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || updated.Price != 279.99 || updated.Name != "Macallan 18 Years" || updated.Stock != 15 {
+		t.Fatalf("partial update returned %d: %+v", code, updated)
+	}
+
+	// The merged product is validated and an invalid one is not saved
+	if code, err = do(r, "admin", http.MethodPatch, "/api/v1/admin/products/whisky", map[string]interface{}{"name": "", "stock": 3}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusBadRequest {
+		t.Fatalf("clearing the name returned %d, want %d", code, http.StatusBadRequest)
+	}
+	product, err := store.Products.Get(context.Background(), "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Name != "Macallan 18 Years" || product.Stock != 15 {
+		t.Fatalf("rejected update was saved: %+v", product)
+	}
+
+	if code, err = do(r, "admin", http.MethodPatch, "/api/v1/admin/products/gin", map[string]interface{}{"price": 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Fatalf("updating an unknown product returned %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestArchiveProduct(t *testing.T) {
+	r := newAdminServer(t)
+
+	var archived Product
+	code, err := do(r, "admin", http.MethodDelete, "/api/v1/admin/products/whisky", nil, &archived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || archived.ArchivedAt == nil {
+		t.Fatalf("archive returned %d: %+v", code, archived)
+	}
+	// Archiving again keeps the original timestamp
+	var again Product
+	if _, err := do(r, "admin", http.MethodDelete, "/api/v1/admin/products/whisky", nil, &again); err != nil {
+		t.Fatal(err)
+	}
+	if again.ArchivedAt == nil || !again.ArchivedAt.Equal(*archived.ArchivedAt) {
+		t.Fatalf("archiving twice moved the timestamp to %v", again.ArchivedAt)
+	}
+
+	var storefront []Product
+	var all ProductPage
+	if _, err := do(r, "", http.MethodGet, "/api/v1/products", nil, &storefront); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := do(r, "admin", http.MethodGet, "/api/v1/admin/products", nil, &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(storefront) != 0 || all.Total != 1 {
+		t.Fatalf("archived product listed %d times on the storefront and %d times for admins", len(storefront), all.Total)
+	}
+	if code, err = do(r, "", http.MethodGet, "/api/v1/products/whisky", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Fatalf("archived product page returned %d, want %d", code, http.StatusNotFound)
+	}
+
+	if code, err = do(r, "admin", http.MethodPost, "/api/v1/admin/products/whisky/restore", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("restore returned %d", code)
+	}
+	if code, err = do(r, "", http.MethodGet, "/api/v1/products/whisky", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("restored product page returned %d", code)
+	}
+}
+
+func TestRestockProduct(t *testing.T) {
+	r := newAdminServer(t)
+
+	var product Product
+	code, err := do(r, "admin", http.MethodPost, "/api/v1/admin/products/whisky/restock", RestockRequest{Quantity: 5}, &product)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || product.Stock != 20 {
+		t.Fatalf("restock returned %d with stock %d, want 20", code, product.Stock)
+	}
+
+	// Restocking cannot be used to write stock off
+	if code, err = do(r, "admin", http.MethodPost, "/api/v1/admin/products/whisky/restock", RestockRequest{Quantity: -3}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusBadRequest {
+		t.Fatalf("negative restock returned %d, want %d", code, http.StatusBadRequest)
+	}
+	if code, err = do(r, "admin", http.MethodPost, "/api/v1/admin/products/gin/restock", RestockRequest{Quantity: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Fatalf("restocking an unknown product returned %d, want %d", code, http.StatusNotFound)
+	}
+	if product, err = store.Products.Get(context.Background(), "whisky"); err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock != 20 {
+		t.Fatalf("rejected restocks changed stock to %d", product.Stock)
+	}
+}
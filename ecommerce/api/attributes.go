@@ -0,0 +1,321 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Category kinds. A category's kind decides which beverage attributes its
+// products may carry; categories without one inherit their parent's.
+const (
+	KindSpirit = "spirit"
+	KindWine   = "wine"
+	KindBeer   = "beer"
+)
+
+// Attributes describes a beverage. Every field is optional; numeric fields
+// are nil when unknown so that zero is never mistaken for a value.
+type Attributes struct {
+	// ABV is the alcohol by volume as a percentage
+	ABV      *float64 `json:"abv,omitempty" binding:"omitempty,gte=0,lte=100"`
+	VolumeML *int     `json:"volume_ml,omitempty" binding:"omitempty,gt=0,lte=20000"`
+	Country  string   `json:"country,omitempty" binding:"max=100"`
+	Region   string   `json:"region,omitempty" binding:"max=100"`
+	// AgeYears is the age statement, e.g. 18 for an 18 year old whisky
+	AgeYears *int   `json:"age_years,omitempty" binding:"omitempty,gte=1,lte=100"`
+	Vintage  *int   `json:"vintage,omitempty" binding:"omitempty,gte=1800"`
+	Cask     string `json:"cask,omitempty" binding:"max=100"`
+	Grape    string `json:"grape,omitempty" binding:"max=100"`
+	Style    string `json:"style,omitempty" binding:"max=100"`
+}
+
+// attributeRule limits the attributes of products in categories of one kind
+type attributeRule struct {
+	minABV, maxABV float64
+	// disallowed names attributes that make no sense for the kind
+	disallowed []string
+}
+
+var attributeRules = map[string]attributeRule{
+	KindSpirit: {minABV: 15, maxABV: 96, disallowed: []string{"grape"}},
+	KindWine:   {minABV: 5, maxABV: 23},
+	KindBeer:   {minABV: 0, maxABV: 20, disallowed: []string{"age_years", "grape"}},
+}
+
+// set reports which attributes have a value, keyed by JSON name
+func (a Attributes) set() map[string]bool {
+	return map[string]bool{
+		"abv": a.ABV != nil, "volume_ml": a.VolumeML != nil, "country": a.Country != "",
+		"region": a.Region != "", "age_years": a.AgeYears != nil, "vintage": a.Vintage != nil,
+		"cask": a.Cask != "", "grape": a.Grape != "", "style": a.Style != "",
+	}
+}
+
+// categoryKind returns the kind of a category, inherited from the nearest
+// ancestor that sets one
+func categoryKind(categories []Category, slug string) string {
+	bySlug := make(map[string]Category, len(categories))
+	for _, c := range categories {
+		bySlug[c.Slug] = c
+	}
+	for seen := make(map[string]bool); slug != "" && !seen[slug]; slug = bySlug[slug].Parent {
+		seen[slug] = true
+		if kind := bySlug[slug].Kind; kind != "" {
+			return kind
+		}
+	}
+	return ""
+}
+
+// ValidateAttributes checks a product's attributes against the rules for its
+// category's kind. The ranges set by the binding rules are checked by
+// ValidateProduct.
+func ValidateAttributes(categories []Category, p Product) error {
+	a := p.Attributes
+	if a.Vintage != nil && *a.Vintage > time.Now().Year() {
+		return fmt.Errorf("vintage %d is in the future", *a.Vintage)
+	}
+
+	kind := categoryKind(categories, p.Category)
+	rule, ok := attributeRules[kind]
+	if !ok {
+		return nil
+	}
+	set := a.set()
+	for _, name := range rule.disallowed {
+		if set[name] {
+			return fmt.Errorf("%s does not apply to %s products", name, kind)
+		}
+	}
+	if a.ABV != nil && (*a.ABV < rule.minABV || *a.ABV > rule.maxABV) {
+		return fmt.Errorf("abv for %s products must be between %g and %g", kind, rule.minABV, rule.maxABV)
+	}
+	return nil
+}
+
+// checkAttributes validates a product's attributes against the stored
+// categories, wrapping rule violations in a validationError
+func checkAttributes(ctx context.Context, p Product) error {
+	categories, err := store.Categories.List(ctx)
+	if err != nil {
+		return err
+	}
+	if err := ValidateAttributes(categories, p); err != nil {
+		return validationError{err}
+	}
+	return nil
+}
+
+// abvBands are the ABV ranges offered as facet values, each including its
+// lower bound and excluding its upper one
+var abvBands = []struct {
+	label    string
+	min, max float64
+}{
+	{"0-20", 0, 20},
+	{"20-40", 20, 40},
+	{"40-50", 40, 50},
+	{"50-100", 50, 100.1},
+}
+
+// abvBand returns the label of the band containing abv
+func abvBand(abv float64) string {
+	for _, band := range abvBands {
+		if abv >= band.min && abv < band.max {
+			return band.label
+		}
+	}
+	return ""
+}
+
+// AttributeFilter restricts a catalog query by beverage attributes. Each
+// field holds the accepted values of one attribute, any of which matches.
+// Text values are compared case-insensitively.
+type AttributeFilter struct {
+	Countries []string
+	Regions   []string
+	Styles    []string
+	Casks     []string
+	Grapes    []string
+	Vintages  []int
+	Ages      []int
+	Volumes   []int
+	// ABVBands holds labels from abvBands
+	ABVBands []string
+}
+
+// FacetValue is one value of a facet with the number of matching products
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// facet is an attribute offered for filtering in product listings. Its
+// counts ignore its own filter so that other values stay selectable.
+type facet struct {
+	name    string
+	numeric bool
+	value   func(a Attributes) string
+	clear   func(f *AttributeFilter)
+}
+
+func itoa(n *int) string {
+	if n == nil {
+		return ""
+	}
+	return strconv.Itoa(*n)
+}
+
+var facets = []facet{
+	{name: "country", value: func(a Attributes) string { return a.Country },
+		clear: func(f *AttributeFilter) { f.Countries = nil }},
+	{name: "region", value: func(a Attributes) string { return a.Region },
+		clear: func(f *AttributeFilter) { f.Regions = nil }},
+	{name: "style", value: func(a Attributes) string { return a.Style },
+		clear: func(f *AttributeFilter) { f.Styles = nil }},
+	{name: "cask", value: func(a Attributes) string { return a.Cask },
+		clear: func(f *AttributeFilter) { f.Casks = nil }},
+	{name: "grape", value: func(a Attributes) string { return a.Grape },
+		clear: func(f *AttributeFilter) { f.Grapes = nil }},
+	{name: "vintage", numeric: true, value: func(a Attributes) string { return itoa(a.Vintage) },
+		clear: func(f *AttributeFilter) { f.Vintages = nil }},
+	{name: "age", numeric: true, value: func(a Attributes) string { return itoa(a.AgeYears) },
+		clear: func(f *AttributeFilter) { f.Ages = nil }},
+	{name: "volume", numeric: true, value: func(a Attributes) string { return itoa(a.VolumeML) },
+		clear: func(f *AttributeFilter) { f.Volumes = nil }},
+	{name: "abv", value: func(a Attributes) string {
+		if a.ABV == nil {
+			return ""
+		}
+		return abvBand(*a.ABV)
+	}, clear: func(f *AttributeFilter) { f.ABVBands = nil }},
+}
+
+// parseAttributeFilter reads the comma-separated attribute query parameters,
+// which share their names with the facets
+func parseAttributeFilter(c *gin.Context) (AttributeFilter, error) {
+	var f AttributeFilter
+	list := func(name string) []string {
+		var values []string
+		for _, v := range strings.Split(c.Query(name), ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return values
+	}
+	f.Countries, f.Regions, f.Styles = list("country"), list("region"), list("style")
+	f.Casks, f.Grapes = list("cask"), list("grape")
+
+	for name, dst := range map[string]*[]int{"vintage": &f.Vintages, "age": &f.Ages, "volume": &f.Volumes} {
+		for _, v := range list(name) {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = append(*dst, n)
+		}
+	}
+	for _, v := range list("abv") {
+		if abvBandRange(v) == nil {
+			return f, fmt.Errorf("invalid abv %q", v)
+		}
+		f.ABVBands = append(f.ABVBands, v)
+	}
+	return f, nil
+}
+
+// abvBandRange returns the bounds of the band with the given label, or nil
+func abvBandRange(label string) []float64 {
+	for _, band := range abvBands {
+		if band.label == label {
+			return []float64{band.min, band.max}
+		}
+	}
+	return nil
+}
+
+// matches reports whether attributes pass the filter
+func (f AttributeFilter) matches(a Attributes) bool {
+	text := func(values []string, v string) bool {
+		if len(values) == 0 {
+			return true
+		}
+		for _, want := range values {
+			if strings.EqualFold(want, v) {
+				return true
+			}
+		}
+		return false
+	}
+	number := func(values []int, v *int) bool {
+		if len(values) == 0 {
+			return true
+		}
+		return v != nil && containsInt(values, *v)
+	}
+	if !text(f.Countries, a.Country) || !text(f.Regions, a.Region) || !text(f.Styles, a.Style) ||
+		!text(f.Casks, a.Cask) || !text(f.Grapes, a.Grape) {
+		return false
+	}
+	if !number(f.Vintages, a.Vintage) || !number(f.Ages, a.AgeYears) || !number(f.Volumes, a.VolumeML) {
+		return false
+	}
+	if len(f.ABVBands) > 0 && (a.ABV == nil || !containsString(f.ABVBands, abvBand(*a.ABV))) {
+		return false
+	}
+	return true
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
+
+// facetQueries returns, for each facet, the query whose matches it counts:
+// q without the facet's own filter
+func facetQueries(q ProductQuery) map[string]ProductQuery {
+	queries := make(map[string]ProductQuery, len(facets))
+	for _, f := range facets {
+		fq := q
+		f.clear(&fq.Attributes)
+		queries[f.name] = fq
+	}
+	return queries
+}
+
+// sortFacetValues orders text facets by popularity, numeric facets by value
+// and ABV bands from weakest to strongest
+func sortFacetValues(counts map[string][]FacetValue) {
+	for _, f := range facets {
+		values := counts[f.name]
+		if values == nil {
+			counts[f.name] = []FacetValue{}
+			continue
+		}
+		sort.Slice(values, func(i, j int) bool {
+			a, b := values[i], values[j]
+			switch {
+			case f.name == "abv":
+				return abvBandRange(a.Value)[0] < abvBandRange(b.Value)[0]
+			case f.numeric:
+				x, _ := strconv.Atoi(a.Value)
+				y, _ := strconv.Atoi(b.Value)
+				return x < y
+			case a.Count != b.Count:
+				return a.Count > b.Count
+			}
+			return a.Value < b.Value
+		})
+	}
+}
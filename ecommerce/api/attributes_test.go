@@ -0,0 +1,218 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func floatPtr(f float64) *float64 { return &f }
+
+func intPtr(n int) *int { return &n }
+
+func TestCategoryKind(t *testing.T) {
+	categories := []Category{
+		{Slug: "spirits", Kind: KindSpirit},
+		{Slug: "whisky", Parent: "spirits"},
+		{Slug: "single-malt", Parent: "whisky"},
+		{Slug: "sake", Parent: "spirits", Kind: KindWine},
+		// A cycle left by a bad edit must not loop forever
+		{Slug: "a", Parent: "b"},
+		{Slug: "b", Parent: "a"},
+	}
+	for slug, want := range map[string]string{
+		"single-malt": KindSpirit,
+		"sake":        KindWine,
+		"a":           "",
+		"missing":     "",
+		"":            "",
+	} {
+		if got := categoryKind(categories, slug); got != want {
+			t.Errorf("categoryKind(%q) = %q, want %q", slug, got, want)
+		}
+	}
+}
+
+func TestValidateAttributes(t *testing.T) {
+	categories := []Category{
+		{Slug: "spirits", Kind: KindSpirit},
+		{Slug: "whisky", Parent: "spirits"},
+		{Slug: "wine", Kind: KindWine},
+		{Slug: "beer", Kind: KindBeer},
+		{Slug: "gifts"},
+	}
+	tests := []struct {
+		name       string
+		category   string
+		attributes Attributes
+		err        string
+	}{
+		{name: "grape on an inherited spirit", category: "whisky", attributes: Attributes{Grape: "Merlot"}, err: "grape does not apply to spirit products"},
+		{name: "age on a beer", category: "beer", attributes: Attributes{AgeYears: intPtr(3)}, err: "age_years does not apply to beer products"},
+		{name: "weak spirit", category: "whisky", attributes: Attributes{ABV: floatPtr(14.9)}, err: "abv for spirit products must be between 15 and 96"},
+		{name: "strongest wine", category: "wine", attributes: Attributes{ABV: floatPtr(23), Grape: "Shiraz"}},
+		{name: "alcohol-free beer", category: "beer", attributes: Attributes{ABV: floatPtr(0)}},
+		{name: "uncategorised", attributes: Attributes{ABV: floatPtr(99), Grape: "Merlot"}},
+		{name: "category without a kind", category: "gifts", attributes: Attributes{ABV: floatPtr(99)}},
+		{name: "future vintage", category: "gifts", attributes: Attributes{Vintage: intPtr(time.Now().Year() + 1)}, err: "is in the future"},
+	}
+	for _, tt := range tests {
+		err := ValidateAttributes(categories, Product{Category: tt.category, Attributes: tt.attributes})
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: expected an error about %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestAttributeFilterAndFacets(t *testing.T) {
+	r := newAdminServer(t)
+	ctx := context.Background()
+	for _, p := range []Product{
+		{ID: "lagavulin", Name: "Lagavulin 16", Attributes: Attributes{ABV: floatPtr(43), Country: "Scotland", Region: "Islay", AgeYears: intPtr(16), VolumeML: intPtr(700)}},
+		{ID: "ardbeg", Name: "Ardbeg Corryvreckan", Attributes: Attributes{ABV: floatPtr(57.1), Country: "Scotland", Region: "Islay", VolumeML: intPtr(700)}},
+		{ID: "macallan", Name: "Macallan 12", Attributes: Attributes{ABV: floatPtr(40), Country: "Scotland", Region: "Speyside", AgeYears: intPtr(12), VolumeML: intPtr(1000)}},
+		{ID: "yamazaki", Name: "Yamazaki 12", Attributes: Attributes{ABV: floatPtr(50), Country: "Japan", AgeYears: intPtr(12), VolumeML: intPtr(700)}},
+		{ID: "merlot", Name: "Merlot", Attributes: Attributes{ABV: floatPtr(13.5), Country: "France", Vintage: intPtr(2019)}},
+	} {
+		p.Price, p.Stock = 50, 1
+		if err := store.Products.Save(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(query string) ProductPage {
+		t.Helper()
+		var page ProductPage
+		code, err := do(r, "", http.MethodGet, "/api/v1/products?paged=true&sort=name&"+query, nil, &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Fatalf("%s returned %d", query, code)
+		}
+		return page
+	}
+	ids := func(page ProductPage) string {
+		var ids []string
+		for _, p := range page.Products {
+			ids = append(ids, p.ID)
+		}
+		return strings.Join(ids, " ")
+	}
+
+	// Values of one attribute widen the match; different attributes narrow it.
+	// ABV bands include their lower bound only.
+	for query, want := range map[string]string{
+		"country=scotland":          "ardbeg lagavulin macallan",
+		"country=japan,+france":     "merlot yamazaki",
+		"country=scotland&age=12":   "macallan",
+		"abv=40-50":                 "lagavulin macallan",
+		"abv=50-100":                "ardbeg yamazaki",
+		"abv=0-20&vintage=2019":     "merlot",
+		"volume=1000,700&region=":   "ardbeg lagavulin macallan yamazaki",
+		"region=islay&age=16,12,18": "lagavulin",
+	} {
+		if got := ids(list(query)); got != want {
+			t.Errorf("%s lists %q, want %q", query, got, want)
+		}
+	}
+
+	// A facet's counts ignore its own filter but not the others', and
+	// products without a value are left out
+	page := list("country=scotland&region=islay")
+	countries := page.Facets["country"]
+	if len(countries) != 1 || countries[0] != (FacetValue{Value: "Scotland", Count: 2}) {
+		t.Errorf("country facet is %+v, want only Scotland from the Islay malts", countries)
+	}
+	regions := page.Facets["region"]
+	if len(regions) != 2 || regions[0] != (FacetValue{Value: "Islay", Count: 2}) || regions[1] != (FacetValue{Value: "Speyside", Count: 1}) {
+		t.Errorf("region facet is %+v, want Islay 2 then Speyside 1", regions)
+	}
+	if grapes := page.Facets["grape"]; grapes == nil || len(grapes) != 0 {
+		t.Errorf("grape facet is %+v, want an empty list", grapes)
+	}
+
+	// Numeric facets and ABV bands are ordered by value rather than popularity
+	page = list("")
+	var ages, bands []string
+	for _, v := range page.Facets["age"] {
+		ages = append(ages, v.Value)
+	}
+	for _, v := range page.Facets["abv"] {
+		bands = append(bands, v.Value)
+	}
+	if strings.Join(ages, " ") != "12 16" || strings.Join(bands, " ") != "0-20 40-50 50-100" {
+		t.Errorf("age facet %v and abv facet %v are out of order", ages, bands)
+	}
+
+	for _, query := range []string{"abv=40-45", "vintage=old", "age=12,x"} {
+		code, err := do(r, "", http.MethodGet, "/api/v1/products?"+query, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusBadRequest {
+			t.Errorf("%s returned %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAdminProductAttributes(t *testing.T) {
+	r := newCategoryServer(t)
+	spirit, beer := KindSpirit, KindBeer
+	for slug, kind := range map[string]*string{"spirits": &spirit, "wine": &beer} {
+		code, err := do(r, "admin", http.MethodPatch, "/api/v1/admin/categories/"+slug, CategoryUpdate{Kind: kind}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Fatalf("setting the kind of %s returned %d", slug, code)
+		}
+	}
+	aged := map[string]interface{}{"age_years": 18, "abv": 43}
+	if _, err := do(r, "admin", http.MethodPatch, "/api/v1/admin/products/whisky",
+		map[string]interface{}{"category": "single-malt", "attributes": aged}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		code   int
+	}{
+		{"unknown kind", http.MethodPost, "/api/v1/admin/categories", Category{Name: "Cider", Kind: "cider"}, http.StatusBadRequest},
+		{"grape on a spirit", http.MethodPost, "/api/v1/admin/products", map[string]interface{}{
+			"name": "Gin", "price": 39.99, "category": "whisky", "attributes": map[string]interface{}{"grape": "Merlot"},
+		}, http.StatusBadRequest},
+		{"abv over 100", http.MethodPost, "/api/v1/admin/products", map[string]interface{}{
+			"name": "Gin", "price": 39.99, "attributes": map[string]interface{}{"abv": 101},
+		}, http.StatusBadRequest},
+		// Moving the aged whisky into a category whose rules it breaks is refused
+		{"move an aged product to beer", http.MethodPatch, "/api/v1/admin/products/whisky", map[string]interface{}{"category": "wine"}, http.StatusBadRequest},
+		{"clear the attributes and move", http.MethodPatch, "/api/v1/admin/products/whisky", map[string]interface{}{
+			"category": "wine", "attributes": map[string]interface{}{"abv": 5},
+		}, http.StatusOK},
+	} {
+		code, err := do(r, "admin", tt.method, tt.path, tt.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	product, err := store.Products.Get(context.Background(), "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Category != "wine" || product.Attributes.AgeYears != nil || *product.Attributes.ABV != 5 {
+		t.Fatalf("unexpected product %+v", product)
+	}
+}
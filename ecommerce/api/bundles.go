@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrBundleStock is returned when stock is adjusted directly on a bundle
+var ErrBundleStock = errors.New("bundle stock is derived from its contents")
+
+// BundleItem is one component of a bundle, such as the bottle in a gift
+// set. SKU selects the variant for components sold in several sizes.
+type BundleItem struct {
+	ProductID string `json:"product_id" binding:"required"`
+	SKU       string `json:"sku,omitempty"`
+	Quantity  int    `json:"quantity" binding:"required,gt=0"`
+}
+
+// IsBundle reports whether the product is made up of other products. A
+// bundle has its own price but no stock of its own: its stock is the number
+// that can be put together from its components' stock, filled in on read,
+// and selling one takes every component off the shelf.
+func (p *Product) IsBundle() bool {
+	return len(p.Bundle) > 0
+}
+
+// validateBundle checks a bundle's contents on their own and clears its
+// stored stock. Checks against the catalog are made by ValidateBundle.
+func validateBundle(p *Product) error {
+	if !p.IsBundle() {
+		return nil
+	}
+	if len(p.Variants) > 0 {
+		return errors.New("bundles cannot have variants")
+	}
+	p.Stock = 0
+	type key struct{ id, sku string }
+	seen := make(map[key]bool, len(p.Bundle))
+	for _, item := range p.Bundle {
+		if item.ProductID == p.ID {
+			return errors.New("a bundle cannot contain itself")
+		}
+		k := key{item.ProductID, item.SKU}
+		if seen[k] {
+			return fmt.Errorf("product %s appears twice in the bundle", item.ProductID)
+		}
+		seen[k] = true
+	}
+	return nil
+}
+
+// bundleStock returns how many of a bundle can be put together from the
+// stock of its components, which get looks up. Missing and archived
+// components have no stock.
+func bundleStock(items []BundleItem, get func(id string) (Product, bool)) int {
+	stock := -1
+	for _, item := range items {
+		available := 0
+		if c, ok := get(item.ProductID); ok && c.ArchivedAt == nil {
+			if v, err := c.resolveSKU(item.SKU); err == nil && v != nil {
+				available = v.Stock
+			} else if err == nil {
+				available = c.Stock
+			}
+		}
+		if n := available / item.Quantity; stock < 0 || n < stock {
+			stock = n
+		}
+	}
+	if stock < 0 {
+		return 0
+	}
+	return stock
+}
+
+// ValidateBundle checks a product against the rest of the catalog: a
+// bundle's components must be unarchived products that are not bundles
+// themselves, and a product that is part of a bundle must keep the SKU the
+// bundle uses and cannot become a bundle
+func ValidateBundle(catalog []Product, p Product) error {
+	byID := make(map[string]Product, len(catalog))
+	for _, other := range catalog {
+		byID[other.ID] = other
+	}
+	for _, item := range p.Bundle {
+		c, ok := byID[item.ProductID]
+		if !ok || c.ArchivedAt != nil {
+			return fmt.Errorf("unknown bundle product %s", item.ProductID)
+		}
+		if c.IsBundle() {
+			return fmt.Errorf("product %s is a bundle and cannot be part of another", c.ID)
+		}
+		if _, err := c.resolveSKU(item.SKU); err != nil {
+			return fmt.Errorf("bundle product %s: %w", c.ID, err)
+		}
+	}
+
+	for _, other := range catalog {
+		if other.ID == p.ID {
+			continue
+		}
+		for _, item := range other.Bundle {
+			if item.ProductID != p.ID {
+				continue
+			}
+			if p.IsBundle() {
+				return fmt.Errorf("product is part of bundle %s and cannot be a bundle", other.ID)
+			}
+			if _, err := p.resolveSKU(item.SKU); err != nil {
+				return fmt.Errorf("bundle %s uses this product: %w", other.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkBundle validates a product against the stored catalog, wrapping rule
+// violations in a validationError
+func checkBundle(ctx context.Context, p Product) error {
+	catalog, err := store.Products.List(ctx)
+	if err != nil {
+		return err
+	}
+	if err := ValidateBundle(catalog, p); err != nil {
+		return validationError{err}
+	}
+	return nil
+}
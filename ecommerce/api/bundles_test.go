@@ -0,0 +1,240 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// giftSet is a bundle of a whisky and two 70cl gins
+func giftSet() Product {
+	return Product{ID: "gift", Name: "Gift set", Price: 350, Bundle: []BundleItem{
+		{ProductID: "whisky", Quantity: 1},
+		{ProductID: "gin", SKU: "GIN-70", Quantity: 2},
+	}}
+}
+
+func TestBundleStock(t *testing.T) {
+	archived := time.Now()
+	catalog := map[string]Product{
+		"whisky": {ID: "whisky", Stock: 15},
+		"gin":    ginVariants(),
+		"rum":    {ID: "rum", Stock: 10, ArchivedAt: &archived},
+	}
+	get := func(id string) (Product, bool) {
+		p, ok := catalog[id]
+		return p, ok
+	}
+
+	for _, tt := range []struct {
+		name  string
+		items []BundleItem
+		want  int
+	}{
+		// Partial sets do not count
+		{"rounded down", []BundleItem{{ProductID: "whisky", Quantity: 4}}, 3},
+		{"scarcest component", giftSet().Bundle, 1},
+		{"size's own stock", []BundleItem{{ProductID: "gin", SKU: "GIN-1L", Quantity: 1}}, 1},
+		{"size left out", []BundleItem{{ProductID: "gin", Quantity: 1}}, 0},
+		{"withdrawn size", []BundleItem{{ProductID: "gin", SKU: "GIN-5L", Quantity: 1}}, 0},
+		{"archived component", []BundleItem{{ProductID: "whisky", Quantity: 1}, {ProductID: "rum", Quantity: 1}}, 0},
+		{"deleted component", []BundleItem{{ProductID: "vodka", Quantity: 1}}, 0},
+		{"empty", nil, 0},
+	} {
+		if got := bundleStock(tt.items, get); got != tt.want {
+			t.Errorf("%s: stock is %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateBundle(t *testing.T) {
+	// Rules that need only the bundle itself
+	for _, tt := range []struct {
+		name   string
+		bundle []BundleItem
+		err    string
+	}{
+		{"itself", []BundleItem{{ProductID: "gift", Quantity: 1}}, "cannot contain itself"},
+		{"same size twice", []BundleItem{{ProductID: "gin", SKU: "GIN-70", Quantity: 1}, {ProductID: "gin", SKU: "GIN-70", Quantity: 1}}, "appears twice"},
+		{"two sizes of one product", []BundleItem{{ProductID: "gin", SKU: "GIN-70", Quantity: 1}, {ProductID: "gin", SKU: "GIN-1L", Quantity: 1}}, ""},
+	} {
+		p := Product{ID: "gift", Name: "Gift set", Price: 350, Stock: 40, Bundle: tt.bundle}
+		err := validateBundle(&p)
+		if tt.err == "" && (err != nil || p.Stock != 0) {
+			t.Errorf("%s: got %v with stock %d, want no error and the stock cleared", tt.name, err, p.Stock)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: expected an error about %q, got %v", tt.name, tt.err, err)
+		}
+	}
+	sized := giftSet()
+	sized.Variants = ginVariants().Variants
+	if err := validateBundle(&sized); err == nil {
+		t.Error("expected a bundle with variants to be refused")
+	}
+
+	// Rules that need the catalog, checked from both sides of the bundle
+	archived := time.Now()
+	catalog := []Product{
+		{ID: "whisky", Price: 299.99, Stock: 15},
+		ginVariants(),
+		{ID: "rum", Price: 29.99, Stock: 10, ArchivedAt: &archived},
+		giftSet(),
+	}
+	withoutSmallGin := ginVariants()
+	withoutSmallGin.Variants = withoutSmallGin.Variants[1:]
+	whiskyBundle := Product{ID: "whisky", Bundle: []BundleItem{{ProductID: "gin", SKU: "GIN-1L", Quantity: 1}}}
+	for _, tt := range []struct {
+		name    string
+		product Product
+		err     string
+	}{
+		{"archived component", Product{ID: "new", Bundle: []BundleItem{{ProductID: "rum", Quantity: 1}}}, "unknown bundle product rum"},
+		{"bundle in a bundle", Product{ID: "new", Bundle: []BundleItem{{ProductID: "gift", Quantity: 1}}}, "is a bundle"},
+		{"size left out", Product{ID: "new", Bundle: []BundleItem{{ProductID: "gin", Quantity: 1}}}, ErrSKURequired.Error()},
+		{"component dropping the size used", withoutSmallGin, "bundle gift uses this product"},
+		{"component becoming a bundle", whiskyBundle, "part of bundle gift"},
+		{"editing the bundle itself", giftSet(), ""},
+	} {
+		err := ValidateBundle(catalog, tt.product)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: expected an error about %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestBundleReservation(t *testing.T) {
+	newTestServer(t)
+	ctx := context.Background()
+	gin := ginVariants()
+	gin.Variants[0].Stock = 5
+	for _, p := range []Product{gin, giftSet()} {
+		if err := store.Products.Save(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stockOf := func(id, sku string) int {
+		t.Helper()
+		p, err := store.Products.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := p.Variant(sku); ok {
+			return v.Stock
+		}
+		return p.Stock
+	}
+	if got := stockOf("gift", ""); got != 2 {
+		t.Fatalf("gift set stock is %d, want 2 from the five small gins", got)
+	}
+
+	// Two sets take four small gins; a third cannot be made from the last
+	order := reserveOrder(t, "order-1", OrderItem{ID: "gift", Price: 350, Quantity: 2, Bundle: giftSet().Bundle})
+	if stockOf("whisky", "") != 13 || stockOf("gin", "GIN-70") != 1 || stockOf("gift", "") != 0 {
+		t.Fatal("expected each set to take a whisky and two small gins")
+	}
+	changes := orderStockChanges([]OrderItem{{ID: "gift", Quantity: 1, Bundle: giftSet().Bundle}}, -1)
+	if err := store.Products.AdjustStocks(ctx, changes); !errors.Is(err, ErrInsufficientStock) {
+		t.Fatalf("reserving a third set returned %v, want %v", err, ErrInsufficientStock)
+	}
+	if stockOf("whisky", "") != 13 {
+		t.Fatal("the failed reservation took a whisky")
+	}
+
+	// Changing the set's contents after the order does not change what the
+	// cancellation gives back
+	_, err := store.Products.Update(ctx, "gift", func(p *Product) error {
+		p.Bundle = []BundleItem{{ProductID: "gin", SKU: "GIN-1L", Quantity: 1}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := settlePayment(ctx, order, false); err != nil {
+		t.Fatal(err)
+	}
+	if stockOf("whisky", "") != 15 || stockOf("gin", "GIN-70") != 5 || stockOf("gin", "GIN-1L") != 1 {
+		t.Fatal("expected the cancellation to return the whiskies and small gins")
+	}
+
+	// The set holds no stock of its own to adjust or reconcile
+	if _, err := store.Products.AdjustStock(ctx, "gift", "", 5); !errors.Is(err, ErrBundleStock) {
+		t.Fatalf("restocking the set returned %v, want %v", err, ErrBundleStock)
+	}
+	err = store.Products.AdjustStocks(ctx, []StockChange{{ProductID: "gift", Delta: -1}})
+	if !errors.Is(err, ErrBundleStock) {
+		t.Fatalf("taking the set off the shelf directly returned %v, want %v", err, ErrBundleStock)
+	}
+	mismatches, err := ReconcileStock(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("ledger disagrees with stock: %+v", mismatches)
+	}
+}
+
+func TestAdminBundle(t *testing.T) {
+	r := newAdminServer(t)
+	if err := store.Products.Save(context.Background(), ginVariants()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stock sent for a bundle is ignored in favour of its components'
+	var bundle Product
+	code, err := do(r, "admin", http.MethodPost, "/api/v1/admin/products", map[string]interface{}{
+		"name": "Gift set", "price": 350, "stock": 50, "bundle": giftSet().Bundle,
+	}, &bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusCreated {
+		t.Fatalf("creating the bundle returned %d", code)
+	}
+	if stored, err := store.Products.Get(context.Background(), bundle.ID); err != nil || stored.Stock != 1 {
+		t.Fatalf("bundle has stock %d (%v), want 1 from the small gins", stored.Stock, err)
+	}
+
+	path := "/api/v1/admin/products/" + bundle.ID
+	for _, tt := range []struct {
+		name string
+		path string
+		body map[string]interface{}
+		code int
+	}{
+		{"set the bundle's stock", path, map[string]interface{}{"stock": 5}, http.StatusBadRequest},
+		{"give the bundle sizes", path, map[string]interface{}{"variants": ginVariants().Variants}, http.StatusBadRequest},
+		{"zero of a component", path, map[string]interface{}{"bundle": []BundleItem{{ProductID: "whisky"}}}, http.StatusBadRequest},
+		{"drop the size the bundle uses", "/api/v1/admin/products/gin", map[string]interface{}{
+			"variants": ginVariants().Variants[1:],
+		}, http.StatusBadRequest},
+		{"swap the whisky for a large gin", path, map[string]interface{}{
+			"bundle": []BundleItem{{ProductID: "gin", SKU: "GIN-70", Quantity: 1}, {ProductID: "gin", SKU: "GIN-1L", Quantity: 1}},
+		}, http.StatusOK},
+	} {
+		code, err := do(r, "admin", http.MethodPatch, tt.path, tt.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	// Emptying the contents turns the bundle into an ordinary product with
+	// stock of its own
+	var product Product
+	code, err = do(r, "admin", http.MethodPatch, path, map[string]interface{}{"bundle": []BundleItem{}, "stock": 4}, &product)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || product.IsBundle() || product.Stock != 4 {
+		t.Fatalf("emptying the bundle returned %d: %+v", code, product)
+	}
+}
@@ -1,24 +1,36 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// Cart represents a shopping cart
+// Cart represents a shopping cart. UserID is the owner's user ID, or for a
+// guest cart "guest:" followed by the ID in the visitor's cart token. The
+// subtotal, discounts and delivery fee are worked out whenever the cart is
+// priced; Total is what checkout will charge.
 type Cart struct {
-	UserID    string
-	Items     []CartItem
-	Total     float64
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	UserID      string         `json:"user_id"`
+	Items       []CartItem     `json:"items"`
+	Subtotal    float64        `json:"subtotal"`
+	Discounts   []DiscountLine `json:"discounts"`
+	DeliveryFee float64        `json:"delivery_fee"`
+	Total       float64        `json:"total"`
+	CouponCode  string         `json:"coupon_code,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
 }
 
-// CartItem represents an item in the cart
+// CartItem represents an item in the cart. Everything but the product, SKU
+// and quantity is copied from the catalog.
 type CartItem struct {
 	ProductID          string  `json:"product_id"`
+	SKU                string  `json:"sku"`
 	Name               string  `json:"name"`
 	Price              float64 `json:"price"`
 	Quantity           int     `json:"quantity"`
@@ -26,12 +38,37 @@ type CartItem struct {
 	ProductDescription string  `json:"product_description"`
 }
 
-// In-memory storage for carts
-var userCarts = make(map[string]*Cart)
+// CartItemRequest is the body of AddToCart. The line's name, price and image
+// are looked up from the product, never taken from the client.
+type CartItemRequest struct {
+	ProductID string `json:"product_id" binding:"required"`
+	SKU       string `json:"sku"`
+	Quantity  int    `json:"quantity" binding:"required,gt=0"`
+}
+
+// CartItemUpdate sets the quantity of a cart line. SKU selects the line for
+// products sold in several sizes; a quantity of zero removes it.
+type CartItemUpdate struct {
+	SKU      string `json:"sku"`
+	Quantity *int   `json:"quantity" binding:"required,gte=0"`
+}
+
+// errCartItemNotFound is returned when a cart has no line for the product
+var errCartItemNotFound = errors.New("item not in cart")
+
+// cartStockError is returned when a cart line would hold more units than
+// are in stock
+type cartStockError struct {
+	Available int
+}
 
-// GetCart returns the user's cart
+func (e *cartStockError) Error() string {
+	return fmt.Sprintf("only %d in stock", e.Available)
+}
+
+// GetCart returns the user's cart at current catalog prices
 func GetCart(c *gin.Context) {
-	userID := GetUserFromContext(c)
+	userID := cartOwner(c)
 	AppLogger.Info.Printf("Getting cart for user: %s", userID)
 
 	if userID == "" {
@@ -40,104 +77,332 @@ func GetCart(c *gin.Context) {
 		return
 	}
 
-	cart, exists := userCarts[userID]
-	if !exists {
-		cart = &Cart{
-			UserID:    userID,
-			Items:     []CartItem{},
-			CreatedAt: time.Now(),
-		}
-		userCarts[userID] = cart
+	// Carts are only stored once something is put in them, so visitors
+	// browsing as guests do not each leave an empty cart behind
+	cart, err := store.Carts.Get(c.Request.Context(), userID)
+	if errors.Is(err, ErrNotFound) {
+		now := time.Now()
+		cart, err = &Cart{UserID: userID, Items: []CartItem{}, CreatedAt: now, UpdatedAt: now}, nil
+	}
+	if err != nil {
+		AppLogger.Error.Printf("Error loading cart: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
 	}
 
+	if err := repriceCart(c.Request.Context(), cart); err != nil {
+		AppLogger.Error.Printf("Error pricing cart: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load prices"})
+		return
+	}
 	AppLogger.Info.Printf("Retrieved cart: %+v", cart)
 	c.JSON(http.StatusOK, cart)
 }
 
-// AddToCart adds an item to the cart
+// AddToCart adds units of a product SKU to the cart, up to the stock
+// available
 func AddToCart(c *gin.Context) {
-	userID := GetUserFromContext(c)
+	userID := cartOwner(c)
 	if userID == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
-	var item CartItem
-	if err := c.BindJSON(&item); err != nil {
+	var req CartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		AppLogger.Error.Printf("Error binding JSON: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	cart, exists := userCarts[userID]
-	if !exists {
-		cart = &Cart{
-			UserID:    userID,
-			Items:     []CartItem{},
-			CreatedAt: time.Now(),
-		}
-		userCarts[userID] = cart
+	cart, err := updateCartLine(c.Request.Context(), userID, req, true)
+	if err != nil {
+		respondCartError(c, err)
+		return
 	}
+	AppLogger.Info.Printf("Updated cart: %+v", cart)
+	c.JSON(http.StatusOK, cart)
+}
 
-	// Check if item already exists
-	for i, existingItem := range cart.Items {
-		if existingItem.ProductID == item.ProductID {
-			cart.Items[i].Quantity += item.Quantity
-			cart.Total = calculateTotal(cart.Items)
-			cart.UpdatedAt = time.Now()
-			AppLogger.Info.Printf("Updated cart: %+v", cart)
-			c.JSON(http.StatusOK, cart)
+// RemoveFromCart removes an item from the cart. The optional sku query
+// parameter removes a single variant; without it every line for the product
+// is removed.
+func RemoveFromCart(c *gin.Context) {
+	userID := cartOwner(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	productID := c.Param("product_id")
+	sku := c.Query("sku")
+	AppLogger.Info.Printf("Removing product %s from cart for user: %s", productID, userID)
+
+	if _, err := store.Carts.Get(c.Request.Context(), userID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			AppLogger.Error.Printf("Cart not found for user: %s", userID)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
 			return
 		}
+		AppLogger.Error.Printf("Error loading cart: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
 	}
 
-	// Add new item
-	cart.Items = append(cart.Items, item)
-	cart.Total = calculateTotal(cart.Items)
-	cart.UpdatedAt = time.Now()
+	cart, err := store.Carts.Update(c.Request.Context(), userID, func(cart *Cart) error {
+		newItems := []CartItem{}
+		for _, item := range cart.Items {
+			if item.ProductID != productID || (sku != "" && item.SKU != sku) {
+				newItems = append(newItems, item)
+			}
+		}
+
+		cart.Items = newItems
+		cart.UpdatedAt = time.Now()
+		return repriceCart(c.Request.Context(), cart)
+	})
+	if err != nil {
+		AppLogger.Error.Printf("Error saving cart: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save cart"})
+		return
+	}
 
 	AppLogger.Info.Printf("Updated cart: %+v", cart)
 	c.JSON(http.StatusOK, cart)
 }
 
-// RemoveFromCart removes an item from the cart
-func RemoveFromCart(c *gin.Context) {
-	userID := GetUserFromContext(c)
+// UpdateCartItem sets the quantity of a product already in the cart, up to
+// the stock available. A quantity of zero removes the line.
+func UpdateCartItem(c *gin.Context) {
+	userID := cartOwner(c)
 	if userID == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
-	productID := c.Param("product_id")
-	AppLogger.Info.Printf("Removing product %s from cart for user: %s", productID, userID)
+	var update CartItemUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	cart, exists := userCarts[userID]
-	if !exists {
-		AppLogger.Error.Printf("Cart not found for user: %s", userID)
-		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+	req := CartItemRequest{ProductID: c.Param("product_id"), SKU: update.SKU, Quantity: *update.Quantity}
+	cart, err := updateCartLine(c.Request.Context(), userID, req, false)
+	if err != nil {
+		respondCartError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, cart)
+}
+
+// ClearCart removes every item, and any coupon, from the user's cart
+func ClearCart(c *gin.Context) {
+	userID := cartOwner(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
 
-	var newItems []CartItem
-	for _, item := range cart.Items {
-		if item.ProductID != productID {
-			newItems = append(newItems, item)
+	cart, err := store.Carts.Update(c.Request.Context(), userID, func(cart *Cart) error {
+		cart.Items = []CartItem{}
+		cart.CouponCode = ""
+		cart.UpdatedAt = time.Now()
+		return repriceCart(c.Request.Context(), cart)
+	})
+	if err != nil {
+		AppLogger.Error.Printf("Error saving cart: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save cart"})
+		return
+	}
+	c.JSON(http.StatusOK, cart)
+}
+
+// removeOrderedItems takes the lines of a placed order out of the user's
+// cart, along with the coupon the order used, so a cart that was checked
+// out is not later treated as abandoned
+func removeOrderedItems(ctx context.Context, order Order) {
+	if _, err := store.Carts.Get(ctx, order.UserID); err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			AppLogger.Error.Printf("Error loading cart for order %s: %v", order.ID, err)
+		}
+		return
+	}
+
+	type line struct{ id, sku string }
+	ordered := make(map[line]int, len(order.Items))
+	for _, item := range order.Items {
+		ordered[line{item.ID, item.SKU}] += item.Quantity
+	}
+	_, err := store.Carts.Update(ctx, order.UserID, func(cart *Cart) error {
+		items := []CartItem{}
+		for _, item := range cart.Items {
+			item.Quantity -= ordered[line{item.ProductID, item.SKU}]
+			if item.Quantity > 0 {
+				items = append(items, item)
+			}
+		}
+		cart.Items = items
+		if order.CouponCode != "" && normalizeCoupon(cart.CouponCode) == order.CouponCode {
+			cart.CouponCode = ""
 		}
+		cart.UpdatedAt = time.Now()
+		return repriceCart(ctx, cart)
+	})
+	if err != nil {
+		AppLogger.Error.Printf("Error removing order %s from cart: %v", order.ID, err)
 	}
+}
 
-	cart.Items = newItems
-	cart.Total = calculateTotal(cart.Items)
-	cart.UpdatedAt = time.Now()
+// respondCartError writes the response for an error from updateCartLine or
+// priceCart
+func respondCartError(c *gin.Context, err error) {
+	var short *cartStockError
+	var invalid *couponError
+	switch {
+	case errors.As(err, &short):
+		c.JSON(http.StatusConflict, gin.H{"error": "Not enough stock", "stock": short.Available})
+	case errors.As(err, &invalid):
+		c.JSON(invalid.status, gin.H{"error": invalid.message})
+	case errors.Is(err, errCartItemNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not in cart"})
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+	case errors.Is(err, ErrUnknownSKU), errors.Is(err, ErrSKURequired):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		AppLogger.Error.Printf("Error saving cart: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save cart"})
+	}
+}
 
-	AppLogger.Info.Printf("Updated cart: %+v", cart)
-	c.JSON(http.StatusOK, cart)
+// cartProduct loads a product that can be put in a cart, with its prices
+// attached. Archived products are not found.
+func cartProduct(ctx context.Context, id string) (*Product, error) {
+	product, err := store.Products.Get(ctx, id)
+	if err == nil && product.ArchivedAt != nil {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	products := []Product{product}
+	if err := attachPrices(ctx, products, time.Now()); err != nil {
+		return nil, err
+	}
+	return &products[0], nil
+}
+
+// cartStock returns the units of a product SKU that can be put in a cart
+func cartStock(ctx context.Context, productID, sku string) (int, error) {
+	product, err := cartProduct(ctx, productID)
+	if err != nil {
+		return 0, err
+	}
+	v, err := product.resolveSKU(sku)
+	if err != nil {
+		return 0, err
+	}
+	if v != nil {
+		return v.Stock, nil
+	}
+	return product.Stock, nil
+}
+
+// updateCartLine sets the quantity of a product SKU in the user's cart, or
+// with add increases it, creating the line if needed. The resulting
+// quantity may not exceed the SKU's stock; a quantity of zero removes the
+// line. Only add creates lines: setting the quantity of a line the cart does
+// not have fails with errCartItemNotFound.
+func updateCartLine(ctx context.Context, userID string, req CartItemRequest, add bool) (*Cart, error) {
+	available := 0
+	if add || req.Quantity > 0 {
+		var err error
+		if available, err = cartStock(ctx, req.ProductID, req.SKU); err != nil {
+			return nil, err
+		}
+	}
+
+	return store.Carts.Update(ctx, userID, func(cart *Cart) error {
+		i := cart.index(req.ProductID, req.SKU)
+		quantity := req.Quantity
+		switch {
+		case i < 0 && !add:
+			return errCartItemNotFound
+		case i >= 0 && add:
+			quantity += cart.Items[i].Quantity
+		}
+
+		switch {
+		case quantity == 0:
+			cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
+		case quantity > available:
+			return &cartStockError{Available: available}
+		case i < 0:
+			cart.Items = append(cart.Items, CartItem{ProductID: req.ProductID, SKU: req.SKU, Quantity: quantity})
+		default:
+			cart.Items[i].Quantity = quantity
+		}
+		cart.UpdatedAt = time.Now()
+		return repriceCart(ctx, cart)
+	})
 }
 
-// Helper function to calculate cart total
-func calculateTotal(items []CartItem) float64 {
-	var total float64
-	for _, item := range items {
-		total += item.Price * float64(item.Quantity)
+// index returns the position of the cart line for a product SKU, or -1
+func (c *Cart) index(productID, sku string) int {
+	for i, item := range c.Items {
+		if item.ProductID == productID && item.SKU == sku {
+			return i
+		}
+	}
+	return -1
+}
+
+// repriceCart refreshes the cart's lines from the catalog: names and images
+// as they are now, and prices in effect now, including active sales, then
+// applies the discounts the cart qualifies for, so the total matches what
+// checkout will charge. Lines for products that have since been archived or
+// removed keep what they had; checkout rejects them. A coupon the cart no
+// longer qualifies for stays on it but takes nothing off.
+func repriceCart(ctx context.Context, cart *Cart) error {
+	return priceCart(ctx, cart, false)
+}
+
+// priceCart reprices the cart as repriceCart does. With requireCoupon, a
+// coupon on the cart that cannot be used fails with a *couponError instead.
+func priceCart(ctx context.Context, cart *Cart, requireCoupon bool) error {
+	items := make([]discountItem, 0, len(cart.Items))
+	for i := range cart.Items {
+		item := &cart.Items[i]
+		line := discountItem{ProductID: item.ProductID, Price: item.Price, Quantity: item.Quantity}
+		product, err := cartProduct(ctx, item.ProductID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err == nil {
+			line.Category = product.Category
+			if price, err := product.EffectivePrice(item.SKU); err == nil {
+				item.Name = product.Name
+				item.Price = price
+				item.ProductImage = product.Image
+				item.ProductDescription = product.Description
+				line.Price = price
+			}
+		}
+		items = append(items, line)
+	}
+
+	now := time.Now()
+	totals, err := priceCheckout(ctx, cart.UserID, items, cart.CouponCode, now)
+	var invalid *couponError
+	if errors.As(err, &invalid) && !requireCoupon {
+		totals, err = priceCheckout(ctx, cart.UserID, items, "", now)
+	}
+	if err != nil {
+		return err
 	}
-	return total
+	cart.Subtotal = totals.Subtotal
+	cart.Discounts = totals.Discounts
+	cart.DeliveryFee = totals.DeliveryFee
+	cart.Total = totals.Total
+	return nil
 }
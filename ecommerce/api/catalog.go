@@ -0,0 +1,271 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Product list sort orders accepted by the sort query parameter
+const (
+	SortNewest    = "newest"
+	SortPriceAsc  = "price"
+	SortPriceDesc = "-price"
+	SortNameAsc   = "name"
+	SortNameDesc  = "-name"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// ProductQuery filters, sorts and paginates the catalog
+type ProductQuery struct {
+	Search   string
+	Category string
+	// Categories is the requested category and its descendants, resolved
+	// from Category by searchProducts
+	Categories      []string
+	MinPrice        *float64
+	MaxPrice        *float64
+	InStock         bool
+	Attributes      AttributeFilter
+	IncludeArchived bool
+	Sort            string
+	Offset          int
+	Limit           int
+	// SalePrices holds the sale price of each product on sale when the query
+	// runs, filled in by searchProducts when the query filters or sorts by
+	// price. Other products sell at their regular price.
+	SalePrices map[string]float64
+}
+
+// ProductPage is one page of catalog search results
+type ProductPage struct {
+	Products []Product `json:"products"`
+	Total    int       `json:"total"`
+	Page     int       `json:"page"`
+	Limit    int       `json:"limit"`
+	Pages    int       `json:"pages"`
+	// Facets counts the products matching the query by each attribute value,
+	// ignoring the facet's own filter
+	Facets map[string][]FacetValue `json:"facets"`
+}
+
+// parseProductQuery reads catalog query parameters from the request
+func parseProductQuery(c *gin.Context) (ProductQuery, error) {
+	q := ProductQuery{
+		Search:   strings.TrimSpace(c.Query("q")),
+		Category: c.Query("category"),
+		Sort:     c.DefaultQuery("sort", SortNewest),
+	}
+
+	switch q.Sort {
+	case SortNewest, SortPriceAsc, SortPriceDesc, SortNameAsc, SortNameDesc:
+	default:
+		return q, fmt.Errorf("invalid sort %q", q.Sort)
+	}
+
+	for name, dst := range map[string]**float64{"min_price": &q.MinPrice, "max_price": &q.MaxPrice} {
+		if v := c.Query(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 {
+				return q, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = &f
+		}
+	}
+
+	if v := c.Query("in_stock"); v != "" {
+		inStock, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid in_stock %q", v)
+		}
+		q.InStock = inStock
+	}
+
+	attributes, err := parseAttributeFilter(c)
+	if err != nil {
+		return q, err
+	}
+	q.Attributes = attributes
+
+	offset, limit, err := parsePage(c)
+	if err != nil {
+		return q, err
+	}
+	q.Offset, q.Limit = offset, limit
+	return q, nil
+}
+
+// parsePage reads the page and limit query parameters
+func parsePage(c *gin.Context) (offset, limit int, err error) {
+	limit = defaultPageSize
+	if v := c.Query("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("invalid limit %q", v)
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+	}
+
+	page := 1
+	if v := c.Query("page"); v != "" {
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return 0, 0, fmt.Errorf("invalid page %q", v)
+		}
+	}
+	return (page - 1) * limit, limit, nil
+}
+
+// pageCount returns the number of pages needed to show total items
+func pageCount(total, limit int) int {
+	return int(math.Ceil(float64(total) / float64(limit)))
+}
+
+// usesPrice reports whether the query filters or sorts by price
+func (q ProductQuery) usesPrice() bool {
+	return q.MinPrice != nil || q.MaxPrice != nil || q.Sort == SortPriceAsc || q.Sort == SortPriceDesc
+}
+
+// price returns what the product sells for, as the query's price filters
+// and sort orders see it
+func (q ProductQuery) price(p Product) float64 {
+	if sale, ok := q.SalePrices[p.ID]; ok {
+		return sale
+	}
+	return p.Price
+}
+
+// matches reports whether a product passes the query's filters
+func (q ProductQuery) matches(p Product) bool {
+	if !q.IncludeArchived && p.ArchivedAt != nil {
+		return false
+	}
+	if q.Search != "" {
+		term := strings.ToLower(q.Search)
+		if !strings.Contains(strings.ToLower(p.Name), term) &&
+			!strings.Contains(strings.ToLower(p.Description), term) {
+			return false
+		}
+	}
+	if q.Category != "" && !containsString(q.Categories, p.Category) {
+		return false
+	}
+	if q.MinPrice != nil && q.price(p) < *q.MinPrice {
+		return false
+	}
+	if q.MaxPrice != nil && q.price(p) > *q.MaxPrice {
+		return false
+	}
+	if q.InStock && p.Stock <= 0 {
+		return false
+	}
+	return q.Attributes.matches(p.Attributes)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sortProducts orders products by the query's sort key, breaking ties by ID
+// so pagination is stable
+func sortProducts(products []Product, q ProductQuery) {
+	sort.Slice(products, func(i, j int) bool {
+		a, b := products[i], products[j]
+		switch q.Sort {
+		case SortPriceAsc:
+			if x, y := q.price(a), q.price(b); x != y {
+				return x < y
+			}
+		case SortPriceDesc:
+			if x, y := q.price(a), q.price(b); x != y {
+				return x > y
+			}
+		case SortNameAsc:
+			if !strings.EqualFold(a.Name, b.Name) {
+				return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+			}
+		case SortNameDesc:
+			if !strings.EqualFold(a.Name, b.Name) {
+				return strings.ToLower(a.Name) > strings.ToLower(b.Name)
+			}
+		default:
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.After(b.CreatedAt)
+			}
+		}
+		return a.ID < b.ID
+	})
+}
+
+// searchProducts runs a catalog query and writes the products found as JSON:
+// a ProductPage if paged, otherwise a bare array
+func searchProducts(c *gin.Context, q ProductQuery, paged bool) {
+	if q.Category != "" {
+		scope, err := categoryScope(c.Request.Context(), q.Category)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load categories"})
+			return
+		}
+		q.Categories = scope
+	}
+	// Filter and sort on what products sell for now, sales included
+	now := time.Now()
+	if q.usesPrice() {
+		sales, err := salePrices(c.Request.Context(), now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load prices"})
+			return
+		}
+		q.SalePrices = sales
+	}
+
+	products, total, err := store.Products.Search(c.Request.Context(), q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load products"})
+		return
+	}
+	if err := attachRatings(c.Request.Context(), products); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load ratings"})
+		return
+	}
+	if err := attachPrices(c.Request.Context(), products, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load prices"})
+		return
+	}
+	if !paged {
+		c.JSON(http.StatusOK, products)
+		return
+	}
+	counts, err := store.Products.Facets(c.Request.Context(), facetQueries(q))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count facets"})
+		return
+	}
+	sortFacetValues(counts)
+
+	c.JSON(http.StatusOK, ProductPage{
+		Products: products,
+		Total:    total,
+		Page:     q.Offset/q.Limit + 1,
+		Limit:    q.Limit,
+		Pages:    pageCount(total, q.Limit),
+		Facets:   counts,
+	})
+}
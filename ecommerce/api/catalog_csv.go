@@ -0,0 +1,439 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// productCSVHeader is the column order written by ExportProductsCSV. Products
+// without variants take one row with an empty sku; products with variants
+// take one row per variant, repeating the product columns.
+var productCSVHeader = []string{"id", "sku", "name", "description", "category", "image", "size", "price", "stock", "barcode",
+	"abv", "volume_ml", "country", "region", "age_years", "vintage", "cask", "grape", "style"}
+
+// ErrInvalidCSV is returned when an import file cannot be parsed at all
+var ErrInvalidCSV = errors.New("invalid CSV")
+
+// ImportReport describes the outcome of a catalog import. When Errors is
+// non-empty nothing was written.
+type ImportReport struct {
+	DryRun  bool       `json:"dry_run"`
+	Rows    int        `json:"rows"`
+	Created int        `json:"created"`
+	Updated int        `json:"updated"`
+	Errors  []RowError `json:"errors"`
+}
+
+func (r ImportReport) String() string {
+	return fmt.Sprintf("%d rows: %d products created, %d updated", r.Rows, r.Created, r.Updated)
+}
+
+// RowError is a problem with one line of an imported CSV file
+type RowError struct {
+	Line  int    `json:"line"`
+	ID    string `json:"id,omitempty"`
+	SKU   string `json:"sku,omitempty"`
+	Error string `json:"error"`
+}
+
+// importRow is one data line of an import. values holds only the columns
+// present in the file, so missing columns leave stored fields unchanged.
+type importRow struct {
+	line   int
+	id     string
+	sku    string
+	values map[string]string
+}
+
+func (r importRow) fail(err error) RowError {
+	return RowError{Line: r.line, ID: r.id, SKU: r.sku, Error: err.Error()}
+}
+
+// apply merges the row into the product
+func (r importRow) apply(p *Product) error {
+	a := &p.Attributes
+	for column, field := range map[string]*string{
+		"name": &p.Name, "description": &p.Description, "category": &p.Category, "image": &p.Image,
+		"country": &a.Country, "region": &a.Region, "cask": &a.Cask, "grape": &a.Grape, "style": &a.Style,
+	} {
+		if v, ok := r.values[column]; ok {
+			*field = v
+		}
+	}
+	// Blank numeric attributes clear the value
+	if v, ok := r.values["abv"]; ok {
+		a.ABV = nil
+		if v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("invalid abv %q", v)
+			}
+			a.ABV = &f
+		}
+	}
+	for column, field := range map[string]**int{"volume_ml": &a.VolumeML, "age_years": &a.AgeYears, "vintage": &a.Vintage} {
+		if v, ok := r.values[column]; ok {
+			*field = nil
+			if v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return fmt.Errorf("invalid %s %q", column, v)
+				}
+				*field = &n
+			}
+		}
+	}
+
+	price, stock := &p.Price, &p.Stock
+	if r.sku != "" {
+		v, ok := p.Variant(r.sku)
+		if !ok {
+			p.Variants = append(p.Variants, Variant{SKU: r.sku})
+			v = &p.Variants[len(p.Variants)-1]
+		}
+		if size, ok := r.values["size"]; ok {
+			v.Size = size
+		}
+		if barcode, ok := r.values["barcode"]; ok {
+			v.Barcode = barcode
+		}
+		price, stock = &v.Price, &v.Stock
+	} else if len(p.Variants) > 0 {
+		return ErrSKURequired
+	}
+
+	if v, ok := r.values["price"]; ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid price %q", v)
+		}
+		*price = f
+	}
+	if v, ok := r.values["stock"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid stock %q", v)
+		}
+		*stock = n
+	}
+
+	if r.sku != "" {
+		v, _ := p.Variant(r.sku)
+		if err := binding.Validator.ValidateStruct(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importProduct gathers the rows that belong to one product
+type importProduct struct {
+	id      string
+	rows    []importRow
+	created bool
+}
+
+// apply merges every row into the product and validates the result
+func (ip *importProduct) apply(p *Product) []RowError {
+	var errs []RowError
+	for _, row := range ip.rows {
+		if err := row.apply(p); err != nil {
+			errs = append(errs, row.fail(err))
+		}
+	}
+	if len(errs) == 0 {
+		if err := ValidateProduct(p); err != nil {
+			errs = append(errs, ip.rows[0].fail(err))
+		}
+	}
+	return errs
+}
+
+// readImportRows parses the CSV into rows, rejecting unknown columns so a
+// misspelt header cannot silently drop data
+func readImportRows(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCSV, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%w: empty file", ErrInvalidCSV)
+	}
+
+	known := make(map[string]bool, len(productCSVHeader))
+	for _, column := range productCSVHeader {
+		known[column] = true
+	}
+	header := make([]string, len(records[0]))
+	present := make(map[string]bool, len(header))
+	for i, name := range records[0] {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+		if !known[header[i]] {
+			return nil, fmt.Errorf("%w: unknown column %q", ErrInvalidCSV, name)
+		}
+		present[header[i]] = true
+	}
+	if !present["id"] && !present["sku"] {
+		return nil, fmt.Errorf("%w: an id or sku column is required", ErrInvalidCSV)
+	}
+
+	rows := make([]importRow, 0, len(records)-1)
+	for n, record := range records[1:] {
+		row := importRow{line: n + 2, values: make(map[string]string, len(record))}
+		for i, value := range record {
+			row.values[header[i]] = strings.TrimSpace(value)
+		}
+		row.id, row.sku = row.values["id"], row.values["sku"]
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ImportProductsCSV upserts products from a CSV in the export format. Rows
+// are matched to products by id, or by sku when id is blank. Every row is
+// validated before anything is written; if any row fails, or dryRun is set,
+// the store is left unchanged.
+func ImportProductsCSV(ctx context.Context, s *Store, r io.Reader, dryRun bool) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Errors: []RowError{}}
+	rows, err := readImportRows(r)
+	if err != nil {
+		return report, err
+	}
+	report.Rows = len(rows)
+
+	// Group rows by product, resolving blank ids from existing SKUs
+	var products []*importProduct
+	byID := make(map[string]*importProduct)
+	skus := make(map[string]int)
+	for _, row := range rows {
+		if row.sku != "" {
+			if line, dup := skus[row.sku]; dup {
+				report.Errors = append(report.Errors, row.fail(fmt.Errorf("sku also on line %d", line)))
+				continue
+			}
+			skus[row.sku] = row.line
+		}
+		if row.id == "" {
+			if row.sku == "" {
+				report.Errors = append(report.Errors, row.fail(errors.New("id or sku is required")))
+				continue
+			}
+			owner, err := s.Products.GetBySKU(ctx, row.sku)
+			if errors.Is(err, ErrNotFound) {
+				report.Errors = append(report.Errors, row.fail(errors.New("id is required for new products")))
+				continue
+			}
+			if err != nil {
+				return report, err
+			}
+			row.id = owner.ID
+		}
+		ip, ok := byID[row.id]
+		if !ok {
+			ip = &importProduct{id: row.id}
+			byID[row.id] = ip
+			products = append(products, ip)
+		}
+		ip.rows = append(ip.rows, row)
+	}
+
+	categories, err := s.Categories.List(ctx)
+	if err != nil {
+		return report, err
+	}
+	catalog, err := s.Products.List(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	// Validate each product as it would be saved
+	for _, ip := range products {
+		product, err := s.Products.Get(ctx, ip.id)
+		ip.created = errors.Is(err, ErrNotFound)
+		if err != nil && !ip.created {
+			return report, err
+		}
+		if ip.created {
+			product = Product{ID: ip.id}
+		}
+
+		if errs := ip.apply(&product); len(errs) > 0 {
+			report.Errors = append(report.Errors, errs...)
+			continue
+		}
+		if product.Category != "" {
+			if _, err := s.Categories.Get(ctx, product.Category); errors.Is(err, ErrNotFound) {
+				report.Errors = append(report.Errors, ip.rows[0].fail(fmt.Errorf("%w %q", ErrUnknownCategory, product.Category)))
+			} else if err != nil {
+				return report, err
+			}
+		}
+		if err := ValidateAttributes(categories, product); err != nil {
+			report.Errors = append(report.Errors, ip.rows[0].fail(err))
+		}
+		if err := ValidateBundle(catalog, product); err != nil {
+			report.Errors = append(report.Errors, ip.rows[0].fail(err))
+		}
+		for _, v := range product.Variants {
+			owner, err := s.Products.GetBySKU(ctx, v.SKU)
+			if err == nil && owner.ID != ip.id {
+				report.Errors = append(report.Errors, RowError{Line: skus[v.SKU], ID: ip.id, SKU: v.SKU,
+					Error: fmt.Sprintf("%s by product %s", ErrDuplicateSKU, owner.ID)})
+			} else if err != nil && !errors.Is(err, ErrNotFound) {
+				return report, err
+			}
+		}
+
+		if ip.created {
+			report.Created++
+		} else {
+			report.Updated++
+		}
+	}
+
+	if len(report.Errors) > 0 {
+		sort.SliceStable(report.Errors, func(i, j int) bool { return report.Errors[i].Line < report.Errors[j].Line })
+		report.Created, report.Updated = 0, 0
+		return report, nil
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	for _, ip := range products {
+		if ip.created {
+			product := Product{ID: ip.id, CreatedAt: time.Now()}
+			ip.apply(&product)
+			if product.Image == "" {
+				product.Image = DefaultProductImage
+			}
+			if err := s.Products.Save(ctx, product); err != nil {
+				return report, fmt.Errorf("product %s: %w", ip.id, err)
+			}
+			continue
+		}
+		// Re-apply inside Update so concurrent stock changes to columns the
+		// file does not touch are not lost
+		_, err := s.Products.Update(ctx, ip.id, func(p *Product) error {
+			if errs := ip.apply(p); len(errs) > 0 {
+				return errors.New(errs[0].Error)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("product %s: %w", ip.id, err)
+		}
+	}
+	return report, nil
+}
+
+// ExportProductsCSV writes every unarchived product in the import format,
+// ordered by ID
+func ExportProductsCSV(ctx context.Context, s *Store, w io.Writer) error {
+	productList, err := s.Products.List(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(productList, func(i, j int) bool { return productList[i].ID < productList[j].ID })
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(productCSVHeader); err != nil {
+		return err
+	}
+	formatPrice := func(f float64) string { return strconv.FormatFloat(f, 'f', 2, 64) }
+	for _, p := range productList {
+		if p.ArchivedAt != nil {
+			continue
+		}
+		a := p.Attributes
+		abv := ""
+		if a.ABV != nil {
+			abv = strconv.FormatFloat(*a.ABV, 'f', -1, 64)
+		}
+		attributes := []string{abv, itoa(a.VolumeML), a.Country, a.Region, itoa(a.AgeYears), itoa(a.Vintage),
+			a.Cask, a.Grape, a.Style}
+		if len(p.Variants) == 0 {
+			writer.Write(append([]string{p.ID, "", p.Name, p.Description, p.Category, p.Image,
+				"", formatPrice(p.Price), strconv.Itoa(p.Stock), ""}, attributes...))
+			continue
+		}
+		for _, v := range p.Variants {
+			writer.Write(append([]string{p.ID, v.SKU, p.Name, p.Description, p.Category, p.Image,
+				v.Size, formatPrice(v.Price), strconv.Itoa(v.Stock), v.Barcode}, attributes...))
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// AdminImportProducts imports a product CSV sent as the "file" field of a
+// multipart form or as the raw request body. With dry_run=true the file is
+// only validated.
+func AdminImportProducts(c *gin.Context) {
+	dryRun := false
+	if v := c.Query("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid dry_run %q", v)})
+			return
+		}
+	}
+
+	var body io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	ctx := WithMovement(c.Request.Context(), MovementSource{
+		Actor:  GetUserFromContext(c),
+		Reason: "catalog import",
+	})
+	report, err := ImportProductsCSV(ctx, store, body, dryRun)
+	switch {
+	case errors.Is(err, ErrInvalidCSV):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		AppLogger.Error.Printf("Error importing products: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import products"})
+	case len(report.Errors) > 0:
+		c.JSON(http.StatusUnprocessableEntity, report)
+	default:
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// AdminExportProducts downloads the catalog as CSV
+func AdminExportProducts(c *gin.Context) {
+	var buf bytes.Buffer
+	if err := ExportProductsCSV(c.Request.Context(), store, &buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export products"})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="products.csv"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportProductsCSV(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	err := s.Products.Save(ctx, Product{
+		ID: "whisky", Name: "Macallan 18 Years", Price: 299.99, Stock: 15, Image: "/macallan.jpg", CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the columns in the file are written, so the whisky keeps its image
+	const file = `id,sku,name,price,stock,size
+whisky,,Macallan 18 Years,279.99,12,
+gin,GIN-70,Hendrick's,39.99,2,70cl
+gin,GIN-1L,Hendrick's,49.99,1,1L
+`
+	report, err := ImportProductsCSV(ctx, s, strings.NewReader(file), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Rows != 3 || report.Created != 1 || report.Updated != 1 {
+		t.Fatalf("dry run reported %v", report)
+	}
+	if _, err := s.Products.Get(ctx, "gin"); err == nil {
+		t.Fatal("dry run created a product")
+	}
+
+	if _, err := ImportProductsCSV(ctx, s, strings.NewReader(file), false); err != nil {
+		t.Fatal(err)
+	}
+	whisky, err := s.Products.Get(ctx, "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whisky.Price != 279.99 || whisky.Stock != 12 || whisky.Image != "/macallan.jpg" {
+		t.Fatalf("unexpected whisky %+v", whisky)
+	}
+
+	// Numeric attributes are parsed, and a blank one clears the value
+	if _, err := ImportProductsCSV(ctx, s, strings.NewReader("id,abv,age_years\nwhisky,43,18\n"), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportProductsCSV(ctx, s, strings.NewReader("id,age_years,country\nwhisky,,Scotland\n"), false); err != nil {
+		t.Fatal(err)
+	}
+	whisky, err = s.Products.Get(ctx, "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := whisky.Attributes; a.ABV == nil || *a.ABV != 43 || a.AgeYears != nil || a.Country != "Scotland" {
+		t.Fatalf("unexpected attributes %+v", a)
+	}
+
+	// Rows without an id update the variant that owns the SKU
+	report, err = ImportProductsCSV(ctx, s, strings.NewReader("sku,stock\nGIN-1L,8\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin, err := s.Products.Get(ctx, "gin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Updated != 1 || len(gin.Variants) != 2 || gin.Price != 39.99 || gin.Stock != 10 {
+		t.Fatalf("sku update reported %v and left %+v", report, gin)
+	}
+}
+
+func TestImportProductsCSVRejectsWholeFile(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	for _, p := range []Product{
+		{ID: "whisky", Name: "Macallan 18 Years", Price: 299.99, Stock: 15},
+		ginVariants(),
+	} {
+		if err := s.Products.Save(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := ImportProductsCSV(ctx, s, strings.NewReader(`id,sku,name,price,stock,category
+whisky,,Macallan 18 Years,289.99,14,
+vodka,,Grey Goose,cheap,2,
+rum,,Kraken,29.99,2,rum
+,RUM-70,,10,1,
+gin,,Hendrick's,39.99,1,
+tonic,GIN-70,Tonic,2,10,
+tonic,GIN-70,Tonic,2,10,
+`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{3, 4, 5, 6, 7, 8}
+	var lines []int
+	for _, e := range report.Errors {
+		lines = append(lines, e.Line)
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("expected errors on lines %v, got %+v", want, report.Errors)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Fatalf("expected errors on lines %v, got %+v", want, report.Errors)
+		}
+	}
+	if report.Created != 0 || report.Updated != 0 {
+		t.Fatalf("a rejected file reported changes: %v", report)
+	}
+	// The valid whisky row is not written either
+	whisky, err := s.Products.Get(ctx, "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whisky.Stock != 15 {
+		t.Fatalf("rejected file changed the whisky's stock to %d", whisky.Stock)
+	}
+
+	// Attribute values are checked like any other column
+	report, err = ImportProductsCSV(ctx, s, strings.NewReader("id,sku,abv,vintage\nwhisky,,strong,\ngin,GIN-70,,2999\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) != 2 || !strings.Contains(report.Errors[0].Error, `invalid abv "strong"`) ||
+		!strings.Contains(report.Errors[1].Error, "in the future") {
+		t.Fatalf("expected the abv and vintage to be rejected, got %+v", report.Errors)
+	}
+
+	for _, file := range []string{"", "id,colour\ngin,clear\n", "name,price\nGin,39.99\n", "id,name\n\"gin,Gin\n"} {
+		if _, err := ImportProductsCSV(ctx, s, strings.NewReader(file), false); !errors.Is(err, ErrInvalidCSV) {
+			t.Errorf("import of %q returned %v, want %v", file, err, ErrInvalidCSV)
+		}
+	}
+}
+
+func TestExportProductsCSV(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	archived := time.Now()
+	for _, p := range []Product{
+		{ID: "whisky", Name: "Macallan, 18 Years", Price: 299.99, Stock: 15, Attributes: Attributes{
+			ABV: floatPtr(43), Country: "Scotland", AgeYears: intPtr(18), Cask: "Sherry oak",
+		}},
+		{ID: "rum", Name: "Kraken", Price: 29.99, Stock: 4, ArchivedAt: &archived},
+		ginVariants(),
+	} {
+		if err := s.Products.Save(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var export bytes.Buffer
+	if err := ExportProductsCSV(ctx, s, &export); err != nil {
+		t.Fatal(err)
+	}
+	want := `id,sku,name,description,category,image,size,price,stock,barcode,abv,volume_ml,country,region,age_years,vintage,cask,grape,style
+gin,GIN-70,Hendrick's,,,,70cl,39.99,2,,,,,,,,,,
+gin,GIN-1L,Hendrick's,,,,1L,49.99,1,,,,,,,,,,
+whisky,,"Macallan, 18 Years",,,,,299.99,15,,43,,Scotland,,18,,Sherry oak,,
+`
+	if export.String() != want {
+		t.Fatalf("export is\n%s\nwant\n%s", export.String(), want)
+	}
+
+	// An export imports back without changes
+	report, err := ImportProductsCSV(ctx, s, bytes.NewReader(export.Bytes()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := ExportProductsCSV(ctx, s, &again); err != nil {
+		t.Fatal(err)
+	}
+	if report.Created != 0 || report.Updated != 2 || again.String() != want {
+		t.Fatalf("re-import reported %v and changed the export to\n%s", report, again.String())
+	}
+}
+
+func TestAdminImportProducts(t *testing.T) {
+	r := newAdminServer(t)
+
+	send := func(path, contentType string, body *bytes.Buffer) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, body)
+		req.Header.Set("Content-Type", contentType)
+		token, err := generateJWT("admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Uploaded as a form file
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	part, err := mw.CreateFormFile("file", "products.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("id,stock\nwhisky,3\n"))
+	mw.Close()
+	w := send("/api/v1/admin/products/import", mw.FormDataContentType(), &form)
+	var report ImportReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || report.Updated != 1 {
+		t.Fatalf("form upload returned %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, tt := range []struct {
+		path string
+		body string
+		code int
+	}{
+		{"/api/v1/admin/products/import?dry_run=maybe", "id,stock\nwhisky,3\n", http.StatusBadRequest},
+		{"/api/v1/admin/products/import", "id,colour\nwhisky,amber\n", http.StatusBadRequest},
+		{"/api/v1/admin/products/import", "id,stock\nwhisky,-3\n", http.StatusUnprocessableEntity},
+		{"/api/v1/admin/products/import?dry_run=true", "id,stock\nwhisky,9\n", http.StatusOK},
+	} {
+		if w := send(tt.path, "text/csv", bytes.NewBufferString(tt.body)); w.Code != tt.code {
+			t.Errorf("%s with %q returned %d, want %d", tt.path, tt.body, w.Code, tt.code)
+		}
+	}
+	whisky, err := store.Products.Get(context.Background(), "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whisky.Stock != 3 {
+		t.Fatalf("whisky stock is %d, want 3 from the uploaded file", whisky.Stock)
+	}
+}
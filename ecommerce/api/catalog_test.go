@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// productIDs returns the IDs of products in order
+func productIDs(products []Product) []string {
+	ids := make([]string, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+	return ids
+}
+
+func TestProductPriceFilterUsesSalePrice(t *testing.T) {
+	r := newTestServer(t)
+	seedProduct(t, Product{ID: "gin", Name: "Hendrick's", Price: 100, Stock: 5})
+	seedProduct(t, Product{ID: "vodka", Name: "Grey Goose", Price: 80, Stock: 5})
+	err := store.Promotions.Create(context.Background(), Promotion{
+		ID: "half-off", ProductID: "gin", Type: DiscountPercent, Value: 50,
+		StartsAt: time.Now().Add(-time.Hour), EndsAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"?min_price=60&max_price=90", []string{"vodka"}},
+		{"?max_price=60", []string{"gin"}},
+		{"?sort=price&max_price=100", []string{"gin", "vodka"}},
+		{"?sort=-price&max_price=100", []string{"vodka", "gin"}},
+		{"?sort=-price", []string{"whisky", "vodka", "gin"}},
+	}
+	for _, tt := range tests {
+		var products []Product
+		code, err := do(r, "", http.MethodGet, "/api/v1/products"+tt.query, nil, &products)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Fatalf("%s returned %d", tt.query, code)
+		}
+		got := productIDs(products)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s returned %v, want %v", tt.query, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s returned %v, want %v", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+// seedCatalog adds n more products to the test server's store, named to
+// sort after its whisky
+func seedCatalog(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		seedProduct(t, Product{ID: fmt.Sprintf("p%02d", i), Name: fmt.Sprintf("Product %02d", i), Price: 10, Stock: 1})
+	}
+}
+
+func TestGetProductsReturnsArrayByDefault(t *testing.T) {
+	r := newTestServer(t)
+	seedCatalog(t, defaultPageSize+5)
+
+	var products []Product
+	code, err := do(r, "", http.MethodGet, "/api/v1/products", nil, &products)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || len(products) != defaultPageSize+6 {
+		t.Fatalf("expected all %d products, got %d (%d)", defaultPageSize+6, len(products), code)
+	}
+
+	code, err = do(r, "", http.MethodGet, "/api/v1/products?sort=name&limit=5&page=2", nil, &products)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || len(products) != 5 || products[0].ID != "p04" {
+		t.Fatalf("expected the second page of five from p04, got %v (%d)", productIDs(products), code)
+	}
+}
+
+func TestGetProductsPagination(t *testing.T) {
+	r := newTestServer(t)
+	seedCatalog(t, 25)
+
+	tests := []struct {
+		query        string
+		products     int
+		page, limit  int
+		pages, total int
+		first        string
+	}{
+		{"", 20, 1, defaultPageSize, 2, 26, ""},
+		{"&sort=name&limit=10&page=3", 6, 3, 10, 3, 26, "p19"},
+		{"&limit=10&page=4", 0, 4, 10, 3, 26, ""},
+		{"&limit=1000", 26, 1, maxPageSize, 1, 26, ""},
+		{"&in_stock=true&max_price=10&limit=10", 10, 1, 10, 3, 25, ""},
+	}
+	for _, tt := range tests {
+		var page ProductPage
+		code, err := do(r, "", http.MethodGet, "/api/v1/products?paged=true"+tt.query, nil, &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Fatalf("%s returned %d", tt.query, code)
+		}
+		if len(page.Products) != tt.products || page.Page != tt.page || page.Limit != tt.limit ||
+			page.Pages != tt.pages || page.Total != tt.total {
+			t.Errorf("%s returned %d products, page %d of %d, limit %d, total %d", tt.query,
+				len(page.Products), page.Page, page.Pages, page.Limit, page.Total)
+		}
+		if tt.first != "" && (len(page.Products) == 0 || page.Products[0].ID != tt.first) {
+			t.Errorf("%s starts with %v, want %s", tt.query, productIDs(page.Products), tt.first)
+		}
+	}
+}
+
+func TestGetProductsInvalidQuery(t *testing.T) {
+	r := newTestServer(t)
+	for _, query := range []string{
+		"sort=cheapest",
+		"sort=price&paged=true",
+		"min_price=abc",
+		"min_price=-1",
+		"max_price=ten",
+		"in_stock=maybe",
+		"page=0",
+		"page=two",
+		"limit=0",
+		"limit=-5",
+		"paged=maybe",
+		"vintage=old",
+	} {
+		code, err := do(r, "", http.MethodGet, "/api/v1/products?"+query, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := http.StatusBadRequest
+		if query == "sort=price&paged=true" {
+			want = http.StatusOK
+		}
+		if code != want {
+			t.Errorf("%s returned %d, want %d", query, code, want)
+		}
+	}
+}
+
+func TestGetProductsFacets(t *testing.T) {
+	r := newTestServer(t)
+	for i, a := range []Attributes{
+		{Country: "Scotland", Region: "Speyside"},
+		{Country: "Scotland", Region: "Islay"},
+		{Country: "Scotland", Region: "Islay"},
+		{Country: "Ireland"},
+	} {
+		seedProduct(t, Product{ID: fmt.Sprintf("w%d", i), Name: "Whisky", Price: 50, Stock: 1, Attributes: a})
+	}
+
+	var page ProductPage
+	code, err := do(r, "", http.MethodGet, "/api/v1/products?paged=true&country=scotland", nil, &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || page.Total != 3 {
+		t.Fatalf("expected 3 Scotch whiskies, got %d (%d)", page.Total, code)
+	}
+	// A facet's own filter does not narrow its counts; the other filters do
+	want := map[string][]FacetValue{
+		"country": {{Value: "Scotland", Count: 3}, {Value: "Ireland", Count: 1}},
+		"region":  {{Value: "Islay", Count: 2}, {Value: "Speyside", Count: 1}},
+		"style":   {},
+	}
+	for name, values := range want {
+		got := page.Facets[name]
+		if len(got) != len(values) {
+			t.Errorf("%s facet is %+v, want %+v", name, got, values)
+			continue
+		}
+		for i := range got {
+			if got[i] != values[i] {
+				t.Errorf("%s facet is %+v, want %+v", name, got, values)
+				break
+			}
+		}
+	}
+}
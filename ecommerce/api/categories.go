@@ -0,0 +1,312 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrCategoryInUse is returned when deleting a category that still has
+// subcategories or products
+var ErrCategoryInUse = errors.New("category has subcategories or products")
+
+// ErrCategoryExists is returned when creating a category whose slug is taken
+var ErrCategoryExists = errors.New("category already exists")
+
+// ErrUnknownCategory is returned when a product names a category that does not exist
+var ErrUnknownCategory = errors.New("unknown category")
+
+// Category is a node in the catalog taxonomy, e.g. Spirits > Whisky > Single Malt.
+// Products reference categories by slug.
+type Category struct {
+	Slug     string `json:"slug"`
+	Name     string `json:"name" binding:"required"`
+	Parent   string `json:"parent,omitempty"`
+	Position int    `json:"position"`
+	// Kind is spirit, wine or beer, or empty to inherit the parent's kind.
+	// It decides which attributes the category's products may carry.
+	Kind      string    `json:"kind,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CategoryNode is a category with its subtree, as returned by GetCategories.
+// ProductCount includes products in every descendant category.
+type CategoryNode struct {
+	Category
+	ProductCount int             `json:"product_count"`
+	Children     []*CategoryNode `json:"children"`
+}
+
+// CategoryUpdate is a partial category update; nil fields are left unchanged.
+// Slugs cannot be changed because products reference them.
+type CategoryUpdate struct {
+	Name     *string `json:"name"`
+	Parent   *string `json:"parent"`
+	Position *int    `json:"position"`
+	Kind     *string `json:"kind"`
+}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+var slugSeparators = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Slugify derives a category slug from a display name ("Single Malt" -> "single-malt")
+func Slugify(name string) string {
+	return strings.Trim(slugSeparators.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// sortCategories orders categories by display position, then name
+func sortCategories(categories []Category) {
+	sort.Slice(categories, func(i, j int) bool {
+		a, b := categories[i], categories[j]
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+}
+
+// descendants returns slug and the slugs of every category below it
+func descendants(categories []Category, slug string) []string {
+	children := make(map[string][]string)
+	for _, c := range categories {
+		children[c.Parent] = append(children[c.Parent], c.Slug)
+	}
+	scope := []string{slug}
+	for i := 0; i < len(scope); i++ {
+		scope = append(scope, children[scope[i]]...)
+	}
+	return scope
+}
+
+// buildCategoryTree arranges categories into a forest and rolls product
+// counts up from each category to its ancestors
+func buildCategoryTree(categories []Category, counts map[string]int) []*CategoryNode {
+	sortCategories(categories)
+	nodes := make(map[string]*CategoryNode, len(categories))
+	for _, c := range categories {
+		nodes[c.Slug] = &CategoryNode{Category: c, Children: []*CategoryNode{}}
+	}
+
+	roots := []*CategoryNode{}
+	for _, c := range categories {
+		node := nodes[c.Slug]
+		if parent, ok := nodes[c.Parent]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	var total func(n *CategoryNode) int
+	total = func(n *CategoryNode) int {
+		n.ProductCount = counts[n.Slug]
+		for _, child := range n.Children {
+			n.ProductCount += total(child)
+		}
+		return n.ProductCount
+	}
+	for _, root := range roots {
+		total(root)
+	}
+	return roots
+}
+
+// validateCategory checks a category's slug and that its parent exists
+// without creating a cycle
+func validateCategory(ctx context.Context, c Category) error {
+	if !slugPattern.MatchString(c.Slug) {
+		return fmt.Errorf("invalid slug %q: use lowercase letters, digits and hyphens", c.Slug)
+	}
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New("name is required")
+	}
+	if _, ok := attributeRules[c.Kind]; c.Kind != "" && !ok {
+		return fmt.Errorf("invalid kind %q: use spirit, wine or beer", c.Kind)
+	}
+	if c.Parent == "" {
+		return nil
+	}
+
+	categories, err := store.Categories.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, slug := range descendants(categories, c.Slug) {
+		if slug == c.Parent {
+			return errors.New("a category cannot be moved below itself")
+		}
+	}
+	for _, other := range categories {
+		if other.Slug == c.Parent {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown parent category %q", c.Parent)
+}
+
+// checkCategory verifies that a product's category exists. Products may be
+// left uncategorised.
+func checkCategory(ctx context.Context, slug string) error {
+	if slug == "" {
+		return nil
+	}
+	_, err := store.Categories.Get(ctx, slug)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("%w %q", ErrUnknownCategory, slug)
+	}
+	return err
+}
+
+// categoryScope resolves a category query parameter to the slugs of the
+// category and its descendants. Unknown categories resolve to nothing.
+func categoryScope(ctx context.Context, category string) ([]string, error) {
+	categories, err := store.Categories.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	slug := strings.ToLower(category)
+	for _, c := range categories {
+		if c.Slug == slug {
+			return descendants(categories, slug), nil
+		}
+	}
+	return nil, nil
+}
+
+// GetCategories returns the category tree with product counts
+func GetCategories(c *gin.Context) {
+	ctx := c.Request.Context()
+	categories, err := store.Categories.List(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load categories"})
+		return
+	}
+	counts, err := store.Products.CountByCategory(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count products"})
+		return
+	}
+	c.JSON(http.StatusOK, buildCategoryTree(categories, counts))
+}
+
+// AdminListCategories returns every category as a flat list in display order
+func AdminListCategories(c *gin.Context) {
+	categories, err := store.Categories.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load categories"})
+		return
+	}
+	sortCategories(categories)
+	c.JSON(http.StatusOK, categories)
+}
+
+// CreateCategory adds a category. The slug is derived from the name when omitted.
+func CreateCategory(c *gin.Context) {
+	var category Category
+	if err := c.ShouldBindJSON(&category); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if category.Slug == "" {
+		category.Slug = Slugify(category.Name)
+	}
+
+	ctx := c.Request.Context()
+	if err := validateCategory(ctx, category); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	category.CreatedAt = time.Now()
+	if err := store.Categories.Create(ctx, category); err != nil {
+		if errors.Is(err, ErrCategoryExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Category already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save category"})
+		return
+	}
+	c.JSON(http.StatusCreated, category)
+}
+
+// UpdateCategory renames, reorders or moves a category
+func UpdateCategory(c *gin.Context) {
+	var update CategoryUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	category, err := store.Categories.Get(ctx, c.Param("slug"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load category"})
+		return
+	}
+
+	if update.Name != nil {
+		category.Name = *update.Name
+	}
+	if update.Parent != nil {
+		category.Parent = *update.Parent
+	}
+	if update.Position != nil {
+		category.Position = *update.Position
+	}
+	if update.Kind != nil {
+		category.Kind = *update.Kind
+	}
+	if err := validateCategory(ctx, category); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := store.Categories.Save(ctx, category); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save category"})
+		return
+	}
+	c.JSON(http.StatusOK, category)
+}
+
+// DeleteCategory removes an empty category. Categories with subcategories or
+// products, including archived ones, must be emptied first.
+func DeleteCategory(c *gin.Context) {
+	ctx := c.Request.Context()
+	slug := c.Param("slug")
+
+	_, total, err := store.Products.Search(ctx, ProductQuery{
+		Category: slug, Categories: []string{slug}, IncludeArchived: true, Limit: 1,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load products"})
+		return
+	}
+	if total > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": ErrCategoryInUse.Error()})
+		return
+	}
+
+	err = store.Categories.Delete(ctx, slug)
+	switch {
+	case err == nil:
+		c.Status(http.StatusNoContent)
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Category not found"})
+	case errors.Is(err, ErrCategoryInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete category"})
+	}
+}
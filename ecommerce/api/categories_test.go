@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newCategoryServer returns the admin test server with Spirits > Whisky >
+// Single Malt and Wine in its store
+func newCategoryServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	r := newAdminServer(t)
+	for _, c := range []Category{
+		{Name: "Spirits"},
+		{Name: "Whisky", Parent: "spirits"},
+		{Name: "Single Malt", Parent: "whisky"},
+		{Name: "Wine", Position: -1},
+	} {
+		code, err := do(r, "admin", http.MethodPost, "/api/v1/admin/categories", c, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusCreated {
+			t.Fatalf("creating %s returned %d", c.Name, code)
+		}
+	}
+	return r
+}
+
+func TestSlugify(t *testing.T) {
+	for name, want := range map[string]string{
+		"Single Malt":          "single-malt",
+		"  Rosé & Sparkling  ": "ros-sparkling",
+		"IPA / Pale Ale":       "ipa-pale-ale",
+		"Top 10":               "top-10",
+	} {
+		if got := Slugify(name); got != want {
+			t.Errorf("Slugify(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestBuildCategoryTree(t *testing.T) {
+	categories := []Category{
+		{Slug: "whisky", Name: "Whisky", Parent: "spirits"},
+		{Slug: "spirits", Name: "Spirits"},
+		{Slug: "bourbon", Name: "Bourbon", Parent: "whisky"},
+		{Slug: "rye", Name: "Rye", Parent: "whisky", Position: -1},
+		{Slug: "wine", Name: "Wine"},
+		// A category whose parent has gone is still shown, at the top
+		{Slug: "cider", Name: "Cider", Parent: "fruit"},
+	}
+	counts := map[string]int{"spirits": 1, "whisky": 2, "bourbon": 3, "wine": 4}
+
+	roots := buildCategoryTree(categories, counts)
+	var names []string
+	for _, root := range roots {
+		names = append(names, root.Slug)
+	}
+	if len(roots) != 3 || names[0] != "cider" || names[1] != "spirits" || names[2] != "wine" {
+		t.Fatalf("roots are %v, want [cider spirits wine]", names)
+	}
+	spirits := roots[1]
+	whisky := spirits.Children[0]
+	if spirits.ProductCount != 6 || whisky.ProductCount != 5 {
+		t.Fatalf("spirits counts %d and whisky %d, want 6 and 5", spirits.ProductCount, whisky.ProductCount)
+	}
+	if len(whisky.Children) != 2 || whisky.Children[0].Slug != "rye" || whisky.Children[1].ProductCount != 3 {
+		t.Fatalf("expected rye before bourbon below whisky, got %+v", whisky.Children)
+	}
+}
+
+func TestCategoryFilterIncludesDescendants(t *testing.T) {
+	r := newCategoryServer(t)
+	ctx := context.Background()
+	for _, p := range []Product{
+		{ID: "macallan", Name: "Macallan 12", Price: 80, Stock: 1, Category: "single-malt"},
+		{ID: "blend", Name: "Johnnie Walker", Price: 40, Stock: 1, Category: "whisky"},
+		{ID: "merlot", Name: "Merlot", Price: 20, Stock: 1, Category: "wine"},
+	} {
+		if err := store.Products.Save(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for category, want := range map[string]string{
+		"spirits":     "blend macallan",
+		"Whisky":      "blend macallan",
+		"single-malt": "macallan",
+		"beer":        "",
+	} {
+		var products []Product
+		code, err := do(r, "", http.MethodGet, "/api/v1/products?sort=name&category="+category, nil, &products)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		for i, p := range products {
+			if i > 0 {
+				got += " "
+			}
+			got += p.ID
+		}
+		if code != http.StatusOK || got != want {
+			t.Errorf("%s lists %q (%d), want %q", category, got, code, want)
+		}
+	}
+}
+
+func TestCategoryAdmin(t *testing.T) {
+	r := newCategoryServer(t)
+	err := store.Products.Save(context.Background(), Product{ID: "macallan", Name: "Macallan 12", Price: 80, Stock: 1, Category: "single-malt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := do(r, "admin", http.MethodDelete, "/api/v1/admin/products/macallan", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		code   int
+	}{
+		{"duplicate slug", http.MethodPost, "/api/v1/admin/categories", Category{Name: "Whisky"}, http.StatusConflict},
+		{"invalid slug", http.MethodPost, "/api/v1/admin/categories", Category{Slug: "Rum!", Name: "Rum"}, http.StatusBadRequest},
+		{"unknown parent", http.MethodPost, "/api/v1/admin/categories", Category{Name: "Rum", Parent: "cane"}, http.StatusBadRequest},
+		{"move below itself", http.MethodPatch, "/api/v1/admin/categories/spirits", moveTo("single-malt"), http.StatusBadRequest},
+		{"update unknown category", http.MethodPatch, "/api/v1/admin/categories/rum", moveTo("spirits"), http.StatusNotFound},
+		{"delete with subcategories", http.MethodDelete, "/api/v1/admin/categories/whisky", nil, http.StatusConflict},
+		{"delete with an archived product", http.MethodDelete, "/api/v1/admin/categories/single-malt", nil, http.StatusConflict},
+		{"delete unknown category", http.MethodDelete, "/api/v1/admin/categories/rum", nil, http.StatusNotFound},
+		{"product in an unknown category", http.MethodPost, "/api/v1/admin/products", map[string]interface{}{"name": "Rum", "price": 30, "category": "rum"}, http.StatusBadRequest},
+		{"move a product to an unknown category", http.MethodPatch, "/api/v1/admin/products/whisky", map[string]interface{}{"category": "rum"}, http.StatusBadRequest},
+		{"move wine below spirits", http.MethodPatch, "/api/v1/admin/categories/wine", moveTo("spirits"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		code, err := do(r, "admin", tt.method, tt.path, tt.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	var categories []Category
+	if _, err := do(r, "admin", http.MethodGet, "/api/v1/admin/categories", nil, &categories); err != nil {
+		t.Fatal(err)
+	}
+	parents := make(map[string]string)
+	for _, c := range categories {
+		parents[c.Slug] = c.Parent
+	}
+	if len(categories) != 4 || parents["spirits"] != "" || parents["wine"] != "spirits" {
+		t.Fatalf("unexpected categories %+v", categories)
+	}
+}
+
+// moveTo returns a category update moving a category below parent
+func moveTo(parent string) CategoryUpdate {
+	return CategoryUpdate{Parent: &parent}
+}
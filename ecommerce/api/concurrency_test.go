@@ -0,0 +1,472 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ecommerce/notify"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const workers = 50
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	if err := SetJWTSecret([]byte("test-secret-that-is-32-bytes-long")); err != nil {
+		panic(err)
+	}
+	AppLogger.Info = log.New(io.Discard, "", 0)
+	AppLogger.Error = log.New(io.Discard, "", 0)
+}
+
+// newTestServer installs a fresh in-memory store holding one product and
+// returns the application's router
+func newTestServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	SetStore(NewMemoryStore())
+	err := store.Products.Save(context.Background(), Product{
+		ID: "whisky", Name: "Macallan 18 Years", Price: 299.99, Stock: 15, CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	SetupRoutes(r)
+	return r
+}
+
+// do performs a request as the given user and decodes the JSON response into out
+func do(r http.Handler, userID, method, path string, body, out interface{}) (int, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return 0, err
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	token, err := generateJWT(userID)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			return w.Code, fmt.Errorf("decoding %s: %w", w.Body.String(), err)
+		}
+	}
+	return w.Code, nil
+}
+
+// parallel runs fn from many goroutines at once and reports the first error
+func parallel(t *testing.T, n int, fn func(i int) error) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			if err := fn(i); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// seedProduct adds a product to the test server's store
+func seedProduct(t *testing.T, p Product) {
+	t.Helper()
+	p.CreatedAt = time.Now()
+	if err := store.Products.Save(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentAddToCartSameUser(t *testing.T) {
+	r := newTestServer(t)
+	seedProduct(t, Product{ID: "vodka", Name: "Grey Goose", Price: 49.99, Stock: workers})
+
+	parallel(t, workers, func(i int) error {
+		item := CartItemRequest{ProductID: "vodka", Quantity: 1}
+		code, err := do(r, "user-1", http.MethodPost, "/api/v1/cart/add", item, nil)
+		if err != nil {
+			return err
+		}
+		if code != http.StatusOK {
+			return fmt.Errorf("add to cart returned %d", code)
+		}
+		return nil
+	})
+
+	var cart Cart
+	if _, err := do(r, "user-1", http.MethodGet, "/api/v1/cart", nil, &cart); err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != workers {
+		t.Fatalf("expected one line with quantity %d, got %+v", workers, cart.Items)
+	}
+
+	item := CartItemRequest{ProductID: "vodka", Quantity: 1}
+	code, err := do(r, "user-1", http.MethodPost, "/api/v1/cart/add", item, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusConflict {
+		t.Fatalf("adding more than is in stock returned %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestConcurrentCartMutationsAcrossUsers(t *testing.T) {
+	r := newTestServer(t)
+	for i := 0; i < workers; i++ {
+		seedProduct(t, Product{ID: fmt.Sprintf("p-%d", i), Name: "Product", Price: 10, Stock: 1})
+	}
+
+	parallel(t, workers, func(i int) error {
+		userID := fmt.Sprintf("user-%d", i%5)
+		item := CartItemRequest{ProductID: fmt.Sprintf("p-%d", i), Quantity: 1}
+		code, err := do(r, userID, http.MethodPost, "/api/v1/cart/add", item, nil)
+		if err != nil {
+			return err
+		}
+		if code != http.StatusOK {
+			return fmt.Errorf("add to cart returned %d", code)
+		}
+		if _, err := do(r, userID, http.MethodGet, "/api/v1/cart", nil, nil); err != nil {
+			return err
+		}
+		if i%2 == 0 {
+			_, err := do(r, userID, http.MethodDelete, "/api/v1/cart/"+item.ProductID, nil, nil)
+			return err
+		}
+		return nil
+	})
+
+	total := 0
+	for u := 0; u < 5; u++ {
+		var cart Cart
+		if _, err := do(r, fmt.Sprintf("user-%d", u), http.MethodGet, "/api/v1/cart", nil, &cart); err != nil {
+			t.Fatal(err)
+		}
+		total += len(cart.Items)
+	}
+	if total != workers/2 {
+		t.Fatalf("expected %d cart lines to survive, got %d", workers/2, total)
+	}
+}
+
+func TestConcurrentOrders(t *testing.T) {
+	r := newTestServer(t)
+
+	var placed atomic.Int32
+	parallel(t, workers, func(i int) error {
+		req := OrderRequest{
+			Items: []OrderItem{{ID: "whisky", Name: "Macallan 18 Years", Price: 299.99, Quantity: 2}},
+			DeliveryDetails: DeliveryDetails{
+				Name: "Test", Address: "1 Moi Avenue", City: "Nairobi", Phone: "0712345678",
+			},
+			PaymentMethod: "mpesa",
+			Total:         599.98,
+		}
+		code, err := do(r, fmt.Sprintf("user-%d", i%3), http.MethodPost, "/api/v1/orders", req, nil)
+		if err != nil {
+			return err
+		}
+		switch code {
+		case http.StatusCreated:
+			placed.Add(1)
+		case http.StatusConflict:
+		default:
+			return fmt.Errorf("create order returned %d", code)
+		}
+		_, err = do(r, fmt.Sprintf("user-%d", i%3), http.MethodGet, "/api/v1/orders", nil, nil)
+		return err
+	})
+
+	// 15 bottles fill exactly 7 orders of 2, leaving one on the shelf
+	if placed.Load() != 7 {
+		t.Fatalf("expected 7 orders to be placed, got %d", placed.Load())
+	}
+	product, err := store.Products.Get(context.Background(), "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock != 1 {
+		t.Fatalf("expected 1 bottle left, got %d", product.Stock)
+	}
+
+	count := 0
+	for u := 0; u < 3; u++ {
+		var orders []Order
+		if _, err := do(r, fmt.Sprintf("user-%d", u), http.MethodGet, "/api/v1/orders", nil, &orders); err != nil {
+			t.Fatal(err)
+		}
+		count += len(orders)
+	}
+	if count != int(placed.Load()) {
+		t.Fatalf("expected %d orders, got %d", placed.Load(), count)
+	}
+}
+
+func TestConcurrentPayments(t *testing.T) {
+	r := newTestServer(t)
+	orders := make([]Order, 10)
+	for i := range orders {
+		orders[i] = placePendingOrder(t, "user-1", 1)
+	}
+
+	parallel(t, workers, func(i int) error {
+		order := orders[i%len(orders)]
+		orderID := order.ID
+		req := STKPushRequest{PhoneNumber: "0712345678", Amount: order.TotalAmount, OrderID: orderID}
+		code, err := do(r, "user-1", http.MethodPost, "/api/v1/mpesa/stkpush", req, nil)
+		if err != nil {
+			return err
+		}
+		if code != http.StatusOK {
+			return fmt.Errorf("stk push returned %d", code)
+		}
+		var status map[string]string
+		code, err = do(r, "user-1", http.MethodGet, "/api/v1/mpesa/status/"+orderID, nil, &status)
+		if err != nil {
+			return err
+		}
+		if code != http.StatusOK || status["status"] != "pending" {
+			return fmt.Errorf("unexpected status %d %v", code, status)
+		}
+		return nil
+	})
+
+	transactions, err := store.Payments.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) != 10 {
+		t.Fatalf("expected 10 transactions, got %d", len(transactions))
+	}
+}
+
+func TestConcurrentStockAdjustment(t *testing.T) {
+	newTestServer(t)
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	sold := 0
+	parallel(t, workers, func(i int) error {
+		_, err := store.Products.AdjustStock(ctx, "whisky", "", -1)
+		if errors.Is(err, ErrInsufficientStock) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		sold++
+		mu.Unlock()
+		return nil
+	})
+
+	product, err := store.Products.Get(ctx, "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sold != 15 || product.Stock != 0 {
+		t.Fatalf("expected to sell exactly 15 bottles, sold %d with %d left", sold, product.Stock)
+	}
+}
+
+func TestConcurrentGuestCartMerge(t *testing.T) {
+	r := newTestServer(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Users.Create(context.Background(), User{
+		ID: "user-1", Email: "guest@example.com", Password: string(hash), Name: "Guest", Role: RoleCustomer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The user has one bottle in their cart and adds two more as a guest
+	if _, err := do(r, "user-1", http.MethodPost, "/api/v1/cart/add", CartItemRequest{ProductID: "whisky", Quantity: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/cart/add", strings.NewReader(`{"product_id":"whisky","quantity":2}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	token := w.Header().Get(cartTokenHeader)
+	if w.Code != http.StatusOK || token == "" {
+		t.Fatalf("guest add to cart returned %d with token %q", w.Code, token)
+	}
+
+	// Logging in from several tabs at once must merge the guest cart once
+	parallel(t, workers, func(i int) error {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/login",
+			strings.NewReader(`{"email":"guest@example.com","password":"password123"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: cartCookie, Value: token})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			return fmt.Errorf("login returned %d", w.Code)
+		}
+		return nil
+	})
+
+	var cart Cart
+	if _, err := do(r, "user-1", http.MethodGet, "/api/v1/cart", nil, &cart); err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].Quantity != 3 {
+		t.Fatalf("expected one line with quantity 3, got %+v", cart.Items)
+	}
+}
+
+// countingSender counts the messages sent through it
+type countingSender struct {
+	sent atomic.Int32
+}
+
+func (s *countingSender) Send(ctx context.Context, msg notify.Message) error {
+	s.sent.Add(1)
+	return nil
+}
+
+func TestConcurrentAbandonedCartReminders(t *testing.T) {
+	r := newTestServer(t)
+	sender := &countingSender{}
+	SetChannel(ChannelEmail, sender)
+	t.Cleanup(func() { SetChannel(ChannelEmail, nil) })
+
+	err := store.Users.Create(context.Background(), User{ID: "user-1", Email: "user@example.com", Name: "User"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := do(r, "user-1", http.MethodPost, "/api/v1/cart/add", CartItemRequest{ProductID: "whisky", Quantity: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overlapping runs of the job must send the first reminder once
+	now := time.Now().Add(2 * time.Hour)
+	parallel(t, workers, func(i int) error {
+		_, err := ProcessAbandonedCarts(context.Background(), now)
+		return err
+	})
+	if n := sender.sent.Load(); n != 1 {
+		t.Fatalf("expected one reminder, sent %d", n)
+	}
+}
+
+func TestConcurrentCouponRedemptions(t *testing.T) {
+	r := newTestServer(t)
+	err := store.Discounts.Create(context.Background(), Discount{
+		ID:         "launch",
+		Name:       "Launch offer",
+		Code:       "LAUNCH",
+		Conditions: DiscountConditions{UsageLimit: 5},
+		Action:     DiscountAction{Type: DiscountFixed, Value: 10},
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Orders racing for the last redemptions must not push the coupon past
+	// its limit
+	var redeemed atomic.Int32
+	parallel(t, workers, func(i int) error {
+		err := store.Discounts.Redeem(context.Background(), "launch", fmt.Sprintf("order-%d", i),
+			fmt.Sprintf("user-%d", i), time.Now())
+		if errors.Is(err, ErrDiscountUsedUp) {
+			return nil
+		}
+		if err == nil {
+			redeemed.Add(1)
+		}
+		return err
+	})
+	if redeemed.Load() != 5 {
+		t.Fatalf("expected 5 redemptions, got %d", redeemed.Load())
+	}
+
+	req := OrderRequest{
+		Items: []OrderItem{{ID: "whisky", Quantity: 1}},
+		DeliveryDetails: DeliveryDetails{
+			Name: "Test", Address: "1 Moi Avenue", City: "Nairobi", Phone: "0712345678",
+		},
+		PaymentMethod: "mpesa",
+		CouponCode:    "launch",
+	}
+	code, err := do(r, "user-late", http.MethodPost, "/api/v1/orders", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusConflict {
+		t.Fatalf("expected the used up coupon to be refused, got %d", code)
+	}
+	product, err := store.Products.Get(context.Background(), "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock != 15 {
+		t.Fatalf("expected the refused order to leave stock alone, %d left", product.Stock)
+	}
+
+	// A new customer placing several orders at once sees no earlier order
+	// when pricing each of them, so only redemption can stop every one of
+	// them getting the first order discount
+	err = store.Discounts.Create(context.Background(), Discount{
+		ID:         "welcome",
+		Name:       "Welcome",
+		Conditions: DiscountConditions{FirstOrder: true},
+		Action:     DiscountAction{Type: DiscountPercent, Value: 20},
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var discounted atomic.Int32
+	parallel(t, workers, func(i int) error {
+		err := store.Discounts.Redeem(context.Background(), "welcome", fmt.Sprintf("order-new-%d", i),
+			"user-new", time.Now())
+		if errors.Is(err, ErrDiscountUsedUp) {
+			return nil
+		}
+		if err == nil {
+			discounted.Add(1)
+		}
+		return err
+	})
+	if discounted.Load() != 1 {
+		t.Fatalf("expected one order with the first order discount, got %d", discounted.Load())
+	}
+}
@@ -0,0 +1,588 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Discount actions besides DiscountPercent and DiscountFixed:
+// DiscountBuyXGetY gives away the cheapest of the units bought and
+// DiscountFreeDelivery waives the delivery fee
+const (
+	DiscountBuyXGetY     = "buy_x_get_y"
+	DiscountFreeDelivery = "free_delivery"
+)
+
+// ErrDiscountExists is returned when creating a discount whose coupon code
+// is used by another unarchived discount
+var ErrDiscountExists = errors.New("a discount with this code already exists")
+
+// ErrDiscountUsedUp is returned when redeeming a discount would exceed one of
+// its usage limits
+var ErrDiscountUsedUp = errors.New("discount has reached its usage limit")
+
+var couponPattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// Discount is a rule that takes money off carts and orders meeting its
+// conditions, e.g. 10% off whisky this weekend. Discounts with a Code are
+// coupons, applied only when the customer enters the code; the rest apply
+// automatically. Discounts are archived rather than deleted so the orders
+// that used them keep their history.
+type Discount struct {
+	ID         string             `json:"id"`
+	Name       string             `json:"name"`
+	Code       string             `json:"code,omitempty"`
+	Conditions DiscountConditions `json:"conditions"`
+	Action     DiscountAction     `json:"action"`
+	// Redemptions counts the orders that used the discount, leaving out
+	// cancelled and expired ones
+	Redemptions int        `json:"redemptions"`
+	ArchivedAt  *time.Time `json:"archived_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// DiscountConditions must all hold for a discount to apply. Categories,
+// including their subcategories, and ProductIDs narrow the items a discount
+// covers; with neither it covers the whole cart. MinSubtotal is checked
+// against the whole cart. Usage limits of zero are unlimited. FirstOrder
+// discounts are for signed-in customers with no earlier orders and can be
+// redeemed once per customer.
+type DiscountConditions struct {
+	Categories   []string   `json:"categories,omitempty"`
+	ProductIDs   []string   `json:"product_ids,omitempty"`
+	MinSubtotal  float64    `json:"min_subtotal,omitempty" binding:"gte=0"`
+	FirstOrder   bool       `json:"first_order,omitempty"`
+	UsageLimit   int        `json:"usage_limit,omitempty" binding:"gte=0"`
+	PerUserLimit int        `json:"per_user_limit,omitempty" binding:"gte=0"`
+	StartsAt     *time.Time `json:"starts_at,omitempty"`
+	EndsAt       *time.Time `json:"ends_at,omitempty"`
+}
+
+// userLimit returns how many times one customer may redeem the discount,
+// or 0 if there is no limit. Two first orders placed at once both see no
+// earlier order, so the limit of one is what keeps the second from getting
+// the discount too.
+func (cond DiscountConditions) userLimit() int {
+	if cond.FirstOrder && (cond.PerUserLimit == 0 || cond.PerUserLimit > 1) {
+		return 1
+	}
+	return cond.PerUserLimit
+}
+
+// DiscountAction is what a discount takes off. Value is the percentage off
+// the covered items for DiscountPercent and the amount off them for
+// DiscountFixed. DiscountBuyXGetY makes Get units of every Buy+Get covered
+// units free, the cheapest ones first.
+type DiscountAction struct {
+	Type  string  `json:"type" binding:"required,oneof=percent fixed buy_x_get_y free_delivery"`
+	Value float64 `json:"value,omitempty" binding:"gte=0"`
+	Buy   int     `json:"buy,omitempty" binding:"gte=0"`
+	Get   int     `json:"get,omitempty" binding:"gte=0"`
+}
+
+// DiscountRequest is the body of CreateDiscount. Coupon codes are not case
+// sensitive and are stored in upper case.
+type DiscountRequest struct {
+	Name       string             `json:"name" binding:"required"`
+	Code       string             `json:"code"`
+	Conditions DiscountConditions `json:"conditions"`
+	Action     DiscountAction     `json:"action"`
+}
+
+// CouponRequest is the body of ApplyCoupon
+type CouponRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// DiscountLine is one discount taken off a cart or order. Amount comes off
+// the subtotal, or for DiscountFreeDelivery off the delivery fee.
+type DiscountLine struct {
+	DiscountID string  `json:"discount_id"`
+	Name       string  `json:"name"`
+	Code       string  `json:"code,omitempty"`
+	Type       string  `json:"type"`
+	Amount     float64 `json:"amount"`
+}
+
+// DeliveryPricing is the fee charged for delivering an order. Orders whose
+// subtotal reaches FreeOver are delivered free; zero never waives the fee.
+type DeliveryPricing struct {
+	Fee      float64
+	FreeOver float64
+}
+
+var deliveryPricing DeliveryPricing
+
+// SetDeliveryPricing replaces the delivery fee. Until it is set delivery is free.
+func SetDeliveryPricing(p DeliveryPricing) error {
+	if p.Fee < 0 || p.FreeOver < 0 {
+		return errors.New("delivery fee and free delivery threshold cannot be negative")
+	}
+	deliveryPricing = p
+	return nil
+}
+
+// fee returns the delivery fee of an order with the given subtotal
+func (p DeliveryPricing) fee(subtotal float64) float64 {
+	if p.FreeOver > 0 && subtotal >= p.FreeOver {
+		return 0
+	}
+	return p.Fee
+}
+
+// couponError explains why a coupon cannot be used
+type couponError struct {
+	status  int
+	message string
+}
+
+func (e *couponError) Error() string {
+	return e.message
+}
+
+// discountItem is a cart line or order item as discount conditions see it
+type discountItem struct {
+	ProductID string
+	Category  string
+	Price     float64
+	Quantity  int
+}
+
+// checkout is a cart or order being priced. parents maps each category to
+// the one above it and is only loaded when a discount needs it.
+type checkout struct {
+	Items       []discountItem
+	Subtotal    float64
+	DeliveryFee float64
+	FirstOrder  bool
+	Guest       bool
+	parents     map[string]string
+}
+
+// checkoutTotals is what a cart or order costs
+type checkoutTotals struct {
+	Subtotal    float64
+	Discounts   []DiscountLine
+	DeliveryFee float64
+	Total       float64
+}
+
+// normalizeCoupon puts a coupon code in the form it is stored in
+func normalizeCoupon(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// running reports whether the discount can be used at t
+func (d Discount) running(t time.Time) bool {
+	cond := d.Conditions
+	return d.ArchivedAt == nil &&
+		(cond.StartsAt == nil || !t.Before(*cond.StartsAt)) &&
+		(cond.EndsAt == nil || t.Before(*cond.EndsAt))
+}
+
+// covers reports whether the discount applies to the item
+func (d Discount) covers(co checkout, item discountItem) bool {
+	cond := d.Conditions
+	if len(cond.Categories) == 0 && len(cond.ProductIDs) == 0 {
+		return true
+	}
+	if containsString(cond.ProductIDs, item.ProductID) {
+		return true
+	}
+	// Walk up from the item's category, guarding against cycles
+	seen := map[string]bool{}
+	for slug := item.Category; slug != "" && !seen[slug]; slug = co.parents[slug] {
+		if containsString(cond.Categories, slug) {
+			return true
+		}
+		seen[slug] = true
+	}
+	return false
+}
+
+// unmet returns why the checkout does not meet the discount's conditions,
+// or "" if it does. The validity window and usage limits are checked
+// separately.
+func (d Discount) unmet(co checkout) string {
+	cond := d.Conditions
+	switch {
+	case co.Subtotal < cond.MinSubtotal:
+		return fmt.Sprintf("requires a subtotal of KES %.2f", cond.MinSubtotal)
+	case cond.FirstOrder && co.Guest:
+		return "is only for a first order; sign in to use it"
+	case cond.FirstOrder && !co.FirstOrder:
+		return "is only for your first order"
+	}
+	for _, item := range co.Items {
+		if d.covers(co, item) {
+			return ""
+		}
+	}
+	return "does not apply to any item in your cart"
+}
+
+// amount returns what the discount takes off the checkout before it is
+// capped by the other discounts
+func (d Discount) amount(co checkout) float64 {
+	if d.Action.Type == DiscountFreeDelivery {
+		return co.DeliveryFee
+	}
+	var covered float64
+	var units []float64
+	for _, item := range co.Items {
+		if !d.covers(co, item) {
+			continue
+		}
+		covered += item.Price * float64(item.Quantity)
+		if d.Action.Type == DiscountBuyXGetY {
+			for i := 0; i < item.Quantity; i++ {
+				units = append(units, item.Price)
+			}
+		}
+	}
+
+	switch d.Action.Type {
+	case DiscountPercent:
+		return roundCents(covered * d.Action.Value / 100)
+	case DiscountFixed:
+		return math.Min(d.Action.Value, covered)
+	case DiscountBuyXGetY:
+		// Most expensive first, so the free units of each group are the
+		// cheapest in it
+		sort.Sort(sort.Reverse(sort.Float64Slice(units)))
+		group := d.Action.Buy + d.Action.Get
+		var free float64
+		for i, price := range units {
+			if i%group >= d.Action.Buy {
+				free += price
+			}
+		}
+		return roundCents(free)
+	}
+	return 0
+}
+
+// validateDiscount checks a discount's action, code and validity window
+func validateDiscount(d Discount, now time.Time) error {
+	a, cond := d.Action, d.Conditions
+	switch a.Type {
+	case DiscountPercent:
+		if a.Value <= 0 || a.Value > 100 {
+			return errors.New("percent discounts need a value above 0 and at most 100")
+		}
+	case DiscountFixed:
+		if a.Value <= 0 {
+			return errors.New("fixed discounts need a positive value")
+		}
+	case DiscountBuyXGetY:
+		if a.Buy <= 0 || a.Get <= 0 {
+			return errors.New("buy X get Y discounts need positive buy and get quantities")
+		}
+	case DiscountFreeDelivery:
+	default:
+		return fmt.Errorf("unknown discount type %q", a.Type)
+	}
+	if d.Code != "" && !couponPattern.MatchString(d.Code) {
+		return errors.New("coupon codes are 3 to 32 letters, digits, dashes or underscores")
+	}
+	if cond.EndsAt != nil && (!cond.EndsAt.After(now) || (cond.StartsAt != nil && !cond.EndsAt.After(*cond.StartsAt))) {
+		return errors.New("ends_at must be in the future and after starts_at")
+	}
+	return nil
+}
+
+// firstOrder reports whether the user has yet to place an order that was
+// not cancelled or expired. Guests cannot place orders, so whether they are
+// new customers is unknown until they sign in and they never qualify.
+func firstOrder(ctx context.Context, userID string) (bool, error) {
+	if strings.HasPrefix(userID, guestCartPrefix) {
+		return false, nil
+	}
+	orders, err := store.Orders.ListByUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, o := range orders {
+		if o.Status != OrderCancelled && o.Status != OrderExpired {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// priceCheckout works out what a user's items cost at now: their subtotal,
+// the automatic discounts they qualify for, the coupon with the given code
+// if any, and the delivery fee. Each discount is worked out on the
+// undiscounted prices, automatic ones first, and together they never take
+// off more than the subtotal and the delivery fee. A coupon that cannot be
+// used fails with a *couponError giving the reason.
+func priceCheckout(ctx context.Context, userID string, items []discountItem, code string, now time.Time) (checkoutTotals, error) {
+	co := checkout{Items: items, Guest: strings.HasPrefix(userID, guestCartPrefix)}
+	for _, item := range items {
+		co.Subtotal += item.Price * float64(item.Quantity)
+	}
+	co.Subtotal = roundCents(co.Subtotal)
+	// Empty carts have nothing to deliver
+	if len(items) > 0 {
+		co.DeliveryFee = deliveryPricing.fee(co.Subtotal)
+	}
+	totals := checkoutTotals{Subtotal: co.Subtotal, DeliveryFee: co.DeliveryFee, Discounts: []DiscountLine{}}
+
+	discounts, err := store.Discounts.Automatic(ctx, now)
+	if err != nil {
+		return totals, err
+	}
+	if code = normalizeCoupon(code); code != "" {
+		coupon, err := store.Discounts.GetByCode(ctx, code)
+		if errors.Is(err, ErrNotFound) {
+			return totals, &couponError{http.StatusNotFound, "Coupon not found"}
+		}
+		if err != nil {
+			return totals, err
+		}
+		if !coupon.running(now) {
+			return totals, &couponError{http.StatusBadRequest, "Coupon is not valid at this time"}
+		}
+		discounts = append(discounts, coupon)
+	}
+
+	for _, d := range discounts {
+		if len(d.Conditions.Categories) > 0 && co.parents == nil {
+			categories, err := store.Categories.List(ctx)
+			if err != nil {
+				return totals, err
+			}
+			co.parents = make(map[string]string, len(categories))
+			for _, c := range categories {
+				co.parents[c.Slug] = c.Parent
+			}
+		}
+		if d.Conditions.FirstOrder && !co.FirstOrder {
+			if co.FirstOrder, err = firstOrder(ctx, userID); err != nil {
+				return totals, err
+			}
+		}
+	}
+
+	goods, delivery := co.Subtotal, co.DeliveryFee
+	for _, d := range discounts {
+		coupon := d.Code != ""
+		if reason := d.unmet(co); reason != "" {
+			if coupon {
+				return totals, &couponError{http.StatusBadRequest, "Coupon " + reason}
+			}
+			continue
+		}
+
+		if perUser := d.Conditions.userLimit(); d.Conditions.UsageLimit > 0 || perUser > 0 {
+			used, usedByUser, err := store.Discounts.Usage(ctx, d.ID, userID)
+			if err != nil {
+				return totals, err
+			}
+			reason := ""
+			switch {
+			case d.Conditions.UsageLimit > 0 && used >= d.Conditions.UsageLimit:
+				reason = "Coupon has been fully redeemed"
+			case perUser > 0 && usedByUser >= perUser:
+				reason = "You have already used this coupon"
+			}
+			if reason != "" && coupon {
+				return totals, &couponError{http.StatusConflict, reason}
+			}
+			if reason != "" {
+				continue
+			}
+		}
+
+		amount := d.amount(co)
+		if d.Action.Type == DiscountFreeDelivery {
+			amount = roundCents(math.Min(amount, delivery))
+			delivery = roundCents(delivery - amount)
+		} else {
+			amount = roundCents(math.Min(amount, goods))
+			goods = roundCents(goods - amount)
+		}
+		if amount <= 0 {
+			continue
+		}
+		totals.Discounts = append(totals.Discounts, DiscountLine{
+			DiscountID: d.ID,
+			Name:       d.Name,
+			Code:       d.Code,
+			Type:       d.Action.Type,
+			Amount:     amount,
+		})
+	}
+	totals.Total = roundCents(goods + delivery)
+	return totals, nil
+}
+
+// redeemDiscounts records the use of an order's discounts. If one of them
+// has been used up since the order was priced, the others are given back
+// and it fails with ErrDiscountUsedUp.
+func redeemDiscounts(ctx context.Context, order Order) error {
+	for _, line := range order.Discounts {
+		err := store.Discounts.Redeem(ctx, line.DiscountID, order.ID, order.UserID, order.CreatedAt)
+		if err != nil {
+			releaseDiscounts(ctx, order.ID)
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseDiscounts gives back the usage of an order's discounts, as when
+// the order is cancelled or never saved
+func releaseDiscounts(ctx context.Context, orderID string) {
+	if err := store.Discounts.Release(ctx, orderID); err != nil {
+		AppLogger.Error.Printf("Error releasing discounts of order %s: %v", orderID, err)
+	}
+}
+
+// ApplyCoupon puts a coupon on the cart, failing with the reason if the
+// cart does not qualify for it. The coupon stays on the cart as it changes,
+// taking nothing off while the cart no longer qualifies.
+func ApplyCoupon(c *gin.Context) {
+	userID := cartOwner(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var req CouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	cart, err := store.Carts.Update(ctx, userID, func(cart *Cart) error {
+		cart.CouponCode = normalizeCoupon(req.Code)
+		return priceCart(ctx, cart, true)
+	})
+	if err != nil {
+		respondCartError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, cart)
+}
+
+// RemoveCoupon takes the coupon off the cart
+func RemoveCoupon(c *gin.Context) {
+	userID := cartOwner(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := store.Carts.Get(ctx, userID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+
+	cart, err := store.Carts.Update(ctx, userID, func(cart *Cart) error {
+		cart.CouponCode = ""
+		return repriceCart(ctx, cart)
+	})
+	if err != nil {
+		respondCartError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, cart)
+}
+
+// ListDiscounts returns every discount, archived ones included, newest first
+func ListDiscounts(c *gin.Context) {
+	discounts, err := store.Discounts.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load discounts"})
+		return
+	}
+	c.JSON(http.StatusOK, discounts)
+}
+
+// CreateDiscount adds a coupon or automatic discount
+func CreateDiscount(c *gin.Context) {
+	var req DiscountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	d := Discount{
+		ID:         uuid.New().String(),
+		Name:       req.Name,
+		Code:       normalizeCoupon(req.Code),
+		Conditions: req.Conditions,
+		Action:     req.Action,
+		CreatedAt:  now,
+	}
+	if err := validateDiscount(d, now); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, slug := range d.Conditions.Categories {
+		err := checkCategory(ctx, slug)
+		if errors.Is(err, ErrUnknownCategory) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load categories"})
+			return
+		}
+	}
+	for _, id := range d.Conditions.ProductIDs {
+		if _, err := store.Products.Get(ctx, id); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown product " + id})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load products"})
+			return
+		}
+	}
+
+	err := store.Discounts.Create(ctx, d)
+	if errors.Is(err, ErrDiscountExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save discount"})
+		return
+	}
+	c.JSON(http.StatusCreated, d)
+}
+
+// ArchiveDiscount ends a discount immediately. Orders that used it keep
+// their discount lines, and its coupon code becomes free for reuse.
+func ArchiveDiscount(c *gin.Context) {
+	d, err := store.Discounts.Archive(c.Request.Context(), c.Param("id"), time.Now())
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Discount not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to archive discount"})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
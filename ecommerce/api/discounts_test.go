@@ -0,0 +1,299 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// seedDiscount adds a discount to the test server's store
+func seedDiscount(t *testing.T, d Discount) {
+	t.Helper()
+	d.CreatedAt = time.Now()
+	if err := store.Discounts.Create(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFirstOrderDiscountEligibility(t *testing.T) {
+	newTestServer(t)
+	ctx := context.Background()
+	seedDiscount(t, Discount{
+		ID:         "welcome",
+		Name:       "Welcome",
+		Conditions: DiscountConditions{FirstOrder: true},
+		Action:     DiscountAction{Type: DiscountPercent, Value: 10},
+	})
+	for id, status := range map[string]string{"regular": OrderPaid, "lapsed": OrderCancelled} {
+		err := store.Orders.Create(ctx, Order{ID: "order-" + id, UserID: id, Status: status, CreatedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items := []discountItem{{ProductID: "whisky", Price: 100, Quantity: 1}}
+	for user, want := range map[string]float64{
+		"new":                   90,
+		"lapsed":                90,
+		"regular":               100,
+		guestCartPrefix + "abc": 100,
+	} {
+		totals, err := priceCheckout(ctx, user, items, "", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if totals.Total != want {
+			t.Errorf("%s pays %.2f, want %.2f", user, totals.Total, want)
+		}
+	}
+
+	// Once redeemed, the discount is not offered to the same customer again
+	if err := store.Discounts.Redeem(ctx, "welcome", "order-1", "new", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	totals, err := priceCheckout(ctx, "new", items, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totals.Total != 100 {
+		t.Errorf("second order costs %.2f, want 100", totals.Total)
+	}
+	err = store.Discounts.Redeem(ctx, "welcome", "order-2", "new", time.Now())
+	if !errors.Is(err, ErrDiscountUsedUp) {
+		t.Fatalf("second redemption returned %v, want %v", err, ErrDiscountUsedUp)
+	}
+}
+
+func TestFirstOrderCouponRefusedForGuests(t *testing.T) {
+	newTestServer(t)
+	seedDiscount(t, Discount{
+		ID:         "welcome",
+		Name:       "Welcome",
+		Code:       "WELCOME",
+		Conditions: DiscountConditions{FirstOrder: true},
+		Action:     DiscountAction{Type: DiscountFixed, Value: 10},
+	})
+
+	items := []discountItem{{ProductID: "whisky", Price: 100, Quantity: 1}}
+	_, err := priceCheckout(context.Background(), guestCartPrefix+"abc", items, "welcome", time.Now())
+	var invalid *couponError
+	if !errors.As(err, &invalid) || invalid.status != http.StatusBadRequest {
+		t.Fatalf("expected a guest to be refused the coupon, got %v", err)
+	}
+}
+
+// setDeliveryFee charges fee on every order for one test
+func setDeliveryFee(t *testing.T, fee float64) {
+	t.Helper()
+	old := deliveryPricing
+	if err := SetDeliveryPricing(DeliveryPricing{Fee: fee}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { deliveryPricing = old })
+}
+
+func TestDiscountActions(t *testing.T) {
+	twoBottles := []discountItem{{ProductID: "whisky", Category: "whisky", Price: 100, Quantity: 2}}
+	tests := []struct {
+		name       string
+		conditions DiscountConditions
+		action     DiscountAction
+		items      []discountItem
+		discount   float64
+		total      float64
+	}{
+		{
+			name:     "percent",
+			action:   DiscountAction{Type: DiscountPercent, Value: 10},
+			items:    twoBottles,
+			discount: 20,
+			total:    480,
+		},
+		{
+			name:     "fixed",
+			action:   DiscountAction{Type: DiscountFixed, Value: 50},
+			items:    twoBottles,
+			discount: 50,
+			total:    450,
+		},
+		{
+			name:     "fixed capped at the covered items",
+			action:   DiscountAction{Type: DiscountFixed, Value: 500},
+			items:    twoBottles,
+			discount: 200,
+			total:    300,
+		},
+		{
+			name:   "buy 2 get 1 free",
+			action: DiscountAction{Type: DiscountBuyXGetY, Buy: 2, Get: 1},
+			items: []discountItem{
+				{ProductID: "whisky", Price: 100, Quantity: 2},
+				{ProductID: "gin", Price: 40, Quantity: 4},
+			},
+			// Units by price are 100 100 40 | 40 40 40: one of each three is free
+			discount: 80,
+			total:    580,
+		},
+		{
+			name:     "free delivery",
+			action:   DiscountAction{Type: DiscountFreeDelivery},
+			items:    twoBottles,
+			discount: 300,
+			total:    200,
+		},
+		{
+			name:       "category",
+			conditions: DiscountConditions{Categories: []string{"gin"}},
+			action:     DiscountAction{Type: DiscountPercent, Value: 50},
+			items: []discountItem{
+				{ProductID: "whisky", Category: "whisky", Price: 100, Quantity: 1},
+				{ProductID: "gin", Category: "gin", Price: 40, Quantity: 1},
+			},
+			discount: 20,
+			total:    420,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestServer(t)
+			setDeliveryFee(t, 300)
+			seedDiscount(t, Discount{ID: "deal", Name: "Deal", Code: "DEAL", Conditions: tt.conditions, Action: tt.action})
+
+			totals, err := priceCheckout(context.Background(), "user-1", tt.items, "deal", time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(totals.Discounts) != 1 || totals.Discounts[0].Amount != tt.discount {
+				t.Fatalf("expected a discount of %.2f, got %+v", tt.discount, totals.Discounts)
+			}
+			if totals.Total != tt.total {
+				t.Fatalf("total is %.2f, want %.2f", totals.Total, tt.total)
+			}
+		})
+	}
+}
+
+func TestCouponConditions(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tests := []struct {
+		name       string
+		conditions DiscountConditions
+		archived   bool
+		code       int
+	}{
+		{name: "minimum subtotal met", conditions: DiscountConditions{MinSubtotal: 200}},
+		{name: "minimum subtotal not met", conditions: DiscountConditions{MinSubtotal: 200.01}, code: http.StatusBadRequest},
+		{name: "expired", conditions: DiscountConditions{EndsAt: &past}, code: http.StatusBadRequest},
+		{name: "not started", conditions: DiscountConditions{StartsAt: &future}, code: http.StatusBadRequest},
+		{name: "archived", archived: true, code: http.StatusNotFound},
+		{name: "product not in cart", conditions: DiscountConditions{ProductIDs: []string{"gin"}}, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestServer(t)
+			seedDiscount(t, Discount{
+				ID: "deal", Name: "Deal", Code: "DEAL", Conditions: tt.conditions,
+				Action: DiscountAction{Type: DiscountFixed, Value: 10},
+			})
+			if tt.archived {
+				if _, err := store.Discounts.Archive(context.Background(), "deal", time.Now()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			items := []discountItem{{ProductID: "whisky", Price: 100, Quantity: 2}}
+			totals, err := priceCheckout(context.Background(), "user-1", items, "deal", time.Now())
+			var invalid *couponError
+			switch {
+			case tt.code == 0 && err != nil:
+				t.Fatal(err)
+			case tt.code == 0 && totals.Total != 190:
+				t.Fatalf("total is %.2f, want 190", totals.Total)
+			case tt.code != 0 && (!errors.As(err, &invalid) || invalid.status != tt.code):
+				t.Fatalf("expected the coupon to be refused with %d, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestAutomaticDiscountConditions(t *testing.T) {
+	newTestServer(t)
+	past := time.Now().Add(-time.Hour)
+	seedDiscount(t, Discount{
+		ID: "big-spender", Name: "Big spender", Conditions: DiscountConditions{MinSubtotal: 500},
+		Action: DiscountAction{Type: DiscountFixed, Value: 50},
+	})
+	seedDiscount(t, Discount{
+		ID: "ended", Name: "Ended", Conditions: DiscountConditions{EndsAt: &past},
+		Action: DiscountAction{Type: DiscountFixed, Value: 5},
+	})
+
+	// Automatic discounts the cart does not qualify for are left out
+	// without failing
+	for subtotal, want := range map[float64]float64{499: 499, 500: 450} {
+		items := []discountItem{{ProductID: "whisky", Price: subtotal, Quantity: 1}}
+		totals, err := priceCheckout(context.Background(), "user-1", items, "", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if totals.Total != want {
+			t.Errorf("a subtotal of %.2f costs %.2f, want %.2f", subtotal, totals.Total, want)
+		}
+	}
+}
+
+func TestCreateOrderTotalMismatch(t *testing.T) {
+	r := newTestServer(t)
+	seedDiscount(t, Discount{
+		ID: "deal", Name: "Deal", Code: "DEAL", Conditions: DiscountConditions{UsageLimit: 1},
+		Action: DiscountAction{Type: DiscountFixed, Value: 10},
+	})
+
+	req := OrderRequest{
+		Items: []OrderItem{{ID: "whisky", Quantity: 1}},
+		DeliveryDetails: DeliveryDetails{
+			Name: "Test", Address: "1 Moi Avenue", City: "Nairobi", Phone: "0712345678",
+		},
+		PaymentMethod: "mpesa",
+		CouponCode:    "deal",
+		// The total before the coupon
+		Total: 299.99,
+	}
+	var conflict struct {
+		Total     float64        `json:"total"`
+		Discounts []DiscountLine `json:"discounts"`
+	}
+	code, err := do(r, "user-1", http.MethodPost, "/api/v1/orders", req, &conflict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusConflict {
+		t.Fatalf("order with the wrong total returned %d, want %d", code, http.StatusConflict)
+	}
+	if conflict.Total != 289.99 || len(conflict.Discounts) != 1 {
+		t.Fatalf("expected the discounted total, got %+v", conflict)
+	}
+	product, err := store.Products.Get(context.Background(), "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock != 15 {
+		t.Fatalf("expected the refused order to leave stock alone, %d left", product.Stock)
+	}
+	if used, _, err := store.Discounts.Usage(context.Background(), "deal", "user-1"); err != nil || used != 0 {
+		t.Fatalf("expected the refused order not to use the coupon, used %d (%v)", used, err)
+	}
+
+	req.Total = conflict.Total
+	var order Order
+	if code, err = do(r, "user-1", http.MethodPost, "/api/v1/orders", req, &order); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusCreated || order.TotalAmount != 289.99 {
+		t.Fatalf("order at the quoted total returned %d with total %.2f", code, order.TotalAmount)
+	}
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// cartCookie holds the signed cart token of a visitor who is not logged
+	// in. API clients may send it in the X-Cart-Token header instead.
+	cartCookie      = "cart_token"
+	cartTokenHeader = "X-Cart-Token"
+	cartTokenTTL    = 30 * 24 * time.Hour
+	// guestCartPrefix keeps guest cart keys apart from user IDs in the
+	// cart store
+	guestCartPrefix = "guest:"
+)
+
+// Merge conflict rules, used when a product is in both carts
+const (
+	MergeSum   = "sum"
+	MergeMax   = "max"
+	MergeUser  = "user"
+	MergeGuest = "guest"
+)
+
+// CartMergeRules decide how a guest cart joins the user's cart when the
+// guest logs in or registers
+type CartMergeRules struct {
+	// Conflict picks the quantity of a product in both carts: MergeSum adds
+	// them, MergeMax keeps the larger, MergeUser keeps the user's and
+	// MergeGuest takes the guest's
+	Conflict string
+	// CapAtStock limits merged lines to the stock available, dropping lines
+	// for products that are sold out or no longer sold
+	CapAtStock bool
+}
+
+var cartMergeRules = CartMergeRules{Conflict: MergeSum, CapAtStock: true}
+
+// SetCartMergeRules replaces the rules used to merge guest carts
+func SetCartMergeRules(rules CartMergeRules) error {
+	switch rules.Conflict {
+	case MergeSum, MergeMax, MergeUser, MergeGuest:
+	default:
+		return fmt.Errorf("unknown cart merge rule %q", rules.Conflict)
+	}
+	cartMergeRules = rules
+	return nil
+}
+
+// signCartToken returns a cart token naming the guest cart id
+func signCartToken(id string) (string, error) {
+	return signToken(jwt.MapClaims{
+		"cart_id": id,
+		"exp":     time.Now().Add(cartTokenTTL).Unix(),
+	})
+}
+
+// guestCartID returns the ID in the request's cart token, if it has a
+// valid one
+func guestCartID(c *gin.Context) (string, bool) {
+	tokenString := c.GetHeader(cartTokenHeader)
+	if tokenString == "" {
+		tokenString, _ = c.Cookie(cartCookie)
+	}
+	if tokenString == "" {
+		return "", false
+	}
+	token, err := jwt.Parse(tokenString, tokenKey)
+	if err != nil || !token.Valid {
+		return "", false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", false
+	}
+	id, ok := claims["cart_id"].(string)
+	return id, ok && id != ""
+}
+
+func setCartCookie(c *gin.Context, token string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(cartCookie, token, maxAge, "/", "", false, true)
+}
+
+// CartMiddleware picks the cart a request works on. Requests with an
+// Authorization header are authenticated as by AuthMiddleware and use the
+// user's cart. Other requests use the guest cart named by their cart token;
+// visitors without a valid one are issued a new token, set as a cookie and
+// returned in the X-Cart-Token header.
+func CartMiddleware() gin.HandlerFunc {
+	auth := AuthMiddleware()
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			auth(c)
+			return
+		}
+
+		id, ok := guestCartID(c)
+		if !ok {
+			id = uuid.New().String()
+			token, err := signCartToken(id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cart"})
+				c.Abort()
+				return
+			}
+			setCartCookie(c, token, int(cartTokenTTL/time.Second))
+			c.Header(cartTokenHeader, token)
+		}
+		c.Set("cart_id", guestCartPrefix+id)
+		c.Next()
+	}
+}
+
+// cartOwner returns the key of the cart chosen by CartMiddleware: the
+// user's ID, or the guest cart's
+func cartOwner(c *gin.Context) string {
+	if id := c.GetString("cart_id"); id != "" {
+		return id
+	}
+	return GetUserFromContext(c)
+}
+
+// mergeCartItems adds a guest cart's lines to cart by the rules
+func mergeCartItems(ctx context.Context, cart *Cart, items []CartItem, rules CartMergeRules) error {
+	for _, item := range items {
+		i := cart.index(item.ProductID, item.SKU)
+		quantity := item.Quantity
+		if i >= 0 {
+			existing := cart.Items[i].Quantity
+			switch rules.Conflict {
+			case MergeSum:
+				quantity += existing
+			case MergeMax:
+				if existing > quantity {
+					quantity = existing
+				}
+			case MergeUser:
+				quantity = existing
+			}
+		}
+
+		if rules.CapAtStock {
+			available, err := cartStock(ctx, item.ProductID, item.SKU)
+			if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrUnknownSKU) && !errors.Is(err, ErrSKURequired) {
+				return err
+			}
+			if quantity > available {
+				quantity = available
+			}
+		}
+
+		switch {
+		case quantity == 0 && i >= 0:
+			cart.Items = append(cart.Items[:i], cart.Items[i+1:]...)
+		case quantity == 0:
+		case i >= 0:
+			cart.Items[i].Quantity = quantity
+		default:
+			cart.Items = append(cart.Items, CartItem{ProductID: item.ProductID, SKU: item.SKU, Quantity: quantity})
+		}
+	}
+	cart.UpdatedAt = time.Now()
+	return repriceCart(ctx, cart)
+}
+
+// mergeGuestCart moves the request's guest cart, if it has one, into the
+// user's cart and clears the cart cookie. The guest cart is deleted before
+// merging so that two logins cannot merge it twice, and put back if the
+// merge fails. Failures are logged rather than failing the login.
+func mergeGuestCart(c *gin.Context, userID string) {
+	id, ok := guestCartID(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	guest, err := store.Carts.Get(ctx, guestCartPrefix+id)
+	if err == nil {
+		err = store.Carts.Delete(ctx, guest.UserID)
+	}
+	if errors.Is(err, ErrNotFound) {
+		setCartCookie(c, "", -1)
+		return
+	}
+	if err != nil {
+		AppLogger.Error.Printf("Error loading guest cart: %v", err)
+		return
+	}
+
+	_, err = store.Carts.Update(ctx, userID, func(cart *Cart) error {
+		return mergeCartItems(ctx, cart, guest.Items, cartMergeRules)
+	})
+	if err != nil {
+		AppLogger.Error.Printf("Error merging guest cart into %s: %v", userID, err)
+		if err := store.Carts.Save(ctx, guest); err != nil {
+			AppLogger.Error.Printf("Error restoring guest cart: %v", err)
+		}
+		return
+	}
+	setCartCookie(c, "", -1)
+}
@@ -1,7 +1,11 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -15,17 +19,44 @@ type Product struct {
 	Name        string    `json:"name" binding:"required"`
 	Description string    `json:"description"`
 	Price       float64   `json:"price" binding:"required,gt=0"`
-	Stock       int       `json:"stock" binding:"required,gte=0"`
+	Stock       int       `json:"stock" binding:"gte=0"`
 	Image       string    `json:"image"`
+	Thumbnail   string    `json:"thumbnail,omitempty"`
 	Category    string    `json:"category"`
-	CreatedAt   time.Time `json:"created_at"`
+	Variants    []Variant `json:"variants,omitempty" binding:"dive"`
+	// Bundle lists the contents of a gift set or hamper; see IsBundle
+	Bundle []BundleItem `json:"bundle,omitempty" binding:"dive"`
+	// Attributes describe the drink and are validated against the rules for
+	// the product's category kind
+	Attributes Attributes `json:"attributes"`
+	// ReorderLevel is the total stock at or below which a low-stock alert is
+	// raised; zero disables alerts. LowStockSince is set while it is reached.
+	ReorderLevel  int        `json:"reorder_level" binding:"gte=0"`
+	LowStockSince *time.Time `json:"low_stock_since,omitempty"`
+	// AverageRating and ReviewCount summarise the visible reviews. They are
+	// filled in when products are read and never stored with the product.
+	AverageRating float64 `json:"average_rating"`
+	ReviewCount   int     `json:"review_count"`
+	// SalePrice is the lowest price under an active promotion and SaleEndsAt
+	// when the promotion giving that price ends. Both are filled in on read.
+	SalePrice  *float64   `json:"sale_price,omitempty"`
+	SaleEndsAt *time.Time `json:"sale_ends_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
 }
 
+// User roles
+const (
+	RoleCustomer = "customer"
+	RoleAdmin    = "admin"
+)
+
 type User struct {
 	ID        string    `json:"id"`
 	Email     string    `json:"email" binding:"required,email"`
 	Password  string    `json:"password" binding:"required,min=6"`
 	Name      string    `json:"name" binding:"required"`
+	Role      string    `json:"role"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
@@ -34,48 +65,153 @@ type LoginCredentials struct {
 	Password string `json:"password" binding:"required"`
 }
 
-var (
-	products  = make(map[string]Product)
-	users     = make(map[string]User)
-	jwtSecret = []byte("your-256-bit-secret") // TODO: Move to environment variable
-)
+// jwtSecret signs login and guest cart tokens. Until SetJWTSecret is called
+// no token can be issued or accepted.
+var jwtSecret []byte
+
+// minJWTSecretLength is the shortest HS256 key accepted, as long as the
+// hash it keys
+const minJWTSecretLength = 32
+
+// errNoJWTSecret is returned when a token is signed before the key is set
+var errNoJWTSecret = errors.New("JWT secret is not configured")
+
+// SetJWTSecret sets the key that signs login and guest cart tokens
+func SetJWTSecret(secret []byte) error {
+	if len(secret) < minJWTSecretLength {
+		return fmt.Errorf("JWT secret must be at least %d bytes", minJWTSecretLength)
+	}
+	jwtSecret = secret
+	return nil
+}
+
+// signToken signs claims with the configured key
+func signToken(claims jwt.MapClaims) (string, error) {
+	if len(jwtSecret) == 0 {
+		return "", errNoJWTSecret
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+}
+
+// tokenKey is the jwt.Parse key function for tokens signed by signToken
+func tokenKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, http.ErrNotSupported
+	}
+	if len(jwtSecret) == 0 {
+		return nil, errNoJWTSecret
+	}
+	return jwtSecret, nil
+}
 
 func CreateProduct(c *gin.Context) {
 	var product Product
-	if err := c.ShouldBindJSON(&product); err != nil {
+	if err := json.NewDecoder(c.Request.Body).Decode(&product); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// Validation runs after decoding so variant prices and stock can fill in
+	// the product totals first
+	if err := ValidateProduct(&product); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkCategory(c.Request.Context(), product.Category); err != nil {
+		if errors.Is(err, ErrUnknownCategory) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load categories"})
+		return
+	}
+	if err := checkAttributes(c.Request.Context(), product); err != nil {
+		var invalid validationError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load categories"})
+		return
+	}
+	if err := checkBundle(c.Request.Context(), product); err != nil {
+		var invalid validationError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load products"})
+		return
+	}
 
 	product.ID = uuid.New().String()
 	product.CreatedAt = time.Now()
+	product.ArchivedAt = nil
+	product.LowStockSince = nil
 
 	// Set default image if none provided
-	defaultPlaceholder := "https://images.unsplash.com/photo-1569529465841-dfecdab7503b?auto=format&fit=crop&w=800&q=80"
 	if product.Image == "" {
-		product.Image = defaultPlaceholder
+		product.Image = DefaultProductImage
 	}
+	// Thumbnails are only generated by UploadProductImage
+	product.Thumbnail = ""
 
-	products[product.ID] = product
+	ctx := WithMovement(c.Request.Context(), MovementSource{Actor: GetUserFromContext(c)})
+	if err := store.Products.Save(ctx, product); err != nil {
+		if errors.Is(err, ErrDuplicateSKU) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save product"})
+		return
+	}
 	c.JSON(http.StatusCreated, product)
 }
 
+// GetProducts lists the storefront catalog. It accepts q (free-text search
+// over name and description), category, min_price, max_price, in_stock,
+// sort (newest, price, -price, name, -name), page and limit, plus the
+// comma-separated attribute filters country, region, style, cask, grape,
+// vintage, age, volume and abv (bands such as 40-50). The response is an
+// array of products, all of them unless page or limit is given; with
+// paged=true it is a ProductPage with the paging details and facet counts.
 func GetProducts(c *gin.Context) {
-	productList := make([]Product, 0, len(products))
-	for _, p := range products {
-		productList = append(productList, p)
+	q, err := parseProductQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	paged, err := strconv.ParseBool(c.DefaultQuery("paged", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid paged %q", c.Query("paged"))})
+		return
+	}
+	if !paged && c.Query("page") == "" && c.Query("limit") == "" {
+		q.Offset, q.Limit = 0, 0
 	}
-	c.JSON(http.StatusOK, productList)
+	searchProducts(c, q, paged)
 }
 
 func GetProduct(c *gin.Context) {
 	id := c.Param("id")
-	product, exists := products[id]
-	if !exists {
+	product, err := store.Products.Get(c.Request.Context(), id)
+	if errors.Is(err, ErrNotFound) || (err == nil && product.ArchivedAt != nil) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 		return
 	}
-	c.JSON(http.StatusOK, product)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load product"})
+		return
+	}
+	products := []Product{product}
+	if err := attachRatings(c.Request.Context(), products); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load ratings"})
+		return
+	}
+	if err := attachPrices(c.Request.Context(), products, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load prices"})
+		return
+	}
+	c.JSON(http.StatusOK, products[0])
 }
 
 func LoginUser(c *gin.Context) {
@@ -86,20 +222,15 @@ func LoginUser(c *gin.Context) {
 	}
 
 	// Find user by email
-	var user User
-	found := false
-	for _, u := range users {
-		if u.Email == credentials.Email {
-			user = u
-			found = true
-			break
-		}
-	}
-
-	if !found {
+	user, err := store.Users.GetByEmail(c.Request.Context(), credentials.Email)
+	if errors.Is(err, ErrNotFound) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
 
 	// Compare passwords
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credentials.Password)); err != nil {
@@ -113,6 +244,7 @@ func LoginUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	mergeGuestCart(c, user.ID)
 
 	c.JSON(http.StatusOK, gin.H{
 		"token": token,
@@ -120,16 +252,16 @@ func LoginUser(c *gin.Context) {
 			"id":    user.ID,
 			"email": user.Email,
 			"name":  user.Name,
+			"role":  user.Role,
 		},
 	})
 }
 
 func generateJWT(userID string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	return signToken(jwt.MapClaims{
 		"user_id": userID,
 		"exp":     time.Now().Add(time.Hour * 24).Unix(),
 	})
-	return token.SignedString(jwtSecret)
 }
 
 func RegisterUser(c *gin.Context) {
@@ -139,14 +271,6 @@ func RegisterUser(c *gin.Context) {
 		return
 	}
 
-	// Check if email already exists
-	for _, u := range users {
-		if u.Email == user.Email {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Email already registered"})
-			return
-		}
-	}
-
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -156,9 +280,18 @@ func RegisterUser(c *gin.Context) {
 
 	user.ID = uuid.New().String()
 	user.Password = string(hashedPassword)
+	user.Role = RoleCustomer
 	user.CreatedAt = time.Now()
 
-	users[user.ID] = user
+	if err := store.Users.Create(c.Request.Context(), user); err != nil {
+		if errors.Is(err, ErrEmailTaken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email already registered"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	mergeGuestCart(c, user.ID)
 
 	c.JSON(http.StatusCreated, gin.H{
 		"id":    user.ID,
@@ -181,12 +314,7 @@ func AuthMiddleware() gin.HandlerFunc {
 			tokenString = tokenString[7:]
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, http.ErrNotSupported
-			}
-			return jwtSecret, nil
-		})
+		token, err := jwt.Parse(tokenString, tokenKey)
 
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
@@ -194,8 +322,13 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			c.Set("user_id", claims["user_id"])
+		claims, ok := token.Claims.(jwt.MapClaims)
+		var userID string
+		if ok {
+			userID, _ = claims["user_id"].(string)
+		}
+		if token.Valid && userID != "" {
+			c.Set("user_id", userID)
 			c.Next()
 		} else {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
@@ -205,6 +338,25 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// AdminMiddleware rejects requests from users without the admin role. It
+// must run after AuthMiddleware.
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := store.Users.Get(c.Request.Context(), GetUserFromContext(c))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			c.Abort()
+			return
+		}
+		if err != nil || user.Role != RoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
 func GetUserFromContext(c *gin.Context) string {
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -212,58 +364,3 @@ func GetUserFromContext(c *gin.Context) string {
 	}
 	return userID.(string)
 }
-
-func init() {
-	// Initialize JWT secret
-	jwtSecret = []byte("your-256-bit-secret")
-
-	// Initialize default test user
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("test123"), bcrypt.DefaultCost)
-	defaultUser := User{
-		ID:        uuid.New().String(),
-		Email:     "test@thedot.com",
-		Password:  string(hashedPassword),
-		Name:      "Test User",
-		CreatedAt: time.Now(),
-	}
-	users[defaultUser.ID] = defaultUser
-
-	// Sample products with placeholder images
-	sampleProducts := []Product{
-		{
-			ID:          "1",
-			Name:        "Macallan 18 Years",
-			Price:       299.99,
-			Description: "Single Malt Scotch Whisky, aged for 18 years in exceptional oak casks",
-			Image:       "/static/images/products/macallan18.jpg",
-			Category:    "Whisky",
-			Stock:       15,
-			CreatedAt:   time.Now(),
-		},
-		{
-			ID:          "2",
-			Name:        "Dom Pérignon Vintage",
-			Price:       249.99,
-			Description: "Prestigious champagne with exceptional aging potential",
-			Image:       "/static/images/products/domperignon.jpg",
-			Category:    "Champagne",
-			Stock:       20,
-			CreatedAt:   time.Now(),
-		},
-		{
-			ID:          "3",
-			Name:        "Grey Goose Original",
-			Price:       49.99,
-			Description: "Premium French vodka made with the finest ingredients",
-			Image:       "/static/images/products/greygoose.jpg",
-			Category:    "Vodka",
-			Stock:       30,
-			CreatedAt:   time.Now(),
-		},
-	}
-
-	// Add sample products to the products map
-	for _, product := range sampleProducts {
-		products[product.ID] = product
-	}
-}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"ecommerce/media"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultProductImage is shown for products without an uploaded image
+const DefaultProductImage = "/static/images/placeholder.svg"
+
+// mediaPrefix is the URL path uploaded files are served under
+const mediaPrefix = "/media/"
+
+// images stores uploaded product images. It defaults to an "uploads" directory
+// in the working directory and can be swapped at startup with SetMediaStorage.
+var images media.Storage = media.NewDiskStorage("uploads")
+
+// SetMediaStorage replaces the storage used for uploaded images
+func SetMediaStorage(s media.Storage) {
+	images = s
+}
+
+// UploadProductImage accepts a JPEG, PNG or GIF as the "image" field of a
+// multipart form, stores it with resized renditions and points the product's
+// Image and Thumbnail at them
+func UploadProductImage(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Param("id")
+
+	if _, err := store.Products.Get(ctx, id); err != nil {
+		respondProduct(c, Product{}, err)
+		return
+	}
+
+	// Leave room for the multipart framing around the file itself
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, media.MaxUploadSize+64<<10)
+	file, err := c.FormFile("image")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": media.ErrTooLarge.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "image is required"})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, media.MaxUploadSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	img, err := media.Save(ctx, images, path.Join("products", id), data)
+	switch {
+	case errors.Is(err, media.ErrTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, media.ErrUnsupportedType):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		AppLogger.Error.Printf("Error storing image for product %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store image"})
+		return
+	}
+
+	product, err := store.Products.Update(ctx, id, func(p *Product) error {
+		p.Image = mediaPrefix + img.Large
+		p.Thumbnail = mediaPrefix + img.Thumb
+		return nil
+	})
+	respondProduct(c, product, err)
+}
+
+// ServeMedia serves uploaded files. Names include a content hash, so
+// responses can be cached indefinitely.
+func ServeMedia(c *gin.Context) {
+	name := strings.TrimPrefix(c.Param("path"), "/")
+	f, err := images.Open(c.Request.Context(), name)
+	if errors.Is(err, media.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load file"})
+		return
+	}
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.DataFromReader(http.StatusOK, -1, contentType, f, nil)
+}
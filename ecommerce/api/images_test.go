@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ecommerce/media"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newImageServer returns the admin test server, storing uploads in a
+// temporary directory
+func newImageServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	r := newAdminServer(t)
+	old := images
+	SetMediaStorage(media.NewDiskStorage(t.TempDir()))
+	t.Cleanup(func() { SetMediaStorage(old) })
+	return r
+}
+
+// uploadImage posts data as the image of a product and returns the response
+func uploadImage(t *testing.T, r http.Handler, userID, productID string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/products/"+productID+"/image", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	token, err := generateJWT(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUploadProductImage(t *testing.T) {
+	r := newImageServer(t)
+
+	var upload bytes.Buffer
+	if err := png.Encode(&upload, image.NewRGBA(image.Rect(0, 0, 1600, 800))); err != nil {
+		t.Fatal(err)
+	}
+	w := uploadImage(t, r, "admin", "whisky", upload.Bytes())
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload returned %d: %s", w.Code, w.Body)
+	}
+	product, err := store.Products.Get(context.Background(), "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(product.Image, mediaPrefix+"products/whisky/") || !strings.HasSuffix(product.Thumbnail, "_thumb.jpg") {
+		t.Fatalf("unexpected image %q and thumbnail %q", product.Image, product.Thumbnail)
+	}
+
+	// Renditions are cacheable JPEGs scaled to their longest side
+	for url, width := range map[string]int{product.Image: media.LargeSize, product.Thumbnail: media.ThumbSize} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" ||
+			!strings.Contains(w.Header().Get("Cache-Control"), "immutable") {
+			t.Fatalf("%s returned %d with headers %v", url, w.Code, w.Header())
+		}
+		config, err := jpeg.DecodeConfig(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != width || config.Height != width/2 {
+			t.Errorf("%s is %dx%d, want %dx%d", url, config.Width, config.Height, width, width/2)
+		}
+	}
+
+	// Pointing the image at a URL drops the generated thumbnail
+	var updated Product
+	if _, err := do(r, "admin", http.MethodPatch, "/api/v1/admin/products/whisky",
+		map[string]interface{}{"image": "https://example.com/macallan.jpg"}, &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Thumbnail != "" {
+		t.Fatalf("thumbnail %q kept for an image set by URL", updated.Thumbnail)
+	}
+}
+
+func TestUploadProductImageErrors(t *testing.T) {
+	r := newImageServer(t)
+
+	tests := []struct {
+		name    string
+		user    string
+		product string
+		data    []byte
+		code    int
+	}{
+		{"not an image", "admin", "whisky", []byte("not an image"), http.StatusUnsupportedMediaType},
+		{"too large", "admin", "whisky", make([]byte, media.MaxUploadSize+1), http.StatusRequestEntityTooLarge},
+		{"unknown product", "admin", "gin", []byte("not an image"), http.StatusNotFound},
+		{"customer", "customer", "whisky", []byte("not an image"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := uploadImage(t, r, tt.user, tt.product, tt.data); w.Code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+	product, err := store.Products.Get(context.Background(), "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Image != "" || product.Thumbnail != "" {
+		t.Fatalf("failed uploads changed the product image to %q", product.Image)
+	}
+
+	for _, path := range []string{"/media/products/whisky/missing.jpg", "/media/../go.mod", "/media/"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s returned %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reservation states of an order's stock. Stock is taken off the shelf when
+// the order is placed (held), kept when payment completes (committed) and
+// put back if payment fails or the order is cancelled or expires (released).
+const (
+	ReservationHeld      = "held"
+	ReservationCommitted = "committed"
+	ReservationReleased  = "released"
+)
+
+// reservationTTL is how long an unpaid order holds its stock
+const reservationTTL = 15 * time.Minute
+
+// StockChange adds Delta units to the stock of one product SKU
+type StockChange struct {
+	ProductID string
+	SKU       string
+	Delta     int
+}
+
+// Shortage describes an order line that cannot be filled
+type Shortage struct {
+	ProductID string `json:"product_id"`
+	SKU       string `json:"sku,omitempty"`
+	Name      string `json:"name"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+// ShortageError is returned when a stock adjustment would take one or more
+// SKUs below zero. It matches ErrInsufficientStock with errors.Is.
+type ShortageError struct {
+	Shortages []Shortage
+}
+
+func (e *ShortageError) Error() string {
+	return fmt.Sprintf("insufficient stock for %d item(s)", len(e.Shortages))
+}
+
+func (e *ShortageError) Is(target error) bool {
+	return target == ErrInsufficientStock
+}
+
+// applyStockChanges applies changes to the loaded products, which must
+// include every product the changes name. Either every change is applied or,
+// if any SKU would go below zero, none are and a ShortageError lists them all.
+func applyStockChanges(products map[string]*Product, changes []StockChange) error {
+	type key struct{ id, sku string }
+	totals := make(map[key]int)
+	var order []key
+	for _, change := range changes {
+		k := key{change.ProductID, change.SKU}
+		if _, seen := totals[k]; !seen {
+			order = append(order, k)
+		}
+		totals[k] += change.Delta
+	}
+
+	stock := func(k key) (*int, error) {
+		p, ok := products[k.id]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		if p.IsBundle() {
+			return nil, ErrBundleStock
+		}
+		variant, err := p.resolveSKU(k.sku)
+		if err != nil {
+			return nil, err
+		}
+		if variant != nil {
+			return &variant.Stock, nil
+		}
+		return &p.Stock, nil
+	}
+
+	var shortages []Shortage
+	for _, k := range order {
+		level, err := stock(k)
+		if err != nil {
+			return err
+		}
+		if *level+totals[k] < 0 {
+			shortages = append(shortages, Shortage{
+				ProductID: k.id, SKU: k.sku, Name: products[k.id].Name,
+				Requested: -totals[k], Available: *level,
+			})
+		}
+	}
+	if len(shortages) > 0 {
+		return &ShortageError{Shortages: shortages}
+	}
+
+	for _, k := range order {
+		level, _ := stock(k)
+		*level += totals[k]
+	}
+	for _, p := range products {
+		p.syncVariants()
+	}
+	return nil
+}
+
+// orderStockChanges returns the stock changes that take (sign -1) or return
+// (sign 1) an order's items. Bundles are replaced by their components.
+func orderStockChanges(items []OrderItem, sign int) []StockChange {
+	changes := make([]StockChange, 0, len(items))
+	for _, item := range items {
+		if len(item.Bundle) == 0 {
+			changes = append(changes, StockChange{ProductID: item.ID, SKU: item.SKU, Delta: sign * item.Quantity})
+			continue
+		}
+		for _, c := range item.Bundle {
+			changes = append(changes, StockChange{ProductID: c.ProductID, SKU: c.SKU, Delta: sign * item.Quantity * c.Quantity})
+		}
+	}
+	return changes
+}
+
+// releaseReservation claims an order's reserved stock, moving the order to
+// status, and returns the stock to the shelf and the order's discounts to
+// their usage limits. Only the caller that moves the reservation to
+// released restocks, so concurrent cancellations and expiry never return
+// the same units twice. If the stock cannot be returned the order is put
+// back as it was, so a later attempt can release it again.
+func releaseReservation(ctx context.Context, orderID, status string, from []string) (Order, error) {
+	var restock bool
+	var prevStatus, prevReservation string
+	order, err := store.Orders.Update(ctx, orderID, func(o *Order) error {
+		if from != nil && !containsString(from, o.Status) {
+			return ErrOrderStatus
+		}
+		prevStatus, prevReservation = o.Status, o.Reservation
+		o.Status = status
+		restock = o.Reservation == ReservationHeld || o.Reservation == ReservationCommitted
+		if restock {
+			o.Reservation = ReservationReleased
+		}
+		return nil
+	})
+	if err != nil {
+		return order, err
+	}
+	if !restock {
+		// Cancelled and expired orders no longer count towards discount limits
+		releaseDiscounts(ctx, orderID)
+		return order, nil
+	}
+
+	src := movementSource(ctx)
+	rctx := WithMovement(ctx, MovementSource{
+		Type:      MovementRelease,
+		Actor:     src.Actor,
+		Reason:    "order " + status,
+		Reference: orderID,
+	})
+	if err := store.Products.AdjustStocks(rctx, orderStockChanges(order.Items, 1)); err != nil {
+		AppLogger.Error.Printf("Error restocking order %s: %v", orderID, err)
+		_, rerr := store.Orders.Update(ctx, orderID, func(o *Order) error {
+			if o.Status != status || o.Reservation != ReservationReleased {
+				return ErrOrderStatus
+			}
+			o.Status, o.Reservation = prevStatus, prevReservation
+			return nil
+		})
+		if rerr != nil {
+			AppLogger.Error.Printf("Error restoring reservation of order %s: %v", orderID, rerr)
+		}
+		return order, err
+	}
+	releaseDiscounts(ctx, orderID)
+	for _, item := range order.Items {
+		notifySubscribers(item.ID)
+		for _, c := range item.Bundle {
+			notifySubscribers(c.ProductID)
+		}
+	}
+	return order, nil
+}
+
+// settlePayment records the outcome of an order's payment: success commits
+// the reserved stock and marks the order paid, failure releases the stock
+// and cancels the order
+func settlePayment(ctx context.Context, orderID string, paid bool) (Order, error) {
+	if !paid {
+		return releaseReservation(ctx, orderID, OrderCancelled, []string{OrderPending})
+	}
+	var committed bool
+	order, err := store.Orders.Update(ctx, orderID, func(o *Order) error {
+		// Orders that expired or were cancelled before the payment arrived
+		// have already given their stock back
+		if o.Status != OrderPending {
+			return ErrOrderStatus
+		}
+		o.Status = OrderPaid
+		committed = o.Reservation == ReservationHeld
+		if committed {
+			o.Reservation = ReservationCommitted
+		}
+		o.ReservedUntil = nil
+		return nil
+	})
+	if err == nil && committed {
+		recordSale(ctx, order)
+	}
+	return order, err
+}
+
+// recordSale writes sale entries to the stock ledger for an order whose
+// reservation was just committed. The stock itself left the shelf when the
+// order was placed, so the entries change no levels.
+func recordSale(ctx context.Context, order Order) {
+	ctx = WithMovement(ctx, MovementSource{
+		Type:      MovementSale,
+		Actor:     movementSource(ctx).Actor,
+		Reference: order.ID,
+	})
+	if err := store.Products.AdjustStocks(ctx, orderStockChanges(order.Items, 0)); err != nil {
+		AppLogger.Error.Printf("Error recording sale of order %s: %v", order.ID, err)
+	}
+}
+
+// ExpireReservations releases the stock of unpaid orders whose reservation
+// has lapsed and marks them expired. It returns the number of orders expired.
+func ExpireReservations(ctx context.Context, now time.Time) (int, error) {
+	orders, err := store.Orders.ListExpired(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, order := range orders {
+		_, err := releaseReservation(ctx, order.ID, OrderExpired, []string{OrderPending})
+		if errors.Is(err, ErrOrderStatus) {
+			// Paid or cancelled since it was listed
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// SweepReservations runs ExpireReservations every interval until ctx is done
+func SweepReservations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := ExpireReservations(ctx, now)
+			if err != nil {
+				AppLogger.Error.Printf("Error expiring reservations: %v", err)
+			} else if n > 0 {
+				AppLogger.Info.Printf("Expired %d unpaid order(s)", n)
+			}
+		}
+	}
+}
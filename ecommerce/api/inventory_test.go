@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReleaseReservationRestoresOrderWhenRestockFails(t *testing.T) {
+	newTestServer(t)
+	ctx := context.Background()
+	// The order's product is not in the store, so it cannot be restocked
+	order := Order{
+		ID:          "order-1",
+		UserID:      "user-1",
+		Items:       []OrderItem{{ID: "gin", Name: "Hendrick's", Price: 39.99, Quantity: 1}},
+		TotalAmount: 39.99,
+		Status:      OrderPending,
+		Reservation: ReservationHeld,
+		CreatedAt:   time.Now(),
+	}
+	if err := store.Orders.Create(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := settlePayment(ctx, order.ID, false); err == nil {
+		t.Fatal("expected the failed restock to be reported")
+	}
+	got, err := store.Orders.Get(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != OrderPending || got.Reservation != ReservationHeld {
+		t.Fatalf("order is %s/%s after a failed release, want %s/%s",
+			got.Status, got.Reservation, OrderPending, ReservationHeld)
+	}
+
+	// Once the product is back the order can be released again
+	seedProduct(t, Product{ID: "gin", Name: "Hendrick's", Price: 39.99})
+	if _, err := settlePayment(ctx, order.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Orders.Get(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != OrderCancelled || got.Reservation != ReservationReleased {
+		t.Fatalf("order is %s/%s, want %s/%s", got.Status, got.Reservation, OrderCancelled, ReservationReleased)
+	}
+	product, err := store.Products.Get(ctx, "gin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock != 1 {
+		t.Fatalf("stock is %d, want 1", product.Stock)
+	}
+}
+
+func TestSweepReservationsExpiresLapsedOrders(t *testing.T) {
+	newTestServer(t)
+	ctx := context.Background()
+	lapsed := placePendingOrder(t, "user-1", 2)
+	fresh := placePendingOrder(t, "user-2", 3)
+	paid := placePendingOrder(t, "user-3", 4)
+	for _, id := range []string{lapsed.ID, paid.ID} {
+		_, err := store.Orders.Update(ctx, id, func(o *Order) error {
+			past := time.Now().Add(-time.Minute)
+			o.ReservedUntil = &past
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Paid after its reservation lapsed but before the sweep
+	if _, err := settlePayment(ctx, paid.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	sweepCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		SweepReservations(sweepCtx, 5*time.Millisecond)
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for orderStatus(t, lapsed.ID) != OrderExpired && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	for id, want := range map[string]string{lapsed.ID: OrderExpired, fresh.ID: OrderPending, paid.ID: OrderPaid} {
+		if got := orderStatus(t, id); got != want {
+			t.Errorf("order %s is %s, want %s", id, got, want)
+		}
+	}
+	product, err := store.Products.Get(ctx, "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock != 8 {
+		t.Fatalf("stock is %d, want only the lapsed order's 2 units back to leave 8", product.Stock)
+	}
+
+	// A second pass finds nothing left to expire
+	if n, err := ExpireReservations(ctx, time.Now()); err != nil || n != 0 {
+		t.Fatalf("second pass expired %d orders (%v)", n, err)
+	}
+}
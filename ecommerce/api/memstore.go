@@ -0,0 +1,1476 @@
+package api
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cartShards is the number of independently locked cart partitions. Users
+// hash onto a shard so concurrent requests from different customers rarely
+// contend on the same lock.
+const cartShards = 32
+
+// NewMemoryStore returns a Store backed by in-process maps. Every store is
+// safe for concurrent use; data is lost when the process exits.
+func NewMemoryStore() *Store {
+	carts := &memCartStore{}
+	for i := range carts.shards {
+		carts.shards[i].carts = make(map[string]*Cart)
+	}
+	movements := &memMovementStore{}
+	prices := &memPriceHistoryStore{}
+	return &Store{
+		Products: &memProductStore{
+			products:  make(map[string]Product),
+			movements: movements,
+			prices:    prices,
+		},
+		Categories:     &memCategoryStore{categories: make(map[string]Category)},
+		Users:          &memUserStore{users: make(map[string]User), byEmail: make(map[string]string)},
+		Orders:         &memOrderStore{orders: make(map[string]Order)},
+		Carts:          carts,
+		Payments:       &memPaymentStore{transactions: make(map[string]*MpesaTransaction)},
+		Reviews:        &memReviewStore{reviews: make(map[string]Review)},
+		Movements:      movements,
+		Promotions:     &memPromotionStore{promotions: make(map[string]Promotion)},
+		PriceSchedules: &memPriceScheduleStore{schedule: make(map[string]ScheduledPrice)},
+		PriceHistory:   prices,
+		Wishlists:      &memWishlistStore{wishlists: make(map[string]Wishlist)},
+		Subscriptions:  &memSubscriptionStore{subscriptions: make(map[string]Subscription)},
+		AbandonedCarts: &memAbandonedCartStore{carts: make(map[string]AbandonedCart)},
+		Discounts:      &memDiscountStore{discounts: make(map[string]Discount)},
+	}
+}
+
+type memProductStore struct {
+	mu        sync.RWMutex
+	products  map[string]Product
+	movements *memMovementStore
+	prices    *memPriceHistoryStore
+}
+
+// copyProduct detaches a product's variant and bundle slices from the stored copy
+func copyProduct(p Product) Product {
+	if p.Variants != nil {
+		p.Variants = append([]Variant(nil), p.Variants...)
+	}
+	if p.Bundle != nil {
+		p.Bundle = append([]BundleItem(nil), p.Bundle...)
+	}
+	return p
+}
+
+// view returns a copy of a stored product as it is read, with a bundle's
+// stock filled in from its components. Callers must hold the lock.
+func (s *memProductStore) view(p Product) Product {
+	p = copyProduct(p)
+	if p.IsBundle() {
+		p.Stock = bundleStock(p.Bundle, func(id string) (Product, bool) {
+			c, ok := s.products[id]
+			return c, ok
+		})
+	}
+	return p
+}
+
+func (s *memProductStore) List(ctx context.Context) ([]Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	productList := make([]Product, 0, len(s.products))
+	for _, p := range s.products {
+		productList = append(productList, s.view(p))
+	}
+	return productList, nil
+}
+
+func (s *memProductStore) Search(ctx context.Context, q ProductQuery) ([]Product, int, error) {
+	s.mu.RLock()
+	matched := []Product{}
+	for _, p := range s.products {
+		if p = s.view(p); q.matches(p) {
+			matched = append(matched, p)
+		}
+	}
+	s.mu.RUnlock()
+
+	sortProducts(matched, q)
+	total := len(matched)
+	if q.Offset >= total {
+		return []Product{}, total, nil
+	}
+	end := total
+	if q.Limit > 0 && q.Offset+q.Limit < end {
+		end = q.Offset + q.Limit
+	}
+	return matched[q.Offset:end], total, nil
+}
+
+func (s *memProductStore) Get(ctx context.Context, id string) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	product, exists := s.products[id]
+	if !exists {
+		return Product{}, ErrNotFound
+	}
+	return s.view(product), nil
+}
+
+func (s *memProductStore) GetBySKU(ctx context.Context, sku string) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.products {
+		if _, ok := p.Variant(sku); ok {
+			return s.view(p), nil
+		}
+	}
+	return Product{}, ErrNotFound
+}
+
+// checkSKUs reports ErrDuplicateSKU if another product uses one of p's SKUs.
+// Callers must hold the lock.
+func (s *memProductStore) checkSKUs(p Product) error {
+	for _, v := range p.Variants {
+		for id, other := range s.products {
+			if id == p.ID {
+				continue
+			}
+			if _, taken := other.Variant(v.SKU); taken {
+				return ErrDuplicateSKU
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memProductStore) Save(ctx context.Context, product Product) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkSKUs(product); err != nil {
+		return err
+	}
+	var before *Product
+	if stored, exists := s.products[product.ID]; exists {
+		before = &stored
+	}
+	s.products[product.ID] = copyProduct(product)
+	s.movements.record(diffMovements(ctx, before, &product))
+	s.prices.record(diffPrices(ctx, before, &product))
+	return nil
+}
+
+func (s *memProductStore) Update(ctx context.Context, id string, fn func(product *Product) error) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.products[id]
+	if !exists {
+		return Product{}, ErrNotFound
+	}
+	product := copyProduct(stored)
+	if err := fn(&product); err != nil {
+		return Product{}, err
+	}
+	if err := s.checkSKUs(product); err != nil {
+		return Product{}, err
+	}
+	s.products[id] = copyProduct(product)
+	s.movements.record(diffMovements(ctx, &stored, &product))
+	s.prices.record(diffPrices(ctx, &stored, &product))
+	return s.view(product), nil
+}
+
+func (s *memProductStore) AdjustStock(ctx context.Context, id, sku string, delta int) (Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.products[id]
+	if !exists {
+		return Product{}, ErrNotFound
+	}
+	product := copyProduct(stored)
+	if product.IsBundle() {
+		return s.view(product), ErrBundleStock
+	}
+	variant, err := product.resolveSKU(sku)
+	if err != nil {
+		return product, err
+	}
+
+	stock := &product.Stock
+	if variant != nil {
+		stock = &variant.Stock
+	}
+	if *stock+delta < 0 {
+		return product, ErrInsufficientStock
+	}
+	*stock += delta
+	product.syncVariants()
+
+	s.products[id] = copyProduct(product)
+	s.movements.record(changeMovements(ctx, map[string]*Product{id: &product},
+		[]StockChange{{ProductID: id, SKU: sku, Delta: delta}}))
+	return product, nil
+}
+
+func (s *memProductStore) AdjustStocks(ctx context.Context, changes []StockChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	products := make(map[string]*Product)
+	for _, change := range changes {
+		if _, loaded := products[change.ProductID]; loaded {
+			continue
+		}
+		stored, exists := s.products[change.ProductID]
+		if !exists {
+			return ErrNotFound
+		}
+		product := copyProduct(stored)
+		products[change.ProductID] = &product
+	}
+	if err := applyStockChanges(products, changes); err != nil {
+		return err
+	}
+	for id, product := range products {
+		s.products[id] = copyProduct(*product)
+	}
+	s.movements.record(changeMovements(ctx, products, changes))
+	return nil
+}
+
+func (s *memProductStore) CountByCategory(ctx context.Context) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, p := range s.products {
+		if p.ArchivedAt == nil {
+			counts[p.Category]++
+		}
+	}
+	return counts, nil
+}
+
+func (s *memProductStore) Facets(ctx context.Context, queries map[string]ProductQuery) (map[string][]FacetValue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string][]FacetValue, len(queries))
+	for _, f := range facets {
+		q, ok := queries[f.name]
+		if !ok {
+			continue
+		}
+		index := make(map[string]int)
+		for _, p := range s.products {
+			value := f.value(p.Attributes)
+			if value == "" || !q.matches(s.view(p)) {
+				continue
+			}
+			i, seen := index[value]
+			if !seen {
+				i = len(counts[f.name])
+				index[value] = i
+				counts[f.name] = append(counts[f.name], FacetValue{Value: value})
+			}
+			counts[f.name][i].Count++
+		}
+	}
+	return counts, nil
+}
+
+type memMovementStore struct {
+	mu        sync.RWMutex
+	movements []StockMovement
+}
+
+// record appends movements to the ledger
+func (s *memMovementStore) record(movements []StockMovement) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.movements = append(s.movements, movements...)
+}
+
+func (s *memMovementStore) ListByProduct(ctx context.Context, productID, sku string, offset, limit int) ([]StockMovement, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := []StockMovement{}
+	for i := len(s.movements) - 1; i >= 0; i-- {
+		m := s.movements[i]
+		if m.ProductID == productID && (sku == "" || m.SKU == sku) {
+			matched = append(matched, m)
+		}
+	}
+	total := len(matched)
+	if offset >= total {
+		return []StockMovement{}, total, nil
+	}
+	end := total
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return matched[offset:end], total, nil
+}
+
+func (s *memMovementStore) Totals(ctx context.Context) ([]StockLevel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	index := make(map[[2]string]int)
+	totals := []StockLevel{}
+	for _, m := range s.movements {
+		k := [2]string{m.ProductID, m.SKU}
+		i, seen := index[k]
+		if !seen {
+			i = len(totals)
+			index[k] = i
+			totals = append(totals, StockLevel{ProductID: m.ProductID, SKU: m.SKU})
+		}
+		totals[i].Quantity += m.Delta
+	}
+	return totals, nil
+}
+
+type memPriceHistoryStore struct {
+	mu      sync.RWMutex
+	changes []PriceChange
+}
+
+// record appends changes to the price history
+func (s *memPriceHistoryStore) record(changes []PriceChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes = append(s.changes, changes...)
+}
+
+func (s *memPriceHistoryStore) ListByProduct(ctx context.Context, productID string, offset, limit int) ([]PriceChange, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := []PriceChange{}
+	for i := len(s.changes) - 1; i >= 0; i-- {
+		if s.changes[i].ProductID == productID {
+			matched = append(matched, s.changes[i])
+		}
+	}
+	total := len(matched)
+	if offset >= total {
+		return []PriceChange{}, total, nil
+	}
+	end := total
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return matched[offset:end], total, nil
+}
+
+type memPromotionStore struct {
+	mu         sync.RWMutex
+	promotions map[string]Promotion
+}
+
+func (s *memPromotionStore) Create(ctx context.Context, promotion Promotion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.promotions[promotion.ID] = promotion
+	return nil
+}
+
+func (s *memPromotionStore) List(ctx context.Context, productID string) ([]Promotion, error) {
+	s.mu.RLock()
+	promotions := []Promotion{}
+	for _, p := range s.promotions {
+		if p.ProductID == productID {
+			promotions = append(promotions, p)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(promotions, func(i, j int) bool {
+		if !promotions[i].StartsAt.Equal(promotions[j].StartsAt) {
+			return promotions[i].StartsAt.After(promotions[j].StartsAt)
+		}
+		return promotions[i].ID < promotions[j].ID
+	})
+	return promotions, nil
+}
+
+func (s *memPromotionStore) Active(ctx context.Context, productIDs []string, t time.Time) (map[string][]Promotion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	active := make(map[string][]Promotion)
+	for _, p := range s.promotions {
+		if containsString(productIDs, p.ProductID) && !t.Before(p.StartsAt) && t.Before(p.EndsAt) {
+			active[p.ProductID] = append(active[p.ProductID], p)
+		}
+	}
+	return active, nil
+}
+
+func (s *memPromotionStore) OnSale(ctx context.Context, t time.Time) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := []string{}
+	for _, p := range s.promotions {
+		if !t.Before(p.StartsAt) && t.Before(p.EndsAt) && !containsString(ids, p.ProductID) {
+			ids = append(ids, p.ProductID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memPromotionStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.promotions[id]; !exists {
+		return ErrNotFound
+	}
+	delete(s.promotions, id)
+	return nil
+}
+
+type memPriceScheduleStore struct {
+	mu       sync.RWMutex
+	schedule map[string]ScheduledPrice
+}
+
+// sortSchedule orders scheduled prices by when they take effect
+func sortSchedule(schedule []ScheduledPrice) {
+	sort.Slice(schedule, func(i, j int) bool {
+		if !schedule[i].EffectiveAt.Equal(schedule[j].EffectiveAt) {
+			return schedule[i].EffectiveAt.Before(schedule[j].EffectiveAt)
+		}
+		return schedule[i].ID < schedule[j].ID
+	})
+}
+
+func (s *memPriceScheduleStore) Create(ctx context.Context, sp ScheduledPrice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedule[sp.ID] = sp
+	return nil
+}
+
+func (s *memPriceScheduleStore) List(ctx context.Context, productID string) ([]ScheduledPrice, error) {
+	s.mu.RLock()
+	schedule := []ScheduledPrice{}
+	for _, sp := range s.schedule {
+		if sp.ProductID == productID {
+			schedule = append(schedule, sp)
+		}
+	}
+	s.mu.RUnlock()
+
+	sortSchedule(schedule)
+	return schedule, nil
+}
+
+func (s *memPriceScheduleStore) Due(ctx context.Context, t time.Time) ([]ScheduledPrice, error) {
+	s.mu.RLock()
+	due := []ScheduledPrice{}
+	for _, sp := range s.schedule {
+		if sp.AppliedAt == nil && !sp.EffectiveAt.After(t) {
+			due = append(due, sp)
+		}
+	}
+	s.mu.RUnlock()
+
+	sortSchedule(due)
+	return due, nil
+}
+
+func (s *memPriceScheduleStore) MarkApplied(ctx context.Context, id string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, exists := s.schedule[id]
+	if !exists {
+		return ErrNotFound
+	}
+	sp.AppliedAt = &t
+	s.schedule[id] = sp
+	return nil
+}
+
+func (s *memPriceScheduleStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, exists := s.schedule[id]
+	if !exists {
+		return ErrNotFound
+	}
+	if sp.AppliedAt != nil {
+		return ErrScheduleApplied
+	}
+	delete(s.schedule, id)
+	return nil
+}
+
+type memCategoryStore struct {
+	mu         sync.RWMutex
+	categories map[string]Category
+}
+
+func (s *memCategoryStore) List(ctx context.Context) ([]Category, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	categories := make([]Category, 0, len(s.categories))
+	for _, c := range s.categories {
+		categories = append(categories, c)
+	}
+	sortCategories(categories)
+	return categories, nil
+}
+
+func (s *memCategoryStore) Get(ctx context.Context, slug string) (Category, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	category, exists := s.categories[slug]
+	if !exists {
+		return Category{}, ErrNotFound
+	}
+	return category, nil
+}
+
+func (s *memCategoryStore) Create(ctx context.Context, category Category) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.categories[category.Slug]; exists {
+		return ErrCategoryExists
+	}
+	s.categories[category.Slug] = category
+	return nil
+}
+
+func (s *memCategoryStore) Save(ctx context.Context, category Category) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.categories[category.Slug] = category
+	return nil
+}
+
+func (s *memCategoryStore) Delete(ctx context.Context, slug string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.categories[slug]; !exists {
+		return ErrNotFound
+	}
+	for _, c := range s.categories {
+		if c.Parent == slug {
+			return ErrCategoryInUse
+		}
+	}
+	delete(s.categories, slug)
+	return nil
+}
+
+type memUserStore struct {
+	mu      sync.RWMutex
+	users   map[string]User
+	byEmail map[string]string
+}
+
+func (s *memUserStore) Get(ctx context.Context, id string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.users[id]
+	if !exists {
+		return User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *memUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, exists := s.byEmail[email]
+	if !exists {
+		return User{}, ErrNotFound
+	}
+	return s.users[id], nil
+}
+
+func (s *memUserStore) Create(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, taken := s.byEmail[user.Email]; taken {
+		return ErrEmailTaken
+	}
+	s.users[user.ID] = user
+	s.byEmail[user.Email] = user.ID
+	return nil
+}
+
+func (s *memUserStore) Save(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, taken := s.byEmail[user.Email]; taken && id != user.ID {
+		return ErrEmailTaken
+	}
+	if existing, exists := s.users[user.ID]; exists {
+		delete(s.byEmail, existing.Email)
+	}
+	s.users[user.ID] = user
+	s.byEmail[user.Email] = user.ID
+	return nil
+}
+
+func (s *memUserStore) Update(ctx context.Context, id string, fn func(user *User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.users[id]
+	if !exists {
+		return User{}, ErrNotFound
+	}
+	user := stored
+	if err := fn(&user); err != nil {
+		return User{}, err
+	}
+	if other, taken := s.byEmail[user.Email]; taken && other != id {
+		return User{}, ErrEmailTaken
+	}
+	delete(s.byEmail, stored.Email)
+	s.users[id] = user
+	s.byEmail[user.Email] = id
+	return user, nil
+}
+
+type memOrderStore struct {
+	mu     sync.RWMutex
+	orders map[string]Order
+}
+
+// copyOrder detaches an order's item and discount slices from the stored copy
+func copyOrder(order Order) Order {
+	order.Items = append([]OrderItem(nil), order.Items...)
+	if order.Discounts != nil {
+		order.Discounts = append([]DiscountLine(nil), order.Discounts...)
+	}
+	return order
+}
+
+func (s *memOrderStore) Create(ctx context.Context, order Order) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.orders[order.ID] = copyOrder(order)
+	return nil
+}
+
+func (s *memOrderStore) Get(ctx context.Context, id string) (Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, exists := s.orders[id]
+	if !exists {
+		return Order{}, ErrNotFound
+	}
+	return copyOrder(order), nil
+}
+
+func (s *memOrderStore) ListByUser(ctx context.Context, userID string) ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userOrders := []Order{}
+	for _, order := range s.orders {
+		if order.UserID == userID {
+			userOrders = append(userOrders, copyOrder(order))
+		}
+	}
+	return userOrders, nil
+}
+
+func (s *memOrderStore) UnitsSold(ctx context.Context, since time.Time) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sold := make(map[string]int)
+	for _, order := range s.orders {
+		if order.CreatedAt.Before(since) || order.Status == OrderCancelled || order.Status == OrderExpired {
+			continue
+		}
+		for _, item := range order.Items {
+			sold[item.ID] += item.Quantity
+		}
+	}
+	return sold, nil
+}
+
+func (s *memOrderStore) ListSince(ctx context.Context, since time.Time) ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orderList := []Order{}
+	for _, order := range s.orders {
+		if order.CreatedAt.Before(since) || order.Status == OrderCancelled || order.Status == OrderExpired {
+			continue
+		}
+		orderList = append(orderList, copyOrder(order))
+	}
+	return orderList, nil
+}
+
+func (s *memOrderStore) Update(ctx context.Context, id string, fn func(order *Order) error) (Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.orders[id]
+	if !exists {
+		return Order{}, ErrNotFound
+	}
+	order := copyOrder(stored)
+	if err := fn(&order); err != nil {
+		return Order{}, err
+	}
+	stored.Status = order.Status
+	stored.Reservation = order.Reservation
+	stored.ReservedUntil = order.ReservedUntil
+	s.orders[id] = stored
+	return copyOrder(stored), nil
+}
+
+func (s *memOrderStore) ListExpired(ctx context.Context, t time.Time) ([]Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	expired := []Order{}
+	for _, order := range s.orders {
+		if order.Status == OrderPending && order.Reservation == ReservationHeld &&
+			order.ReservedUntil != nil && order.ReservedUntil.Before(t) {
+			expired = append(expired, copyOrder(order))
+		}
+	}
+	return expired, nil
+}
+
+// cartShard is one lock-protected partition of the cart map
+type cartShard struct {
+	mu    sync.Mutex
+	carts map[string]*Cart
+}
+
+type memCartStore struct {
+	shards [cartShards]cartShard
+}
+
+func (s *memCartStore) shard(userID string) *cartShard {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return &s.shards[h.Sum32()%cartShards]
+}
+
+// copyCart returns a deep copy so callers never share item slices with the store
+func copyCart(cart *Cart) *Cart {
+	c := *cart
+	c.Items = append([]CartItem{}, cart.Items...)
+	c.Discounts = append([]DiscountLine{}, cart.Discounts...)
+	return &c
+}
+
+func (s *memCartStore) Get(ctx context.Context, userID string) (*Cart, error) {
+	shard := s.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	cart, exists := shard.carts[userID]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return copyCart(cart), nil
+}
+
+func (s *memCartStore) Save(ctx context.Context, cart *Cart) error {
+	shard := s.shard(cart.UserID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.carts[cart.UserID] = copyCart(cart)
+	return nil
+}
+
+func (s *memCartStore) Update(ctx context.Context, userID string, fn func(cart *Cart) error) (*Cart, error) {
+	shard := s.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	var cart *Cart
+	if existing, exists := shard.carts[userID]; exists {
+		cart = copyCart(existing)
+	} else {
+		now := time.Now()
+		cart = &Cart{UserID: userID, Items: []CartItem{}, CreatedAt: now, UpdatedAt: now}
+	}
+
+	if err := fn(cart); err != nil {
+		return nil, err
+	}
+	shard.carts[userID] = copyCart(cart)
+	return cart, nil
+}
+
+func (s *memCartStore) Delete(ctx context.Context, userID string) error {
+	shard := s.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if _, exists := shard.carts[userID]; !exists {
+		return ErrNotFound
+	}
+	delete(shard.carts, userID)
+	return nil
+}
+
+func (s *memCartStore) ListIdle(ctx context.Context, t time.Time) ([]Cart, error) {
+	carts := []Cart{}
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		for _, cart := range shard.carts {
+			if cart.UpdatedAt.Before(t) {
+				carts = append(carts, *copyCart(cart))
+			}
+		}
+		shard.mu.Unlock()
+	}
+	sort.Slice(carts, func(i, j int) bool { return carts[i].UpdatedAt.Before(carts[j].UpdatedAt) })
+	return carts, nil
+}
+
+func (s *memCartStore) Expire(ctx context.Context, userID string, t time.Time) error {
+	shard := s.shard(userID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	cart, exists := shard.carts[userID]
+	if !exists || cart.UpdatedAt.After(t) {
+		return ErrNotFound
+	}
+	delete(shard.carts, userID)
+	return nil
+}
+
+type memPaymentStore struct {
+	mu           sync.RWMutex
+	transactions map[string]*MpesaTransaction
+}
+
+func (s *memPaymentStore) Save(ctx context.Context, transaction *MpesaTransaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := *transaction
+	s.transactions[transaction.OrderID] = &t
+	return nil
+}
+
+func (s *memPaymentStore) GetByOrder(ctx context.Context, orderID string) (*MpesaTransaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	transaction, exists := s.transactions[orderID]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	t := *transaction
+	return &t, nil
+}
+
+func (s *memPaymentStore) GetByCheckoutRequest(ctx context.Context, checkoutRequestID string) (*MpesaTransaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, transaction := range s.transactions {
+		if transaction.CheckoutRequestID != "" && transaction.CheckoutRequestID == checkoutRequestID {
+			t := *transaction
+			return &t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memPaymentStore) List(ctx context.Context) ([]*MpesaTransaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	transactions := make([]*MpesaTransaction, 0, len(s.transactions))
+	for _, transaction := range s.transactions {
+		t := *transaction
+		transactions = append(transactions, &t)
+	}
+	return transactions, nil
+}
+
+type memReviewStore struct {
+	mu      sync.RWMutex
+	reviews map[string]Review
+}
+
+func (s *memReviewStore) Create(ctx context.Context, review Review) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.reviews {
+		if r.ProductID == review.ProductID && r.UserID == review.UserID {
+			return ErrAlreadyReviewed
+		}
+	}
+	s.reviews[review.ID] = review
+	return nil
+}
+
+func (s *memReviewStore) ListByProduct(ctx context.Context, productID string, includeHidden bool, offset, limit int) ([]Review, int, error) {
+	s.mu.RLock()
+	matched := []Review{}
+	for _, r := range s.reviews {
+		if r.ProductID == productID && (includeHidden || !r.Hidden) {
+			matched = append(matched, r)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].CreatedAt.Equal(matched[j].CreatedAt) {
+			return matched[i].CreatedAt.After(matched[j].CreatedAt)
+		}
+		return matched[i].ID < matched[j].ID
+	})
+	total := len(matched)
+	if offset >= total {
+		return []Review{}, total, nil
+	}
+	end := total
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return matched[offset:end], total, nil
+}
+
+func (s *memReviewStore) SetHidden(ctx context.Context, id string, hidden bool) (Review, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	review, exists := s.reviews[id]
+	if !exists {
+		return Review{}, ErrNotFound
+	}
+	review.Hidden = hidden
+	s.reviews[id] = review
+	return review, nil
+}
+
+func (s *memReviewStore) Summaries(ctx context.Context, productIDs []string) (map[string]RatingSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	wanted := make(map[string]bool, len(productIDs))
+	for _, id := range productIDs {
+		wanted[id] = true
+	}
+	sums := make(map[string]int)
+	summaries := make(map[string]RatingSummary)
+	for _, r := range s.reviews {
+		if r.Hidden || !wanted[r.ProductID] {
+			continue
+		}
+		sums[r.ProductID] += r.Rating
+		summary := summaries[r.ProductID]
+		summary.Count++
+		summary.Average = float64(sums[r.ProductID]) / float64(summary.Count)
+		summaries[r.ProductID] = summary
+	}
+	return summaries, nil
+}
+
+type memWishlistStore struct {
+	mu        sync.RWMutex
+	wishlists map[string]Wishlist
+}
+
+func copyWishlist(w Wishlist) Wishlist {
+	w.Items = append([]WishlistItem{}, w.Items...)
+	return w
+}
+
+// nameTaken reports whether another of the user's lists has the name.
+// Callers must hold the lock.
+func (s *memWishlistStore) nameTaken(w Wishlist) bool {
+	for _, other := range s.wishlists {
+		if other.ID != w.ID && other.UserID == w.UserID && strings.EqualFold(other.Name, w.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memWishlistStore) ListByUser(ctx context.Context, userID string) ([]Wishlist, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	lists := []Wishlist{}
+	for _, w := range s.wishlists {
+		if w.UserID == userID {
+			lists = append(lists, copyWishlist(w))
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool {
+		if !lists[i].CreatedAt.Equal(lists[j].CreatedAt) {
+			return lists[i].CreatedAt.Before(lists[j].CreatedAt)
+		}
+		return lists[i].ID < lists[j].ID
+	})
+	return lists, nil
+}
+
+func (s *memWishlistStore) Get(ctx context.Context, id string) (Wishlist, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	w, exists := s.wishlists[id]
+	if !exists {
+		return Wishlist{}, ErrNotFound
+	}
+	return copyWishlist(w), nil
+}
+
+func (s *memWishlistStore) Create(ctx context.Context, w Wishlist) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nameTaken(w) {
+		return ErrWishlistExists
+	}
+	s.wishlists[w.ID] = copyWishlist(w)
+	return nil
+}
+
+func (s *memWishlistStore) Update(ctx context.Context, id string, fn func(w *Wishlist) error) (Wishlist, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.wishlists[id]
+	if !exists {
+		return Wishlist{}, ErrNotFound
+	}
+	w := copyWishlist(stored)
+	if err := fn(&w); err != nil {
+		return Wishlist{}, err
+	}
+	if s.nameTaken(w) {
+		return Wishlist{}, ErrWishlistExists
+	}
+	s.wishlists[id] = copyWishlist(w)
+	return w, nil
+}
+
+func (s *memWishlistStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.wishlists[id]; !exists {
+		return ErrNotFound
+	}
+	delete(s.wishlists, id)
+	return nil
+}
+
+type memSubscriptionStore struct {
+	mu            sync.RWMutex
+	subscriptions map[string]Subscription
+}
+
+func (s *memSubscriptionStore) Create(ctx context.Context, sub Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.subscriptions {
+		if other.NotifiedAt == nil && other.UserID == sub.UserID && other.ProductID == sub.ProductID &&
+			other.SKU == sub.SKU && other.Type == sub.Type {
+			return ErrAlreadySubscribed
+		}
+	}
+	s.subscriptions[sub.ID] = sub
+	return nil
+}
+
+func (s *memSubscriptionStore) Get(ctx context.Context, id string) (Subscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sub, exists := s.subscriptions[id]
+	if !exists {
+		return Subscription{}, ErrNotFound
+	}
+	return sub, nil
+}
+
+// active returns the active subscriptions passing keep, oldest first
+func (s *memSubscriptionStore) active(keep func(sub Subscription) bool) []Subscription {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subs := []Subscription{}
+	for _, sub := range s.subscriptions {
+		if sub.NotifiedAt == nil && keep(sub) {
+			subs = append(subs, sub)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		if !subs[i].CreatedAt.Equal(subs[j].CreatedAt) {
+			return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+		}
+		return subs[i].ID < subs[j].ID
+	})
+	return subs
+}
+
+func (s *memSubscriptionStore) ListByUser(ctx context.Context, userID string) ([]Subscription, error) {
+	subs := s.active(func(sub Subscription) bool { return sub.UserID == userID })
+	for i, j := 0, len(subs)-1; i < j; i, j = i+1, j-1 {
+		subs[i], subs[j] = subs[j], subs[i]
+	}
+	return subs, nil
+}
+
+func (s *memSubscriptionStore) ListActive(ctx context.Context, productIDs []string) ([]Subscription, error) {
+	return s.active(func(sub Subscription) bool {
+		return productIDs == nil || containsString(productIDs, sub.ProductID)
+	}), nil
+}
+
+func (s *memSubscriptionStore) Claim(ctx context.Context, id string, t time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, exists := s.subscriptions[id]
+	if !exists || sub.NotifiedAt != nil {
+		return false, nil
+	}
+	sub.NotifiedAt = &t
+	s.subscriptions[id] = sub
+	return true, nil
+}
+
+func (s *memSubscriptionStore) Release(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, exists := s.subscriptions[id]
+	if !exists {
+		return ErrNotFound
+	}
+	sub.NotifiedAt = nil
+	s.subscriptions[id] = sub
+	return nil
+}
+
+func (s *memSubscriptionStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.subscriptions[id]; !exists {
+		return ErrNotFound
+	}
+	delete(s.subscriptions, id)
+	return nil
+}
+
+type memAbandonedCartStore struct {
+	mu    sync.Mutex
+	carts map[string]AbandonedCart
+}
+
+func (s *memAbandonedCartStore) Open(ctx context.Context, cart AbandonedCart) (AbandonedCart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.carts {
+		if existing.UserID == cart.UserID && existing.AbandonedAt.Equal(cart.AbandonedAt) {
+			return existing, nil
+		}
+	}
+	s.carts[cart.ID] = cart
+	return cart, nil
+}
+
+func (s *memAbandonedCartStore) ClaimReminder(ctx context.Context, id string, sent, due int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cart, exists := s.carts[id]
+	if !exists || !cart.open() || cart.RemindersSent != sent {
+		return false, nil
+	}
+	cart.RemindersSent = due
+	s.carts[id] = cart
+	return true, nil
+}
+
+func (s *memAbandonedCartStore) ReleaseReminder(ctx context.Context, id string, sent, due int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cart, exists := s.carts[id]
+	if !exists {
+		return ErrNotFound
+	}
+	if cart.RemindersSent == due {
+		cart.RemindersSent = sent
+		s.carts[id] = cart
+	}
+	return nil
+}
+
+func (s *memAbandonedCartStore) Recover(ctx context.Context, userID, orderID string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var latest *AbandonedCart
+	for _, cart := range s.carts {
+		if cart.UserID != userID || !cart.open() || cart.AbandonedAt.After(t) {
+			continue
+		}
+		if latest == nil || cart.AbandonedAt.After(latest.AbandonedAt) {
+			cart := cart
+			latest = &cart
+		}
+	}
+	if latest != nil {
+		latest.OrderID = orderID
+		latest.RecoveredAt = &t
+		s.carts[latest.ID] = *latest
+	}
+	return nil
+}
+
+func (s *memAbandonedCartStore) Expire(ctx context.Context, userID string, abandonedAt, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, cart := range s.carts {
+		if cart.UserID == userID && cart.AbandonedAt.Equal(abandonedAt) && cart.open() {
+			cart.ExpiredAt = &t
+			s.carts[id] = cart
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memAbandonedCartStore) ListSince(ctx context.Context, since time.Time) ([]AbandonedCart, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	carts := []AbandonedCart{}
+	for _, cart := range s.carts {
+		if !cart.AbandonedAt.Before(since) {
+			carts = append(carts, cart)
+		}
+	}
+	sort.Slice(carts, func(i, j int) bool {
+		if !carts[i].AbandonedAt.Equal(carts[j].AbandonedAt) {
+			return carts[i].AbandonedAt.Before(carts[j].AbandonedAt)
+		}
+		return carts[i].ID < carts[j].ID
+	})
+	return carts, nil
+}
+
+// memRedemption is one order's use of a discount
+type memRedemption struct {
+	discountID string
+	orderID    string
+	userID     string
+	redeemedAt time.Time
+}
+
+type memDiscountStore struct {
+	mu          sync.Mutex
+	discounts   map[string]Discount
+	redemptions []memRedemption
+}
+
+// copyDiscount detaches a discount's condition slices from the stored copy
+// and fills in its redemption count. The caller must hold s.mu.
+func (s *memDiscountStore) copyDiscount(d Discount) Discount {
+	d.Conditions.Categories = append([]string(nil), d.Conditions.Categories...)
+	d.Conditions.ProductIDs = append([]string(nil), d.Conditions.ProductIDs...)
+	d.Redemptions, _ = s.usage(d.ID, "")
+	return d
+}
+
+// usage counts a discount's redemptions, in all and by the user. The caller
+// must hold s.mu.
+func (s *memDiscountStore) usage(id, userID string) (int, int) {
+	used, usedByUser := 0, 0
+	for _, r := range s.redemptions {
+		if r.discountID != id {
+			continue
+		}
+		used++
+		if r.userID == userID {
+			usedByUser++
+		}
+	}
+	return used, usedByUser
+}
+
+func (s *memDiscountStore) Create(ctx context.Context, discount Discount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if discount.Code != "" {
+		for _, existing := range s.discounts {
+			if existing.Code == discount.Code && existing.ArchivedAt == nil {
+				return ErrDiscountExists
+			}
+		}
+	}
+	s.discounts[discount.ID] = s.copyDiscount(discount)
+	return nil
+}
+
+func (s *memDiscountStore) Get(ctx context.Context, id string) (Discount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, exists := s.discounts[id]
+	if !exists {
+		return Discount{}, ErrNotFound
+	}
+	return s.copyDiscount(d), nil
+}
+
+func (s *memDiscountStore) GetByCode(ctx context.Context, code string) (Discount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.discounts {
+		if d.Code != "" && d.Code == code && d.ArchivedAt == nil {
+			return s.copyDiscount(d), nil
+		}
+	}
+	return Discount{}, ErrNotFound
+}
+
+func (s *memDiscountStore) List(ctx context.Context) ([]Discount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	discounts := []Discount{}
+	for _, d := range s.discounts {
+		discounts = append(discounts, s.copyDiscount(d))
+	}
+	sort.Slice(discounts, func(i, j int) bool {
+		if !discounts[i].CreatedAt.Equal(discounts[j].CreatedAt) {
+			return discounts[i].CreatedAt.After(discounts[j].CreatedAt)
+		}
+		return discounts[i].ID < discounts[j].ID
+	})
+	return discounts, nil
+}
+
+func (s *memDiscountStore) Automatic(ctx context.Context, t time.Time) ([]Discount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	discounts := []Discount{}
+	for _, d := range s.discounts {
+		if d.Code == "" && d.running(t) {
+			discounts = append(discounts, s.copyDiscount(d))
+		}
+	}
+	sort.Slice(discounts, func(i, j int) bool {
+		if !discounts[i].CreatedAt.Equal(discounts[j].CreatedAt) {
+			return discounts[i].CreatedAt.Before(discounts[j].CreatedAt)
+		}
+		return discounts[i].ID < discounts[j].ID
+	})
+	return discounts, nil
+}
+
+func (s *memDiscountStore) Archive(ctx context.Context, id string, t time.Time) (Discount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, exists := s.discounts[id]
+	if !exists {
+		return Discount{}, ErrNotFound
+	}
+	if d.ArchivedAt == nil {
+		d.ArchivedAt = &t
+		s.discounts[id] = d
+	}
+	return s.copyDiscount(d), nil
+}
+
+func (s *memDiscountStore) Usage(ctx context.Context, id, userID string) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used, usedByUser := s.usage(id, userID)
+	return used, usedByUser, nil
+}
+
+func (s *memDiscountStore) Redeem(ctx context.Context, id, orderID, userID string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, exists := s.discounts[id]
+	if !exists {
+		return ErrNotFound
+	}
+	for _, r := range s.redemptions {
+		if r.discountID == id && r.orderID == orderID {
+			return nil
+		}
+	}
+	used, usedByUser := s.usage(id, userID)
+	if (d.Conditions.UsageLimit > 0 && used >= d.Conditions.UsageLimit) ||
+		(d.Conditions.userLimit() > 0 && usedByUser >= d.Conditions.userLimit()) {
+		return ErrDiscountUsedUp
+	}
+	s.redemptions = append(s.redemptions, memRedemption{discountID: id, orderID: orderID, userID: userID, redeemedAt: t})
+	return nil
+}
+
+func (s *memDiscountStore) Release(ctx context.Context, orderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.redemptions[:0]
+	for _, r := range s.redemptions {
+		if r.orderID != orderID {
+			kept = append(kept, r)
+		}
+	}
+	s.redemptions = kept
+	return nil
+}
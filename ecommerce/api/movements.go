@@ -0,0 +1,310 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Stock movement types. Units leave the shelf when an order reserves them;
+// the sale entry written when payment completes records that the reserved
+// units were sold and does not change the stock level again.
+const (
+	MovementOpening     = "opening"
+	MovementReservation = "reservation"
+	MovementSale        = "sale"
+	MovementRelease     = "release"
+	MovementRestock     = "restock"
+	MovementAdjustment  = "adjustment"
+	MovementBreakage    = "breakage"
+	MovementReturn      = "return"
+)
+
+// StockMovement is one immutable entry in a product's stock ledger. Balance
+// is the SKU's stock level after the movement.
+type StockMovement struct {
+	ID        string    `json:"id"`
+	ProductID string    `json:"product_id"`
+	SKU       string    `json:"sku"`
+	Type      string    `json:"type"`
+	Delta     int       `json:"delta"`
+	Balance   int       `json:"balance"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason"`
+	Reference string    `json:"reference"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StockLevel is the quantity of one product SKU
+type StockLevel struct {
+	ProductID string
+	SKU       string
+	Quantity  int
+}
+
+// MovementSource describes who is changing stock and why. Stores record it
+// against every movement written under a context carrying it.
+type MovementSource struct {
+	Type      string
+	Actor     string
+	Reason    string
+	Reference string
+}
+
+type movementKey struct{}
+
+// WithMovement returns a context whose stock changes are recorded with src
+func WithMovement(ctx context.Context, src MovementSource) context.Context {
+	return context.WithValue(ctx, movementKey{}, src)
+}
+
+// movementSource returns the source set on ctx. Changes made without one are
+// recorded as adjustments by the system.
+func movementSource(ctx context.Context) MovementSource {
+	src, _ := ctx.Value(movementKey{}).(MovementSource)
+	if src.Type == "" {
+		src.Type = MovementAdjustment
+	}
+	if src.Actor == "" {
+		src.Actor = "system"
+	}
+	return src
+}
+
+// stockLevels returns the stock of each SKU of a product, keyed by SKU.
+// Products without variants hold their stock under the empty SKU.
+func stockLevels(p *Product) map[string]int {
+	if p == nil {
+		return nil
+	}
+	if len(p.Variants) == 0 {
+		return map[string]int{"": p.Stock}
+	}
+	levels := make(map[string]int, len(p.Variants))
+	for _, v := range p.Variants {
+		levels[v.SKU] = v.Stock
+	}
+	return levels
+}
+
+// newMovement fills in the fields shared by every movement written from src
+func newMovement(src MovementSource, productID, sku string, delta, balance int) StockMovement {
+	return StockMovement{
+		ID:        uuid.New().String(),
+		ProductID: productID,
+		SKU:       sku,
+		Type:      src.Type,
+		Delta:     delta,
+		Balance:   balance,
+		Actor:     src.Actor,
+		Reason:    src.Reason,
+		Reference: src.Reference,
+		CreatedAt: time.Now(),
+	}
+}
+
+// diffMovements returns the movements that take a product's stock from
+// before (nil for a new product) to after. A new product's stock is
+// recorded as its opening balance.
+func diffMovements(ctx context.Context, before, after *Product) []StockMovement {
+	src := movementSource(ctx)
+	if before == nil {
+		src.Type = MovementOpening
+	}
+	old, levels := stockLevels(before), stockLevels(after)
+
+	skus := make([]string, 0, len(old)+len(levels))
+	for sku := range levels {
+		skus = append(skus, sku)
+	}
+	for sku := range old {
+		if _, kept := levels[sku]; !kept {
+			skus = append(skus, sku)
+		}
+	}
+	sort.Strings(skus)
+
+	var movements []StockMovement
+	for _, sku := range skus {
+		if delta := levels[sku] - old[sku]; delta != 0 {
+			movements = append(movements, newMovement(src, after.ID, sku, delta, levels[sku]))
+		}
+	}
+	return movements
+}
+
+// changeMovements returns one movement per SKU named by changes, which have
+// already been applied to products. Unlike diffMovements it records SKUs
+// whose net change is zero, such as sales.
+func changeMovements(ctx context.Context, products map[string]*Product, changes []StockChange) []StockMovement {
+	type key struct{ id, sku string }
+	src := movementSource(ctx)
+	totals := make(map[key]int)
+	var order []key
+	for _, change := range changes {
+		k := key{change.ProductID, change.SKU}
+		if _, seen := totals[k]; !seen {
+			order = append(order, k)
+		}
+		totals[k] += change.Delta
+	}
+
+	movements := make([]StockMovement, 0, len(order))
+	for _, k := range order {
+		balance := stockLevels(products[k.id])[k.sku]
+		movements = append(movements, newMovement(src, k.id, k.sku, totals[k], balance))
+	}
+	return movements
+}
+
+// StockMismatch is a SKU whose stock level disagrees with its ledger
+type StockMismatch struct {
+	ProductID string `json:"product_id"`
+	SKU       string `json:"sku"`
+	Name      string `json:"name"`
+	Stock     int    `json:"stock"`
+	Ledger    int    `json:"ledger"`
+}
+
+// ReconcileStock recomputes every SKU's stock from its movements and returns
+// those that differ from the stored level
+func ReconcileStock(ctx context.Context, s *Store) ([]StockMismatch, error) {
+	products, err := s.Products.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	totals, err := s.Movements.Totals(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ledger := make(map[string]map[string]int)
+	for _, t := range totals {
+		if ledger[t.ProductID] == nil {
+			ledger[t.ProductID] = make(map[string]int)
+		}
+		ledger[t.ProductID][t.SKU] = t.Quantity
+	}
+
+	mismatches := []StockMismatch{}
+	for _, p := range products {
+		levels := stockLevels(&p)
+		if p.IsBundle() {
+			// Bundles are read with their components' stock but hold none
+			levels = map[string]int{"": 0}
+		}
+		for sku, total := range ledger[p.ID] {
+			if _, exists := levels[sku]; !exists && total != 0 {
+				// Movements for a SKU the product no longer has
+				levels[sku] = 0
+			}
+		}
+		for sku, stock := range levels {
+			if total := ledger[p.ID][sku]; total != stock {
+				mismatches = append(mismatches, StockMismatch{
+					ProductID: p.ID, SKU: sku, Name: p.Name, Stock: stock, Ledger: total,
+				})
+			}
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].ProductID != mismatches[j].ProductID {
+			return mismatches[i].ProductID < mismatches[j].ProductID
+		}
+		return mismatches[i].SKU < mismatches[j].SKU
+	})
+	return mismatches, nil
+}
+
+// MovementPage is one page of a product's stock movements
+type MovementPage struct {
+	Movements []StockMovement `json:"movements"`
+	Total     int             `json:"total"`
+	Page      int             `json:"page"`
+	Limit     int             `json:"limit"`
+	Pages     int             `json:"pages"`
+}
+
+// StockMovementRequest records a manual stock change. Quantity is signed for
+// adjustments; breakages always remove and returns always add units.
+type StockMovementRequest struct {
+	SKU       string `json:"sku"`
+	Type      string `json:"type" binding:"required,oneof=adjustment breakage return"`
+	Quantity  int    `json:"quantity" binding:"required"`
+	Reason    string `json:"reason" binding:"required"`
+	Reference string `json:"reference"`
+}
+
+// delta returns the signed stock change the request makes
+func (r StockMovementRequest) delta() int {
+	quantity := r.Quantity
+	if quantity < 0 {
+		quantity = -quantity
+	}
+	switch r.Type {
+	case MovementBreakage:
+		return -quantity
+	case MovementReturn:
+		return quantity
+	default:
+		return r.Quantity
+	}
+}
+
+// AdminListMovements returns a page of a product's stock movements, newest
+// first, optionally limited to one SKU with ?sku=
+func AdminListMovements(c *gin.Context) {
+	offset, limit, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	id := c.Param("id")
+	if _, err := store.Products.Get(ctx, id); err != nil {
+		respondProduct(c, Product{}, err)
+		return
+	}
+
+	movements, total, err := store.Movements.ListByProduct(ctx, id, c.Query("sku"), offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load stock movements"})
+		return
+	}
+	c.JSON(http.StatusOK, MovementPage{
+		Movements: movements,
+		Total:     total,
+		Page:      offset/limit + 1,
+		Limit:     limit,
+		Pages:     pageCount(total, limit),
+	})
+}
+
+// RecordStockMovement applies a manual adjustment, breakage or customer
+// return to a product's stock
+func RecordStockMovement(c *gin.Context) {
+	var req StockMovementRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := WithMovement(c.Request.Context(), MovementSource{
+		Type:      req.Type,
+		Actor:     GetUserFromContext(c),
+		Reason:    req.Reason,
+		Reference: req.Reference,
+	})
+	product, err := store.Products.AdjustStock(ctx, c.Param("id"), req.SKU, req.delta())
+	if errors.Is(err, ErrInsufficientStock) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Stock cannot go below zero"})
+		return
+	}
+	respondProduct(c, product, err)
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newMovementServer returns the admin test server with the gin, sold in two
+// sizes, in its store
+func newMovementServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	r := newAdminServer(t)
+	if err := store.Products.Save(context.Background(), ginVariants()); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// listMovements returns a product's ledger, newest first
+func listMovements(t *testing.T, r http.Handler, path string) MovementPage {
+	t.Helper()
+	var page MovementPage
+	code, err := do(r, "admin", http.MethodGet, path, nil, &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("%s returned %d", path, code)
+	}
+	return page
+}
+
+// reserveOrder takes an order's items off the shelf as user-1 and stores it
+// awaiting payment, as placing the order does
+func reserveOrder(t *testing.T, id string, items ...OrderItem) string {
+	t.Helper()
+	ctx := WithMovement(context.Background(), MovementSource{
+		Type: MovementReservation, Actor: "user-1", Reference: id,
+	})
+	if err := store.Products.AdjustStocks(ctx, orderStockChanges(items, -1)); err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(reservationTTL)
+	err := store.Orders.Create(ctx, Order{
+		ID: id, UserID: "user-1", Items: items, Status: OrderPending,
+		Reservation: ReservationHeld, ReservedUntil: &until, CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestRecordStockMovement(t *testing.T) {
+	r := newMovementServer(t)
+
+	// Breakages always remove and returns always add, whatever the sign sent
+	for _, tt := range []struct {
+		name    string
+		product string
+		req     StockMovementRequest
+		code    int
+	}{
+		{"breakage", "whisky", StockMovementRequest{Type: MovementBreakage, Quantity: 2, Reason: "dropped"}, http.StatusOK},
+		{"negative breakage", "whisky", StockMovementRequest{Type: MovementBreakage, Quantity: -1, Reason: "dropped"}, http.StatusOK},
+		{"negative return", "whisky", StockMovementRequest{Type: MovementReturn, Quantity: -4, Reason: "unopened", Reference: "order-1"}, http.StatusOK},
+		{"adjustment below zero", "whisky", StockMovementRequest{Type: MovementAdjustment, Quantity: -17, Reason: "count"}, http.StatusConflict},
+		{"sale", "whisky", StockMovementRequest{Type: MovementSale, Quantity: 1, Reason: "till"}, http.StatusBadRequest},
+		{"no reason", "whisky", StockMovementRequest{Type: MovementAdjustment, Quantity: 1}, http.StatusBadRequest},
+		{"sku of a product without sizes", "whisky", StockMovementRequest{Type: MovementAdjustment, SKU: "GIN-70", Quantity: 1, Reason: "count"}, http.StatusBadRequest},
+		{"size required", "gin", StockMovementRequest{Type: MovementAdjustment, Quantity: 1, Reason: "count"}, http.StatusBadRequest},
+		{"one size", "gin", StockMovementRequest{Type: MovementAdjustment, SKU: "GIN-1L", Quantity: 3, Reason: "count"}, http.StatusOK},
+		{"unknown product", "rum", StockMovementRequest{Type: MovementReturn, Quantity: 1, Reason: "unopened"}, http.StatusNotFound},
+	} {
+		code, err := do(r, "admin", http.MethodPost, "/api/v1/admin/products/"+tt.product+"/movements", tt.req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	page := listMovements(t, r, "/api/v1/admin/products/whisky/movements")
+	want := []StockMovement{
+		{Type: MovementReturn, Delta: 4, Balance: 16, Actor: "admin", Reason: "unopened", Reference: "order-1"},
+		{Type: MovementBreakage, Delta: -1, Balance: 12, Actor: "admin", Reason: "dropped"},
+		{Type: MovementBreakage, Delta: -2, Balance: 13, Actor: "admin", Reason: "dropped"},
+		{Type: MovementOpening, Delta: 15, Balance: 15, Actor: "system"},
+	}
+	if page.Total != len(want) {
+		t.Fatalf("whisky has %d movements, want %d: %+v", page.Total, len(want), page.Movements)
+	}
+	for i, m := range page.Movements {
+		w := want[i]
+		if m.ProductID != "whisky" || m.Type != w.Type || m.Delta != w.Delta || m.Balance != w.Balance ||
+			m.Actor != w.Actor || m.Reason != w.Reason || m.Reference != w.Reference {
+			t.Errorf("movement %d is %+v, want %+v", i, m, w)
+		}
+	}
+
+	code, err := do(r, "admin", http.MethodGet, "/api/v1/admin/products/rum/movements", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Fatalf("movements of an unknown product returned %d", code)
+	}
+}
+
+func TestOrderMovements(t *testing.T) {
+	r := newMovementServer(t)
+	ctx := context.Background()
+
+	// The bottles leave the shelf when the order is placed; payment records
+	// the sale without moving the balance again
+	paid := reserveOrder(t, "order-1", OrderItem{ID: "gin", SKU: "GIN-70", Price: 39.99, Quantity: 2})
+	if _, err := settlePayment(ctx, paid, true); err != nil {
+		t.Fatal(err)
+	}
+	cancelled := reserveOrder(t, "order-2", OrderItem{ID: "gin", SKU: "GIN-1L", Price: 49.99, Quantity: 1})
+	if _, err := settlePayment(ctx, cancelled, false); err != nil {
+		t.Fatal(err)
+	}
+
+	page := listMovements(t, r, "/api/v1/admin/products/gin/movements?sku=GIN-70")
+	want := []StockMovement{
+		{Type: MovementSale, Delta: 0, Balance: 0, Actor: "system", Reference: paid},
+		{Type: MovementReservation, Delta: -2, Balance: 0, Actor: "user-1", Reference: paid},
+		{Type: MovementOpening, Delta: 2, Balance: 2, Actor: "system"},
+	}
+	if page.Total != len(want) {
+		t.Fatalf("GIN-70 has %d movements, want %d: %+v", page.Total, len(want), page.Movements)
+	}
+	for i, m := range page.Movements {
+		w := want[i]
+		if m.SKU != "GIN-70" || m.Type != w.Type || m.Delta != w.Delta || m.Balance != w.Balance ||
+			m.Actor != w.Actor || m.Reference != w.Reference {
+			t.Errorf("movement %d is %+v, want %+v", i, m, w)
+		}
+	}
+
+	// A cancelled order gives its bottles back
+	page = listMovements(t, r, "/api/v1/admin/products/gin/movements?sku=GIN-1L&limit=1")
+	if page.Total != 3 || page.Pages != 3 || len(page.Movements) != 1 {
+		t.Fatalf("expected the first of 3 GIN-1L movements, got %+v", page)
+	}
+	if m := page.Movements[0]; m.Type != MovementRelease || m.Delta != 1 || m.Balance != 1 || m.Reason != "order cancelled" {
+		t.Fatalf("expected the cancellation to release the bottle, got %+v", m)
+	}
+
+	mismatches, err := ReconcileStock(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("ledger disagrees with stock: %+v", mismatches)
+	}
+}
+
+func TestReconcileStock(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	if err := s.Products.Save(ctx, ginVariants()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dropping a size writes its stock out of the ledger
+	_, err := s.Products.Update(ctx, "gin", func(p *Product) error {
+		p.Variants = p.Variants[:1]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err := ReconcileStock(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("ledger disagrees with stock: %+v", mismatches)
+	}
+
+	// Stock changed behind the ledger's back, as by a hand edit of the
+	// database, is reported for each SKU, including sizes the product no
+	// longer has
+	recorded := NewMemoryStore()
+	if err := recorded.Products.Save(ctx, ginVariants()); err != nil {
+		t.Fatal(err)
+	}
+	edited := NewMemoryStore()
+	gin := ginVariants()
+	gin.Variants = []Variant{{SKU: "GIN-70", Size: "70cl", Price: 39.99, Stock: 5}}
+	if err := edited.Products.Save(ctx, gin); err != nil {
+		t.Fatal(err)
+	}
+	unrecorded := *edited
+	unrecorded.Movements = recorded.Movements
+	mismatches, err = ReconcileStock(ctx, &unrecorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []StockMismatch{
+		{ProductID: "gin", SKU: "GIN-1L", Name: "Hendrick's", Stock: 0, Ledger: 1},
+		{ProductID: "gin", SKU: "GIN-70", Name: "Hendrick's", Stock: 5, Ledger: 2},
+	}
+	if len(mismatches) != len(want) || mismatches[0] != want[0] || mismatches[1] != want[1] {
+		t.Fatalf("reported %+v, want %+v", mismatches, want)
+	}
+}
@@ -1,12 +1,17 @@
 package api
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 // MpesaConfig holds M-Pesa API configuration
@@ -16,6 +21,9 @@ type MpesaConfig struct {
 	BusinessCode   string
 	PassKey        string
 	CallbackURL    string
+	// CallbackToken is the secret M-Pesa quotes back in the token query
+	// parameter of CallbackURL
+	CallbackToken string
 }
 
 // Initialize M-Pesa config from environment variables
@@ -25,18 +33,19 @@ var mpesaConfig = MpesaConfig{
 	BusinessCode:   os.Getenv("MPESA_BUSINESS_CODE"),
 	PassKey:        os.Getenv("MPESA_PASS_KEY"),
 	CallbackURL:    os.Getenv("MPESA_CALLBACK_URL"),
+	CallbackToken:  os.Getenv("MPESA_CALLBACK_TOKEN"),
 }
 
 // MpesaTransaction represents an M-Pesa payment transaction
 type MpesaTransaction struct {
 	CheckoutRequestID string    `json:"checkout_request_id"`
-	OrderID          string    `json:"order_id"`
-	PhoneNumber      string    `json:"phone_number"`
-	Amount           float64   `json:"amount"`
-	Status           string    `json:"status"`
-	ResultCode       string    `json:"result_code"`
-	ResultDesc       string    `json:"result_desc"`
-	CreatedAt        time.Time `json:"created_at"`
+	OrderID           string    `json:"order_id"`
+	PhoneNumber       string    `json:"phone_number"`
+	Amount            float64   `json:"amount"`
+	Status            string    `json:"status"`
+	ResultCode        string    `json:"result_code"`
+	ResultDesc        string    `json:"result_desc"`
+	CreatedAt         time.Time `json:"created_at"`
 }
 
 // STKPushRequest represents the request for M-Pesa payment
@@ -46,36 +55,45 @@ type STKPushRequest struct {
 	OrderID     string  `json:"order_id" binding:"required"`
 }
 
-// In-memory storage for M-Pesa transactions
-var mpesaTransactions = make(map[string]*MpesaTransaction)
-
-func handleMpesaPayment(order Order) error {
+// handleMpesaPayment starts the STK push for a new order. The order stays
+// pending, holding its stock, until M-Pesa reports the outcome to
+// HandleMpesaCallback or the reservation lapses.
+func handleMpesaPayment(ctx context.Context, order Order) error {
 	if order.PaymentDetails.Phone == "" {
 		return fmt.Errorf("phone number required for M-Pesa payment")
 	}
+	_, err := startSTKPush(ctx, order, order.PaymentDetails.Phone)
+	return err
+}
 
-	// Create M-Pesa transaction record
-	transaction := &MpesaTransaction{
-		OrderID:     order.ID,
-		PhoneNumber: order.PaymentDetails.Phone,
-		Amount:      order.TotalAmount,
-		Status:      "pending",
-		CreatedAt:   time.Now(),
+// startSTKPush asks phone to pay the order's total and saves the pending
+// transaction, replacing any earlier attempt for the order
+func startSTKPush(ctx context.Context, order Order, phone string) (*MpesaTransaction, error) {
+	// Format phone number (remove leading zero or +254)
+	if len(phone) > 9 {
+		phone = phone[len(phone)-9:]
 	}
+	phone = "254" + phone
 
-	// Store transaction
-	mpesaTransactions[order.ID] = transaction
-
-	// In production, initiate actual M-Pesa STK push here
-	// For now, simulate success
-	transaction.Status = "completed"
-	transaction.ResultCode = "0"
-	transaction.ResultDesc = "Success"
-
-	return nil
+	// TODO: Implement actual M-Pesa STK push. CheckoutRequestID stands in
+	// for the ID M-Pesa returns, which its callback quotes.
+	transaction := &MpesaTransaction{
+		CheckoutRequestID: uuid.New().String(),
+		OrderID:           order.ID,
+		PhoneNumber:       phone,
+		Amount:            order.TotalAmount,
+		Status:            "pending",
+		CreatedAt:         time.Now(),
+	}
+	if err := store.Payments.Save(ctx, transaction); err != nil {
+		return nil, err
+	}
+	return transaction, nil
 }
 
-// HandleMpesaSTKPush initiates an M-Pesa payment
+// HandleMpesaSTKPush asks the customer's phone to pay for one of their
+// pending orders. The amount must be the order's total. The order is not
+// settled here: M-Pesa reports the outcome to HandleMpesaCallback.
 func HandleMpesaSTKPush(c *gin.Context) {
 	var req STKPushRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -83,55 +101,166 @@ func HandleMpesaSTKPush(c *gin.Context) {
 		return
 	}
 
-	// Format phone number (remove leading zero or +254)
-	phone := req.PhoneNumber
-	if len(phone) > 9 {
-		phone = phone[len(phone)-9:]
+	order, err := store.Orders.Get(c.Request.Context(), req.OrderID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
 	}
-	phone = "254" + phone
-
-	// Create transaction record
-	transaction := &MpesaTransaction{
-		OrderID:     req.OrderID,
-		PhoneNumber: phone,
-		Amount:      req.Amount,
-		Status:      "pending",
-		CreatedAt:   time.Now(),
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load order"})
+		return
+	}
+	if order.UserID != GetUserFromContext(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized to pay for this order"})
+		return
+	}
+	if order.Status != OrderPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order is not awaiting payment"})
+		return
+	}
+	if roundCents(req.Amount) != roundCents(order.TotalAmount) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Amount does not match the order total", "total": order.TotalAmount})
+		return
 	}
 
-	// Store transaction
-	mpesaTransactions[req.OrderID] = transaction
-
-	// TODO: Implement actual M-Pesa STK push
-	// For development, simulate success
-	transaction.Status = "completed"
-	transaction.ResultCode = "0"
-	transaction.ResultDesc = "Success"
+	transaction, err := startSTKPush(c.Request.Context(), order, req.PhoneNumber)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save transaction"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Payment initiated successfully",
-		"data":    transaction,
+		"data": gin.H{
+			"order_id": transaction.OrderID,
+			"amount":   transaction.Amount,
+			"status":   transaction.Status,
+		},
 	})
 }
 
-// HandleMpesaCallback processes M-Pesa payment callbacks
+// MpesaCallback is the body M-Pesa posts with the outcome of an STK push
+type MpesaCallback struct {
+	Body struct {
+		StkCallback struct {
+			CheckoutRequestID string `json:"CheckoutRequestID" binding:"required"`
+			ResultCode        int    `json:"ResultCode"`
+			ResultDesc        string `json:"ResultDesc"`
+			CallbackMetadata  struct {
+				Item []struct {
+					Name  string      `json:"Name"`
+					Value interface{} `json:"Value"`
+				} `json:"Item"`
+			} `json:"CallbackMetadata"`
+		} `json:"stkCallback"`
+	} `json:"Body"`
+}
+
+// amount returns the amount paid according to the callback
+func (cb MpesaCallback) amount() (float64, bool) {
+	for _, item := range cb.Body.StkCallback.CallbackMetadata.Item {
+		if v, ok := item.Value.(float64); ok && item.Name == "Amount" {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// HandleMpesaCallback settles an order from M-Pesa's report of its STK
+// push. The callback URL carries a secret token, MPESA_CALLBACK_TOKEN, and
+// the report must name a pending transaction this server started; without
+// a configured token every callback is refused. A successful payment marks
+// the order paid only if the amount paid is the order's total; a failed one
+// releases the order's stock.
 func HandleMpesaCallback(c *gin.Context) {
-	// TODO: Implement actual M-Pesa callback handling
-	// This will be called by M-Pesa to update the transaction status
+	token := c.Query("token")
+	if mpesaConfig.CallbackToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(mpesaConfig.CallbackToken)) != 1 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid callback token"})
+		return
+	}
+
+	var cb MpesaCallback
+	if err := c.ShouldBindJSON(&cb); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	result := cb.Body.StkCallback
+
+	ctx := c.Request.Context()
+	transaction, err := store.Payments.GetByCheckoutRequest(ctx, result.CheckoutRequestID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load transaction"})
+		return
+	}
+	// M-Pesa retries callbacks; only the first one counts
+	if transaction.Status != "pending" {
+		c.JSON(http.StatusOK, gin.H{"message": "Callback processed"})
+		return
+	}
+
+	paid := result.ResultCode == 0
+	transaction.Status = "failed"
+	transaction.ResultCode = strconv.Itoa(result.ResultCode)
+	transaction.ResultDesc = result.ResultDesc
+	if amount, ok := cb.amount(); paid && (!ok || roundCents(amount) != roundCents(transaction.Amount)) {
+		// A payment for the wrong amount is recorded for follow-up but
+		// does not pay for the order, which keeps its reservation until
+		// it lapses
+		transaction.ResultDesc = fmt.Sprintf("amount paid does not match the order total of %.2f", transaction.Amount)
+		if err := store.Payments.Save(ctx, transaction); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save transaction"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Callback processed"})
+		return
+	}
+	if paid {
+		transaction.Status = "completed"
+	}
+	if err := store.Payments.Save(ctx, transaction); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save transaction"})
+		return
+	}
+
+	// Payments for orders that are no longer pending are recorded but do not
+	// change the order
+	_, err = settlePayment(ctx, transaction.OrderID, paid)
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrOrderStatus) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order"})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"message": "Callback processed"})
 }
 
+// AdminListTransactions returns every M-Pesa transaction
+func AdminListTransactions(c *gin.Context) {
+	transactions, err := store.Payments.List(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load transactions"})
+		return
+	}
+	c.JSON(http.StatusOK, transactions)
+}
+
 // GetMpesaTransactionStatus retrieves the status of an M-Pesa transaction
 func GetMpesaTransactionStatus(c *gin.Context) {
 	orderID := c.Param("id")
-	transaction, exists := mpesaTransactions[orderID]
-	if !exists {
+	transaction, err := store.Payments.GetByOrder(c.Request.Context(), orderID)
+	if errors.Is(err, ErrNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load transaction"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"status": transaction.Status,
 		"reason": transaction.ResultDesc,
 	})
-}
\ No newline at end of file
+}
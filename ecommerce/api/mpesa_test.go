@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// placePendingOrder takes quantity whiskies off the shelf for an unpaid
+// order of userID's, as CreateOrderHandler does before payment
+func placePendingOrder(t *testing.T, userID string, quantity int) Order {
+	t.Helper()
+	ctx := context.Background()
+	items := []OrderItem{{ID: "whisky", Name: "Macallan 18 Years", Price: 299.99, Quantity: quantity}}
+	if err := store.Products.AdjustStocks(ctx, orderStockChanges(items, -1)); err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(time.Hour)
+	order := Order{
+		ID:            uuid.New().String(),
+		UserID:        userID,
+		Items:         items,
+		Subtotal:      roundCents(299.99 * float64(quantity)),
+		TotalAmount:   roundCents(299.99 * float64(quantity)),
+		Status:        OrderPending,
+		Reservation:   ReservationHeld,
+		ReservedUntil: &until,
+		CreatedAt:     time.Now(),
+	}
+	if err := store.Orders.Create(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// setCallbackToken configures the M-Pesa callback secret for one test
+func setCallbackToken(t *testing.T, token string) {
+	old := mpesaConfig.CallbackToken
+	mpesaConfig.CallbackToken = token
+	t.Cleanup(func() { mpesaConfig.CallbackToken = old })
+}
+
+// stkCallback builds the body M-Pesa posts for a checkout request
+func stkCallback(checkoutRequestID string, resultCode int, amount float64) MpesaCallback {
+	var cb MpesaCallback
+	cb.Body.StkCallback.CheckoutRequestID = checkoutRequestID
+	cb.Body.StkCallback.ResultCode = resultCode
+	cb.Body.StkCallback.CallbackMetadata.Item = append(cb.Body.StkCallback.CallbackMetadata.Item, struct {
+		Name  string      `json:"Name"`
+		Value interface{} `json:"Value"`
+	}{Name: "Amount", Value: amount})
+	return cb
+}
+
+func orderStatus(t *testing.T, id string) string {
+	t.Helper()
+	order, err := store.Orders.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order.Status
+}
+
+func TestSTKPushRejectsAnotherUsersOrder(t *testing.T) {
+	r := newTestServer(t)
+	order := placePendingOrder(t, "owner", 1)
+
+	req := STKPushRequest{PhoneNumber: "0712345678", Amount: order.TotalAmount, OrderID: order.ID}
+	code, err := do(r, "intruder", http.MethodPost, "/api/v1/mpesa/stkpush", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusForbidden {
+		t.Fatalf("paying another user's order returned %d, want %d", code, http.StatusForbidden)
+	}
+	if status := orderStatus(t, order.ID); status != OrderPending {
+		t.Fatalf("order is %s, want %s", status, OrderPending)
+	}
+	if _, err := store.Payments.GetByOrder(context.Background(), order.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected no transaction, got %v", err)
+	}
+}
+
+func TestSTKPushRejectsWrongAmount(t *testing.T) {
+	r := newTestServer(t)
+	order := placePendingOrder(t, "owner", 2)
+
+	req := STKPushRequest{PhoneNumber: "0712345678", Amount: 1, OrderID: order.ID}
+	code, err := do(r, "owner", http.MethodPost, "/api/v1/mpesa/stkpush", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusBadRequest {
+		t.Fatalf("paying the wrong amount returned %d, want %d", code, http.StatusBadRequest)
+	}
+	if status := orderStatus(t, order.ID); status != OrderPending {
+		t.Fatalf("order is %s, want %s", status, OrderPending)
+	}
+}
+
+func TestSTKPushSettlesOnlyFromCallback(t *testing.T) {
+	r := newTestServer(t)
+	setCallbackToken(t, "secret")
+	order := placePendingOrder(t, "owner", 1)
+
+	req := STKPushRequest{PhoneNumber: "0712345678", Amount: order.TotalAmount, OrderID: order.ID}
+	code, err := do(r, "owner", http.MethodPost, "/api/v1/mpesa/stkpush", req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("stk push returned %d", code)
+	}
+	if status := orderStatus(t, order.ID); status != OrderPending {
+		t.Fatalf("order is %s after the push, want %s", status, OrderPending)
+	}
+
+	transaction, err := store.Payments.GetByOrder(context.Background(), order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := stkCallback(transaction.CheckoutRequestID, 0, order.TotalAmount)
+
+	// Callbacks without the secret, or for the wrong amount, pay nothing
+	code, err = do(r, "", http.MethodPost, "/api/v1/mpesa/callback?token=guess", cb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusForbidden {
+		t.Fatalf("callback with the wrong token returned %d, want %d", code, http.StatusForbidden)
+	}
+	if status := orderStatus(t, order.ID); status != OrderPending {
+		t.Fatalf("order is %s after a forged callback, want %s", status, OrderPending)
+	}
+
+	code, err = do(r, "", http.MethodPost, "/api/v1/mpesa/callback?token=secret", cb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("callback returned %d", code)
+	}
+	if status := orderStatus(t, order.ID); status != OrderPaid {
+		t.Fatalf("order is %s after the callback, want %s", status, OrderPaid)
+	}
+	product, err := store.Products.Get(context.Background(), "whisky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Stock != 14 {
+		t.Fatalf("stock is %d, want 14", product.Stock)
+	}
+}
+
+func TestMpesaCallbackWrongAmount(t *testing.T) {
+	r := newTestServer(t)
+	setCallbackToken(t, "secret")
+	order := placePendingOrder(t, "owner", 1)
+
+	req := STKPushRequest{PhoneNumber: "0712345678", Amount: order.TotalAmount, OrderID: order.ID}
+	if _, err := do(r, "owner", http.MethodPost, "/api/v1/mpesa/stkpush", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	transaction, err := store.Payments.GetByOrder(context.Background(), order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb := stkCallback(transaction.CheckoutRequestID, 0, 1)
+	code, err := do(r, "", http.MethodPost, "/api/v1/mpesa/callback?token=secret", cb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("callback returned %d", code)
+	}
+	if status := orderStatus(t, order.ID); status != OrderPending {
+		t.Fatalf("order is %s after an underpayment, want %s", status, OrderPending)
+	}
+	transaction, err = store.Payments.GetByOrder(context.Background(), order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transaction.Status != "failed" {
+		t.Fatalf("transaction is %s, want failed", transaction.Status)
+	}
+}
+
+func TestMpesaOrderStaysPendingUntilCallback(t *testing.T) {
+	r := newTestServer(t)
+	setCallbackToken(t, "secret")
+	ctx := context.Background()
+	stock := func() int {
+		t.Helper()
+		product, err := store.Products.Get(ctx, "whisky")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return product.Stock
+	}
+
+	var order Order
+	code, err := do(r, "owner", http.MethodPost, "/api/v1/orders", OrderRequest{
+		Items: []OrderItem{{ID: "whisky", Quantity: 2}},
+		DeliveryDetails: DeliveryDetails{
+			Name: "Test", Address: "1 Moi Avenue", City: "Nairobi", Phone: "0712345678",
+		},
+		PaymentMethod: "mpesa",
+	}, &order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusCreated {
+		t.Fatalf("placing the order returned %d", code)
+	}
+	// Placing the order starts the push but pays for nothing
+	if order.Status != OrderPending || order.Reservation != ReservationHeld || stock() != 13 {
+		t.Fatalf("new order is %s with reservation %q and stock %d, want it pending and holding 2", order.Status, order.Reservation, stock())
+	}
+	first, err := store.Payments.GetByOrder(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Status != "pending" || first.PhoneNumber != "254712345678" || first.Amount != order.TotalAmount {
+		t.Fatalf("unexpected transaction %+v", first)
+	}
+
+	// The customer asks for the prompt again; the new request replaces the
+	// first, whose late callback no longer matches
+	req := STKPushRequest{PhoneNumber: "0712345678", Amount: order.TotalAmount, OrderID: order.ID}
+	if code, err = do(r, "owner", http.MethodPost, "/api/v1/mpesa/stkpush", req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("stk push returned %d", code)
+	}
+	if status := orderStatus(t, order.ID); status != OrderPending {
+		t.Fatalf("order is %s after the push, want %s", status, OrderPending)
+	}
+	second, err := store.Payments.GetByOrder(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.CheckoutRequestID == first.CheckoutRequestID {
+		t.Fatal("the second push reused the first checkout request")
+	}
+	code, err = do(r, "", http.MethodPost, "/api/v1/mpesa/callback?token=secret", stkCallback(first.CheckoutRequestID, 0, order.TotalAmount), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound || orderStatus(t, order.ID) != OrderPending {
+		t.Fatalf("callback for the replaced request returned %d and left the order %s", code, orderStatus(t, order.ID))
+	}
+
+	code, err = do(r, "", http.MethodPost, "/api/v1/mpesa/callback?token=secret", stkCallback(second.CheckoutRequestID, 0, order.TotalAmount), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("callback returned %d", code)
+	}
+	paid, err := store.Orders.Get(ctx, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paid.Status != OrderPaid || paid.Reservation != ReservationCommitted || stock() != 13 {
+		t.Fatalf("order is %s with reservation %q and stock %d after the callback", paid.Status, paid.Reservation, stock())
+	}
+}
@@ -9,12 +9,43 @@ import (
 	"github.com/google/uuid"
 )
 
+// Order statuses
+const (
+	OrderPending   = "pending"
+	OrderPaid      = "paid"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+	// OrderExpired marks unpaid orders whose stock reservation lapsed
+	OrderExpired = "expired"
+)
+
+// orderTransitions lists, for each status, the statuses an order may move to it from
+var orderTransitions = map[string][]string{
+	OrderPaid:      {OrderPending},
+	OrderShipped:   {OrderPending, OrderPaid},
+	OrderDelivered: {OrderShipped},
+	OrderCancelled: {OrderPending, OrderPaid},
+}
+
+// ErrOrderStatus is returned when an order cannot move to the requested status
+var ErrOrderStatus = errors.New("order cannot move to that status")
+
+// OrderStatusUpdate is the body of UpdateOrderStatus
+type OrderStatusUpdate struct {
+	Status string `json:"status" binding:"required"`
+}
+
 // OrderItem represents an item in an order
 type OrderItem struct {
 	ID       string  `json:"id"`
+	SKU      string  `json:"sku"`
 	Name     string  `json:"name"`
 	Price    float64 `json:"price"`
-	Quantity int     `json:"quantity"`
+	Quantity int     `json:"quantity" binding:"gt=0"`
+	// Bundle is the bundle's contents when the order was placed, so its
+	// stock goes back to the same components if the order is cancelled
+	Bundle []BundleItem `json:"bundle,omitempty"`
 }
 
 // DeliveryDetails contains shipping information
@@ -34,11 +65,15 @@ type PaymentDetails struct {
 	CVV        string `json:"cvv"`
 }
 
-// OrderRequest represents the incoming order creation request
+// OrderRequest represents the incoming order creation request. Item names
+// and prices are filled in from the catalog; Total, if set, is the amount the
+// customer was shown and must match the prices, discounts and delivery fee
+// in effect at checkout.
 type OrderRequest struct {
 	Items           []OrderItem     `json:"items" binding:"required,dive"`
 	DeliveryDetails DeliveryDetails `json:"delivery_details" binding:"required"`
 	PaymentMethod   string          `json:"payment_method" binding:"required"`
+	CouponCode      string          `json:"coupon_code"`
 	Total           float64         `json:"total"`
 }
 
@@ -49,14 +84,21 @@ type Order struct {
 	Items           []OrderItem     `json:"items"`
 	DeliveryDetails DeliveryDetails `json:"delivery_details"`
 	PaymentDetails  PaymentDetails  `json:"payment_details"`
-	TotalAmount     float64         `json:"total_amount"`
-	Status          string          `json:"status"`
-	CreatedAt       time.Time       `json:"created_at"`
+	// Subtotal is the items' cost before discounts; TotalAmount is what
+	// the customer pays, after discounts and with the delivery fee
+	Subtotal    float64        `json:"subtotal"`
+	Discounts   []DiscountLine `json:"discounts,omitempty"`
+	DeliveryFee float64        `json:"delivery_fee"`
+	CouponCode  string         `json:"coupon_code,omitempty"`
+	TotalAmount float64        `json:"total_amount"`
+	Status      string         `json:"status"`
+	// Reservation tracks the order's hold on stock; ReservedUntil is when
+	// an unpaid order's hold lapses
+	Reservation   string     `json:"reservation,omitempty"`
+	ReservedUntil *time.Time `json:"reserved_until,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
 }
 
-// Store orders in memory
-var orders = make(map[string]Order)
-
 // CreateOrderHandler handles the creation of new orders
 func CreateOrderHandler(c *gin.Context) {
 	var req OrderRequest
@@ -71,19 +113,97 @@ func CreateOrderHandler(c *gin.Context) {
 		return
 	}
 
-	// Validate total
-	var total float64
-	for _, item := range req.Items {
-		total += item.Price * float64(item.Quantity)
+	// Every line must name a product in the catalog and, for products sold
+	// in several sizes, one of its variants. Lines are charged the price in
+	// effect now, including any active sale.
+	now := time.Now()
+	lines := make([]discountItem, 0, len(req.Items))
+	for i := range req.Items {
+		item := &req.Items[i]
+		product, err := store.Products.Get(c.Request.Context(), item.ID)
+		if errors.Is(err, ErrNotFound) || (err == nil && product.ArchivedAt != nil) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown product " + item.ID})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load products"})
+			return
+		}
+		products := []Product{product}
+		if err := attachPrices(c.Request.Context(), products, now); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load prices"})
+			return
+		}
+		price, err := products[0].EffectivePrice(item.SKU)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		item.Name = product.Name
+		item.Price = price
+		item.Bundle = product.Bundle
+		lines = append(lines, discountItem{
+			ProductID: item.ID,
+			Category:  product.Category,
+			Price:     price,
+			Quantity:  item.Quantity,
+		})
 	}
 
-	if total != req.Total {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid total amount"})
+	totals, err := priceCheckout(c.Request.Context(), userID, lines, req.CouponCode, now)
+	var invalid *couponError
+	if errors.As(err, &invalid) {
+		c.JSON(invalid.status, gin.H{"error": invalid.message})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply discounts"})
+		return
+	}
+	total := totals.Total
 
-	// Create order
+	switch req.PaymentMethod {
+	case "mpesa":
+		if req.DeliveryDetails.Phone == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Phone number required for M-Pesa payment"})
+			return
+		}
+	case "card", "paypal":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment method"})
+		return
+	}
+
+	if req.Total != 0 && roundCents(req.Total) != total {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":     "Prices have changed",
+			"total":     total,
+			"items":     req.Items,
+			"discounts": totals.Discounts,
+		})
+		return
+	}
+
+	// Take the stock off the shelf before anything else so two customers
+	// can never buy the last bottle
 	orderID := uuid.New().String()
+	ctx := WithMovement(c.Request.Context(), MovementSource{
+		Type:      MovementReservation,
+		Actor:     userID,
+		Reference: orderID,
+	})
+	if err := store.Products.AdjustStocks(ctx, orderStockChanges(req.Items, -1)); err != nil {
+		var shortage *ShortageError
+		if errors.As(err, &shortage) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Insufficient stock", "items": shortage.Shortages})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve stock"})
+		return
+	}
+
+	// Create order
+	reservedUntil := time.Now().Add(reservationTTL)
 	order := Order{
 		ID:              orderID,
 		UserID:          userID,
@@ -92,38 +212,78 @@ func CreateOrderHandler(c *gin.Context) {
 		PaymentDetails: PaymentDetails{
 			Method: req.PaymentMethod,
 		},
-		TotalAmount: total,
-		Status:      "pending",
-		CreatedAt:   time.Now(),
+		Subtotal:      totals.Subtotal,
+		Discounts:     totals.Discounts,
+		DeliveryFee:   totals.DeliveryFee,
+		CouponCode:    normalizeCoupon(req.CouponCode),
+		TotalAmount:   total,
+		Status:        OrderPending,
+		Reservation:   ReservationHeld,
+		ReservedUntil: &reservedUntil,
+		CreatedAt:     time.Now(),
+	}
+	if req.PaymentMethod == "mpesa" {
+		order.PaymentDetails.Phone = req.DeliveryDetails.Phone
+	}
+
+	// restock returns the reserved stock of an order that was never saved
+	restock := func(reason string) {
+		ctx := WithMovement(ctx, MovementSource{
+			Type:      MovementRelease,
+			Actor:     userID,
+			Reason:    reason,
+			Reference: orderID,
+		})
+		if err := store.Products.AdjustStocks(ctx, orderStockChanges(order.Items, 1)); err != nil {
+			AppLogger.Error.Printf("Error restocking unsaved order %s: %v", order.ID, err)
+		}
+	}
+
+	// Count the discounts against their usage limits, which may have been
+	// reached by other orders since this one was priced
+	if err := redeemDiscounts(ctx, order); err != nil {
+		restock("discount not available")
+		if errors.Is(err, ErrDiscountUsedUp) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A discount on this order is no longer available"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply discounts"})
+		return
+	}
+
+	// Store order
+	if err := store.Orders.Create(ctx, order); err != nil {
+		releaseDiscounts(ctx, order.ID)
+		restock("order not saved")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save order"})
+		return
 	}
 
 	// Handle different payment methods
-	var err error
 	switch req.PaymentMethod {
 	case "mpesa":
-		if req.DeliveryDetails.Phone == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Phone number required for M-Pesa payment"})
-			return
-		}
-		order.PaymentDetails.Phone = req.DeliveryDetails.Phone
-		err = handleMpesaPayment(order)
+		err = handleMpesaPayment(ctx, order)
 	case "card":
 		err = handleCardPayment(order)
 	case "paypal":
 		err = handlePayPalPayment(order)
-	default:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment method"})
-		return
 	}
 
 	if err != nil {
+		// The payment never started, so give the stock back straight away
+		if _, err := settlePayment(ctx, order.ID, false); err != nil {
+			AppLogger.Error.Printf("Error releasing order %s: %v", order.ID, err)
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	removeOrderedItems(ctx, order)
+	recoverAbandonedCart(ctx, order)
 
-	// Store order
-	orders[orderID] = order
-
+	if order, err = store.Orders.Get(ctx, order.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load order"})
+		return
+	}
 	c.JSON(http.StatusCreated, order)
 }
 
@@ -140,12 +300,10 @@ func handlePayPalPayment(order Order) error {
 // GetOrders returns the user's orders
 func GetOrders(c *gin.Context) {
 	userID := GetUserFromContext(c)
-	userOrdersList := []Order{}
-
-	for _, order := range orders {
-		if order.UserID == userID {
-			userOrdersList = append(userOrdersList, order)
-		}
+	userOrdersList, err := store.Orders.ListByUser(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load orders"})
+		return
 	}
 
 	c.JSON(http.StatusOK, userOrdersList)
@@ -156,11 +314,15 @@ func GetOrder(c *gin.Context) {
 	userID := GetUserFromContext(c)
 	orderID := c.Param("id")
 
-	order, exists := orders[orderID]
-	if !exists {
+	order, err := store.Orders.Get(c.Request.Context(), orderID)
+	if errors.Is(err, ErrNotFound) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
 		return
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load order"})
+		return
+	}
 
 	if order.UserID != userID {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Not authorized to view this order"})
@@ -168,4 +330,54 @@ func GetOrder(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, order)
-}
\ No newline at end of file
+}
+
+// UpdateOrderStatus moves an order along its fulfilment lifecycle. Cancelling
+// an order puts its stock back on the shelf.
+func UpdateOrderStatus(c *gin.Context) {
+	var req OrderStatusUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, ok := orderTransitions[req.Status]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order status"})
+		return
+	}
+
+	ctx := WithMovement(c.Request.Context(), MovementSource{Actor: GetUserFromContext(c)})
+	var order Order
+	var err error
+	if req.Status == OrderCancelled {
+		order, err = releaseReservation(ctx, c.Param("id"), req.Status, from)
+	} else {
+		var committed bool
+		order, err = store.Orders.Update(ctx, c.Param("id"), func(o *Order) error {
+			if !containsString(from, o.Status) {
+				return ErrOrderStatus
+			}
+			o.Status = req.Status
+			// Paid and cash-on-delivery orders keep their stock for good
+			committed = o.Reservation == ReservationHeld
+			if committed {
+				o.Reservation = ReservationCommitted
+				o.ReservedUntil = nil
+			}
+			return nil
+		})
+		if err == nil && committed {
+			recordSale(ctx, order)
+		}
+	}
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, order)
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+	case errors.Is(err, ErrOrderStatus):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order"})
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestUpdateOrderStatusTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string
+		code  int
+		stock int
+	}{
+		{name: "paid, shipped and delivered", steps: []string{OrderPaid, OrderShipped, OrderDelivered}, code: http.StatusOK, stock: 13},
+		{name: "cash on delivery shipped", steps: []string{OrderShipped}, code: http.StatusOK, stock: 13},
+		{name: "cancelled before payment", steps: []string{OrderCancelled}, code: http.StatusOK, stock: 15},
+		{name: "cancelled after payment", steps: []string{OrderPaid, OrderCancelled}, code: http.StatusOK, stock: 15},
+		{name: "delivered before shipping", steps: []string{OrderDelivered}, code: http.StatusConflict, stock: 13},
+		{name: "cancelled after shipping", steps: []string{OrderShipped, OrderCancelled}, code: http.StatusConflict, stock: 13},
+		{name: "cancelled twice", steps: []string{OrderCancelled, OrderCancelled}, code: http.StatusConflict, stock: 15},
+		{name: "back to pending", steps: []string{OrderPending}, code: http.StatusBadRequest, stock: 13},
+		{name: "unknown status", steps: []string{"lost"}, code: http.StatusBadRequest, stock: 13},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newAdminServer(t)
+			order := placePendingOrder(t, "user-1", 2)
+
+			var code int
+			for _, status := range tt.steps {
+				var err error
+				code, err = do(r, "admin", http.MethodPatch, "/api/v1/admin/orders/"+order.ID+"/status", OrderStatusUpdate{Status: status}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if code != tt.code {
+				t.Fatalf("last step returned %d, want %d", code, tt.code)
+			}
+			want := tt.steps[len(tt.steps)-1]
+			if code != http.StatusOK {
+				want = OrderPending
+				if len(tt.steps) > 1 {
+					want = tt.steps[len(tt.steps)-2]
+				}
+			}
+			if got := orderStatus(t, order.ID); got != want {
+				t.Fatalf("order is %s, want %s", got, want)
+			}
+			product, err := store.Products.Get(context.Background(), "whisky")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if product.Stock != tt.stock {
+				t.Fatalf("stock is %d, want %d", product.Stock, tt.stock)
+			}
+		})
+	}
+
+	r := newAdminServer(t)
+	code, err := do(r, "admin", http.MethodPatch, "/api/v1/admin/orders/missing/status", OrderStatusUpdate{Status: OrderPaid}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Fatalf("updating a missing order returned %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,2002 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// NewPostgresStore returns a Store backed by a PostgreSQL database
+func NewPostgresStore(db *sql.DB) *Store {
+	return &Store{
+		Products:       pgProductStore{db: db},
+		Categories:     pgCategoryStore{db: db},
+		Users:          pgUserStore{db: db},
+		Orders:         pgOrderStore{db: db},
+		Carts:          pgCartStore{db: db},
+		Payments:       pgPaymentStore{db: db},
+		Reviews:        pgReviewStore{db: db},
+		Movements:      pgMovementStore{db: db},
+		Promotions:     pgPromotionStore{db: db},
+		PriceSchedules: pgPriceScheduleStore{db: db},
+		PriceHistory:   pgPriceHistoryStore{db: db},
+		Wishlists:      pgWishlistStore{db: db},
+		Subscriptions:  pgSubscriptionStore{db: db},
+		AbandonedCarts: pgAbandonedCartStore{db: db},
+		Discounts:      pgDiscountStore{db: db},
+	}
+}
+
+// isUniqueViolation reports whether err is a PostgreSQL unique constraint error
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// isForeignKeyViolation reports whether err is a PostgreSQL foreign key error
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// withTx runs fn inside a transaction, committing on success and rolling
+// back on error
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type pgProductStore struct {
+	db *sql.DB
+}
+
+const productColumns = `id, name, description, price, stock, image, thumbnail, category, created_at, archived_at,
+	reorder_level, low_stock_since, abv, volume_ml, country, region, age_years, vintage, cask, grape, style`
+
+func scanProduct(row interface{ Scan(...interface{}) error }) (Product, error) {
+	var p Product
+	a := &p.Attributes
+	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Stock, &p.Image, &p.Thumbnail, &p.Category,
+		&p.CreatedAt, &p.ArchivedAt, &p.ReorderLevel, &p.LowStockSince,
+		&a.ABV, &a.VolumeML, &a.Country, &a.Region, &a.AgeYears, &a.Vintage, &a.Cask, &a.Grape, &a.Style)
+	return p, err
+}
+
+// queryProducts runs a product query and loads the variants and bundle
+// contents of every match. Bundles are left without stock; read methods add
+// it with attachBundleStock.
+func queryProducts(ctx context.Context, q queryer, query string, args ...interface{}) ([]Product, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	productList := []Product{}
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		productList = append(productList, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := attachVariants(ctx, q, productList); err != nil {
+		return nil, err
+	}
+	return productList, attachBundleItems(ctx, q, productList)
+}
+
+// productIndex returns the IDs of the products and the position of each
+func productIndex(productList []Product) ([]string, map[string]int) {
+	index := make(map[string]int, len(productList))
+	ids := make([]string, len(productList))
+	for i, p := range productList {
+		index[p.ID] = i
+		ids[i] = p.ID
+	}
+	return ids, index
+}
+
+func attachBundleItems(ctx context.Context, q queryer, productList []Product) error {
+	if len(productList) == 0 {
+		return nil
+	}
+	ids, index := productIndex(productList)
+	rows, err := q.QueryContext(ctx, `SELECT bundle_id, product_id, sku, quantity
+		FROM bundle_items WHERE bundle_id = ANY($1) ORDER BY bundle_id, position`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bundleID string
+		var item BundleItem
+		if err := rows.Scan(&bundleID, &item.ProductID, &item.SKU, &item.Quantity); err != nil {
+			return err
+		}
+		p := &productList[index[bundleID]]
+		p.Bundle = append(p.Bundle, item)
+	}
+	return rows.Err()
+}
+
+// attachBundleStock fills in the stock of the bundles in productList from
+// their components
+func attachBundleStock(ctx context.Context, q queryer, productList []Product) error {
+	var ids []string
+	for _, p := range productList {
+		if p.IsBundle() {
+			ids = append(ids, p.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	_, index := productIndex(productList)
+	rows, err := q.QueryContext(ctx, `SELECT id, bundle_stock(id) FROM unnest($1::text[]) AS id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var stock int
+		if err := rows.Scan(&id, &stock); err != nil {
+			return err
+		}
+		productList[index[id]].Stock = stock
+	}
+	return rows.Err()
+}
+
+// readProducts runs a product query for a read method, including the stock
+// of bundles
+func readProducts(ctx context.Context, q queryer, query string, args ...interface{}) ([]Product, error) {
+	productList, err := queryProducts(ctx, q, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return productList, attachBundleStock(ctx, q, productList)
+}
+
+func attachVariants(ctx context.Context, q queryer, productList []Product) error {
+	if len(productList) == 0 {
+		return nil
+	}
+	ids, index := productIndex(productList)
+	rows, err := q.QueryContext(ctx, `SELECT product_id, sku, size, price, stock, barcode
+		FROM product_variants WHERE product_id = ANY($1) ORDER BY product_id, position`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var productID string
+		var v Variant
+		if err := rows.Scan(&productID, &v.SKU, &v.Size, &v.Price, &v.Stock, &v.Barcode); err != nil {
+			return err
+		}
+		p := &productList[index[productID]]
+		p.Variants = append(p.Variants, v)
+	}
+	return rows.Err()
+}
+
+func (s pgProductStore) List(ctx context.Context) ([]Product, error) {
+	return readProducts(ctx, s.db, `SELECT `+productColumns+` FROM products ORDER BY created_at`)
+}
+
+// productOrder maps catalog sort keys to SQL ORDER BY clauses
+var productOrder = map[string]string{
+	SortNewest:    "created_at DESC, id",
+	SortPriceAsc:  "%s, id",
+	SortPriceDesc: "%s DESC, id",
+	SortNameAsc:   "lower(name), id",
+	SortNameDesc:  "lower(name) DESC, id",
+}
+
+// priceColumn returns the SQL for what a product sells for, as
+// ProductQuery.price sees it, adding its parameters through arg
+func priceColumn(q ProductQuery, arg func(v interface{}) string) string {
+	if len(q.SalePrices) == 0 {
+		return "price"
+	}
+	ids := make([]string, 0, len(q.SalePrices))
+	prices := make([]float64, 0, len(q.SalePrices))
+	for id, price := range q.SalePrices {
+		ids = append(ids, id)
+		prices = append(prices, price)
+	}
+	return "COALESCE((SELECT sale.price FROM unnest(" + arg(pq.Array(ids)) + "::text[], " +
+		arg(pq.Array(prices)) + "::numeric[]) AS sale(id, price) WHERE sale.id = products.id), price)"
+}
+
+// productFilter returns the WHERE conditions for a catalog query, adding
+// their parameters through arg
+func productFilter(q ProductQuery, arg func(v interface{}) string) []string {
+	var where []string
+	if !q.IncludeArchived {
+		where = append(where, "archived_at IS NULL")
+	}
+	if q.Search != "" {
+		pattern := arg("%" + likeEscaper.Replace(q.Search) + "%")
+		where = append(where, "(name ILIKE "+pattern+" OR description ILIKE "+pattern+")")
+	}
+	if q.Category != "" {
+		where = append(where, "category = ANY("+arg(pq.Array(q.Categories))+")")
+	}
+	if q.MinPrice != nil || q.MaxPrice != nil {
+		price := priceColumn(q, arg)
+		if q.MinPrice != nil {
+			where = append(where, price+" >= "+arg(*q.MinPrice))
+		}
+		if q.MaxPrice != nil {
+			where = append(where, price+" <= "+arg(*q.MaxPrice))
+		}
+	}
+	if q.InStock {
+		where = append(where, "COALESCE(bundle_stock(id), stock) > 0")
+	}
+
+	f := q.Attributes
+	for _, filter := range []struct {
+		column string
+		values []string
+	}{{"country", f.Countries}, {"region", f.Regions}, {"style", f.Styles}, {"cask", f.Casks}, {"grape", f.Grapes}} {
+		if len(filter.values) > 0 {
+			lower := make([]string, len(filter.values))
+			for i, v := range filter.values {
+				lower[i] = strings.ToLower(v)
+			}
+			where = append(where, "lower("+filter.column+") = ANY("+arg(pq.Array(lower))+")")
+		}
+	}
+	for _, filter := range []struct {
+		column string
+		values []int
+	}{{"vintage", f.Vintages}, {"age_years", f.Ages}, {"volume_ml", f.Volumes}} {
+		if len(filter.values) > 0 {
+			where = append(where, filter.column+" = ANY("+arg(pq.Array(filter.values))+")")
+		}
+	}
+	if len(f.ABVBands) > 0 {
+		var bands []string
+		for _, label := range f.ABVBands {
+			bounds := abvBandRange(label)
+			bands = append(bands, "(abv >= "+arg(bounds[0])+" AND abv < "+arg(bounds[1])+")")
+		}
+		where = append(where, "("+strings.Join(bands, " OR ")+")")
+	}
+	return where
+}
+
+// whereClause joins conditions into a WHERE clause
+func whereClause(where []string) string {
+	if len(where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(where, " AND ")
+}
+
+func (s pgProductStore) Search(ctx context.Context, q ProductQuery) ([]Product, int, error) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	clause := whereClause(productFilter(q, arg))
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM products`+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	order, ok := productOrder[q.Sort]
+	if !ok {
+		order = productOrder[SortNewest]
+	}
+	if q.Sort == SortPriceAsc || q.Sort == SortPriceDesc {
+		order = fmt.Sprintf(order, priceColumn(q, arg))
+	}
+	query := `SELECT ` + productColumns + ` FROM products` + clause + ` ORDER BY ` + order
+	if q.Limit > 0 {
+		query += " LIMIT " + arg(q.Limit)
+	}
+	query += " OFFSET " + arg(q.Offset)
+
+	productList, err := readProducts(ctx, s.db, query, args...)
+	return productList, total, err
+}
+
+// likeEscaper escapes LIKE wildcards in user-supplied search terms
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s pgProductStore) Get(ctx context.Context, id string) (Product, error) {
+	p, err := getProduct(ctx, s.db, id, "")
+	if err != nil {
+		return Product{}, err
+	}
+	return p, s.withBundleStock(ctx, &p)
+}
+
+// withBundleStock fills in the stock of a bundle read by a single-product
+// method
+func (s pgProductStore) withBundleStock(ctx context.Context, p *Product) error {
+	productList := []Product{*p}
+	if err := attachBundleStock(ctx, s.db, productList); err != nil {
+		return err
+	}
+	*p = productList[0]
+	return nil
+}
+
+func (s pgProductStore) GetBySKU(ctx context.Context, sku string) (Product, error) {
+	productList, err := readProducts(ctx, s.db, `SELECT `+productColumns+` FROM products
+		WHERE id = (SELECT product_id FROM product_variants WHERE sku = $1)`, sku)
+	if err != nil {
+		return Product{}, err
+	}
+	if len(productList) == 0 {
+		return Product{}, ErrNotFound
+	}
+	return productList[0], nil
+}
+
+// getProduct loads one product, optionally appending a locking clause
+func getProduct(ctx context.Context, q queryer, id, lock string) (Product, error) {
+	productList, err := queryProducts(ctx, q, `SELECT `+productColumns+` FROM products WHERE id = $1 `+lock, id)
+	if err != nil {
+		return Product{}, err
+	}
+	if len(productList) == 0 {
+		return Product{}, ErrNotFound
+	}
+	return productList[0], nil
+}
+
+func (s pgProductStore) Save(ctx context.Context, p Product) error {
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var before *Product
+		stored, err := getProduct(ctx, tx, p.ID, "FOR UPDATE")
+		if err == nil {
+			before = &stored
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := saveProduct(ctx, tx, p); err != nil {
+			return err
+		}
+		if err := insertPriceChanges(ctx, tx, diffPrices(ctx, before, &p)); err != nil {
+			return err
+		}
+		return insertMovements(ctx, tx, diffMovements(ctx, before, &p))
+	})
+}
+
+// saveProduct upserts the product row and replaces its variants and bundle
+// contents
+func saveProduct(ctx context.Context, tx *sql.Tx, p Product) error {
+	a := p.Attributes
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO products (`+productColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+		ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name,
+			description = EXCLUDED.description,
+			price = EXCLUDED.price,
+			stock = EXCLUDED.stock,
+			image = EXCLUDED.image,
+			thumbnail = EXCLUDED.thumbnail,
+			category = EXCLUDED.category,
+			archived_at = EXCLUDED.archived_at,
+			reorder_level = EXCLUDED.reorder_level,
+			low_stock_since = EXCLUDED.low_stock_since,
+			abv = EXCLUDED.abv,
+			volume_ml = EXCLUDED.volume_ml,
+			country = EXCLUDED.country,
+			region = EXCLUDED.region,
+			age_years = EXCLUDED.age_years,
+			vintage = EXCLUDED.vintage,
+			cask = EXCLUDED.cask,
+			grape = EXCLUDED.grape,
+			style = EXCLUDED.style`,
+		p.ID, p.Name, p.Description, p.Price, p.Stock, p.Image, p.Thumbnail, p.Category, p.CreatedAt, p.ArchivedAt,
+		p.ReorderLevel, p.LowStockSince, a.ABV, a.VolumeML, a.Country, a.Region, a.AgeYears, a.Vintage,
+		a.Cask, a.Grape, a.Style)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM product_variants WHERE product_id = $1`, p.ID); err != nil {
+		return err
+	}
+	for i, v := range p.Variants {
+		_, err := tx.ExecContext(ctx, `INSERT INTO product_variants
+			(sku, product_id, position, size, price, stock, barcode)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			v.SKU, p.ID, i, v.Size, v.Price, v.Stock, v.Barcode)
+		if isUniqueViolation(err) {
+			return ErrDuplicateSKU
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM bundle_items WHERE bundle_id = $1`, p.ID); err != nil {
+		return err
+	}
+	for i, item := range p.Bundle {
+		_, err := tx.ExecContext(ctx, `INSERT INTO bundle_items (bundle_id, position, product_id, sku, quantity)
+			VALUES ($1, $2, $3, $4, $5)`, p.ID, i, item.ProductID, item.SKU, item.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s pgProductStore) Update(ctx context.Context, id string, fn func(product *Product) error) (Product, error) {
+	var p Product
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		p, err = getProduct(ctx, tx, id, "FOR UPDATE")
+		if err != nil {
+			return err
+		}
+		before := copyProduct(p)
+		if err := fn(&p); err != nil {
+			return err
+		}
+		if err := saveProduct(ctx, tx, p); err != nil {
+			return err
+		}
+		if err := insertPriceChanges(ctx, tx, diffPrices(ctx, &before, &p)); err != nil {
+			return err
+		}
+		return insertMovements(ctx, tx, diffMovements(ctx, &before, &p))
+	})
+	if err != nil {
+		return Product{}, err
+	}
+	return p, s.withBundleStock(ctx, &p)
+}
+
+func (s pgProductStore) AdjustStock(ctx context.Context, id, sku string, delta int) (Product, error) {
+	var p Product
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		p, err = getProduct(ctx, tx, id, "FOR UPDATE")
+		if err != nil {
+			return err
+		}
+		if p.IsBundle() {
+			return ErrBundleStock
+		}
+		variant, err := p.resolveSKU(sku)
+		if err != nil {
+			return err
+		}
+
+		stock := &p.Stock
+		if variant != nil {
+			stock = &variant.Stock
+		}
+		if *stock+delta < 0 {
+			return ErrInsufficientStock
+		}
+		*stock += delta
+		p.syncVariants()
+
+		if variant != nil {
+			_, err := tx.ExecContext(ctx, `UPDATE product_variants SET stock = $2 WHERE sku = $1`,
+				variant.SKU, variant.Stock)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE products SET stock = $2 WHERE id = $1`, p.ID, p.Stock); err != nil {
+			return err
+		}
+		return insertMovements(ctx, tx, changeMovements(ctx, map[string]*Product{p.ID: &p},
+			[]StockChange{{ProductID: id, SKU: sku, Delta: delta}}))
+	})
+	if errors.Is(err, ErrInsufficientStock) {
+		return p, err
+	}
+	if err != nil {
+		return Product{}, err
+	}
+	return p, nil
+}
+
+func (s pgProductStore) AdjustStocks(ctx context.Context, changes []StockChange) error {
+	ids := make([]string, 0, len(changes))
+	for _, change := range changes {
+		if !containsString(ids, change.ProductID) {
+			ids = append(ids, change.ProductID)
+		}
+	}
+	// Lock rows in a fixed order so concurrent checkouts cannot deadlock
+	sort.Strings(ids)
+
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		products := make(map[string]*Product, len(ids))
+		for _, id := range ids {
+			p, err := getProduct(ctx, tx, id, "FOR UPDATE")
+			if err != nil {
+				return err
+			}
+			products[id] = &p
+		}
+		if err := applyStockChanges(products, changes); err != nil {
+			return err
+		}
+
+		for _, p := range products {
+			for _, v := range p.Variants {
+				_, err := tx.ExecContext(ctx, `UPDATE product_variants SET stock = $2 WHERE sku = $1`, v.SKU, v.Stock)
+				if err != nil {
+					return err
+				}
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE products SET stock = $2 WHERE id = $1`, p.ID, p.Stock); err != nil {
+				return err
+			}
+		}
+		return insertMovements(ctx, tx, changeMovements(ctx, products, changes))
+	})
+}
+
+func (s pgProductStore) CountByCategory(ctx context.Context) (map[string]int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT category, count(*) FROM products
+		WHERE archived_at IS NULL GROUP BY category`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var slug string
+		var n int
+		if err := rows.Scan(&slug, &n); err != nil {
+			return nil, err
+		}
+		counts[slug] = n
+	}
+	return counts, rows.Err()
+}
+
+// facetExpressions gives the SQL for each facet's value; NULL or empty
+// values are not counted
+var facetExpressions = func() map[string]string {
+	band := "CASE"
+	for _, b := range abvBands {
+		band += fmt.Sprintf(" WHEN abv >= %g AND abv < %g THEN '%s'", b.min, b.max, b.label)
+	}
+	band += " END"
+	return map[string]string{
+		"country": "country", "region": "region", "style": "style", "cask": "cask", "grape": "grape",
+		"vintage": "vintage::text", "age": "age_years::text", "volume": "volume_ml::text", "abv": band,
+	}
+}()
+
+// Facets counts every facet in one statement, a UNION of one grouped query
+// per facet with that facet's filter
+func (s pgProductStore) Facets(ctx context.Context, queries map[string]ProductQuery) (map[string][]FacetValue, error) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	var parts []string
+	for _, f := range facets {
+		q, ok := queries[f.name]
+		if !ok {
+			continue
+		}
+		expr := facetExpressions[f.name]
+		where := append(productFilter(q, arg), "COALESCE("+expr+", '') <> ''")
+		parts = append(parts, "SELECT "+arg(f.name)+"::text, "+expr+", count(*) FROM products"+
+			whereClause(where)+" GROUP BY 2")
+	}
+	counts := make(map[string][]FacetValue, len(parts))
+	if len(parts) == 0 {
+		return counts, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, strings.Join(parts, " UNION ALL "), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var v FacetValue
+		if err := rows.Scan(&name, &v.Value, &v.Count); err != nil {
+			return nil, err
+		}
+		counts[name] = append(counts[name], v)
+	}
+	return counts, rows.Err()
+}
+
+// insertMovements appends movements to the stock ledger
+func insertMovements(ctx context.Context, tx *sql.Tx, movements []StockMovement) error {
+	for _, m := range movements {
+		_, err := tx.ExecContext(ctx, `INSERT INTO stock_movements
+			(`+movementColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			m.ID, m.ProductID, m.SKU, m.Type, m.Delta, m.Balance, m.Actor, m.Reason, m.Reference, m.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type pgMovementStore struct {
+	db *sql.DB
+}
+
+const movementColumns = `id, product_id, sku, type, delta, balance, actor, reason, reference, created_at`
+
+func (s pgMovementStore) ListByProduct(ctx context.Context, productID, sku string, offset, limit int) ([]StockMovement, int, error) {
+	where := ` WHERE product_id = $1 AND ($2 = '' OR sku = $2)`
+
+	var total int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM stock_movements`+where, productID, sku).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+movementColumns+` FROM stock_movements`+where+`
+		ORDER BY created_at DESC, id LIMIT $3 OFFSET $4`, productID, sku, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	movements := []StockMovement{}
+	for rows.Next() {
+		var m StockMovement
+		err := rows.Scan(&m.ID, &m.ProductID, &m.SKU, &m.Type, &m.Delta, &m.Balance, &m.Actor, &m.Reason,
+			&m.Reference, &m.CreatedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		movements = append(movements, m)
+	}
+	return movements, total, rows.Err()
+}
+
+func (s pgMovementStore) Totals(ctx context.Context) ([]StockLevel, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT product_id, sku, sum(delta) FROM stock_movements
+		GROUP BY product_id, sku ORDER BY product_id, sku`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []StockLevel{}
+	for rows.Next() {
+		var t StockLevel
+		if err := rows.Scan(&t.ProductID, &t.SKU, &t.Quantity); err != nil {
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
+
+// insertPriceChanges appends changes to the price history
+func insertPriceChanges(ctx context.Context, tx *sql.Tx, changes []PriceChange) error {
+	for _, pc := range changes {
+		_, err := tx.ExecContext(ctx, `INSERT INTO price_history
+			(`+priceChangeColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			pc.ID, pc.ProductID, pc.SKU, pc.OldPrice, pc.Price, pc.Actor, pc.Reason, pc.Reference, pc.ChangedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type pgPriceHistoryStore struct {
+	db *sql.DB
+}
+
+const priceChangeColumns = `id, product_id, sku, old_price, price, actor, reason, reference, changed_at`
+
+func (s pgPriceHistoryStore) ListByProduct(ctx context.Context, productID string, offset, limit int) ([]PriceChange, int, error) {
+	var total int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM price_history WHERE product_id = $1`, productID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+priceChangeColumns+` FROM price_history
+		WHERE product_id = $1 ORDER BY changed_at DESC, id LIMIT $2 OFFSET $3`, productID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	changes := []PriceChange{}
+	for rows.Next() {
+		var pc PriceChange
+		err := rows.Scan(&pc.ID, &pc.ProductID, &pc.SKU, &pc.OldPrice, &pc.Price, &pc.Actor, &pc.Reason,
+			&pc.Reference, &pc.ChangedAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, pc)
+	}
+	return changes, total, rows.Err()
+}
+
+type pgPromotionStore struct {
+	db *sql.DB
+}
+
+const promotionColumns = `id, product_id, sku, name, type, value, starts_at, ends_at, created_at`
+
+func (s pgPromotionStore) Create(ctx context.Context, p Promotion) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO promotions (`+promotionColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		p.ID, p.ProductID, p.SKU, p.Name, p.Type, p.Value, p.StartsAt, p.EndsAt, p.CreatedAt)
+	return err
+}
+
+func (s pgPromotionStore) query(ctx context.Context, clause string, args ...interface{}) ([]Promotion, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+promotionColumns+` FROM promotions `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	promotions := []Promotion{}
+	for rows.Next() {
+		var p Promotion
+		err := rows.Scan(&p.ID, &p.ProductID, &p.SKU, &p.Name, &p.Type, &p.Value, &p.StartsAt, &p.EndsAt,
+			&p.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		promotions = append(promotions, p)
+	}
+	return promotions, rows.Err()
+}
+
+func (s pgPromotionStore) List(ctx context.Context, productID string) ([]Promotion, error) {
+	return s.query(ctx, `WHERE product_id = $1 ORDER BY starts_at DESC, id`, productID)
+}
+
+func (s pgPromotionStore) Active(ctx context.Context, productIDs []string, t time.Time) (map[string][]Promotion, error) {
+	promotions, err := s.query(ctx, `WHERE product_id = ANY($1) AND starts_at <= $2 AND ends_at > $2`,
+		pq.Array(productIDs), t)
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[string][]Promotion)
+	for _, p := range promotions {
+		active[p.ProductID] = append(active[p.ProductID], p)
+	}
+	return active, nil
+}
+
+func (s pgPromotionStore) OnSale(ctx context.Context, t time.Time) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT product_id FROM promotions
+		WHERE starts_at <= $1 AND ends_at > $1`, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s pgPromotionStore) Delete(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM promotions WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type pgPriceScheduleStore struct {
+	db *sql.DB
+}
+
+const scheduledPriceColumns = `id, product_id, sku, price, effective_at, applied_at, created_by, created_at`
+
+func (s pgPriceScheduleStore) Create(ctx context.Context, sp ScheduledPrice) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO price_schedule (`+scheduledPriceColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		sp.ID, sp.ProductID, sp.SKU, sp.Price, sp.EffectiveAt, sp.AppliedAt, sp.CreatedBy, sp.CreatedAt)
+	return err
+}
+
+func (s pgPriceScheduleStore) query(ctx context.Context, clause string, args ...interface{}) ([]ScheduledPrice, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+scheduledPriceColumns+` FROM price_schedule `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedule := []ScheduledPrice{}
+	for rows.Next() {
+		var sp ScheduledPrice
+		err := rows.Scan(&sp.ID, &sp.ProductID, &sp.SKU, &sp.Price, &sp.EffectiveAt, &sp.AppliedAt, &sp.CreatedBy,
+			&sp.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, sp)
+	}
+	return schedule, rows.Err()
+}
+
+func (s pgPriceScheduleStore) List(ctx context.Context, productID string) ([]ScheduledPrice, error) {
+	return s.query(ctx, `WHERE product_id = $1 ORDER BY effective_at, id`, productID)
+}
+
+func (s pgPriceScheduleStore) Due(ctx context.Context, t time.Time) ([]ScheduledPrice, error) {
+	return s.query(ctx, `WHERE applied_at IS NULL AND effective_at <= $1 ORDER BY effective_at, id`, t)
+}
+
+func (s pgPriceScheduleStore) MarkApplied(ctx context.Context, id string, t time.Time) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE price_schedule SET applied_at = $2 WHERE id = $1`, id, t)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s pgPriceScheduleStore) Delete(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM price_schedule WHERE id = $1 AND applied_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM price_schedule WHERE id = $1)`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrScheduleApplied
+	}
+	return ErrNotFound
+}
+
+type pgCategoryStore struct {
+	db *sql.DB
+}
+
+const categoryColumns = `slug, name, COALESCE(parent, ''), position, kind, created_at`
+
+func scanCategory(row interface{ Scan(...interface{}) error }) (Category, error) {
+	var c Category
+	err := row.Scan(&c.Slug, &c.Name, &c.Parent, &c.Position, &c.Kind, &c.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Category{}, ErrNotFound
+	}
+	return c, err
+}
+
+func (s pgCategoryStore) List(ctx context.Context) ([]Category, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+categoryColumns+` FROM categories ORDER BY position, lower(name)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	for rows.Next() {
+		c, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+func (s pgCategoryStore) Get(ctx context.Context, slug string) (Category, error) {
+	return scanCategory(s.db.QueryRowContext(ctx, `SELECT `+categoryColumns+` FROM categories WHERE slug = $1`, slug))
+}
+
+func (s pgCategoryStore) Create(ctx context.Context, c Category) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO categories (slug, name, parent, position, kind, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)`,
+		c.Slug, c.Name, c.Parent, c.Position, c.Kind, c.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrCategoryExists
+	}
+	return err
+}
+
+func (s pgCategoryStore) Save(ctx context.Context, c Category) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO categories (slug, name, parent, position, kind, created_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)
+		ON CONFLICT (slug) DO UPDATE SET
+			name = EXCLUDED.name,
+			parent = EXCLUDED.parent,
+			position = EXCLUDED.position,
+			kind = EXCLUDED.kind`,
+		c.Slug, c.Name, c.Parent, c.Position, c.Kind, c.CreatedAt)
+	return err
+}
+
+func (s pgCategoryStore) Delete(ctx context.Context, slug string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM categories WHERE slug = $1`, slug)
+	if isForeignKeyViolation(err) {
+		return ErrCategoryInUse
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type pgUserStore struct {
+	db *sql.DB
+}
+
+const userColumns = `id, email, password, name, role, created_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Email, &u.Password, &u.Name, &u.Role, &u.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	return u, err
+}
+
+func (s pgUserStore) Get(ctx context.Context, id string) (User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+}
+
+func (s pgUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	return scanUser(s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE email = $1`, email))
+}
+
+func (s pgUserStore) Create(ctx context.Context, u User) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO users (`+userColumns+`) VALUES ($1, $2, $3, $4, $5, $6)`,
+		u.ID, u.Email, u.Password, u.Name, u.Role, u.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+func (s pgUserStore) Save(ctx context.Context, u User) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO users (`+userColumns+`) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE SET
+			email = EXCLUDED.email,
+			password = EXCLUDED.password,
+			name = EXCLUDED.name,
+			role = EXCLUDED.role`,
+		u.ID, u.Email, u.Password, u.Name, u.Role, u.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+func (s pgUserStore) Update(ctx context.Context, id string, fn func(user *User) error) (User, error) {
+	var u User
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		u, err = scanUser(tx.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1 FOR UPDATE`, id))
+		if err != nil {
+			return err
+		}
+		if err := fn(&u); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE users SET email = $2, password = $3, name = $4, role = $5 WHERE id = $1`,
+			u.ID, u.Email, u.Password, u.Name, u.Role)
+		if isUniqueViolation(err) {
+			return ErrEmailTaken
+		}
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+type pgOrderStore struct {
+	db *sql.DB
+}
+
+const orderColumns = `id, user_id, delivery_name, delivery_address, delivery_city, delivery_phone,
+	payment_method, payment_phone, subtotal, delivery_fee, coupon_code, total_amount, status, reservation,
+	reserved_until, created_at`
+
+func (s pgOrderStore) Create(ctx context.Context, o Order) error {
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO orders (`+orderColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`,
+			o.ID, o.UserID, o.DeliveryDetails.Name, o.DeliveryDetails.Address, o.DeliveryDetails.City,
+			o.DeliveryDetails.Phone, o.PaymentDetails.Method, o.PaymentDetails.Phone, o.Subtotal, o.DeliveryFee,
+			o.CouponCode, o.TotalAmount, o.Status, o.Reservation, o.ReservedUntil, o.CreatedAt)
+		if err != nil {
+			return err
+		}
+		for i, d := range o.Discounts {
+			_, err := tx.ExecContext(ctx, `INSERT INTO order_discounts
+				(order_id, position, discount_id, name, code, type, amount) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+				o.ID, i, d.DiscountID, d.Name, d.Code, d.Type, d.Amount)
+			if err != nil {
+				return err
+			}
+		}
+		for i, item := range o.Items {
+			_, err := tx.ExecContext(ctx, `INSERT INTO order_items (order_id, position, product_id, sku, name, price, quantity)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+				o.ID, i, item.ID, item.SKU, item.Name, item.Price, item.Quantity)
+			if err != nil {
+				return err
+			}
+			for j, c := range item.Bundle {
+				_, err := tx.ExecContext(ctx, `INSERT INTO order_item_bundles
+					(order_id, position, component, product_id, sku, quantity) VALUES ($1, $2, $3, $4, $5, $6)`,
+					o.ID, i, j, c.ProductID, c.SKU, c.Quantity)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s pgOrderStore) Get(ctx context.Context, id string) (Order, error) {
+	orders, err := s.query(ctx, `WHERE id = $1`, id)
+	if err != nil {
+		return Order{}, err
+	}
+	if len(orders) == 0 {
+		return Order{}, ErrNotFound
+	}
+	return orders[0], nil
+}
+
+func (s pgOrderStore) ListByUser(ctx context.Context, userID string) ([]Order, error) {
+	return s.query(ctx, `WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+}
+
+func (s pgOrderStore) UnitsSold(ctx context.Context, since time.Time) (map[string]int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT i.product_id, sum(i.quantity)
+		FROM order_items i JOIN orders o ON o.id = i.order_id
+		WHERE o.created_at >= $1 AND o.status <> ALL($2)
+		GROUP BY i.product_id`, since, pq.Array([]string{OrderCancelled, OrderExpired}))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sold := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		sold[id] = n
+	}
+	return sold, rows.Err()
+}
+
+func (s pgOrderStore) ListSince(ctx context.Context, since time.Time) ([]Order, error) {
+	return s.query(ctx, `WHERE created_at >= $1 AND status <> ALL($2) ORDER BY created_at`,
+		since, pq.Array([]string{OrderCancelled, OrderExpired}))
+}
+
+func (s pgOrderStore) Update(ctx context.Context, id string, fn func(order *Order) error) (Order, error) {
+	var order Order
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		orders, err := queryOrders(ctx, tx, `WHERE id = $1 FOR UPDATE`, id)
+		if err != nil {
+			return err
+		}
+		if len(orders) == 0 {
+			return ErrNotFound
+		}
+		order = orders[0]
+		if err := fn(&order); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE orders SET status = $2, reservation = $3, reserved_until = $4
+			WHERE id = $1`, order.ID, order.Status, order.Reservation, order.ReservedUntil)
+		return err
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+func (s pgOrderStore) ListExpired(ctx context.Context, t time.Time) ([]Order, error) {
+	return s.query(ctx, `WHERE status = $1 AND reservation = $2 AND reserved_until < $3`,
+		OrderPending, ReservationHeld, t)
+}
+
+func (s pgOrderStore) query(ctx context.Context, clause string, args ...interface{}) ([]Order, error) {
+	return queryOrders(ctx, s.db, clause, args...)
+}
+
+// queryOrders loads the orders matching the given clause along with their items
+func queryOrders(ctx context.Context, q queryer, clause string, args ...interface{}) ([]Order, error) {
+	rows, err := q.QueryContext(ctx, `SELECT `+orderColumns+` FROM orders `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orderList := []Order{}
+	for rows.Next() {
+		var o Order
+		err := rows.Scan(&o.ID, &o.UserID, &o.DeliveryDetails.Name, &o.DeliveryDetails.Address,
+			&o.DeliveryDetails.City, &o.DeliveryDetails.Phone, &o.PaymentDetails.Method,
+			&o.PaymentDetails.Phone, &o.Subtotal, &o.DeliveryFee, &o.CouponCode, &o.TotalAmount, &o.Status,
+			&o.Reservation, &o.ReservedUntil, &o.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		orderList = append(orderList, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range orderList {
+		items, err := orderItems(ctx, q, orderList[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		orderList[i].Items = items
+		if orderList[i].Discounts, err = orderDiscounts(ctx, q, orderList[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return orderList, nil
+}
+
+func orderDiscounts(ctx context.Context, q queryer, orderID string) ([]DiscountLine, error) {
+	rows, err := q.QueryContext(ctx, `SELECT discount_id, name, code, type, amount
+		FROM order_discounts WHERE order_id = $1 ORDER BY position`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var discounts []DiscountLine
+	for rows.Next() {
+		var d DiscountLine
+		if err := rows.Scan(&d.DiscountID, &d.Name, &d.Code, &d.Type, &d.Amount); err != nil {
+			return nil, err
+		}
+		discounts = append(discounts, d)
+	}
+	return discounts, rows.Err()
+}
+
+func orderItems(ctx context.Context, q queryer, orderID string) ([]OrderItem, error) {
+	rows, err := q.QueryContext(ctx, `SELECT product_id, sku, name, price, quantity
+		FROM order_items WHERE order_id = $1 ORDER BY position`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []OrderItem{}
+	for rows.Next() {
+		var item OrderItem
+		if err := rows.Scan(&item.ID, &item.SKU, &item.Name, &item.Price, &item.Quantity); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = q.QueryContext(ctx, `SELECT position, product_id, sku, quantity
+		FROM order_item_bundles WHERE order_id = $1 ORDER BY position, component`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var position int
+		var c BundleItem
+		if err := rows.Scan(&position, &c.ProductID, &c.SKU, &c.Quantity); err != nil {
+			return nil, err
+		}
+		if position < len(items) {
+			items[position].Bundle = append(items[position].Bundle, c)
+		}
+	}
+	return items, rows.Err()
+}
+
+type pgCartStore struct {
+	db *sql.DB
+}
+
+func (s pgCartStore) Get(ctx context.Context, userID string) (*Cart, error) {
+	return loadCart(ctx, s.db, userID, "")
+}
+
+func (s pgCartStore) Save(ctx context.Context, cart *Cart) error {
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		return saveCart(ctx, tx, cart)
+	})
+}
+
+func (s pgCartStore) Update(ctx context.Context, userID string, fn func(cart *Cart) error) (*Cart, error) {
+	var cart *Cart
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO carts (user_id, total, created_at, updated_at)
+			VALUES ($1, 0, now(), now()) ON CONFLICT (user_id) DO NOTHING`, userID)
+		if err != nil {
+			return err
+		}
+		// Lock the cart row so concurrent updates for the same user serialize
+		cart, err = loadCart(ctx, tx, userID, "FOR UPDATE")
+		if err != nil {
+			return err
+		}
+		if err := fn(cart); err != nil {
+			return err
+		}
+		return saveCart(ctx, tx, cart)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+func (s pgCartStore) Delete(ctx context.Context, userID string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM carts WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s pgCartStore) ListIdle(ctx context.Context, t time.Time) ([]Cart, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user_id FROM carts WHERE updated_at < $1 ORDER BY updated_at`, t)
+	if err != nil {
+		return nil, err
+	}
+	var userIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	carts := []Cart{}
+	for _, id := range userIDs {
+		cart, err := loadCart(ctx, s.db, id, "")
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		carts = append(carts, *cart)
+	}
+	return carts, nil
+}
+
+func (s pgCartStore) Expire(ctx context.Context, userID string, t time.Time) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM carts WHERE user_id = $1 AND updated_at <= $2`, userID, t)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func loadCart(ctx context.Context, q queryer, userID, lock string) (*Cart, error) {
+	cart := &Cart{UserID: userID, Items: []CartItem{}}
+	err := q.QueryRowContext(ctx, `SELECT total, coupon_code, created_at, updated_at
+		FROM carts WHERE user_id = $1 `+lock, userID).
+		Scan(&cart.Total, &cart.CouponCode, &cart.CreatedAt, &cart.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT product_id, sku, name, price, quantity, product_image, product_description
+		FROM cart_items WHERE user_id = $1 ORDER BY position`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item CartItem
+		err := rows.Scan(&item.ProductID, &item.SKU, &item.Name, &item.Price, &item.Quantity,
+			&item.ProductImage, &item.ProductDescription)
+		if err != nil {
+			return nil, err
+		}
+		cart.Items = append(cart.Items, item)
+	}
+	return cart, rows.Err()
+}
+
+func saveCart(ctx context.Context, tx *sql.Tx, cart *Cart) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO carts (user_id, total, coupon_code, created_at, updated_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET total = EXCLUDED.total, coupon_code = EXCLUDED.coupon_code,
+			updated_at = EXCLUDED.updated_at`,
+		cart.UserID, cart.Total, cart.CouponCode, cart.CreatedAt, cart.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM cart_items WHERE user_id = $1`, cart.UserID); err != nil {
+		return err
+	}
+	for i, item := range cart.Items {
+		_, err := tx.ExecContext(ctx, `INSERT INTO cart_items
+			(user_id, position, product_id, sku, name, price, quantity, product_image, product_description)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			cart.UserID, i, item.ProductID, item.SKU, item.Name, item.Price, item.Quantity,
+			item.ProductImage, item.ProductDescription)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type pgPaymentStore struct {
+	db *sql.DB
+}
+
+const transactionColumns = `order_id, checkout_request_id, phone_number, amount, status, result_code, result_desc, created_at`
+
+func scanTransaction(row interface{ Scan(...interface{}) error }) (*MpesaTransaction, error) {
+	t := &MpesaTransaction{}
+	err := row.Scan(&t.OrderID, &t.CheckoutRequestID, &t.PhoneNumber, &t.Amount, &t.Status,
+		&t.ResultCode, &t.ResultDesc, &t.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return t, err
+}
+
+func (s pgPaymentStore) Save(ctx context.Context, t *MpesaTransaction) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO mpesa_transactions (`+transactionColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (order_id) DO UPDATE SET
+			checkout_request_id = EXCLUDED.checkout_request_id,
+			phone_number = EXCLUDED.phone_number,
+			amount = EXCLUDED.amount,
+			status = EXCLUDED.status,
+			result_code = EXCLUDED.result_code,
+			result_desc = EXCLUDED.result_desc`,
+		t.OrderID, t.CheckoutRequestID, t.PhoneNumber, t.Amount, t.Status, t.ResultCode, t.ResultDesc, t.CreatedAt)
+	return err
+}
+
+func (s pgPaymentStore) GetByOrder(ctx context.Context, orderID string) (*MpesaTransaction, error) {
+	return scanTransaction(s.db.QueryRowContext(ctx,
+		`SELECT `+transactionColumns+` FROM mpesa_transactions WHERE order_id = $1`, orderID))
+}
+
+func (s pgPaymentStore) GetByCheckoutRequest(ctx context.Context, checkoutRequestID string) (*MpesaTransaction, error) {
+	return scanTransaction(s.db.QueryRowContext(ctx, `SELECT `+transactionColumns+`
+		FROM mpesa_transactions WHERE checkout_request_id = $1 AND checkout_request_id <> ''`, checkoutRequestID))
+}
+
+func (s pgPaymentStore) List(ctx context.Context) ([]*MpesaTransaction, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+transactionColumns+` FROM mpesa_transactions ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []*MpesaTransaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, t)
+	}
+	return transactions, rows.Err()
+}
+
+type pgReviewStore struct {
+	db *sql.DB
+}
+
+const reviewColumns = `id, product_id, user_id, author, rating, body, hidden, created_at`
+
+func scanReview(row interface{ Scan(...interface{}) error }) (Review, error) {
+	var r Review
+	err := row.Scan(&r.ID, &r.ProductID, &r.UserID, &r.Author, &r.Rating, &r.Body, &r.Hidden, &r.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Review{}, ErrNotFound
+	}
+	return r, err
+}
+
+func (s pgReviewStore) Create(ctx context.Context, r Review) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO reviews (`+reviewColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		r.ID, r.ProductID, r.UserID, r.Author, r.Rating, r.Body, r.Hidden, r.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrAlreadyReviewed
+	}
+	return err
+}
+
+func (s pgReviewStore) ListByProduct(ctx context.Context, productID string, includeHidden bool, offset, limit int) ([]Review, int, error) {
+	clause := ` WHERE product_id = $1`
+	if !includeHidden {
+		clause += ` AND NOT hidden`
+	}
+
+	var total int
+	if err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM reviews`+clause, productID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+reviewColumns+` FROM reviews`+clause+`
+		ORDER BY created_at DESC, id LIMIT $2 OFFSET $3`, productID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	reviews := []Review{}
+	for rows.Next() {
+		r, err := scanReview(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		reviews = append(reviews, r)
+	}
+	return reviews, total, rows.Err()
+}
+
+func (s pgReviewStore) SetHidden(ctx context.Context, id string, hidden bool) (Review, error) {
+	return scanReview(s.db.QueryRowContext(ctx, `UPDATE reviews SET hidden = $2 WHERE id = $1
+		RETURNING `+reviewColumns, id, hidden))
+}
+
+func (s pgReviewStore) Summaries(ctx context.Context, productIDs []string) (map[string]RatingSummary, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT product_id, avg(rating), count(*) FROM reviews
+		WHERE product_id = ANY($1) AND NOT hidden GROUP BY product_id`, pq.Array(productIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := make(map[string]RatingSummary)
+	for rows.Next() {
+		var productID string
+		var summary RatingSummary
+		if err := rows.Scan(&productID, &summary.Average, &summary.Count); err != nil {
+			return nil, err
+		}
+		summaries[productID] = summary
+	}
+	return summaries, rows.Err()
+}
+
+type pgWishlistStore struct {
+	db *sql.DB
+}
+
+// queryWishlists loads the lists matching the given clause along with their items
+func queryWishlists(ctx context.Context, q queryer, clause string, args ...interface{}) ([]Wishlist, error) {
+	rows, err := q.QueryContext(ctx, `SELECT id, user_id, name, created_at, updated_at FROM wishlists `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []Wishlist{}
+	index := make(map[string]int)
+	var ids []string
+	for rows.Next() {
+		w := Wishlist{Items: []WishlistItem{}}
+		if err := rows.Scan(&w.ID, &w.UserID, &w.Name, &w.CreatedAt, &w.UpdatedAt); err != nil {
+			return nil, err
+		}
+		index[w.ID] = len(lists)
+		ids = append(ids, w.ID)
+		lists = append(lists, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if len(lists) == 0 {
+		return lists, nil
+	}
+
+	rows, err = q.QueryContext(ctx, `SELECT wishlist_id, product_id, sku, added_at FROM wishlist_items
+		WHERE wishlist_id = ANY($1) ORDER BY added_at, product_id, sku`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var item WishlistItem
+		if err := rows.Scan(&id, &item.ProductID, &item.SKU, &item.AddedAt); err != nil {
+			return nil, err
+		}
+		w := &lists[index[id]]
+		w.Items = append(w.Items, item)
+	}
+	return lists, rows.Err()
+}
+
+func (s pgWishlistStore) ListByUser(ctx context.Context, userID string) ([]Wishlist, error) {
+	return queryWishlists(ctx, s.db, `WHERE user_id = $1 ORDER BY created_at, id`, userID)
+}
+
+func (s pgWishlistStore) Get(ctx context.Context, id string) (Wishlist, error) {
+	return getWishlist(ctx, s.db, id, "")
+}
+
+func getWishlist(ctx context.Context, q queryer, id, lock string) (Wishlist, error) {
+	lists, err := queryWishlists(ctx, q, `WHERE id = $1 `+lock, id)
+	if err != nil {
+		return Wishlist{}, err
+	}
+	if len(lists) == 0 {
+		return Wishlist{}, ErrNotFound
+	}
+	return lists[0], nil
+}
+
+func (s pgWishlistStore) Create(ctx context.Context, w Wishlist) error {
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO wishlists (id, user_id, name, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5)`, w.ID, w.UserID, w.Name, w.CreatedAt, w.UpdatedAt)
+		if isUniqueViolation(err) {
+			return ErrWishlistExists
+		}
+		if err != nil {
+			return err
+		}
+		return saveWishlistItems(ctx, tx, w)
+	})
+}
+
+func (s pgWishlistStore) Update(ctx context.Context, id string, fn func(w *Wishlist) error) (Wishlist, error) {
+	var w Wishlist
+	err := withTx(ctx, s.db, func(tx *sql.Tx) error {
+		var err error
+		w, err = getWishlist(ctx, tx, id, "FOR UPDATE")
+		if err != nil {
+			return err
+		}
+		if err := fn(&w); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE wishlists SET name = $2, updated_at = $3 WHERE id = $1`,
+			w.ID, w.Name, w.UpdatedAt)
+		if isUniqueViolation(err) {
+			return ErrWishlistExists
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM wishlist_items WHERE wishlist_id = $1`, w.ID); err != nil {
+			return err
+		}
+		return saveWishlistItems(ctx, tx, w)
+	})
+	if err != nil {
+		return Wishlist{}, err
+	}
+	return w, nil
+}
+
+// saveWishlistItems inserts the list's items
+func saveWishlistItems(ctx context.Context, tx *sql.Tx, w Wishlist) error {
+	for _, item := range w.Items {
+		_, err := tx.ExecContext(ctx, `INSERT INTO wishlist_items (wishlist_id, product_id, sku, added_at)
+			VALUES ($1, $2, $3, $4)`, w.ID, item.ProductID, item.SKU, item.AddedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s pgWishlistStore) Delete(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM wishlists WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type pgSubscriptionStore struct {
+	db *sql.DB
+}
+
+const subscriptionColumns = `id, user_id, product_id, sku, type, channel, destination, price, created_at, notified_at`
+
+func (s pgSubscriptionStore) query(ctx context.Context, clause string, args ...interface{}) ([]Subscription, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+subscriptionColumns+` FROM subscriptions `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []Subscription{}
+	for rows.Next() {
+		var sub Subscription
+		err := rows.Scan(&sub.ID, &sub.UserID, &sub.ProductID, &sub.SKU, &sub.Type, &sub.Channel,
+			&sub.Destination, &sub.Price, &sub.CreatedAt, &sub.NotifiedAt)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s pgSubscriptionStore) Create(ctx context.Context, sub Subscription) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO subscriptions (`+subscriptionColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		sub.ID, sub.UserID, sub.ProductID, sub.SKU, sub.Type, sub.Channel, sub.Destination, sub.Price,
+		sub.CreatedAt, sub.NotifiedAt)
+	if isUniqueViolation(err) {
+		return ErrAlreadySubscribed
+	}
+	return err
+}
+
+func (s pgSubscriptionStore) Get(ctx context.Context, id string) (Subscription, error) {
+	subs, err := s.query(ctx, `WHERE id = $1`, id)
+	if err != nil {
+		return Subscription{}, err
+	}
+	if len(subs) == 0 {
+		return Subscription{}, ErrNotFound
+	}
+	return subs[0], nil
+}
+
+func (s pgSubscriptionStore) ListByUser(ctx context.Context, userID string) ([]Subscription, error) {
+	return s.query(ctx, `WHERE user_id = $1 AND notified_at IS NULL ORDER BY created_at DESC, id`, userID)
+}
+
+func (s pgSubscriptionStore) ListActive(ctx context.Context, productIDs []string) ([]Subscription, error) {
+	if productIDs == nil {
+		return s.query(ctx, `WHERE notified_at IS NULL ORDER BY created_at, id`)
+	}
+	return s.query(ctx, `WHERE notified_at IS NULL AND product_id = ANY($1) ORDER BY created_at, id`,
+		pq.Array(productIDs))
+}
+
+func (s pgSubscriptionStore) Claim(ctx context.Context, id string, t time.Time) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE subscriptions SET notified_at = $2
+		WHERE id = $1 AND notified_at IS NULL`, id, t)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s pgSubscriptionStore) Release(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE subscriptions SET notified_at = NULL WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s pgSubscriptionStore) Delete(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type pgAbandonedCartStore struct {
+	db *sql.DB
+}
+
+const abandonedCartColumns = `id, user_id, abandoned_at, items, total, reminders_sent, order_id, recovered_at, expired_at`
+
+func (s pgAbandonedCartStore) query(ctx context.Context, clause string, args ...interface{}) ([]AbandonedCart, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+abandonedCartColumns+` FROM abandoned_carts `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	carts := []AbandonedCart{}
+	for rows.Next() {
+		var cart AbandonedCart
+		err := rows.Scan(&cart.ID, &cart.UserID, &cart.AbandonedAt, &cart.Items, &cart.Total,
+			&cart.RemindersSent, &cart.OrderID, &cart.RecoveredAt, &cart.ExpiredAt)
+		if err != nil {
+			return nil, err
+		}
+		carts = append(carts, cart)
+	}
+	return carts, rows.Err()
+}
+
+func (s pgAbandonedCartStore) Open(ctx context.Context, cart AbandonedCart) (AbandonedCart, error) {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO abandoned_carts (`+abandonedCartColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (user_id, abandoned_at) DO NOTHING`,
+		cart.ID, cart.UserID, cart.AbandonedAt, cart.Items, cart.Total, cart.RemindersSent, cart.OrderID,
+		cart.RecoveredAt, cart.ExpiredAt)
+	if err != nil {
+		return AbandonedCart{}, err
+	}
+	carts, err := s.query(ctx, `WHERE user_id = $1 AND abandoned_at = $2`, cart.UserID, cart.AbandonedAt)
+	if err != nil {
+		return AbandonedCart{}, err
+	}
+	if len(carts) == 0 {
+		return AbandonedCart{}, ErrNotFound
+	}
+	return carts[0], nil
+}
+
+func (s pgAbandonedCartStore) ClaimReminder(ctx context.Context, id string, sent, due int) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `UPDATE abandoned_carts SET reminders_sent = $3
+		WHERE id = $1 AND reminders_sent = $2 AND recovered_at IS NULL AND expired_at IS NULL`, id, sent, due)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s pgAbandonedCartStore) ReleaseReminder(ctx context.Context, id string, sent, due int) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE abandoned_carts SET reminders_sent = $2
+		WHERE id = $1 AND reminders_sent = $3`, id, sent, due)
+	return err
+}
+
+func (s pgAbandonedCartStore) Recover(ctx context.Context, userID, orderID string, t time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE abandoned_carts SET order_id = $2, recovered_at = $3
+		WHERE id = (
+			SELECT id FROM abandoned_carts
+			WHERE user_id = $1 AND abandoned_at <= $3 AND recovered_at IS NULL AND expired_at IS NULL
+			ORDER BY abandoned_at DESC LIMIT 1
+		) AND recovered_at IS NULL`, userID, orderID, t)
+	return err
+}
+
+func (s pgAbandonedCartStore) Expire(ctx context.Context, userID string, abandonedAt, t time.Time) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE abandoned_carts SET expired_at = $3
+		WHERE user_id = $1 AND abandoned_at = $2 AND recovered_at IS NULL AND expired_at IS NULL`,
+		userID, abandonedAt, t)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s pgAbandonedCartStore) ListSince(ctx context.Context, since time.Time) ([]AbandonedCart, error) {
+	return s.query(ctx, `WHERE abandoned_at >= $1 ORDER BY abandoned_at, id`, since)
+}
+
+type pgDiscountStore struct {
+	db *sql.DB
+}
+
+const discountColumns = `id, name, code, categories, product_ids, min_subtotal, first_order, usage_limit,
+	per_user_limit, starts_at, ends_at, action, value, buy_quantity, get_quantity, archived_at, created_at`
+
+func (s pgDiscountStore) Create(ctx context.Context, d Discount) error {
+	cond, a := d.Conditions, d.Action
+	_, err := s.db.ExecContext(ctx, `INSERT INTO discounts (`+discountColumns+`)
+		VALUES ($1, $2, $3, COALESCE($4::text[], '{}'), COALESCE($5::text[], '{}'), $6, $7, $8, $9, $10, $11,
+			$12, $13, $14, $15, $16, $17)`,
+		d.ID, d.Name, d.Code, pq.Array(cond.Categories), pq.Array(cond.ProductIDs), cond.MinSubtotal,
+		cond.FirstOrder, cond.UsageLimit, cond.PerUserLimit, cond.StartsAt, cond.EndsAt,
+		a.Type, a.Value, a.Buy, a.Get, d.ArchivedAt, d.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrDiscountExists
+	}
+	return err
+}
+
+func (s pgDiscountStore) query(ctx context.Context, clause string, args ...interface{}) ([]Discount, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+discountColumns+`,
+		(SELECT count(*) FROM discount_redemptions r WHERE r.discount_id = discounts.id)
+		FROM discounts `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	discounts := []Discount{}
+	for rows.Next() {
+		var d Discount
+		cond, a := &d.Conditions, &d.Action
+		err := rows.Scan(&d.ID, &d.Name, &d.Code, pq.Array(&cond.Categories), pq.Array(&cond.ProductIDs),
+			&cond.MinSubtotal, &cond.FirstOrder, &cond.UsageLimit, &cond.PerUserLimit, &cond.StartsAt,
+			&cond.EndsAt, &a.Type, &a.Value, &a.Buy, &a.Get, &d.ArchivedAt, &d.CreatedAt, &d.Redemptions)
+		if err != nil {
+			return nil, err
+		}
+		discounts = append(discounts, d)
+	}
+	return discounts, rows.Err()
+}
+
+func (s pgDiscountStore) one(ctx context.Context, clause string, args ...interface{}) (Discount, error) {
+	discounts, err := s.query(ctx, clause, args...)
+	if err != nil {
+		return Discount{}, err
+	}
+	if len(discounts) == 0 {
+		return Discount{}, ErrNotFound
+	}
+	return discounts[0], nil
+}
+
+func (s pgDiscountStore) Get(ctx context.Context, id string) (Discount, error) {
+	return s.one(ctx, `WHERE id = $1`, id)
+}
+
+func (s pgDiscountStore) GetByCode(ctx context.Context, code string) (Discount, error) {
+	return s.one(ctx, `WHERE code = $1 AND code <> '' AND archived_at IS NULL`, code)
+}
+
+func (s pgDiscountStore) List(ctx context.Context) ([]Discount, error) {
+	return s.query(ctx, `ORDER BY created_at DESC, id`)
+}
+
+func (s pgDiscountStore) Automatic(ctx context.Context, t time.Time) ([]Discount, error) {
+	return s.query(ctx, `WHERE code = '' AND archived_at IS NULL
+		AND (starts_at IS NULL OR starts_at <= $1) AND (ends_at IS NULL OR ends_at > $1)
+		ORDER BY created_at, id`, t)
+}
+
+func (s pgDiscountStore) Archive(ctx context.Context, id string, t time.Time) (Discount, error) {
+	_, err := s.db.ExecContext(ctx, `UPDATE discounts SET archived_at = $2 WHERE id = $1 AND archived_at IS NULL`, id, t)
+	if err != nil {
+		return Discount{}, err
+	}
+	return s.Get(ctx, id)
+}
+
+func (s pgDiscountStore) Usage(ctx context.Context, id, userID string) (int, int, error) {
+	var used, usedByUser int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*), count(*) FILTER (WHERE user_id = $2)
+		FROM discount_redemptions WHERE discount_id = $1`, id, userID).Scan(&used, &usedByUser)
+	return used, usedByUser, err
+}
+
+func (s pgDiscountStore) Redeem(ctx context.Context, id, orderID, userID string, t time.Time) error {
+	return withTx(ctx, s.db, func(tx *sql.Tx) error {
+		// Lock the discount so concurrent redemptions are counted one at a time
+		var cond DiscountConditions
+		err := tx.QueryRowContext(ctx, `SELECT usage_limit, per_user_limit, first_order FROM discounts WHERE id = $1 FOR UPDATE`, id).
+			Scan(&cond.UsageLimit, &cond.PerUserLimit, &cond.FirstOrder)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		limit, perUser := cond.UsageLimit, cond.userLimit()
+		var used, usedByUser int
+		err = tx.QueryRowContext(ctx, `SELECT count(*), count(*) FILTER (WHERE user_id = $2)
+			FROM discount_redemptions WHERE discount_id = $1 AND order_id <> $3`, id, userID, orderID).
+			Scan(&used, &usedByUser)
+		if err != nil {
+			return err
+		}
+		if (limit > 0 && used >= limit) || (perUser > 0 && usedByUser >= perUser) {
+			return ErrDiscountUsedUp
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO discount_redemptions (discount_id, order_id, user_id, redeemed_at)
+			VALUES ($1, $2, $3, $4) ON CONFLICT (discount_id, order_id) DO NOTHING`, id, orderID, userID, t)
+		return err
+	})
+}
+
+func (s pgDiscountStore) Release(ctx context.Context, orderID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM discount_redemptions WHERE order_id = $1`, orderID)
+	return err
+}
@@ -0,0 +1,403 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ecommerce/migrations"
+
+	"github.com/google/uuid"
+)
+
+// newPostgresStore returns a store on a schema of its own in the database
+// named by DATABASE_URL, migrated to the latest version and dropped when the
+// test ends. The test is skipped when DATABASE_URL is not set.
+func newPostgresStore(t *testing.T) *Store {
+	t.Helper()
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	ctx := context.Background()
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	if _, err := admin.ExecContext(ctx, `CREATE SCHEMA `+schema); err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+
+	// Every connection in the pool must see only the test's schema
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		if _, err := admin.ExecContext(ctx, `DROP SCHEMA `+schema+` CASCADE`); err != nil {
+			t.Errorf("dropping %s: %v", schema, err)
+		}
+		admin.Close()
+	})
+
+	migrator, err := migrations.New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return NewPostgresStore(db)
+}
+
+// testStores runs fn against the in-memory store and, when DATABASE_URL is
+// set, the PostgreSQL one, so both are held to the same behaviour
+func testStores(t *testing.T, fn func(t *testing.T, s *Store)) {
+	t.Helper()
+	for name, open := range map[string]func(t *testing.T) *Store{
+		"memory":   func(t *testing.T) *Store { return NewMemoryStore() },
+		"postgres": newPostgresStore,
+	} {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			SetStore(s)
+			fn(t, s)
+		})
+	}
+}
+
+// saveProducts saves products in order, a second apart so that the newest
+// is the last
+func saveProducts(t *testing.T, s *Store, products ...Product) {
+	t.Helper()
+	created := time.Now().Add(-time.Hour)
+	for i, p := range products {
+		p.CreatedAt = created.Add(time.Duration(i) * time.Second)
+		if err := s.Products.Save(context.Background(), p); err != nil {
+			t.Fatalf("saving %s: %v", p.ID, err)
+		}
+	}
+}
+
+func TestStoreSearch(t *testing.T) {
+	testStores(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		archived := time.Now()
+		saveProducts(t, s,
+			Product{ID: "whisky", Name: "Macallan 18", Category: "single-malt", Price: 300, Stock: 5,
+				Attributes: Attributes{Country: "Scotland", ABV: floatPtr(43)}},
+			Product{ID: "blend", Name: "Chivas 12", Category: "blended", Price: 60, Stock: 0,
+				Attributes: Attributes{Country: "Scotland", ABV: floatPtr(40)}},
+			Product{ID: "rum", Name: "Rum 100% Agricole", Category: "rum", Price: 45, Stock: 3,
+				Attributes: Attributes{Country: "Martinique", ABV: floatPtr(50)}},
+			Product{ID: "gin", Name: "Gin 100 Proof", Category: "gin", Price: 40, Stock: 2,
+				Attributes: Attributes{Country: "England", ABV: floatPtr(50)}},
+			Product{ID: "old", Name: "Old Pulteney", Category: "single-malt", Price: 50, Stock: 9, ArchivedAt: &archived},
+			// Sold out because the blend is
+			Product{ID: "gift", Name: "Gift set", Category: "gifts", Price: 350, Bundle: []BundleItem{
+				{ProductID: "whisky", Quantity: 1}, {ProductID: "blend", Quantity: 1},
+			}},
+		)
+
+		whiskies := []string{"whisky", "single-malt", "blended"}
+		for _, tt := range []struct {
+			name  string
+			query ProductQuery
+			want  string
+			total int
+		}{
+			{"newest first", ProductQuery{}, "gift gin rum blend whisky", 5},
+			// The percent sign is matched literally rather than as a wildcard
+			{"wildcard in the search", ProductQuery{Search: "100%"}, "rum", 1},
+			{"search in another case", ProductQuery{Search: "MACALLAN"}, "whisky", 1},
+			{"category and its children", ProductQuery{Category: "whisky", Categories: whiskies, Sort: SortNameAsc}, "blend whisky", 2},
+			{"archived included", ProductQuery{Category: "whisky", Categories: whiskies, IncludeArchived: true, Sort: SortNameAsc}, "blend whisky old", 3},
+			{"in stock", ProductQuery{InStock: true, Sort: SortNameAsc}, "gin whisky rum", 3},
+			// The whisky's sale brings it under the limit and the rum's takes it over
+			{"price limit on sale prices", ProductQuery{
+				MaxPrice: floatPtr(50), Sort: SortPriceAsc, SalePrices: map[string]float64{"whisky": 45, "rum": 55},
+			}, "gin whisky", 2},
+			{"price range", ProductQuery{MinPrice: floatPtr(45), MaxPrice: floatPtr(60), Sort: SortPriceAsc}, "rum blend", 2},
+			{"sale price sort breaking ties by id", ProductQuery{
+				Sort: SortPriceDesc, SalePrices: map[string]float64{"whisky": 45},
+			}, "gift blend rum whisky gin", 5},
+			{"attributes", ProductQuery{
+				Attributes: AttributeFilter{Countries: []string{"scotland"}, ABVBands: []string{"40-50"}}, Sort: SortNameAsc,
+			}, "blend whisky", 2},
+			// Bands take in their lower bound but not their upper one
+			{"abv band", ProductQuery{
+				Attributes: AttributeFilter{ABVBands: []string{"50-100"}}, Sort: SortNameAsc,
+			}, "gin rum", 2},
+			{"page", ProductQuery{Sort: SortNameAsc, Offset: 1, Limit: 2}, "gift gin", 5},
+			{"page past the end", ProductQuery{Sort: SortNameAsc, Offset: 5, Limit: 2}, "", 5},
+		} {
+			products, total, err := s.Products.Search(ctx, tt.query)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			var ids []string
+			for _, p := range products {
+				ids = append(ids, p.ID)
+			}
+			if got := strings.Join(ids, " "); got != tt.want || total != tt.total {
+				t.Errorf("%s: found %q of %d, want %q of %d", tt.name, got, total, tt.want, tt.total)
+			}
+		}
+	})
+}
+
+func TestStoreAdjustStocks(t *testing.T) {
+	testStores(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		saveProducts(t, s,
+			Product{ID: "vodka", Name: "Grey Goose", Price: 49.99, Stock: 5},
+			Product{ID: "tonic", Name: "Fever-Tree", Price: 2.99, Stock: 100},
+		)
+		stockOf := func(id string) int {
+			t.Helper()
+			p, err := s.Products.Get(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return p.Stock
+		}
+
+		// A shortage in one line leaves every line untouched
+		err := s.Products.AdjustStocks(ctx, []StockChange{{ProductID: "tonic", Delta: -1}, {ProductID: "vodka", Delta: -6}})
+		if !errors.Is(err, ErrInsufficientStock) {
+			t.Fatalf("overselling returned %v, want %v", err, ErrInsufficientStock)
+		}
+		if stockOf("vodka") != 5 || stockOf("tonic") != 100 {
+			t.Fatal("the failed adjustment changed stock")
+		}
+		err = s.Products.AdjustStocks(ctx, []StockChange{{ProductID: "vodka", Delta: -1}, {ProductID: "rum", Delta: -1}})
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("adjusting an unknown product returned %v, want %v", err, ErrNotFound)
+		}
+
+		// Checkouts listing the products in either order sell exactly the
+		// five bottles, without deadlocking
+		var sold int32
+		parallel(t, 20, func(i int) error {
+			changes := []StockChange{{ProductID: "vodka", Delta: -1}, {ProductID: "tonic", Delta: -1}}
+			if i%2 == 1 {
+				changes[0], changes[1] = changes[1], changes[0]
+			}
+			err := s.Products.AdjustStocks(ctx, changes)
+			if errors.Is(err, ErrInsufficientStock) {
+				return nil
+			}
+			if err == nil {
+				atomic.AddInt32(&sold, 1)
+			}
+			return err
+		})
+		if sold != 5 || stockOf("vodka") != 0 || stockOf("tonic") != 95 {
+			t.Fatalf("sold %d, leaving %d vodka and %d tonic", sold, stockOf("vodka"), stockOf("tonic"))
+		}
+	})
+}
+
+func TestStoreCartUpdate(t *testing.T) {
+	testStores(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+
+		// The first update creates the cart
+		cart, err := s.Carts.Update(ctx, "user-1", func(cart *Cart) error {
+			cart.Items = append(cart.Items, CartItem{ProductID: "whisky", Name: "Macallan 18", Price: 299.99, Quantity: 1})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cart.UserID != "user-1" || len(cart.Items) != 1 {
+			t.Fatalf("first update returned %+v", cart)
+		}
+
+		// A failed update saves nothing
+		errRefused := errors.New("refused")
+		cart, err = s.Carts.Update(ctx, "user-1", func(cart *Cart) error {
+			cart.Items = nil
+			cart.CouponCode = "SAVE10"
+			return errRefused
+		})
+		if !errors.Is(err, errRefused) || cart != nil {
+			t.Fatalf("failed update returned %+v, %v", cart, err)
+		}
+		if cart, err := s.Carts.Get(ctx, "user-1"); err != nil || len(cart.Items) != 1 || cart.CouponCode != "" {
+			t.Fatalf("cart after the failed update is %+v (%v)", cart, err)
+		}
+
+		// Concurrent updates each see the one before
+		parallel(t, 20, func(i int) error {
+			_, err := s.Carts.Update(ctx, "user-1", func(cart *Cart) error {
+				cart.Items[0].Quantity++
+				return nil
+			})
+			return err
+		})
+		cart, err = s.Carts.Get(ctx, "user-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cart.Items[0].Quantity != 21 {
+			t.Fatalf("quantity is %d after 20 increments of 1, want 21", cart.Items[0].Quantity)
+		}
+	})
+}
+
+func TestStoreDiscountRedeem(t *testing.T) {
+	testStores(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		now := time.Now()
+		for id, cond := range map[string]DiscountConditions{
+			"twice":      {UsageLimit: 2},
+			"once-each":  {PerUserLimit: 1},
+			"welcome":    {FirstOrder: true, PerUserLimit: 3},
+			"flash-sale": {UsageLimit: 3},
+		} {
+			err := s.Discounts.Create(ctx, Discount{
+				ID: id, Name: id, Conditions: cond, Action: DiscountAction{Type: DiscountPercent, Value: 10}, CreatedAt: now,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, tt := range []struct {
+			discount string
+			order    string
+			user     string
+			err      error
+		}{
+			{"twice", "order-1", "user-1", nil},
+			// Redeeming again for the same order counts once
+			{"twice", "order-1", "user-1", nil},
+			{"twice", "order-2", "user-2", nil},
+			{"twice", "order-3", "user-3", ErrDiscountUsedUp},
+			{"once-each", "order-1", "user-1", nil},
+			{"once-each", "order-4", "user-1", ErrDiscountUsedUp},
+			{"once-each", "order-2", "user-2", nil},
+			// A first order discount is once per customer whatever its limit
+			{"welcome", "order-1", "user-1", nil},
+			{"welcome", "order-4", "user-1", ErrDiscountUsedUp},
+			{"unknown", "order-1", "user-1", ErrNotFound},
+		} {
+			err := s.Discounts.Redeem(ctx, tt.discount, tt.order, tt.user, now)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("redeeming %s for %s returned %v, want %v", tt.discount, tt.order, err, tt.err)
+			}
+		}
+		if used, byUser, err := s.Discounts.Usage(ctx, "twice", "user-1"); err != nil || used != 2 || byUser != 1 {
+			t.Fatalf("twice used %d times, %d by user-1 (%v), want 2 and 1", used, byUser, err)
+		}
+
+		// Releasing a cancelled order's redemptions frees their places
+		if err := s.Discounts.Release(ctx, "order-2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Discounts.Redeem(ctx, "twice", "order-3", "user-3", now); err != nil {
+			t.Fatalf("redeeming after the release: %v", err)
+		}
+
+		var redeemed int32
+		parallel(t, 20, func(i int) error {
+			err := s.Discounts.Redeem(ctx, "flash-sale", fmt.Sprintf("flash-%d", i), fmt.Sprintf("shopper-%d", i), now)
+			if errors.Is(err, ErrDiscountUsedUp) {
+				return nil
+			}
+			if err == nil {
+				atomic.AddInt32(&redeemed, 1)
+			}
+			return err
+		})
+		if used, _, err := s.Discounts.Usage(ctx, "flash-sale", ""); err != nil || redeemed != 3 || used != 3 {
+			t.Fatalf("%d of 20 concurrent redemptions succeeded and %d were recorded (%v), want 3", redeemed, used, err)
+		}
+	})
+}
+
+func TestStoreBundleStock(t *testing.T) {
+	testStores(t, func(t *testing.T, s *Store) {
+		ctx := context.Background()
+		archived := time.Now()
+		gin := ginVariants()
+		gin.Variants[0].Stock = 5
+		gin.syncVariants()
+		bundle := func(id string, items ...BundleItem) Product {
+			return Product{ID: id, Name: id, Price: 100, Bundle: items}
+		}
+		saveProducts(t, s,
+			Product{ID: "whisky", Name: "Macallan 18", Price: 299.99, Stock: 7},
+			gin,
+			Product{ID: "rum", Name: "Rum", Price: 29.99, Stock: 10, ArchivedAt: &archived},
+			bundle("pair", BundleItem{ProductID: "whisky", Quantity: 2}),
+			giftSet(),
+			bundle("with-rum", BundleItem{ProductID: "whisky", Quantity: 1}, BundleItem{ProductID: "rum", Quantity: 1}),
+			bundle("no-size", BundleItem{ProductID: "gin", Quantity: 1}),
+			bundle("litre", BundleItem{ProductID: "gin", SKU: "GIN-1L", Quantity: 1}),
+		)
+		check := func(when string, want map[string]int) {
+			t.Helper()
+			for id, stock := range want {
+				p, err := s.Products.Get(ctx, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.Stock != stock {
+					t.Errorf("%s: %s has stock %d, want %d", when, id, p.Stock, stock)
+				}
+			}
+		}
+
+		// Partial sets do not count, and components that cannot be sold
+		// leave none to sell
+		check("initially", map[string]int{
+			"pair": 3, "gift": 2, "with-rum": 0, "no-size": 0, "litre": 1, "whisky": 7,
+		})
+
+		// The bundles follow their components' stock and sizes
+		if _, err := s.Products.AdjustStock(ctx, "whisky", "", -6); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Products.Update(ctx, "gin", func(p *Product) error {
+			p.Variants = p.Variants[:1]
+			p.syncVariants()
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		check("after the changes", map[string]int{"pair": 0, "gift": 1, "litre": 0})
+
+		products, _, err := s.Products.Search(ctx, ProductQuery{InStock: true, Sort: SortNameAsc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, p := range products {
+			ids = append(ids, p.ID)
+		}
+		if got := strings.Join(ids, " "); got != "gift gin whisky" {
+			t.Errorf("in stock are %q, want the gift set, gin and whisky", got)
+		}
+	})
+}
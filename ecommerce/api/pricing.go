@@ -0,0 +1,510 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Promotion discount types: Value is a percentage off for DiscountPercent
+// and an amount off each unit for DiscountFixed
+const (
+	DiscountPercent = "percent"
+	DiscountFixed   = "fixed"
+)
+
+// ErrScheduleApplied is returned when cancelling a price change that has
+// already taken effect
+var ErrScheduleApplied = errors.New("price change has already been applied")
+
+// Promotion is a time-boxed sale on a product. An empty SKU applies it to
+// every variant. The sale runs from StartsAt until EndsAt.
+type Promotion struct {
+	ID        string    `json:"id"`
+	ProductID string    `json:"product_id"`
+	SKU       string    `json:"sku"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Value     float64   `json:"value"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PromotionRequest is the body of CreatePromotion. StartsAt defaults to now.
+type PromotionRequest struct {
+	SKU      string     `json:"sku"`
+	Name     string     `json:"name"`
+	Type     string     `json:"type" binding:"required,oneof=percent fixed"`
+	Value    float64    `json:"value" binding:"required,gt=0"`
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   time.Time  `json:"ends_at" binding:"required"`
+}
+
+// ScheduledPrice changes the regular price of a product SKU at EffectiveAt.
+// AppliedAt is set once the change has been made.
+type ScheduledPrice struct {
+	ID          string     `json:"id"`
+	ProductID   string     `json:"product_id"`
+	SKU         string     `json:"sku"`
+	Price       float64    `json:"price"`
+	EffectiveAt time.Time  `json:"effective_at"`
+	AppliedAt   *time.Time `json:"applied_at,omitempty"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// ScheduledPriceRequest is the body of CreateScheduledPrice
+type ScheduledPriceRequest struct {
+	SKU         string    `json:"sku"`
+	Price       float64   `json:"price" binding:"required,gt=0"`
+	EffectiveAt time.Time `json:"effective_at" binding:"required"`
+}
+
+// PriceChange is one entry in a product's regular price history
+type PriceChange struct {
+	ID        string    `json:"id"`
+	ProductID string    `json:"product_id"`
+	SKU       string    `json:"sku"`
+	OldPrice  float64   `json:"old_price"`
+	Price     float64   `json:"price"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason"`
+	Reference string    `json:"reference"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// PriceHistoryPage is one page of a product's price history
+type PriceHistoryPage struct {
+	Changes []PriceChange `json:"changes"`
+	Total   int           `json:"total"`
+	Page    int           `json:"page"`
+	Limit   int           `json:"limit"`
+	Pages   int           `json:"pages"`
+}
+
+// roundCents rounds an amount to the nearest cent
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// applies reports whether the promotion covers the SKU
+func (p Promotion) applies(sku string) bool {
+	return p.SKU == "" || p.SKU == sku
+}
+
+// discount returns the sale price of a unit at the given regular price, or
+// false if the promotion would not reduce it to a positive amount
+func (p Promotion) discount(price float64) (float64, bool) {
+	sale := price - p.Value
+	if p.Type == DiscountPercent {
+		sale = price * (100 - p.Value) / 100
+	}
+	sale = roundCents(sale)
+	return sale, sale > 0 && sale < price
+}
+
+// EffectivePrice returns what one unit of the SKU costs right now: its sale
+// price if attachPrices found an active promotion, otherwise its regular price
+func (p *Product) EffectivePrice(sku string) (float64, error) {
+	v, err := p.resolveSKU(sku)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case v == nil && p.SalePrice != nil:
+		return *p.SalePrice, nil
+	case v == nil:
+		return p.Price, nil
+	case v.SalePrice != nil:
+		return *v.SalePrice, nil
+	default:
+		return v.Price, nil
+	}
+}
+
+// attachPrices fills in the sale prices of products with a promotion active
+// at now. When several promotions cover a SKU the lowest price wins, and the
+// sale ends when the last promotion giving that price does. For
+// products with variants, SalePrice is set when a variant's sale brings the
+// "from" price down.
+func attachPrices(ctx context.Context, products []Product, now time.Time) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]string, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+	active, err := store.Promotions.Active(ctx, ids, now)
+	if err != nil {
+		return err
+	}
+
+	for i := range products {
+		p := &products[i]
+		promotions := active[p.ID]
+		if len(promotions) == 0 {
+			continue
+		}
+
+		best := func(sku string, price float64) (*float64, *time.Time) {
+			var sale *float64
+			var ends *time.Time
+			for _, promo := range promotions {
+				if !promo.applies(sku) {
+					continue
+				}
+				s, ok := promo.discount(price)
+				if !ok || (sale != nil && (s > *sale || (s == *sale && !promo.EndsAt.After(*ends)))) {
+					continue
+				}
+				e := promo.EndsAt
+				sale, ends = &s, &e
+			}
+			return sale, ends
+		}
+
+		if len(p.Variants) == 0 {
+			p.SalePrice, p.SaleEndsAt = best("", p.Price)
+			continue
+		}
+		for j := range p.Variants {
+			v := &p.Variants[j]
+			var ends *time.Time
+			v.SalePrice, ends = best(v.SKU, v.Price)
+			// The product is only on sale if a variant now costs less than
+			// the cheapest regular price
+			if v.SalePrice != nil && *v.SalePrice < p.Price && (p.SalePrice == nil || *v.SalePrice < *p.SalePrice) {
+				p.SalePrice, p.SaleEndsAt = v.SalePrice, ends
+			}
+		}
+	}
+	return nil
+}
+
+// salePrices returns the sale price at now of every product on sale, as
+// attachPrices sets it
+func salePrices(ctx context.Context, now time.Time) (map[string]float64, error) {
+	ids, err := store.Promotions.OnSale(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	products := make([]Product, 0, len(ids))
+	for _, id := range ids {
+		p, err := store.Products.Get(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	if err := attachPrices(ctx, products, now); err != nil {
+		return nil, err
+	}
+
+	sales := make(map[string]float64, len(products))
+	for _, p := range products {
+		if p.SalePrice != nil {
+			sales[p.ID] = *p.SalePrice
+		}
+	}
+	return sales, nil
+}
+
+// priceLevels returns the regular price of each SKU of a product, keyed like
+// stockLevels
+func priceLevels(p *Product) map[string]float64 {
+	if p == nil {
+		return nil
+	}
+	if len(p.Variants) == 0 {
+		return map[string]float64{"": p.Price}
+	}
+	prices := make(map[string]float64, len(p.Variants))
+	for _, v := range p.Variants {
+		prices[v.SKU] = v.Price
+	}
+	return prices
+}
+
+// diffPrices returns the price history entries for a product saved as
+// after, which was before (nil for a new product)
+func diffPrices(ctx context.Context, before, after *Product) []PriceChange {
+	src := movementSource(ctx)
+	old, prices := priceLevels(before), priceLevels(after)
+
+	skus := make([]string, 0, len(prices))
+	for sku := range prices {
+		skus = append(skus, sku)
+	}
+	sort.Strings(skus)
+
+	var changes []PriceChange
+	now := time.Now()
+	for _, sku := range skus {
+		if prices[sku] == old[sku] {
+			continue
+		}
+		changes = append(changes, PriceChange{
+			ID:        uuid.New().String(),
+			ProductID: after.ID,
+			SKU:       sku,
+			OldPrice:  old[sku],
+			Price:     prices[sku],
+			Actor:     src.Actor,
+			Reason:    src.Reason,
+			Reference: src.Reference,
+			ChangedAt: now,
+		})
+	}
+	return changes
+}
+
+// ApplyScheduledPrices makes every scheduled price change that is due at
+// now and returns the number applied
+func ApplyScheduledPrices(ctx context.Context, now time.Time) (int, error) {
+	due, err := store.PriceSchedules.Due(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, sp := range due {
+		ctx := WithMovement(ctx, MovementSource{
+			Actor:     sp.CreatedBy,
+			Reason:    "scheduled price change",
+			Reference: sp.ID,
+		})
+		_, err := store.Products.Update(ctx, sp.ProductID, func(p *Product) error {
+			v, err := p.resolveSKU(sp.SKU)
+			if err != nil {
+				return err
+			}
+			if v != nil {
+				v.Price = sp.Price
+			} else {
+				p.Price = sp.Price
+			}
+			p.syncVariants()
+			return nil
+		})
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnknownSKU) || errors.Is(err, ErrSKURequired) {
+			// The product or variant is gone; there is nothing left to reprice
+			AppLogger.Error.Printf("Skipping scheduled price %s: %v", sp.ID, err)
+		} else if err != nil {
+			return applied, err
+		} else {
+			notifySubscribers(sp.ProductID)
+		}
+		if err := store.PriceSchedules.MarkApplied(ctx, sp.ID, now); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// WatchPrices runs ApplyScheduledPrices every interval until ctx is done
+func WatchPrices(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := ApplyScheduledPrices(ctx, now)
+			if err != nil {
+				AppLogger.Error.Printf("Error applying scheduled prices: %v", err)
+			} else if n > 0 {
+				AppLogger.Info.Printf("Applied %d scheduled price change(s)", n)
+			}
+		}
+	}
+}
+
+// loadProductForPricing loads a product and checks sku against it, writing
+// the error response if either fails
+func loadProductForPricing(c *gin.Context, sku string) (Product, bool) {
+	product, err := store.Products.Get(c.Request.Context(), c.Param("id"))
+	if err == nil && sku != "" {
+		_, err = product.resolveSKU(sku)
+	}
+	if err != nil {
+		respondProduct(c, Product{}, err)
+		return Product{}, false
+	}
+	return product, true
+}
+
+// CreatePromotion puts a product, or one of its variants, on sale for a
+// limited time
+func CreatePromotion(c *gin.Context) {
+	var req PromotionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	product, ok := loadProductForPricing(c, req.SKU)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	promo := Promotion{
+		ID:        uuid.New().String(),
+		ProductID: product.ID,
+		SKU:       req.SKU,
+		Name:      req.Name,
+		Type:      req.Type,
+		Value:     req.Value,
+		StartsAt:  now,
+		EndsAt:    req.EndsAt,
+		CreatedAt: now,
+	}
+	if req.StartsAt != nil {
+		promo.StartsAt = *req.StartsAt
+	}
+	if !promo.EndsAt.After(promo.StartsAt) || !promo.EndsAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ends_at must be in the future and after starts_at"})
+		return
+	}
+	for sku, price := range priceLevels(&product) {
+		if !promo.applies(sku) {
+			continue
+		}
+		if _, ok := promo.discount(price); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Discount must leave a positive price below the regular price"})
+			return
+		}
+	}
+
+	if err := store.Promotions.Create(c.Request.Context(), promo); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save promotion"})
+		return
+	}
+	// Promotions starting later are picked up by the periodic sweep
+	notifySubscribers(promo.ProductID)
+	c.JSON(http.StatusCreated, promo)
+}
+
+// ListPromotions returns a product's promotions, including past and upcoming ones
+func ListPromotions(c *gin.Context) {
+	promotions, err := store.Promotions.List(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load promotions"})
+		return
+	}
+	c.JSON(http.StatusOK, promotions)
+}
+
+// DeletePromotion removes a promotion, ending the sale immediately
+func DeletePromotion(c *gin.Context) {
+	err := store.Promotions.Delete(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Promotion not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete promotion"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// CreateScheduledPrice schedules a change to the regular price of a product
+// or one of its variants
+func CreateScheduledPrice(c *gin.Context) {
+	var req ScheduledPriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	product, ok := loadProductForPricing(c, req.SKU)
+	if !ok {
+		return
+	}
+	if _, err := product.resolveSKU(req.SKU); err != nil {
+		respondProduct(c, product, err)
+		return
+	}
+	if !req.EffectiveAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "effective_at must be in the future"})
+		return
+	}
+
+	sp := ScheduledPrice{
+		ID:          uuid.New().String(),
+		ProductID:   product.ID,
+		SKU:         req.SKU,
+		Price:       roundCents(req.Price),
+		EffectiveAt: req.EffectiveAt,
+		CreatedBy:   GetUserFromContext(c),
+		CreatedAt:   time.Now(),
+	}
+	if err := store.PriceSchedules.Create(c.Request.Context(), sp); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save price change"})
+		return
+	}
+	c.JSON(http.StatusCreated, sp)
+}
+
+// ListScheduledPrices returns a product's scheduled price changes
+func ListScheduledPrices(c *gin.Context) {
+	schedule, err := store.PriceSchedules.List(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load scheduled prices"})
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+// DeleteScheduledPrice cancels a price change that has not taken effect yet
+func DeleteScheduledPrice(c *gin.Context) {
+	err := store.PriceSchedules.Delete(c.Request.Context(), c.Param("id"))
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled price not found"})
+	case errors.Is(err, ErrScheduleApplied):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete scheduled price"})
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// AdminPriceHistory returns a page of a product's regular price changes,
+// newest first
+func AdminPriceHistory(c *gin.Context) {
+	offset, limit, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := loadProductForPricing(c, ""); !ok {
+		return
+	}
+
+	changes, total, err := store.PriceHistory.ListByProduct(c.Request.Context(), c.Param("id"), offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load price history"})
+		return
+	}
+	c.JSON(http.StatusOK, PriceHistoryPage{
+		Changes: changes,
+		Total:   total,
+		Page:    offset/limit + 1,
+		Limit:   limit,
+		Pages:   pageCount(total, limit),
+	})
+}
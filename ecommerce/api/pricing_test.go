@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSalePriceWithOverlappingPromotions(t *testing.T) {
+	newTestServer(t)
+	ctx := context.Background()
+	now := time.Now()
+	seedProduct(t, Product{ID: "gin", Name: "Hendrick's", Price: 100, Stock: 5})
+	for _, promo := range []Promotion{
+		{ID: "short", Type: DiscountPercent, Value: 10, EndsAt: now.Add(time.Hour)},
+		{ID: "long", Type: DiscountFixed, Value: 20, EndsAt: now.Add(3 * time.Hour)},
+		{ID: "longer", Type: DiscountFixed, Value: 20, EndsAt: now.Add(5 * time.Hour)},
+	} {
+		promo.ProductID = "gin"
+		promo.StartsAt = now.Add(-time.Hour)
+		if err := store.Promotions.Create(ctx, promo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sale := func(at time.Time) (*float64, *time.Time) {
+		t.Helper()
+		p, err := store.Products.Get(ctx, "gin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		products := []Product{p}
+		if err := attachPrices(ctx, products, at); err != nil {
+			t.Fatal(err)
+		}
+		return products[0].SalePrice, products[0].SaleEndsAt
+	}
+	check := func(at time.Time, wantPrice float64, wantEnds time.Time) {
+		t.Helper()
+		price, ends := sale(at)
+		if price == nil || *price != wantPrice || ends == nil || !ends.Equal(wantEnds) {
+			t.Fatalf("at %v the sale is %v until %v, want %.2f until %v", at, price, ends, wantPrice, wantEnds)
+		}
+	}
+
+	// The lowest price holds until the last promotion giving it ends, even
+	// though a dearer promotion ends sooner
+	check(now, 80, now.Add(5*time.Hour))
+
+	// A scheduled change of the regular price moves the sale price with it
+	err := store.PriceSchedules.Create(ctx, ScheduledPrice{
+		ID: "rise", ProductID: "gin", Price: 150, EffectiveAt: now.Add(-time.Minute), CreatedAt: now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ApplyScheduledPrices(ctx, now); err != nil || n != 1 {
+		t.Fatalf("applied %d scheduled prices (%v), want 1", n, err)
+	}
+	check(now, 130, now.Add(5*time.Hour))
+	check(now.Add(4*time.Hour), 130, now.Add(5*time.Hour))
+
+	if price, ends := sale(now.Add(6 * time.Hour)); price != nil || ends != nil {
+		t.Fatalf("expected the sale to be over, got %v until %v", price, ends)
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ProfileUpdate changes the signed-in user's name or password. Changing the
+// password requires the current one.
+type ProfileUpdate struct {
+	Name            *string `json:"name"`
+	CurrentPassword string  `json:"current_password"`
+	NewPassword     string  `json:"new_password" binding:"omitempty,min=6"`
+}
+
+// profile is the public view of a user account
+func profile(user User) gin.H {
+	return gin.H{
+		"id":         user.ID,
+		"email":      user.Email,
+		"name":       user.Name,
+		"role":       user.Role,
+		"created_at": user.CreatedAt,
+	}
+}
+
+// loadProfileUser loads the signed-in user, writing an error response if
+// that fails
+func loadProfileUser(c *gin.Context) (User, bool) {
+	user, err := store.Users.Get(c.Request.Context(), GetUserFromContext(c))
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return User{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return User{}, false
+	}
+	return user, true
+}
+
+// GetProfile returns the signed-in user's account details
+func GetProfile(c *gin.Context) {
+	user, ok := loadProfileUser(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, profile(user))
+}
+
+// errWrongPassword is returned from a profile update whose current password
+// does not match
+var errWrongPassword = errors.New("current password is incorrect")
+
+// UpdateProfile applies a ProfileUpdate to the signed-in user's account
+func UpdateProfile(c *gin.Context) {
+	var update ProfileUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var name string
+	if update.Name != nil {
+		if name = strings.TrimSpace(*update.Name); name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+			return
+		}
+	}
+	var hashedPassword []byte
+	if update.NewPassword != "" {
+		var err error
+		if hashedPassword, err = bcrypt.GenerateFromPassword([]byte(update.NewPassword), bcrypt.DefaultCost); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+	}
+
+	// The password is checked against the stored user inside the update so
+	// that a concurrent change cannot be overwritten with stale fields
+	user, err := store.Users.Update(c.Request.Context(), GetUserFromContext(c), func(user *User) error {
+		if update.NewPassword != "" {
+			if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(update.CurrentPassword)); err != nil {
+				return errWrongPassword
+			}
+			user.Password = string(hashedPassword)
+		}
+		if name != "" {
+			user.Name = name
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, errWrongPassword):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
+	default:
+		c.JSON(http.StatusOK, profile(user))
+	}
+}
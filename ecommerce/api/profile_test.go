@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// seedUser adds a customer with the given password to the test server's store
+func seedUser(t *testing.T, id, password string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Users.Create(context.Background(), User{
+		ID: id, Email: id + "@example.com", Name: "Old Name", Password: string(hash), Role: RoleCustomer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	name := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		update   ProfileUpdate
+		code     int
+		wantName string
+		password string
+	}{
+		{
+			name:     "name only",
+			update:   ProfileUpdate{Name: name("  New Name ")},
+			code:     http.StatusOK,
+			wantName: "New Name",
+			password: "secret1",
+		},
+		{
+			name:     "blank name",
+			update:   ProfileUpdate{Name: name(" ")},
+			code:     http.StatusBadRequest,
+			wantName: "Old Name",
+			password: "secret1",
+		},
+		{
+			name:     "new password",
+			update:   ProfileUpdate{CurrentPassword: "secret1", NewPassword: "secret2"},
+			code:     http.StatusOK,
+			wantName: "Old Name",
+			password: "secret2",
+		},
+		{
+			name:     "wrong current password",
+			update:   ProfileUpdate{Name: name("New Name"), CurrentPassword: "guess", NewPassword: "secret2"},
+			code:     http.StatusUnauthorized,
+			wantName: "Old Name",
+			password: "secret1",
+		},
+		{
+			name:     "new password without current password",
+			update:   ProfileUpdate{NewPassword: "secret2"},
+			code:     http.StatusUnauthorized,
+			wantName: "Old Name",
+			password: "secret1",
+		},
+		{
+			name:     "short new password",
+			update:   ProfileUpdate{CurrentPassword: "secret1", NewPassword: "abc"},
+			code:     http.StatusBadRequest,
+			wantName: "Old Name",
+			password: "secret1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestServer(t)
+			seedUser(t, "user-1", "secret1")
+
+			code, err := do(r, "user-1", http.MethodPatch, "/api/v1/profile", tt.update, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.code {
+				t.Fatalf("update returned %d, want %d", code, tt.code)
+			}
+
+			var got map[string]interface{}
+			if _, err := do(r, "user-1", http.MethodGet, "/api/v1/profile", nil, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got["name"] != tt.wantName {
+				t.Errorf("name is %v, want %q", got["name"], tt.wantName)
+			}
+			if _, ok := got["password"]; ok {
+				t.Error("profile exposes the password hash")
+			}
+			user, err := store.Users.Get(context.Background(), "user-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(tt.password)) != nil {
+				t.Errorf("password is not %q", tt.password)
+			}
+		})
+	}
+}
+
+func TestGetProfileUnknownUser(t *testing.T) {
+	r := newTestServer(t)
+	code, err := do(r, "nobody", http.MethodGet, "/api/v1/profile", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Fatalf("profile of an unknown user returned %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestConcurrentProfileUpdates(t *testing.T) {
+	r := newTestServer(t)
+	name := "New Name"
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("user-%d", i)
+		seedUser(t, id, "secret1")
+
+		// Renaming must not put back the password hash read before the
+		// password change, nor the other way round
+		parallel(t, 2, func(n int) error {
+			update := ProfileUpdate{Name: &name}
+			if n == 1 {
+				update = ProfileUpdate{CurrentPassword: "secret1", NewPassword: "secret2"}
+			}
+			code, err := do(r, id, http.MethodPatch, "/api/v1/profile", update, nil)
+			if err == nil && code != http.StatusOK {
+				err = fmt.Errorf("update %+v returned %d", update, code)
+			}
+			return err
+		})
+		user, err := store.Users.Get(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Name != name || bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("secret2")) != nil {
+			t.Fatalf("%s lost an update: name %q", id, user.Name)
+		}
+	}
+
+	code, err := do(r, "nobody", http.MethodPatch, "/api/v1/profile", ProfileUpdate{Name: &name}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Fatalf("updating an unknown user returned %d, want %d", code, http.StatusNotFound)
+	}
+}
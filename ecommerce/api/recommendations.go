@@ -0,0 +1,357 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// recommendationWindow is how many days of orders recommendations learn from
+	recommendationWindow = 365
+	// minCoOccurrence is the number of orders (or customers) two products
+	// must share before one is recommended for the other
+	minCoOccurrence        = 2
+	defaultRecommendations = 4
+	maxRecommendations     = 20
+)
+
+// Recommendations are the products suggested alongside a product or cart.
+// Either list is topped up with bestsellers from the same category when
+// there are too few orders to learn from.
+type Recommendations struct {
+	// FrequentlyBoughtTogether holds products found in the same orders
+	FrequentlyBoughtTogether []Product `json:"frequently_bought_together"`
+	// CustomersAlsoBought holds products bought, in any order, by customers
+	// who bought the same products
+	CustomersAlsoBought []Product `json:"customers_also_bought"`
+}
+
+// recommendationIndex holds co-occurrence counts learnt from past orders
+type recommendationIndex struct {
+	// together counts the orders holding both products
+	together map[string]map[string]int
+	// customers counts the customers who bought both products
+	customers map[string]map[string]int
+	// sold counts units sold, ranking bestsellers and breaking ties
+	sold map[string]int
+}
+
+// recommendations is the index served to requests, replaced wholesale by
+// RefreshRecommendations
+var recommendations struct {
+	mu    sync.RWMutex
+	index *recommendationIndex
+}
+
+// countPairs adds one to the count of every ordered pair of distinct products
+func countPairs(counts map[string]map[string]int, products map[string]bool) {
+	for a := range products {
+		for b := range products {
+			if a == b {
+				continue
+			}
+			if counts[a] == nil {
+				counts[a] = make(map[string]int)
+			}
+			counts[a][b]++
+		}
+	}
+}
+
+// buildRecommendationIndex learns co-occurrence from the orders placed in
+// the window before now
+func buildRecommendationIndex(ctx context.Context, now time.Time) (*recommendationIndex, error) {
+	orders, err := store.Orders.ListSince(ctx, now.AddDate(0, 0, -recommendationWindow))
+	if err != nil {
+		return nil, err
+	}
+
+	index := &recommendationIndex{
+		together:  make(map[string]map[string]int),
+		customers: make(map[string]map[string]int),
+		sold:      make(map[string]int),
+	}
+	bought := make(map[string]map[string]bool)
+	for _, order := range orders {
+		products := make(map[string]bool, len(order.Items))
+		for _, item := range order.Items {
+			products[item.ID] = true
+			index.sold[item.ID] += item.Quantity
+		}
+		countPairs(index.together, products)
+
+		if bought[order.UserID] == nil {
+			bought[order.UserID] = make(map[string]bool)
+		}
+		for id := range products {
+			bought[order.UserID][id] = true
+		}
+	}
+	for _, products := range bought {
+		countPairs(index.customers, products)
+	}
+	return index, nil
+}
+
+// RefreshRecommendations rebuilds the recommendation index from recent orders
+func RefreshRecommendations(ctx context.Context, now time.Time) error {
+	index, err := buildRecommendationIndex(ctx, now)
+	if err != nil {
+		return err
+	}
+	recommendations.mu.Lock()
+	recommendations.index = index
+	recommendations.mu.Unlock()
+	return nil
+}
+
+// WatchRecommendations refreshes the recommendation index now and then every
+// interval until ctx is done
+func WatchRecommendations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := time.Now(); ; {
+		if err := RefreshRecommendations(ctx, now); err != nil {
+			AppLogger.Error.Printf("Error refreshing recommendations: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
+
+// currentRecommendationIndex returns the served index, building it on first
+// use if the background refresh has not run yet
+func currentRecommendationIndex(ctx context.Context) (*recommendationIndex, error) {
+	recommendations.mu.RLock()
+	index := recommendations.index
+	recommendations.mu.RUnlock()
+	if index != nil {
+		return index, nil
+	}
+	if err := RefreshRecommendations(ctx, time.Now()); err != nil {
+		return nil, err
+	}
+	recommendations.mu.RLock()
+	defer recommendations.mu.RUnlock()
+	return recommendations.index, nil
+}
+
+// recommender picks recommendations for a set of seed products from a
+// snapshot of the catalog
+type recommender struct {
+	index    *recommendationIndex
+	products map[string]Product
+	// exclude holds the seeds and products already recommended
+	exclude map[string]bool
+	limit   int
+}
+
+// available reports whether a product can be recommended
+func (r *recommender) available(id string) bool {
+	p, ok := r.products[id]
+	return ok && !r.exclude[id] && p.ArchivedAt == nil && p.Stock > 0
+}
+
+// rank returns up to limit products that co-occur with the seeds at least
+// minCoOccurrence times, by total count, then sales
+func (r *recommender) rank(counts map[string]map[string]int, seeds []string) []string {
+	scores := make(map[string]int)
+	for _, seed := range seeds {
+		for id, n := range counts[seed] {
+			scores[id] += n
+		}
+	}
+	var ids []string
+	for id, score := range scores {
+		if score >= minCoOccurrence && r.available(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		if r.index.sold[a] != r.index.sold[b] {
+			return r.index.sold[a] > r.index.sold[b]
+		}
+		return a < b
+	})
+	if len(ids) > r.limit {
+		ids = ids[:r.limit]
+	}
+	return ids
+}
+
+// bestsellers returns up to n of the best-selling products in the seeds'
+// categories
+func (r *recommender) bestsellers(seeds []string, n int) []string {
+	categories := make(map[string]bool)
+	for _, seed := range seeds {
+		if p, ok := r.products[seed]; ok && p.Category != "" {
+			categories[p.Category] = true
+		}
+	}
+	var ids []string
+	for id, p := range r.products {
+		if categories[p.Category] && r.available(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if r.index.sold[a] != r.index.sold[b] {
+			return r.index.sold[a] > r.index.sold[b]
+		}
+		return a < b
+	})
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// pick ranks products by counts and tops the list up with bestsellers
+func (r *recommender) pick(counts map[string]map[string]int, seeds []string) []Product {
+	ids := r.rank(counts, seeds)
+	for _, id := range ids {
+		r.exclude[id] = true
+	}
+	for _, id := range r.bestsellers(seeds, r.limit-len(ids)) {
+		r.exclude[id] = true
+		ids = append(ids, id)
+	}
+
+	products := make([]Product, len(ids))
+	for i, id := range ids {
+		products[i] = r.products[id]
+	}
+	return products
+}
+
+// recommend builds both recommendation lists for the seed products
+func recommend(ctx context.Context, seeds []string, limit int) (Recommendations, error) {
+	index, err := currentRecommendationIndex(ctx)
+	if err != nil {
+		return Recommendations{}, err
+	}
+	productList, err := store.Products.List(ctx)
+	if err != nil {
+		return Recommendations{}, err
+	}
+
+	r := &recommender{
+		index:    index,
+		products: make(map[string]Product, len(productList)),
+		exclude:  make(map[string]bool, len(seeds)),
+		limit:    limit,
+	}
+	for _, p := range productList {
+		r.products[p.ID] = p
+	}
+	for _, seed := range seeds {
+		r.exclude[seed] = true
+	}
+
+	result := Recommendations{
+		FrequentlyBoughtTogether: r.pick(index.together, seeds),
+		CustomersAlsoBought:      r.pick(index.customers, seeds),
+	}
+	for _, products := range [][]Product{result.FrequentlyBoughtTogether, result.CustomersAlsoBought} {
+		if err := attachRatings(ctx, products); err != nil {
+			return Recommendations{}, err
+		}
+		if err := attachPrices(ctx, products, time.Now()); err != nil {
+			return Recommendations{}, err
+		}
+	}
+	return result, nil
+}
+
+// parseRecommendationLimit reads the limit query parameter
+func parseRecommendationLimit(c *gin.Context) (int, error) {
+	v := c.Query("limit")
+	if v == "" {
+		return defaultRecommendations, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxRecommendations {
+		return 0, errors.New("limit must be between 1 and 20")
+	}
+	return n, nil
+}
+
+// GetRecommendations suggests products to buy with a product, up to ?limit=
+// per list (default 4)
+func GetRecommendations(c *gin.Context) {
+	limit, err := parseRecommendationLimit(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	product, err := store.Products.Get(ctx, c.Param("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && product.ArchivedAt != nil) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load product"})
+		return
+	}
+
+	result, err := recommend(ctx, []string{product.ID}, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load recommendations"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetCartRecommendations suggests products to add to the user's cart based
+// on everything already in it
+func GetCartRecommendations(c *gin.Context) {
+	userID := cartOwner(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	limit, err := parseRecommendationLimit(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	cart, err := store.Carts.Get(ctx, userID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+	var seeds []string
+	if cart != nil {
+		for _, item := range cart.Items {
+			if !containsString(seeds, item.ProductID) {
+				seeds = append(seeds, item.ProductID)
+			}
+		}
+	}
+
+	result, err := recommend(ctx, seeds, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load recommendations"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
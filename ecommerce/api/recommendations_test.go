@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRecommendationServer returns the test server with a small bar's worth
+// of products and order history. Gin and tonic are bought together; the
+// customers who bought gin also came back for the Macallan.
+func newRecommendationServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	r := newTestServer(t)
+	ctx := context.Background()
+
+	archived := time.Now()
+	for _, p := range []Product{
+		{ID: "gin", Category: "gin", Stock: 10},
+		{ID: "tonic", Category: "mixers", Stock: 10},
+		{ID: "lime", Category: "mixers", Stock: 0},
+		{ID: "ice", Category: "mixers", Stock: 10, ArchivedAt: &archived},
+		{ID: "macallan", Category: "whisky", Stock: 10},
+		{ID: "glenlivet", Category: "whisky", Stock: 10},
+		{ID: "laphroaig", Category: "whisky", Stock: 10},
+	} {
+		p.Name, p.Price = p.ID, 10
+		if err := store.Products.Save(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	for i, o := range []struct {
+		user     string
+		status   string
+		age      time.Duration
+		products []string
+	}{
+		{"u1", OrderPaid, time.Hour, []string{"gin", "tonic", "lime"}},
+		{"u2", OrderDelivered, time.Hour, []string{"gin", "tonic", "lime", "ice"}},
+		{"u3", OrderPaid, time.Hour, []string{"gin", "tonic", "ice"}},
+		{"u1", OrderPaid, time.Hour, []string{"macallan"}},
+		{"u2", OrderPaid, time.Hour, []string{"macallan"}},
+		// Bought together only once, which is not enough to go on
+		{"u4", OrderPaid, time.Hour, []string{"gin", "glenlivet"}},
+		// Cancelled and year-old orders are not learnt from
+		{"u5", OrderCancelled, time.Hour, []string{"gin", "laphroaig"}},
+		{"u6", OrderCancelled, time.Hour, []string{"gin", "laphroaig"}},
+		{"u7", OrderDelivered, 400 * 24 * time.Hour, []string{"gin", "laphroaig"}},
+		{"u8", OrderDelivered, 400 * 24 * time.Hour, []string{"gin", "laphroaig"}},
+	} {
+		order := Order{ID: fmt.Sprintf("order-%d", i), UserID: o.user, Status: o.status, CreatedAt: now.Add(-o.age)}
+		for _, id := range o.products {
+			order.Items = append(order.Items, OrderItem{ID: id, Quantity: 1})
+		}
+		if err := store.Orders.Create(ctx, order); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RefreshRecommendations(ctx, now); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		recommendations.mu.Lock()
+		recommendations.index = nil
+		recommendations.mu.Unlock()
+	})
+	return r
+}
+
+// recommendedIDs fetches recommendations and returns the IDs in each list
+func recommendedIDs(t *testing.T, r http.Handler, userID, path string) (together, alsoBought string) {
+	t.Helper()
+	var result Recommendations
+	code, err := do(r, userID, http.MethodGet, path, nil, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("%s returned %d", path, code)
+	}
+	join := func(products []Product) string {
+		ids := make([]string, len(products))
+		for i, p := range products {
+			ids[i] = p.ID
+		}
+		return strings.Join(ids, " ")
+	}
+	return join(result.FrequentlyBoughtTogether), join(result.CustomersAlsoBought)
+}
+
+func TestProductRecommendations(t *testing.T) {
+	r := newRecommendationServer(t)
+
+	// Lime is out of stock and ice archived, so only tonic is bought with
+	// gin often enough; it is not repeated in the second list
+	for _, tt := range []struct {
+		product    string
+		together   string
+		alsoBought string
+	}{
+		{"gin", "tonic", "macallan"},
+		// Without co-occurrences the Macallan falls back to the best-selling
+		// whiskies; tonic ties with gin but sold fewer units
+		{"macallan", "glenlivet laphroaig", "gin tonic"},
+	} {
+		together, alsoBought := recommendedIDs(t, r, "", "/api/v1/products/"+tt.product+"/recommendations")
+		if together != tt.together || alsoBought != tt.alsoBought {
+			t.Errorf("%s recommends %q and %q, want %q and %q", tt.product, together, alsoBought, tt.together, tt.alsoBought)
+		}
+	}
+
+	together, alsoBought := recommendedIDs(t, r, "", "/api/v1/products/macallan/recommendations?limit=1")
+	if together != "glenlivet" || alsoBought != "gin" {
+		t.Errorf("limit=1 recommends %q and %q", together, alsoBought)
+	}
+
+	for path, want := range map[string]int{
+		"/api/v1/products/ice/recommendations":            http.StatusNotFound,
+		"/api/v1/products/rum/recommendations":            http.StatusNotFound,
+		"/api/v1/products/gin/recommendations?limit=0":    http.StatusBadRequest,
+		"/api/v1/products/gin/recommendations?limit=21":   http.StatusBadRequest,
+		"/api/v1/products/gin/recommendations?limit=many": http.StatusBadRequest,
+	} {
+		code, err := do(r, "", http.MethodGet, path, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Errorf("%s returned %d, want %d", path, code, want)
+		}
+	}
+}
+
+func TestRecommendationsRefresh(t *testing.T) {
+	r := newRecommendationServer(t)
+	ctx := context.Background()
+
+	// A second order of gin with the Glenlivet is only learnt on refresh
+	err := store.Orders.Create(ctx, Order{
+		ID: "order-new", UserID: "u9", Status: OrderPaid, CreatedAt: time.Now(),
+		Items: []OrderItem{{ID: "gin", Quantity: 1}, {ID: "glenlivet", Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if together, _ := recommendedIDs(t, r, "", "/api/v1/products/gin/recommendations"); together != "tonic" {
+		t.Fatalf("recommended %q before the refresh", together)
+	}
+	if err := RefreshRecommendations(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if together, _ := recommendedIDs(t, r, "", "/api/v1/products/gin/recommendations"); together != "tonic glenlivet" {
+		t.Fatalf("recommended %q after the refresh, want tonic then glenlivet", together)
+	}
+}
+
+func TestCartRecommendations(t *testing.T) {
+	r := newRecommendationServer(t)
+
+	// An empty cart has nothing to go on
+	together, alsoBought := recommendedIDs(t, r, "shopper", "/api/v1/cart/recommendations")
+	if together != "" || alsoBought != "" {
+		t.Fatalf("empty cart recommends %q and %q", together, alsoBought)
+	}
+
+	_, err := store.Carts.Update(context.Background(), "shopper", func(cart *Cart) error {
+		cart.Items = []CartItem{
+			{ProductID: "gin", Quantity: 1},
+			{ProductID: "tonic", Quantity: 2},
+			{ProductID: "gin", SKU: "GIN-1L", Quantity: 1},
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scores add up across the cart, but the Glenlivet's single order with
+	// gin still falls short, and nothing in the cart is suggested
+	together, alsoBought = recommendedIDs(t, r, "shopper", "/api/v1/cart/recommendations")
+	if together != "" || alsoBought != "macallan" {
+		t.Fatalf("cart recommends %q and %q, want nothing and macallan", together, alsoBought)
+	}
+
+	code, err := do(r, "", http.MethodGet, "/api/v1/cart/recommendations", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusUnauthorized {
+		t.Fatalf("anonymous cart recommendations returned %d", code)
+	}
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ErrAlreadyReviewed is returned when a customer reviews the same product twice
+var ErrAlreadyReviewed = errors.New("you have already reviewed this product")
+
+// Review is a customer's rating of a product they bought
+type Review struct {
+	ID        string    `json:"id"`
+	ProductID string    `json:"product_id"`
+	UserID    string    `json:"user_id"`
+	Author    string    `json:"author"`
+	Rating    int       `json:"rating"`
+	Body      string    `json:"body"`
+	Hidden    bool      `json:"hidden"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReviewRequest is the body of CreateReview
+type ReviewRequest struct {
+	Rating int    `json:"rating" binding:"required,min=1,max=5"`
+	Body   string `json:"body" binding:"max=2000"`
+}
+
+// ReviewModeration is the body of ModerateReview
+type ReviewModeration struct {
+	Hidden *bool `json:"hidden" binding:"required"`
+}
+
+// RatingSummary aggregates the visible reviews of one product
+type RatingSummary struct {
+	Average float64
+	Count   int
+}
+
+// ReviewPage is one page of a product's reviews
+type ReviewPage struct {
+	Reviews []Review `json:"reviews"`
+	Total   int      `json:"total"`
+	Page    int      `json:"page"`
+	Limit   int      `json:"limit"`
+	Pages   int      `json:"pages"`
+}
+
+// attachRatings fills in the rating summary of each product
+func attachRatings(ctx context.Context, products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	ids := make([]string, len(products))
+	for i, p := range products {
+		ids[i] = p.ID
+	}
+	summaries, err := store.Reviews.Summaries(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		summary := summaries[products[i].ID]
+		products[i].AverageRating = math.Round(summary.Average*10) / 10
+		products[i].ReviewCount = summary.Count
+	}
+	return nil
+}
+
+// hasReceived reports whether the user has a delivered order containing the product
+func hasReceived(ctx context.Context, userID, productID string) (bool, error) {
+	orders, err := store.Orders.ListByUser(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, order := range orders {
+		if order.Status != OrderDelivered {
+			continue
+		}
+		for _, item := range order.Items {
+			if item.ID == productID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// listReviews writes one page of a product's reviews
+func listReviews(c *gin.Context, includeHidden bool) {
+	offset, limit, err := parsePage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reviews, total, err := store.Reviews.ListByProduct(c.Request.Context(), c.Param("id"), includeHidden, offset, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load reviews"})
+		return
+	}
+	c.JSON(http.StatusOK, ReviewPage{
+		Reviews: reviews,
+		Total:   total,
+		Page:    offset/limit + 1,
+		Limit:   limit,
+		Pages:   pageCount(total, limit),
+	})
+}
+
+// GetReviews returns a page of a product's visible reviews, newest first
+func GetReviews(c *gin.Context) {
+	listReviews(c, false)
+}
+
+// AdminListReviews returns a product's reviews including hidden ones
+func AdminListReviews(c *gin.Context) {
+	listReviews(c, true)
+}
+
+// CreateReview records a rating from a customer who has received the product
+func CreateReview(c *gin.Context) {
+	var req ReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	userID := GetUserFromContext(c)
+	productID := c.Param("id")
+
+	product, err := store.Products.Get(ctx, productID)
+	if errors.Is(err, ErrNotFound) || (err == nil && product.ArchivedAt != nil) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load product"})
+		return
+	}
+
+	received, err := hasReceived(ctx, userID, productID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load orders"})
+		return
+	}
+	if !received {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only customers who have received this product can review it"})
+		return
+	}
+
+	user, err := store.Users.Get(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	review := Review{
+		ID:        uuid.New().String(),
+		ProductID: productID,
+		UserID:    userID,
+		Author:    user.Name,
+		Rating:    req.Rating,
+		Body:      strings.TrimSpace(req.Body),
+		CreatedAt: time.Now(),
+	}
+	if err := store.Reviews.Create(ctx, review); err != nil {
+		if errors.Is(err, ErrAlreadyReviewed) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save review"})
+		return
+	}
+	c.JSON(http.StatusCreated, review)
+}
+
+// ModerateReview hides or restores a review
+func ModerateReview(c *gin.Context) {
+	var req ReviewModeration
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	review, err := store.Reviews.SetHidden(c.Request.Context(), c.Param("id"), *req.Hidden)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update review"})
+		return
+	}
+	c.JSON(http.StatusOK, review)
+}
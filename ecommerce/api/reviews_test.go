@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newReviewServer returns the admin test server with customers "alice" and
+// "bob"
+func newReviewServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	r := newAdminServer(t)
+	for _, u := range []User{
+		{ID: "alice", Name: "Alice", Email: "alice@example.com", Role: RoleCustomer},
+		{ID: "bob", Name: "Bob", Email: "bob@example.com", Role: RoleCustomer},
+	} {
+		if err := store.Users.Create(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+// placeOrder stores a pending order for one unit of a product
+func placeOrder(t *testing.T, id, userID, productID string) {
+	t.Helper()
+	err := store.Orders.Create(context.Background(), Order{
+		ID: id, UserID: userID, Status: OrderPending, CreatedAt: time.Now(),
+		Items: []OrderItem{{ID: productID, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// moveOrder walks an order through the given statuses as the admin
+func moveOrder(t *testing.T, r http.Handler, id string, statuses ...string) {
+	t.Helper()
+	for _, status := range statuses {
+		code, err := do(r, "admin", http.MethodPatch, "/api/v1/admin/orders/"+id+"/status", OrderStatusUpdate{Status: status}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			t.Fatalf("moving %s to %s returned %d", id, status, code)
+		}
+	}
+}
+
+func TestUpdateOrderStatus(t *testing.T) {
+	r := newReviewServer(t)
+	placeOrder(t, "order-1", "alice", "whisky")
+
+	for _, tt := range []struct {
+		status string
+		code   int
+	}{
+		{"delivered", http.StatusConflict},
+		{"refunded", http.StatusBadRequest},
+		{"paid", http.StatusOK},
+		{"paid", http.StatusConflict},
+		{"shipped", http.StatusOK},
+		{"cancelled", http.StatusConflict},
+		{"delivered", http.StatusOK},
+	} {
+		code, err := do(r, "admin", http.MethodPatch, "/api/v1/admin/orders/order-1/status", OrderStatusUpdate{Status: tt.status}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("moving to %s returned %d, want %d", tt.status, code, tt.code)
+		}
+	}
+	code, err := do(r, "admin", http.MethodPatch, "/api/v1/admin/orders/missing/status", OrderStatusUpdate{Status: OrderPaid}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Fatalf("updating an unknown order returned %d", code)
+	}
+}
+
+func TestCreateReviewRequiresDelivery(t *testing.T) {
+	r := newReviewServer(t)
+	placeOrder(t, "order-1", "alice", "whisky")
+	review := ReviewRequest{Rating: 5, Body: "  Superb  "}
+
+	// Paying for or shipping the bottle is not enough; it has to arrive
+	for _, status := range []string{OrderPaid, OrderShipped} {
+		moveOrder(t, r, "order-1", status)
+		code, err := do(r, "alice", http.MethodPost, "/api/v1/products/whisky/reviews", review, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusForbidden {
+			t.Fatalf("reviewing a %s order returned %d", status, code)
+		}
+	}
+	moveOrder(t, r, "order-1", OrderDelivered)
+
+	var created Review
+	code, err := do(r, "alice", http.MethodPost, "/api/v1/products/whisky/reviews", review, &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusCreated || created.Author != "Alice" || created.Body != "Superb" {
+		t.Fatalf("review returned %d: %+v", code, created)
+	}
+
+	// A delivered order for one product does not allow reviewing another
+	gin := Product{ID: "gin", Name: "Hendrick's", Price: 39.99, Stock: 2}
+	if err := store.Products.Save(context.Background(), gin); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		user    string
+		product string
+		review  ReviewRequest
+		code    int
+	}{
+		{"second review", "alice", "whisky", ReviewRequest{Rating: 1}, http.StatusConflict},
+		{"product not ordered", "alice", "gin", ReviewRequest{Rating: 4}, http.StatusForbidden},
+		{"another customer", "bob", "whisky", ReviewRequest{Rating: 4}, http.StatusForbidden},
+		{"unknown product", "alice", "rum", ReviewRequest{Rating: 4}, http.StatusNotFound},
+		{"no rating", "alice", "gin", ReviewRequest{Body: "Nice"}, http.StatusBadRequest},
+		{"rating out of range", "alice", "gin", ReviewRequest{Rating: 6}, http.StatusBadRequest},
+	} {
+		code, err := do(r, tt.user, http.MethodPost, "/api/v1/products/"+tt.product+"/reviews", tt.review, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	// Archived products cannot be reviewed even by those who received them
+	if _, err := do(r, "admin", http.MethodDelete, "/api/v1/admin/products/whisky", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	placeOrder(t, "order-2", "bob", "whisky")
+	moveOrder(t, r, "order-2", OrderShipped, OrderDelivered)
+	code, err = do(r, "bob", http.MethodPost, "/api/v1/products/whisky/reviews", review, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusNotFound {
+		t.Fatalf("reviewing an archived product returned %d", code)
+	}
+}
+
+func TestModerateReview(t *testing.T) {
+	r := newReviewServer(t)
+	ctx := context.Background()
+	base := time.Now()
+	for i, review := range []Review{
+		{ID: "r1", UserID: "alice", Rating: 5},
+		{ID: "r2", UserID: "bob", Rating: 4},
+		{ID: "r3", UserID: "carol", Rating: 4},
+	} {
+		review.ProductID = "whisky"
+		review.CreatedAt = base.Add(time.Duration(i) * time.Minute)
+		if err := store.Reviews.Create(ctx, review); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The average is rounded to one decimal place
+	var product Product
+	if _, err := do(r, "", http.MethodGet, "/api/v1/products/whisky", nil, &product); err != nil {
+		t.Fatal(err)
+	}
+	if product.AverageRating != 4.3 || product.ReviewCount != 3 {
+		t.Fatalf("rated %.2f from %d reviews, want 4.3 from 3", product.AverageRating, product.ReviewCount)
+	}
+
+	hidden := true
+	var moderated Review
+	code, err := do(r, "admin", http.MethodPatch, "/api/v1/admin/reviews/r1", ReviewModeration{Hidden: &hidden}, &moderated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || !moderated.Hidden {
+		t.Fatalf("hiding returned %d: %+v", code, moderated)
+	}
+	for _, tt := range []struct {
+		name   string
+		user   string
+		review string
+		body   interface{}
+		code   int
+	}{
+		{"unknown review", "admin", "missing", ReviewModeration{Hidden: &hidden}, http.StatusNotFound},
+		{"hidden omitted", "admin", "r2", map[string]interface{}{}, http.StatusBadRequest},
+		{"customer", "alice", "r2", ReviewModeration{Hidden: &hidden}, http.StatusForbidden},
+	} {
+		code, err := do(r, tt.user, http.MethodPatch, "/api/v1/admin/reviews/"+tt.review, tt.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	// Hidden reviews leave the public list and the rating, but not the admin list
+	var public, all ReviewPage
+	if _, err := do(r, "", http.MethodGet, "/api/v1/products/whisky/reviews?limit=1", nil, &public); err != nil {
+		t.Fatal(err)
+	}
+	if public.Total != 2 || public.Pages != 2 || len(public.Reviews) != 1 || public.Reviews[0].ID != "r3" {
+		t.Fatalf("public list is %+v, want r3 first of 2", public)
+	}
+	if _, err := do(r, "admin", http.MethodGet, "/api/v1/admin/products/whisky/reviews", nil, &all); err != nil {
+		t.Fatal(err)
+	}
+	if all.Total != 3 || all.Reviews[2].ID != "r1" || !all.Reviews[2].Hidden {
+		t.Fatalf("admin list is %+v, want all 3 with r1 hidden", all)
+	}
+	if _, err := do(r, "", http.MethodGet, "/api/v1/products/whisky", nil, &product); err != nil {
+		t.Fatal(err)
+	}
+	if product.AverageRating != 4 || product.ReviewCount != 2 {
+		t.Fatalf("rated %.2f from %d reviews after hiding, want 4 from 2", product.AverageRating, product.ReviewCount)
+	}
+}
@@ -6,78 +6,149 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// SetupRoutes configures all the routes for our application
-func SetupRoutes(router *gin.Engine) {
-	// Middleware
-	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-		c.Next()
-	})
-
-	router.Use(gin.Logger())
-	router.Use(gin.Recovery())
-
-	// Serve static files
-	router.Static("/static", "./static")
-
-	// Public API routes
-	router.POST("/api/v1/register", RegisterUser)
-	router.POST("/api/v1/login", LoginUser)
-	router.GET("/api/v1/products", GetProducts)
-	router.GET("/api/v1/products/:id", GetProduct)
-
-	// Frontend routes
-	router.GET("/", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "index.html", nil)
-	})
-	router.GET("/products", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "products.html", nil)
-	})
-	router.GET("/login", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "login.html", nil)
-	})
-	router.GET("/register", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "register.html", nil)
-	})
-	router.GET("/cart", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "cart.html", nil)
-	})
-
-	// Protected API routes
-	protected := router.Group("/api/v1")
-	protected.Use(AuthMiddleware())
-	{
-		// Cart routes
-		protected.GET("/cart", GetCart)
-		protected.POST("/cart", AddToCart)
-		protected.DELETE("/cart/:product_id", RemoveFromCart)
-
-		// Order routes
-		protected.POST("/orders", CreateOrderHandler)
-		protected.GET("/orders/:id", GetOrder)
-		protected.GET("/orders", GetOrders)
+// page serves an HTML template with no data; the storefront pages load
+// everything else from the API
+func page(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.HTML(http.StatusOK, name, nil)
+	}
+}
+
+// cors lets the API be called from other origins, answering preflight
+// requests itself
+func cors(c *gin.Context) {
+	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+	c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+	c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	if c.Request.Method == http.MethodOptions {
+		c.AbortWithStatus(http.StatusNoContent)
+		return
 	}
+	c.Next()
+}
 
-	// Public M-Pesa callback
-	router.POST("/api/v1/mpesa/callback", HandleMpesaCallback)
+// SetupRoutes registers every route the application serves: storefront
+// pages, the JSON API, admin endpoints and payment webhooks. Templates must
+// be loaded on the router before pages are requested.
+func SetupRoutes(r *gin.Engine) {
+	r.Use(cors)
 
-	// Admin routes
-	admin := router.Group("/admin")
-	admin.Use(AuthMiddleware())
+	// Static files and uploaded media
+	r.Static("/static", "./static")
+	r.GET("/media/*path", ServeMedia)
+
+	// Storefront pages
+	r.GET("/", page("index.html"))
+	r.GET("/products", page("product.html"))
+	r.GET("/login", page("login.html"))
+	r.GET("/register", page("register.html"))
+	r.GET("/cart", page("cart.html"))
+	r.GET("/profile", page("profile.html"))
+	// The dashboard is a shell; the admin API it fetches checks the token
+	r.GET("/admin/dashboard", page("admin.html"))
+
+	v1 := r.Group("/api/v1")
 	{
-		admin.GET("/dashboard", handleAdminDashboard)
-		admin.GET("/transactions", func(c *gin.Context) {
-			var transactions []*MpesaTransaction
-			for _, t := range mpesaTransactions {
-				transactions = append(transactions, t)
-			}
-			c.JSON(http.StatusOK, transactions)
-		})
+		// Auth routes
+		v1.POST("/register", RegisterUser)
+		v1.POST("/login", LoginUser)
+
+		// Product routes
+		v1.GET("/products", GetProducts)
+		v1.GET("/products/:id", GetProduct)
+		v1.GET("/products/:id/reviews", GetReviews)
+		v1.GET("/products/:id/recommendations", GetRecommendations)
+		v1.GET("/categories", GetCategories)
+
+		// Webhooks are called by payment providers, which carry no token
+		v1.POST("/mpesa/callback", HandleMpesaCallback)
+
+		// Cart routes serve logged-in users and guests alike
+		cart := v1.Group("/cart")
+		cart.Use(CartMiddleware())
+		{
+			cart.GET("", GetCart)
+			cart.POST("/add", AddToCart)
+			cart.PATCH("/:product_id", UpdateCartItem)
+			cart.DELETE("/:product_id", RemoveFromCart)
+			cart.DELETE("", ClearCart)
+			cart.POST("/coupon", ApplyCoupon)
+			cart.DELETE("/coupon", RemoveCoupon)
+			cart.GET("/recommendations", GetCartRecommendations)
+		}
+
+		// Protected routes
+		authorized := v1.Group("/")
+		authorized.Use(AuthMiddleware())
+		{
+			// Profile routes
+			authorized.GET("/profile", GetProfile)
+			authorized.PATCH("/profile", UpdateProfile)
+
+			// Wishlist routes
+			authorized.GET("/wishlists", ListWishlists)
+			authorized.POST("/wishlists", CreateWishlist)
+			authorized.GET("/wishlists/:id", GetWishlist)
+			authorized.PATCH("/wishlists/:id", RenameWishlist)
+			authorized.DELETE("/wishlists/:id", DeleteWishlist)
+			authorized.POST("/wishlists/:id/items", AddWishlistItem)
+			authorized.DELETE("/wishlists/:id/items/:product_id", RemoveWishlistItem)
+			authorized.POST("/wishlists/:id/items/:product_id/move-to-cart", MoveWishlistItemToCart)
+
+			// Alert routes
+			authorized.POST("/products/:id/subscriptions", Subscribe)
+			authorized.GET("/subscriptions", ListSubscriptions)
+			authorized.DELETE("/subscriptions/:id", Unsubscribe)
+
+			// Order routes
+			authorized.POST("/orders", CreateOrderHandler)
+			authorized.GET("/orders", GetOrders)
+			authorized.GET("/orders/:id", GetOrder)
+
+			// Review routes
+			authorized.POST("/products/:id/reviews", CreateReview)
+
+			// M-Pesa routes
+			authorized.POST("/mpesa/stkpush", HandleMpesaSTKPush)
+			authorized.GET("/mpesa/status/:id", GetMpesaTransactionStatus)
+		}
+
+		// Admin routes
+		admin := v1.Group("/admin")
+		admin.Use(AuthMiddleware(), AdminMiddleware())
+		{
+			admin.GET("/products", AdminListProducts)
+			admin.POST("/products", CreateProduct)
+			admin.PATCH("/products/:id", UpdateProduct)
+			admin.DELETE("/products/:id", ArchiveProduct)
+			admin.POST("/products/:id/restore", RestoreProduct)
+			admin.POST("/products/:id/restock", RestockProduct)
+			admin.GET("/products/:id/movements", AdminListMovements)
+			admin.POST("/products/:id/movements", RecordStockMovement)
+			admin.GET("/inventory/low-stock", AdminLowStock)
+			admin.GET("/carts/abandoned", AdminAbandonedCarts)
+			admin.GET("/products/:id/promotions", ListPromotions)
+			admin.POST("/products/:id/promotions", CreatePromotion)
+			admin.DELETE("/promotions/:id", DeletePromotion)
+			admin.GET("/discounts", ListDiscounts)
+			admin.POST("/discounts", CreateDiscount)
+			admin.DELETE("/discounts/:id", ArchiveDiscount)
+			admin.GET("/products/:id/scheduled-prices", ListScheduledPrices)
+			admin.POST("/products/:id/scheduled-prices", CreateScheduledPrice)
+			admin.DELETE("/scheduled-prices/:id", DeleteScheduledPrice)
+			admin.GET("/products/:id/price-history", AdminPriceHistory)
+			admin.POST("/products/:id/image", UploadProductImage)
+			admin.GET("/products/:id/reviews", AdminListReviews)
+			admin.PATCH("/reviews/:id", ModerateReview)
+			admin.PATCH("/orders/:id/status", UpdateOrderStatus)
+			admin.POST("/products/import", AdminImportProducts)
+			admin.GET("/products/export", AdminExportProducts)
+			admin.GET("/transactions", AdminListTransactions)
+
+			admin.GET("/categories", AdminListCategories)
+			admin.POST("/categories", CreateCategory)
+			admin.PATCH("/categories/:slug", UpdateCategory)
+			admin.DELETE("/categories/:slug", DeleteCategory)
+		}
 	}
 }
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// fetchCall matches a fetch of a literal URL in the shipped JavaScript
+	fetchCall = regexp.MustCompile("(?:fetch|authenticatedFetch)\\(\\s*(['\"`])(/[^'\"`]*)['\"`]")
+	// fetchMethod matches the method option of a fetch call
+	fetchMethod = regexp.MustCompile(`method:\s*['"](\w+)['"]`)
+	// templateExpr matches ${...} in template literal URLs
+	templateExpr = regexp.MustCompile(`\$\{[^}]*\}`)
+)
+
+// endpoint is a method and path requested by the storefront
+type endpoint struct {
+	file, method, path string
+}
+
+// shippedEndpoints returns every endpoint fetched by the JavaScript served
+// from static/js or embedded in the templates
+func shippedEndpoints(t *testing.T) []endpoint {
+	t.Helper()
+	var files []string
+	for _, pattern := range []string{"../static/js/*.js", "../templates/*.html"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, matches...)
+	}
+
+	var endpoints []endpoint
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := string(src)
+		calls := fetchCall.FindAllStringSubmatchIndex(text, -1)
+		for i, call := range calls {
+			// The options of a call end where the next call starts
+			end := len(text)
+			if i+1 < len(calls) {
+				end = calls[i+1][0]
+			}
+			method := "GET"
+			if m := fetchMethod.FindStringSubmatch(text[call[1]:end]); m != nil {
+				method = strings.ToUpper(m[1])
+			}
+			path := templateExpr.ReplaceAllString(text[call[4]:call[5]], "x")
+			path, _, _ = strings.Cut(path, "?")
+			endpoints = append(endpoints, endpoint{file: filepath.Base(file), method: method, path: path})
+		}
+	}
+	return endpoints
+}
+
+// routeMatches reports whether a registered route pattern serves path
+func routeMatches(pattern, path string) bool {
+	want, got := strings.Split(pattern, "/"), strings.Split(path, "/")
+	for i, segment := range want {
+		if strings.HasPrefix(segment, "*") {
+			return true
+		}
+		if i >= len(got) || (segment != got[i] && !strings.HasPrefix(segment, ":")) {
+			return false
+		}
+	}
+	return len(want) == len(got)
+}
+
+func TestShippedJavaScriptEndpointsAreRouted(t *testing.T) {
+	r := gin.New()
+	SetupRoutes(r)
+	routes := r.Routes()
+
+	endpoints := shippedEndpoints(t)
+	if len(endpoints) == 0 {
+		t.Fatal("no fetch calls found in the shipped JavaScript")
+	}
+	for _, e := range endpoints {
+		found := false
+		for _, route := range routes {
+			if route.Method == e.method && routeMatches(route.Path, e.path) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%s: %s %s is not routed", e.file, e.method, e.path)
+		}
+	}
+}
+
+func TestAdminDashboard(t *testing.T) {
+	r := newTestServer(t)
+	r.LoadHTMLGlob("../templates/*")
+	err := store.Users.Create(context.Background(), User{ID: "admin", Email: "admin@example.com", Role: RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A browser opening the page sends no token, so the page is public and
+	// the data it fetches is what checks for an admin
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/dashboard", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("dashboard without a token returned %d, want %d", w.Code, http.StatusOK)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/admin/transactions", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("transactions without a token returned %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	for user, want := range map[string]int{"customer": http.StatusForbidden, "admin": http.StatusOK} {
+		code, err := do(r, user, http.MethodGet, "/api/v1/admin/transactions", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Errorf("transactions as %s returned %d, want %d", user, code, want)
+		}
+	}
+
+	// The table reads the transactions by their JSON names
+	src, err := os.ReadFile("../templates/admin.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]bool{}
+	typ := reflect.TypeOf(MpesaTransaction{})
+	for i := 0; i < typ.NumField(); i++ {
+		fields[typ.Field(i).Tag.Get("json")] = true
+	}
+	for _, m := range regexp.MustCompile(`\bt\.(\w+)`).FindAllStringSubmatch(string(src), -1) {
+		if !fields[m[1]] {
+			t.Errorf("admin.html reads t.%s, which transactions do not have", m[1])
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	r := newTestServer(t)
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/v1/cart/whisky", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("preflight returned %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin is %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, http.MethodPatch) {
+		t.Errorf("Access-Control-Allow-Methods %q does not allow PATCH", got)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/products", nil))
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin on a GET is %q", got)
+	}
+}
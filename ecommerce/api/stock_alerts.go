@@ -0,0 +1,231 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"ecommerce/notify"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSalesWindow is the number of days of orders used to estimate sales
+const defaultSalesWindow = 30
+
+// notifier delivers stock alerts to alertRecipients. Until SetNotifier is
+// called alerts are written to the info log.
+var (
+	notifier        notify.Sender
+	alertRecipients []string
+)
+
+// SetNotifier replaces the sender used for stock alerts and the addresses
+// they go to
+func SetNotifier(s notify.Sender, to ...string) {
+	notifier = s
+	alertRecipients = to
+}
+
+func sendAlert(ctx context.Context, subject, body string) error {
+	sender := notifier
+	if sender == nil {
+		sender = notify.NewLogSender(AppLogger.Info)
+	}
+	return sender.Send(ctx, notify.Message{To: alertRecipients, Subject: subject, Body: body})
+}
+
+// LowStockItem is a product at or below its reorder level. DaysOfCover
+// estimates how long the stock will last at the recent rate of sale and is
+// omitted for products that have not sold in the window.
+type LowStockItem struct {
+	ProductID     string     `json:"product_id"`
+	Name          string     `json:"name"`
+	Category      string     `json:"category"`
+	Stock         int        `json:"stock"`
+	ReorderLevel  int        `json:"reorder_level"`
+	LowStockSince *time.Time `json:"low_stock_since,omitempty"`
+	UnitsSold     int        `json:"units_sold"`
+	DailySales    float64    `json:"daily_sales"`
+	DaysOfCover   *float64   `json:"days_of_cover,omitempty"`
+}
+
+// isLowStock reports whether a product has reached its reorder level
+func isLowStock(p Product) bool {
+	return p.ArchivedAt == nil && p.ReorderLevel > 0 && p.Stock <= p.ReorderLevel
+}
+
+// newLowStockItem estimates the cover of a product that sold the given
+// number of units in the last days
+func newLowStockItem(p Product, sold, days int) LowStockItem {
+	item := LowStockItem{
+		ProductID:     p.ID,
+		Name:          p.Name,
+		Category:      p.Category,
+		Stock:         p.Stock,
+		ReorderLevel:  p.ReorderLevel,
+		LowStockSince: p.LowStockSince,
+		UnitsSold:     sold,
+		DailySales:    math.Round(float64(sold)/float64(days)*100) / 100,
+	}
+	if sold > 0 {
+		cover := math.Round(float64(p.Stock)*float64(days)/float64(sold)*10) / 10
+		item.DaysOfCover = &cover
+	}
+	return item
+}
+
+// lowStockItems returns the products at or below their reorder level, the
+// shortest cover first
+func lowStockItems(ctx context.Context, products []Product, now time.Time, days int) ([]LowStockItem, error) {
+	sold, err := store.Orders.UnitsSold(ctx, now.AddDate(0, 0, -days))
+	if err != nil {
+		return nil, err
+	}
+
+	items := []LowStockItem{}
+	for _, p := range products {
+		if isLowStock(p) {
+			items = append(items, newLowStockItem(p, sold[p.ID], days))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i].DaysOfCover, items[j].DaysOfCover
+		if (a == nil) != (b == nil) {
+			return a != nil
+		}
+		if a != nil && *a != *b {
+			return *a < *b
+		}
+		return items[i].Name < items[j].Name
+	})
+	return items, nil
+}
+
+// CheckStockLevels raises an alert for each product that has reached its
+// reorder level since the last check and re-arms products that have been
+// restocked above it. It returns the number of alerts sent.
+func CheckStockLevels(ctx context.Context, now time.Time) (int, error) {
+	products, err := store.Products.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	items, err := lowStockItems(ctx, products, now, defaultSalesWindow)
+	if err != nil {
+		return 0, err
+	}
+	low := make(map[string]bool, len(items))
+	var raise []LowStockItem
+	for _, item := range items {
+		low[item.ProductID] = true
+		if item.LowStockSince == nil {
+			raise = append(raise, item)
+		}
+	}
+
+	for _, p := range products {
+		if p.LowStockSince == nil || low[p.ID] {
+			continue
+		}
+		_, err := store.Products.Update(ctx, p.ID, func(p *Product) error {
+			if !isLowStock(*p) {
+				p.LowStockSince = nil
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(raise) == 0 {
+		return 0, nil
+	}
+	if err := sendAlert(ctx, lowStockSubject(raise), lowStockBody(raise)); err != nil {
+		// Leave the products unmarked so the next check tries again
+		return 0, fmt.Errorf("sending low-stock alert: %w", err)
+	}
+	for _, item := range raise {
+		_, err := store.Products.Update(ctx, item.ProductID, func(p *Product) error {
+			if p.LowStockSince == nil {
+				p.LowStockSince = &now
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(raise), nil
+}
+
+func lowStockSubject(items []LowStockItem) string {
+	if len(items) == 1 {
+		return fmt.Sprintf("Low stock: %s", items[0].Name)
+	}
+	return fmt.Sprintf("Low stock: %d products need reordering", len(items))
+}
+
+func lowStockBody(items []LowStockItem) string {
+	var b strings.Builder
+	b.WriteString("These products have reached their reorder level:\n\n")
+	for _, item := range items {
+		fmt.Fprintf(&b, "- %s (%s): %d left, reorder level %d", item.Name, item.ProductID, item.Stock, item.ReorderLevel)
+		if item.DaysOfCover != nil {
+			fmt.Fprintf(&b, ", about %.1f days of cover", *item.DaysOfCover)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// WatchStockLevels runs CheckStockLevels every interval until ctx is done
+func WatchStockLevels(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := CheckStockLevels(ctx, now)
+			if err != nil {
+				AppLogger.Error.Printf("Error checking stock levels: %v", err)
+			} else if n > 0 {
+				AppLogger.Info.Printf("Raised low-stock alerts for %d product(s)", n)
+			}
+		}
+	}
+}
+
+// AdminLowStock lists products at or below their reorder level with their
+// days of cover, estimated from the last ?days= of orders (default 30)
+func AdminLowStock(c *gin.Context) {
+	days := defaultSalesWindow
+	if v := c.Query("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 365"})
+			return
+		}
+		days = n
+	}
+
+	ctx := c.Request.Context()
+	products, err := store.Products.List(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load stock levels"})
+		return
+	}
+	items, err := lowStockItems(ctx, products, time.Now(), days)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load stock levels"})
+		return
+	}
+	c.JSON(http.StatusOK, items)
+}
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"ecommerce/notify"
+)
+
+// recordingSender keeps the messages it is asked to send, failing instead
+// while err is set
+type recordingSender struct {
+	messages []notify.Message
+	err      error
+}
+
+func (s *recordingSender) Send(ctx context.Context, msg notify.Message) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// useSender routes stock alerts to a recordingSender for the rest of the test
+func useSender(t *testing.T) *recordingSender {
+	t.Helper()
+	sender := &recordingSender{}
+	oldSender, oldTo := notifier, alertRecipients
+	SetNotifier(sender, "buyer@thedot.com")
+	t.Cleanup(func() { SetNotifier(oldSender, oldTo...) })
+	return sender
+}
+
+// setStock sets a product's stock without going through an order
+func setStock(t *testing.T, id string, stock int) {
+	t.Helper()
+	_, err := store.Products.Update(context.Background(), id, func(p *Product) error {
+		p.Stock = stock
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsLowStock(t *testing.T) {
+	archived := time.Now()
+	for _, tt := range []struct {
+		name    string
+		product Product
+		want    bool
+	}{
+		{"below the level", Product{Stock: 2, ReorderLevel: 3}, true},
+		{"at the level", Product{Stock: 3, ReorderLevel: 3}, true},
+		{"above the level", Product{Stock: 4, ReorderLevel: 3}, false},
+		{"alerts disabled", Product{Stock: 0}, false},
+		{"archived", Product{Stock: 0, ReorderLevel: 3, ArchivedAt: &archived}, false},
+	} {
+		if got := isLowStock(tt.product); got != tt.want {
+			t.Errorf("%s: isLowStock = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckStockLevels(t *testing.T) {
+	newTestServer(t)
+	sender := useSender(t)
+	ctx := context.Background()
+	now := time.Now()
+	for _, p := range []Product{
+		{ID: "gin", Name: "Hendrick's", Price: 39.99, Stock: 2, ReorderLevel: 5},
+		{ID: "rum", Name: "Kraken", Price: 29.99, Stock: 10, ReorderLevel: 5},
+	} {
+		if err := store.Products.Save(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(want int) {
+		t.Helper()
+		n, err := CheckStockLevels(ctx, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("raised %d alerts, want %d", n, want)
+		}
+	}
+
+	// An alert is raised once, not on every check
+	check(1)
+	check(0)
+	if len(sender.messages) != 1 || sender.messages[0].Subject != "Low stock: Hendrick's" ||
+		sender.messages[0].To[0] != "buyer@thedot.com" {
+		t.Fatalf("unexpected alerts %+v", sender.messages)
+	}
+	if gin, _ := store.Products.Get(ctx, "gin"); gin.LowStockSince == nil || !gin.LowStockSince.Equal(now) {
+		t.Fatalf("gin marked low since %v, want %v", gin.LowStockSince, now)
+	}
+
+	// A failed delivery leaves the products unmarked so the next check retries
+	setStock(t, "rum", 5)
+	sender.err = errors.New("mail server down")
+	if _, err := CheckStockLevels(ctx, now); err == nil {
+		t.Fatal("expected the failed delivery to be reported")
+	}
+	if rum, _ := store.Products.Get(ctx, "rum"); rum.LowStockSince != nil {
+		t.Fatal("rum was marked low although its alert was not sent")
+	}
+	sender.err = nil
+	check(1)
+
+	// Restocking above the level re-arms the alert for the next shortage
+	setStock(t, "gin", 6)
+	check(0)
+	if gin, _ := store.Products.Get(ctx, "gin"); gin.LowStockSince != nil {
+		t.Fatal("restocked gin is still marked low")
+	}
+	setStock(t, "gin", 1)
+	setStock(t, "rum", 10)
+	check(1)
+	if got := sender.messages[len(sender.messages)-1].Subject; got != "Low stock: Hendrick's" {
+		t.Fatalf("last alert is %q, want the gin's", got)
+	}
+}
+
+func TestCheckStockLevelsGroupsAlerts(t *testing.T) {
+	newTestServer(t)
+	sender := useSender(t)
+	ctx := context.Background()
+	now := time.Now()
+	for _, p := range []Product{
+		{ID: "gin", Name: "Hendrick's", Price: 39.99, Stock: 2, ReorderLevel: 5},
+		{ID: "rum", Name: "Kraken", Price: 29.99, Stock: 4, ReorderLevel: 5},
+	} {
+		if err := store.Products.Save(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Six gins sold in the window, so the two left last about ten days
+	err := store.Orders.Create(ctx, Order{
+		ID: "order-1", UserID: "user-1", Status: OrderPaid, CreatedAt: now,
+		Items: []OrderItem{{ID: "gin", Quantity: 6}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := CheckStockLevels(ctx, now); err != nil || n != 2 {
+		t.Fatalf("raised %d alerts (%v), want 2", n, err)
+	}
+	msg := sender.messages[0]
+	if msg.Subject != "Low stock: 2 products need reordering" {
+		t.Fatalf("subject is %q", msg.Subject)
+	}
+	for _, line := range []string{
+		"- Hendrick's (gin): 2 left, reorder level 5, about 10.0 days of cover\n",
+		"- Kraken (rum): 4 left, reorder level 5\n",
+	} {
+		if !strings.Contains(msg.Body, line) {
+			t.Errorf("alert body %q is missing %q", msg.Body, line)
+		}
+	}
+}
+
+func TestAdminLowStock(t *testing.T) {
+	r := newAdminServer(t)
+	ctx := context.Background()
+	for _, p := range []Product{
+		{ID: "gin", Name: "Hendrick's", Price: 39.99, Stock: 4, ReorderLevel: 5},
+		{ID: "rum", Name: "Kraken", Price: 29.99, Stock: 3, ReorderLevel: 5},
+		{ID: "vodka", Name: "Grey Goose", Price: 49.99, Stock: 1, ReorderLevel: 5},
+		{ID: "wine", Name: "Merlot", Price: 19.99, Stock: 0},
+	} {
+		if err := store.Products.Save(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Recent sales of gin and rum; the old and cancelled orders do not count
+	orders := []struct {
+		id, product string
+		quantity    int
+		status      string
+		age         time.Duration
+	}{
+		{"order-1", "gin", 8, OrderPaid, time.Hour},
+		{"order-2", "rum", 2, OrderDelivered, 24 * time.Hour},
+		{"order-3", "rum", 50, OrderCancelled, time.Hour},
+		{"order-4", "vodka", 9, OrderDelivered, 40 * 24 * time.Hour},
+	}
+	for _, o := range orders {
+		err := store.Orders.Create(ctx, Order{
+			ID: o.id, UserID: "user-1", Status: o.status, CreatedAt: time.Now().Add(-o.age),
+			Items: []OrderItem{{ID: o.product, Quantity: o.quantity}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var items []LowStockItem
+	code, err := do(r, "admin", http.MethodGet, "/api/v1/admin/inventory/low-stock?days=10", nil, &items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || len(items) != 3 {
+		t.Fatalf("low-stock report returned %d: %+v", code, items)
+	}
+	// The shortest cover comes first and products without sales come last
+	want := []struct {
+		id    string
+		sold  int
+		daily float64
+		cover float64
+	}{
+		{"gin", 8, 0.8, 5},
+		{"rum", 2, 0.2, 15},
+		{"vodka", 0, 0, -1},
+	}
+	for i, w := range want {
+		item := items[i]
+		if item.ProductID != w.id || item.UnitsSold != w.sold || item.DailySales != w.daily {
+			t.Errorf("item %d is %+v, want %s with %d sold", i, item, w.id, w.sold)
+		}
+		if (w.cover < 0) != (item.DaysOfCover == nil) || (item.DaysOfCover != nil && *item.DaysOfCover != w.cover) {
+			t.Errorf("%s has days of cover %v, want %v", w.id, item.DaysOfCover, w.cover)
+		}
+	}
+
+	for _, days := range []string{"0", "366", "week"} {
+		code, err := do(r, "admin", http.MethodGet, "/api/v1/admin/inventory/low-stock?days="+days, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusBadRequest {
+			t.Errorf("days=%s returned %d, want %d", days, code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by stores when the requested record does not exist
+var ErrNotFound = errors.New("record not found")
+
+// ErrEmailTaken is returned when registering a user with an email already in use
+var ErrEmailTaken = errors.New("email already registered")
+
+// ErrInsufficientStock is returned when a stock adjustment would take a
+// product's stock below zero
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// ProductStore persists the product catalog. Every change to a SKU's stock or
+// regular price, whichever method makes it, is recorded in the stock ledger
+// or price history in the same atomic step, using the MovementSource carried
+// by the context.
+type ProductStore interface {
+	List(ctx context.Context) ([]Product, error)
+	// Search returns one page of products matching the query along with the
+	// total number of matches
+	Search(ctx context.Context, q ProductQuery) ([]Product, int, error)
+	Get(ctx context.Context, id string) (Product, error)
+	// GetBySKU returns the product that owns the variant with the given SKU
+	GetBySKU(ctx context.Context, sku string) (Product, error)
+	// Save inserts or replaces a product and its variants, failing with
+	// ErrDuplicateSKU if another product already uses one of its SKUs
+	Save(ctx context.Context, product Product) error
+	// Update applies fn to the stored product and saves the result as a
+	// single atomic read-modify-write. If fn returns an error nothing is saved.
+	Update(ctx context.Context, id string, fn func(product *Product) error) (Product, error)
+	// AdjustStock atomically adds delta to the stock of the product's SKU
+	// (empty for products without variants) and returns the updated product,
+	// failing with ErrInsufficientStock if the result would be negative
+	AdjustStock(ctx context.Context, id, sku string, delta int) (Product, error)
+	// AdjustStocks applies several stock changes atomically. If any SKU would
+	// go below zero nothing changes and a *ShortageError lists every such SKU.
+	AdjustStocks(ctx context.Context, changes []StockChange) error
+	// CountByCategory returns the number of unarchived products directly in
+	// each category, keyed by slug
+	CountByCategory(ctx context.Context) (map[string]int, error)
+	// Facets counts the products matching each query by the value of the
+	// facet it is keyed by. Products without a value are not counted.
+	Facets(ctx context.Context, queries map[string]ProductQuery) (map[string][]FacetValue, error)
+}
+
+// CategoryStore persists the category taxonomy
+type CategoryStore interface {
+	List(ctx context.Context) ([]Category, error)
+	Get(ctx context.Context, slug string) (Category, error)
+	// Create inserts a category, failing with ErrCategoryExists if the slug is taken
+	Create(ctx context.Context, category Category) error
+	// Save inserts or replaces the category with the same slug
+	Save(ctx context.Context, category Category) error
+	// Delete removes a category, failing with ErrCategoryInUse if it still
+	// has subcategories
+	Delete(ctx context.Context, slug string) error
+}
+
+// UserStore persists customer accounts
+type UserStore interface {
+	Get(ctx context.Context, id string) (User, error)
+	GetByEmail(ctx context.Context, email string) (User, error)
+	Create(ctx context.Context, user User) error
+	// Save inserts or replaces the user with the same ID, failing with
+	// ErrEmailTaken if another account already uses the email
+	Save(ctx context.Context, user User) error
+	// Update applies fn to the stored user and saves the result as a single
+	// atomic read-modify-write. If fn returns an error nothing is saved.
+	Update(ctx context.Context, id string, fn func(user *User) error) (User, error)
+}
+
+// OrderStore persists placed orders
+type OrderStore interface {
+	Create(ctx context.Context, order Order) error
+	Get(ctx context.Context, id string) (Order, error)
+	ListByUser(ctx context.Context, userID string) ([]Order, error)
+	// Update applies fn to the stored order and saves the result as a single
+	// atomic read-modify-write. Items and delivery details are fixed when the
+	// order is placed; only the status and reservation fields are saved.
+	Update(ctx context.Context, id string, fn func(order *Order) error) (Order, error)
+	// ListExpired returns pending orders whose stock reservation lapsed before t
+	ListExpired(ctx context.Context, t time.Time) ([]Order, error)
+	// UnitsSold returns the quantity of each product ordered since t, keyed
+	// by product ID. Cancelled and expired orders are not counted.
+	UnitsSold(ctx context.Context, since time.Time) (map[string]int, error)
+	// ListSince returns the orders placed since t with their items, leaving
+	// out cancelled and expired ones
+	ListSince(ctx context.Context, since time.Time) ([]Order, error)
+}
+
+// CartStore persists shopping carts, one per user. Carts returned by the
+// store are copies; changes must go through Save or Update.
+type CartStore interface {
+	Get(ctx context.Context, userID string) (*Cart, error)
+	Save(ctx context.Context, cart *Cart) error
+	// Update loads the user's cart, creating an empty one if needed, applies
+	// fn and saves the result as a single atomic read-modify-write. If fn
+	// returns an error nothing is saved.
+	Update(ctx context.Context, userID string, fn func(cart *Cart) error) (*Cart, error)
+	// Delete removes the cart, failing with ErrNotFound if there is none
+	Delete(ctx context.Context, userID string) error
+	// ListIdle returns the carts, guest carts included, last changed before t
+	ListIdle(ctx context.Context, t time.Time) ([]Cart, error)
+	// Expire removes the user's cart if it has not changed since t, failing
+	// with ErrNotFound if there is no such cart
+	Expire(ctx context.Context, userID string, t time.Time) error
+}
+
+// PaymentStore persists M-Pesa transactions keyed by order ID. Transactions
+// returned by the store are copies.
+type PaymentStore interface {
+	Save(ctx context.Context, transaction *MpesaTransaction) error
+	GetByOrder(ctx context.Context, orderID string) (*MpesaTransaction, error)
+	// GetByCheckoutRequest returns the transaction M-Pesa knows by the ID
+	GetByCheckoutRequest(ctx context.Context, checkoutRequestID string) (*MpesaTransaction, error)
+	List(ctx context.Context) ([]*MpesaTransaction, error)
+}
+
+// ReviewStore persists product reviews
+type ReviewStore interface {
+	// Create saves a review, failing with ErrAlreadyReviewed if the user has
+	// already reviewed the product
+	Create(ctx context.Context, review Review) error
+	// ListByProduct returns one page of a product's reviews, newest first,
+	// along with the total number of matches
+	ListByProduct(ctx context.Context, productID string, includeHidden bool, offset, limit int) ([]Review, int, error)
+	SetHidden(ctx context.Context, id string, hidden bool) (Review, error)
+	// Summaries returns the rating summary of the visible reviews of each
+	// product that has any
+	Summaries(ctx context.Context, productIDs []string) (map[string]RatingSummary, error)
+}
+
+// WishlistStore persists customers' named wishlists. Lists returned by the
+// store are copies; changes must go through Update.
+type WishlistStore interface {
+	// ListByUser returns the user's lists, oldest first
+	ListByUser(ctx context.Context, userID string) ([]Wishlist, error)
+	Get(ctx context.Context, id string) (Wishlist, error)
+	// Create saves a new list, failing with ErrWishlistExists if the user
+	// already has one with the same name, ignoring case
+	Create(ctx context.Context, wishlist Wishlist) error
+	// Update applies fn to the stored list and saves the result as a single
+	// atomic read-modify-write. If fn returns an error nothing is saved.
+	Update(ctx context.Context, id string, fn func(wishlist *Wishlist) error) (Wishlist, error)
+	// Delete removes a list and its items
+	Delete(ctx context.Context, id string) error
+}
+
+// SubscriptionStore persists customers' back-in-stock and price-drop alerts
+type SubscriptionStore interface {
+	// Create saves a subscription, failing with ErrAlreadySubscribed if the
+	// user has an active one of the same type on the same product SKU
+	Create(ctx context.Context, sub Subscription) error
+	Get(ctx context.Context, id string) (Subscription, error)
+	// ListByUser returns the user's active subscriptions, newest first
+	ListByUser(ctx context.Context, userID string) ([]Subscription, error)
+	// ListActive returns the active subscriptions on the given products, or
+	// on every product when productIDs is nil
+	ListActive(ctx context.Context, productIDs []string) ([]Subscription, error)
+	// Claim marks an active subscription as notified at t. It reports false
+	// if the subscription is gone or another caller claimed it first.
+	Claim(ctx context.Context, id string, t time.Time) (bool, error)
+	// Release makes a claimed subscription active again
+	Release(ctx context.Context, id string) error
+	Delete(ctx context.Context, id string) error
+}
+
+// AbandonedCartStore tracks carts that went idle, the reminders sent about
+// them and whether they turned into orders. A record is identified by its
+// user and the time the cart was last changed.
+type AbandonedCartStore interface {
+	// Open records an abandoned cart, returning the existing record instead
+	// if the cart was already recorded for the same AbandonedAt
+	Open(ctx context.Context, cart AbandonedCart) (AbandonedCart, error)
+	// ClaimReminder raises RemindersSent from sent to due on an open record.
+	// It reports false if the record is gone, closed, or another caller
+	// changed it first.
+	ClaimReminder(ctx context.Context, id string, sent, due int) (bool, error)
+	// ReleaseReminder lowers RemindersSent from due back to sent after the
+	// reminder could not be sent
+	ReleaseReminder(ctx context.Context, id string, sent, due int) error
+	// Recover marks the user's latest open record, if any, as recovered by
+	// the order placed at t
+	Recover(ctx context.Context, userID, orderID string, t time.Time) error
+	// Expire closes the user's open record for the cart abandoned at
+	// abandonedAt, failing with ErrNotFound if there is none
+	Expire(ctx context.Context, userID string, abandonedAt, t time.Time) error
+	// ListSince returns the carts abandoned since t, oldest first
+	ListSince(ctx context.Context, since time.Time) ([]AbandonedCart, error)
+}
+
+// DiscountStore persists discount rules and their redemptions, one per
+// order that used a discount
+type DiscountStore interface {
+	// Create saves a discount, failing with ErrDiscountExists if another
+	// unarchived discount has the same coupon code
+	Create(ctx context.Context, discount Discount) error
+	Get(ctx context.Context, id string) (Discount, error)
+	// GetByCode returns the unarchived coupon with the code
+	GetByCode(ctx context.Context, code string) (Discount, error)
+	// List returns every discount, newest first
+	List(ctx context.Context) ([]Discount, error)
+	// Automatic returns the unarchived discounts without a code that are
+	// running at t, oldest first
+	Automatic(ctx context.Context, t time.Time) ([]Discount, error)
+	// Archive ends a discount at t, keeping its redemptions
+	Archive(ctx context.Context, id string, t time.Time) (Discount, error)
+	// Usage returns how many times a discount has been redeemed, in all and
+	// by the user
+	Usage(ctx context.Context, id, userID string) (int, int, error)
+	// Redeem records the discount's use by an order, failing with
+	// ErrDiscountUsedUp if that would exceed its usage limits. Limits are
+	// checked and the redemption saved as a single atomic step.
+	Redeem(ctx context.Context, id, orderID, userID string, t time.Time) error
+	// Release removes the order's redemptions so they no longer count
+	// towards the limits
+	Release(ctx context.Context, orderID string) error
+}
+
+// MovementStore reads the stock ledger. Movements are written only by the
+// ProductStore and never change once recorded.
+type MovementStore interface {
+	// ListByProduct returns one page of a product's movements, newest first,
+	// along with the total number of matches. An empty sku matches all SKUs.
+	ListByProduct(ctx context.Context, productID, sku string, offset, limit int) ([]StockMovement, int, error)
+	// Totals returns the net quantity recorded for each SKU with movements
+	Totals(ctx context.Context) ([]StockLevel, error)
+}
+
+// PromotionStore persists time-boxed sales
+type PromotionStore interface {
+	Create(ctx context.Context, promotion Promotion) error
+	// List returns every promotion of a product, the latest start first
+	List(ctx context.Context, productID string) ([]Promotion, error)
+	// Active returns the promotions running at t for each of the products
+	// that has any
+	Active(ctx context.Context, productIDs []string, t time.Time) (map[string][]Promotion, error)
+	// OnSale returns the IDs of the products with a promotion running at t
+	OnSale(ctx context.Context, t time.Time) ([]string, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// PriceScheduleStore persists future changes to regular prices
+type PriceScheduleStore interface {
+	Create(ctx context.Context, sp ScheduledPrice) error
+	// List returns a product's scheduled changes, the earliest first
+	List(ctx context.Context, productID string) ([]ScheduledPrice, error)
+	// Due returns the unapplied changes effective at or before t, the
+	// earliest first
+	Due(ctx context.Context, t time.Time) ([]ScheduledPrice, error)
+	MarkApplied(ctx context.Context, id string, t time.Time) error
+	// Delete cancels a change, failing with ErrScheduleApplied if it has
+	// already been made
+	Delete(ctx context.Context, id string) error
+}
+
+// PriceHistoryStore reads the regular price history. Entries are written
+// only by the ProductStore.
+type PriceHistoryStore interface {
+	// ListByProduct returns one page of a product's price changes, newest
+	// first, along with the total number of changes
+	ListByProduct(ctx context.Context, productID string, offset, limit int) ([]PriceChange, int, error)
+}
+
+// Store groups the repositories the handlers depend on
+type Store struct {
+	Products       ProductStore
+	Categories     CategoryStore
+	Users          UserStore
+	Orders         OrderStore
+	Carts          CartStore
+	Payments       PaymentStore
+	Reviews        ReviewStore
+	Movements      MovementStore
+	Promotions     PromotionStore
+	PriceSchedules PriceScheduleStore
+	PriceHistory   PriceHistoryStore
+	Wishlists      WishlistStore
+	Subscriptions  SubscriptionStore
+	AbandonedCarts AbandonedCartStore
+	Discounts      DiscountStore
+}
+
+// store is the backend used by the handlers. It defaults to the in-memory
+// implementation and can be swapped at startup with SetStore.
+var store = NewMemoryStore()
+
+// SetStore replaces the storage backend used by the handlers
+func SetStore(s *Store) {
+	store = s
+}
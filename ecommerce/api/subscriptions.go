@@ -0,0 +1,310 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"ecommerce/notify"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Subscription types
+const (
+	SubscriptionBackInStock = "back_in_stock"
+	SubscriptionPriceDrop   = "price_drop"
+)
+
+// Notification channels
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// ErrAlreadySubscribed is returned when a user subscribes twice to the same alert
+var ErrAlreadySubscribed = errors.New("you are already subscribed to this alert")
+
+// Subscription asks for one message when a product SKU comes back into
+// stock or its price falls below Price, the price when the user subscribed.
+// It is active until NotifiedAt is set, after which it is never sent again.
+type Subscription struct {
+	ID          string     `json:"id"`
+	UserID      string     `json:"user_id"`
+	ProductID   string     `json:"product_id"`
+	SKU         string     `json:"sku,omitempty"`
+	Type        string     `json:"type"`
+	Channel     string     `json:"channel"`
+	Destination string     `json:"destination"`
+	Price       float64    `json:"price"`
+	CreatedAt   time.Time  `json:"created_at"`
+	NotifiedAt  *time.Time `json:"notified_at,omitempty"`
+}
+
+// SubscriptionRequest is the body of Subscribe. Channel defaults to email,
+// sent to the account's address; SMS alerts need a phone number.
+type SubscriptionRequest struct {
+	Type    string `json:"type" binding:"required,oneof=back_in_stock price_drop"`
+	SKU     string `json:"sku"`
+	Channel string `json:"channel" binding:"omitempty,oneof=email sms"`
+	Phone   string `json:"phone"`
+}
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9]{9,15}$`)
+
+// channels holds the sender for each notification channel. Channels
+// without one write messages to the info log.
+var channels = map[string]notify.Sender{}
+
+// SetChannel replaces the sender used for a notification channel
+func SetChannel(name string, s notify.Sender) {
+	channels[name] = s
+}
+
+func channelSender(name string) notify.Sender {
+	if s := channels[name]; s != nil {
+		return s
+	}
+	return notify.NewLogSender(AppLogger.Info)
+}
+
+// subscriptionJobs carries the IDs of products whose stock or price changed
+var subscriptionJobs = make(chan string, 256)
+
+// notifySubscribers queues a check of the subscriptions on the products. It
+// never blocks; when the queue is full the periodic sweep catches up.
+func notifySubscribers(productIDs ...string) {
+	for _, id := range productIDs {
+		select {
+		case subscriptionJobs <- id:
+		default:
+		}
+	}
+}
+
+// RunSubscriptionJobs checks subscriptions on each product queued by a stock
+// or price change, and on every product each interval so changes made
+// elsewhere, such as promotions starting, are not missed
+func RunSubscriptionJobs(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var productIDs []string
+		now := time.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-subscriptionJobs:
+			productIDs = []string{id}
+		case now = <-ticker.C:
+		}
+		n, err := ProcessSubscriptions(ctx, productIDs, now)
+		if err != nil {
+			AppLogger.Error.Printf("Error processing subscriptions: %v", err)
+		} else if n > 0 {
+			AppLogger.Info.Printf("Sent %d subscription alert(s)", n)
+		}
+	}
+}
+
+// subscriptionDue reports whether a subscription's condition holds for the
+// product, which has had its prices attached
+func subscriptionDue(sub Subscription, p *Product) bool {
+	if p.ArchivedAt != nil {
+		return false
+	}
+	v, err := p.resolveSKU(sub.SKU)
+	if err != nil {
+		return false
+	}
+	switch sub.Type {
+	case SubscriptionBackInStock:
+		if v != nil {
+			return v.Stock > 0
+		}
+		return p.Stock > 0
+	case SubscriptionPriceDrop:
+		price, _ := p.EffectivePrice(sub.SKU)
+		return roundCents(price) < roundCents(sub.Price)
+	}
+	return false
+}
+
+// subscriptionMessage describes why the alert was sent
+func subscriptionMessage(sub Subscription, p *Product) notify.Message {
+	msg := notify.Message{To: []string{sub.Destination}}
+	price, _ := p.EffectivePrice(sub.SKU)
+	if sub.Type == SubscriptionBackInStock {
+		msg.Subject = fmt.Sprintf("%s is back in stock", p.Name)
+		msg.Body = fmt.Sprintf("%s is available again at KES %.2f.", p.Name, price)
+	} else {
+		msg.Subject = fmt.Sprintf("Price drop: %s", p.Name)
+		msg.Body = fmt.Sprintf("%s is now KES %.2f, down from KES %.2f.", p.Name, price, sub.Price)
+	}
+	return msg
+}
+
+// ProcessSubscriptions sends the alerts whose condition now holds on the
+// given products, or on every product when productIDs is nil. Each
+// subscription is claimed before sending so it is sent at most once, and
+// released again if sending fails so the next run retries it. It returns
+// the number of alerts sent.
+func ProcessSubscriptions(ctx context.Context, productIDs []string, now time.Time) (int, error) {
+	subs, err := store.Subscriptions.ListActive(ctx, productIDs)
+	if err != nil || len(subs) == 0 {
+		return 0, err
+	}
+
+	products := make(map[string]*Product)
+	for _, sub := range subs {
+		if _, loaded := products[sub.ProductID]; loaded {
+			continue
+		}
+		p, err := store.Products.Get(ctx, sub.ProductID)
+		if errors.Is(err, ErrNotFound) {
+			products[sub.ProductID] = nil
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		list := []Product{p}
+		if err := attachPrices(ctx, list, now); err != nil {
+			return 0, err
+		}
+		products[sub.ProductID] = &list[0]
+	}
+
+	sent := 0
+	for _, sub := range subs {
+		p := products[sub.ProductID]
+		if p == nil || !subscriptionDue(sub, p) {
+			continue
+		}
+		claimed, err := store.Subscriptions.Claim(ctx, sub.ID, now)
+		if err != nil {
+			return sent, err
+		}
+		if !claimed {
+			continue
+		}
+		if err := channelSender(sub.Channel).Send(ctx, subscriptionMessage(sub, p)); err != nil {
+			AppLogger.Error.Printf("Error sending subscription %s: %v", sub.ID, err)
+			if err := store.Subscriptions.Release(ctx, sub.ID); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// Subscribe signs the user up for a back-in-stock or price-drop alert on a
+// product
+func Subscribe(c *gin.Context) {
+	var req SubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Channel == "" {
+		req.Channel = ChannelEmail
+	}
+
+	ctx := c.Request.Context()
+	userID := GetUserFromContext(c)
+	product, err := store.Products.Get(ctx, c.Param("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && product.ArchivedAt != nil) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load product"})
+		return
+	}
+	products := []Product{product}
+	if err := attachPrices(ctx, products, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load prices"})
+		return
+	}
+	price, err := products[0].EffectivePrice(req.SKU)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sub := Subscription{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		ProductID: product.ID,
+		SKU:       req.SKU,
+		Type:      req.Type,
+		Channel:   req.Channel,
+		Price:     price,
+		CreatedAt: time.Now(),
+	}
+	if sub.Type == SubscriptionBackInStock && subscriptionDue(sub, &products[0]) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Product is in stock"})
+		return
+	}
+
+	if req.Channel == ChannelSMS {
+		if !phonePattern.MatchString(req.Phone) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A valid phone number is required for SMS alerts"})
+			return
+		}
+		sub.Destination = req.Phone
+	} else {
+		user, err := store.Users.Get(ctx, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+		sub.Destination = user.Email
+	}
+
+	err = store.Subscriptions.Create(ctx, sub)
+	if errors.Is(err, ErrAlreadySubscribed) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save subscription"})
+		return
+	}
+	c.JSON(http.StatusCreated, sub)
+}
+
+// ListSubscriptions returns the user's active alerts
+func ListSubscriptions(c *gin.Context) {
+	subs, err := store.Subscriptions.ListByUser(c.Request.Context(), GetUserFromContext(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load subscriptions"})
+		return
+	}
+	c.JSON(http.StatusOK, subs)
+}
+
+// Unsubscribe cancels one of the user's alerts
+func Unsubscribe(c *gin.Context) {
+	ctx := c.Request.Context()
+	sub, err := store.Subscriptions.Get(ctx, c.Param("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && sub.UserID != GetUserFromContext(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load subscription"})
+		return
+	}
+	if err := store.Subscriptions.Delete(ctx, sub.ID); err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete subscription"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newSubscriptionServer returns the test server with customers alice and
+// bob, and the gin with its litre sold out
+func newSubscriptionServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	r := newTestServer(t)
+	ctx := context.Background()
+	for _, u := range []User{
+		{ID: "alice", Email: "alice@example.com", Role: RoleCustomer},
+		{ID: "bob", Email: "bob@example.com", Role: RoleCustomer},
+	} {
+		if err := store.Users.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	product := ginVariants()
+	product.Variants[1].Stock = 0
+	if err := store.Products.Save(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// useChannels routes subscription alerts to recording senders for the rest
+// of the test
+func useChannels(t *testing.T) (email, sms *recordingSender) {
+	t.Helper()
+	email, sms = &recordingSender{}, &recordingSender{}
+	SetChannel(ChannelEmail, email)
+	SetChannel(ChannelSMS, sms)
+	t.Cleanup(func() {
+		SetChannel(ChannelEmail, nil)
+		SetChannel(ChannelSMS, nil)
+	})
+	return email, sms
+}
+
+func TestSubscriptionDue(t *testing.T) {
+	archived := time.Now()
+	sale := 39.98
+	for _, tt := range []struct {
+		name    string
+		sub     Subscription
+		product Product
+		want    bool
+	}{
+		{"restocked", Subscription{Type: SubscriptionBackInStock}, Product{Stock: 1}, true},
+		{"still sold out", Subscription{Type: SubscriptionBackInStock}, Product{Stock: 0}, false},
+		// Only the size asked for counts
+		{"other size restocked", Subscription{Type: SubscriptionBackInStock, SKU: "GIN-1L"}, ginVariants(), true},
+		{"size sold out", Subscription{Type: SubscriptionBackInStock, SKU: "GIN-1L"}, Product{Stock: 5, Variants: []Variant{
+			{SKU: "GIN-70", Stock: 5}, {SKU: "GIN-1L", Stock: 0},
+		}}, false},
+		{"size withdrawn", Subscription{Type: SubscriptionBackInStock, SKU: "GIN-35"}, ginVariants(), false},
+		{"archived", Subscription{Type: SubscriptionBackInStock}, Product{Stock: 1, ArchivedAt: &archived}, false},
+		// Prices are compared in whole cents
+		{"a cent cheaper", Subscription{Type: SubscriptionPriceDrop, Price: 39.99}, Product{Price: 39.99, SalePrice: &sale}, true},
+		{"under half a cent cheaper", Subscription{Type: SubscriptionPriceDrop, Price: 39.99}, Product{Price: 39.986}, false},
+		{"dearer", Subscription{Type: SubscriptionPriceDrop, SKU: "GIN-70", Price: 35}, ginVariants(), false},
+	} {
+		if got := subscriptionDue(tt.sub, &tt.product); got != tt.want {
+			t.Errorf("%s: subscriptionDue = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	r := newSubscriptionServer(t)
+
+	var sub Subscription
+	code, err := do(r, "alice", http.MethodPost, "/api/v1/products/gin/subscriptions",
+		SubscriptionRequest{Type: SubscriptionBackInStock, SKU: "GIN-1L"}, &sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Email goes to the account's address and the price is the size's
+	if code != http.StatusCreated || sub.Channel != ChannelEmail || sub.Destination != "alice@example.com" || sub.Price != 49.99 {
+		t.Fatalf("subscribing returned %d: %+v", code, sub)
+	}
+
+	archived := time.Now()
+	if _, err := store.Products.Update(context.Background(), "whisky", func(p *Product) error {
+		p.ArchivedAt = &archived
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		user    string
+		product string
+		req     SubscriptionRequest
+		code    int
+	}{
+		{"same alert twice", "alice", "gin", SubscriptionRequest{Type: SubscriptionBackInStock, SKU: "GIN-1L"}, http.StatusConflict},
+		{"same alert for another customer", "bob", "gin", SubscriptionRequest{Type: SubscriptionBackInStock, SKU: "GIN-1L"}, http.StatusCreated},
+		{"size in stock", "alice", "gin", SubscriptionRequest{Type: SubscriptionBackInStock, SKU: "GIN-70"}, http.StatusConflict},
+		{"price drop on a size in stock", "alice", "gin", SubscriptionRequest{Type: SubscriptionPriceDrop, SKU: "GIN-70"}, http.StatusCreated},
+		{"size required", "alice", "gin", SubscriptionRequest{Type: SubscriptionPriceDrop}, http.StatusBadRequest},
+		{"unknown size", "alice", "gin", SubscriptionRequest{Type: SubscriptionBackInStock, SKU: "GIN-35"}, http.StatusBadRequest},
+		{"archived product", "alice", "whisky", SubscriptionRequest{Type: SubscriptionPriceDrop}, http.StatusNotFound},
+		{"unknown type", "alice", "gin", SubscriptionRequest{Type: "restock", SKU: "GIN-1L"}, http.StatusBadRequest},
+		{"unknown channel", "alice", "gin", SubscriptionRequest{Type: SubscriptionPriceDrop, SKU: "GIN-1L", Channel: "push"}, http.StatusBadRequest},
+		{"sms to a short number", "alice", "gin", SubscriptionRequest{Type: SubscriptionPriceDrop, SKU: "GIN-1L", Channel: ChannelSMS, Phone: "0712"}, http.StatusBadRequest},
+		{"sms", "alice", "gin", SubscriptionRequest{Type: SubscriptionPriceDrop, SKU: "GIN-1L", Channel: ChannelSMS, Phone: "+254712345678"}, http.StatusCreated},
+	} {
+		code, err := do(r, tt.user, http.MethodPost, "/api/v1/products/"+tt.product+"/subscriptions", tt.req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	var subs []Subscription
+	if _, err := do(r, "alice", http.MethodGet, "/api/v1/subscriptions", nil, &subs); err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 3 {
+		t.Fatalf("alice has %d subscriptions, want 3: %+v", len(subs), subs)
+	}
+
+	// Another customer's subscription is not found rather than forbidden
+	for _, tt := range []struct {
+		user string
+		code int
+	}{
+		{"bob", http.StatusNotFound},
+		{"alice", http.StatusNoContent},
+		{"alice", http.StatusNotFound},
+	} {
+		code, err := do(r, tt.user, http.MethodDelete, "/api/v1/subscriptions/"+sub.ID, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s unsubscribing returned %d, want %d", tt.user, code, tt.code)
+		}
+	}
+}
+
+func TestProcessSubscriptions(t *testing.T) {
+	newSubscriptionServer(t)
+	email, sms := useChannels(t)
+	ctx := context.Background()
+	for _, sub := range []Subscription{
+		{ID: "litre", UserID: "alice", ProductID: "gin", SKU: "GIN-1L", Type: SubscriptionBackInStock,
+			Channel: ChannelEmail, Destination: "alice@example.com", Price: 49.99},
+		{ID: "cheaper", UserID: "bob", ProductID: "gin", SKU: "GIN-70", Type: SubscriptionPriceDrop,
+			Channel: ChannelSMS, Destination: "+254712345678", Price: 39.99},
+		{ID: "gone", UserID: "bob", ProductID: "rum", Type: SubscriptionBackInStock,
+			Channel: ChannelEmail, Destination: "bob@example.com"},
+	} {
+		sub.CreatedAt = time.Now()
+		if err := store.Subscriptions.Create(ctx, sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	process := func(productIDs []string, want int) {
+		t.Helper()
+		n, err := ProcessSubscriptions(ctx, productIDs, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Fatalf("sent %d alerts, want %d", n, want)
+		}
+	}
+
+	// Restocking the other size does not count; the product that no longer
+	// exists is skipped rather than failing the run
+	if _, err := store.Products.AdjustStock(ctx, "gin", "GIN-70", 3); err != nil {
+		t.Fatal(err)
+	}
+	process(nil, 0)
+
+	// A run for other products leaves the gin's alerts for later
+	if _, err := store.Products.AdjustStock(ctx, "gin", "GIN-1L", 1); err != nil {
+		t.Fatal(err)
+	}
+	process([]string{"whisky"}, 0)
+	process([]string{"gin"}, 1)
+	process(nil, 0)
+	if len(email.messages) != 1 || email.messages[0].To[0] != "alice@example.com" ||
+		email.messages[0].Subject != "Hendrick's is back in stock" ||
+		email.messages[0].Body != "Hendrick's is available again at KES 49.99." {
+		t.Fatalf("unexpected emails %+v", email.messages)
+	}
+	// A sent alert is no longer listed and the customer may sign up again
+	if subs, _ := store.Subscriptions.ListByUser(ctx, "alice"); len(subs) != 0 {
+		t.Fatalf("alice still has active subscriptions %+v", subs)
+	}
+	resubscribe := Subscription{ID: "again", UserID: "alice", ProductID: "gin", SKU: "GIN-1L", Type: SubscriptionBackInStock}
+	if err := store.Subscriptions.Create(ctx, resubscribe); err != nil {
+		t.Fatalf("subscribing again after the alert: %v", err)
+	}
+	if err := store.Subscriptions.Delete(ctx, "again"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed text is released and sent on the next run
+	err := store.Promotions.Create(ctx, Promotion{
+		ID: "half-off", ProductID: "gin", Type: DiscountPercent, Value: 50,
+		StartsAt: time.Now().Add(-time.Hour), EndsAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms.err = errors.New("gateway down")
+	process(nil, 0)
+	sms.err = nil
+	process(nil, 1)
+	process(nil, 0)
+	if len(sms.messages) != 1 || sms.messages[0].Body != "Hendrick's is now KES 20.00, down from KES 39.99." {
+		t.Fatalf("unexpected texts %+v", sms.messages)
+	}
+}
+
+func TestNotifySubscribersNeverBlocks(t *testing.T) {
+	old := subscriptionJobs
+	subscriptionJobs = make(chan string, 1)
+	t.Cleanup(func() { subscriptionJobs = old })
+
+	// The second product is dropped for the sweep to pick up
+	notifySubscribers("gin", "whisky")
+	if id := <-subscriptionJobs; id != "gin" || len(subscriptionJobs) != 0 {
+		t.Fatalf("queued %q with %d more, want only gin", id, len(subscriptionJobs))
+	}
+}
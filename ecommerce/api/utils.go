@@ -2,7 +2,6 @@ package api
 
 import (
 	"log"
-	"net/http"
 	"os"
 
 	"github.com/gin-gonic/gin"
@@ -33,10 +32,3 @@ func DebugMiddleware() gin.HandlerFunc {
 		AppLogger.Info.Printf("Response Status: %d", c.Writer.Status())
 	}
 }
-
-// Admin dashboard handler
-func handleAdminDashboard(c *gin.Context) {
-	c.HTML(http.StatusOK, "admin.html", gin.H{
-		"title": "Admin Dashboard",
-	})
-}
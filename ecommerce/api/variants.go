@@ -0,0 +1,108 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin/binding"
+)
+
+// ErrDuplicateSKU is returned when a SKU is already used by another variant
+var ErrDuplicateSKU = errors.New("sku already in use")
+
+// ErrUnknownSKU is returned when a product has no variant with the given SKU
+var ErrUnknownSKU = errors.New("unknown sku")
+
+// ErrSKURequired is returned when a product with variants is referenced
+// without choosing one of them
+var ErrSKURequired = errors.New("sku required for products with variants")
+
+// Variant is one sellable size or pack of a product, e.g. a 750ml bottle or
+// a 6-pack. Each variant has its own price and stock.
+type Variant struct {
+	SKU     string  `json:"sku" binding:"required"`
+	Size    string  `json:"size" binding:"required"`
+	Price   float64 `json:"price" binding:"required,gt=0"`
+	Stock   int     `json:"stock" binding:"gte=0"`
+	Barcode string  `json:"barcode"`
+	// SalePrice is the price under an active promotion. Like the product's,
+	// it is filled in when products are read and never stored.
+	SalePrice *float64 `json:"sale_price,omitempty"`
+}
+
+// Variant returns the product's variant with the given SKU
+func (p *Product) Variant(sku string) (*Variant, bool) {
+	for i := range p.Variants {
+		if p.Variants[i].SKU == sku {
+			return &p.Variants[i], true
+		}
+	}
+	return nil, false
+}
+
+// resolveSKU checks that sku is valid for the product. Products without
+// variants are sold under the empty SKU.
+func (p *Product) resolveSKU(sku string) (*Variant, error) {
+	if len(p.Variants) == 0 {
+		if sku != "" {
+			return nil, ErrUnknownSKU
+		}
+		return nil, nil
+	}
+	if sku == "" {
+		return nil, ErrSKURequired
+	}
+	v, ok := p.Variant(sku)
+	if !ok {
+		return nil, ErrUnknownSKU
+	}
+	return v, nil
+}
+
+// UnitPrice returns the price of one unit of the given SKU
+func (p *Product) UnitPrice(sku string) (float64, error) {
+	v, err := p.resolveSKU(sku)
+	if err != nil {
+		return 0, err
+	}
+	if v == nil {
+		return p.Price, nil
+	}
+	return v.Price, nil
+}
+
+// syncVariants derives the product's headline price and stock from its
+// variants: the lowest variant price ("from" price) and the total stock
+func (p *Product) syncVariants() {
+	if len(p.Variants) == 0 {
+		return
+	}
+	p.Price = p.Variants[0].Price
+	p.Stock = 0
+	for _, v := range p.Variants {
+		if v.Price < p.Price {
+			p.Price = v.Price
+		}
+		p.Stock += v.Stock
+	}
+}
+
+// ValidateProduct derives variant totals and checks the product against its
+// binding rules
+func ValidateProduct(p *Product) error {
+	p.syncVariants()
+	if err := binding.Validator.ValidateStruct(p); err != nil {
+		return err
+	}
+	if err := validateBundle(p); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(p.Variants))
+	for _, v := range p.Variants {
+		if seen[v.SKU] {
+			return fmt.Errorf("duplicate sku %q", v.SKU)
+		}
+		seen[v.SKU] = true
+	}
+	return nil
+}
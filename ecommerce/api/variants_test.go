@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// ginVariants is a product sold in two sizes
+func ginVariants() Product {
+	return Product{ID: "gin", Name: "Hendrick's", Variants: []Variant{
+		{SKU: "GIN-70", Size: "70cl", Price: 39.99, Stock: 2},
+		{SKU: "GIN-1L", Size: "1L", Price: 49.99, Stock: 1},
+	}}
+}
+
+func TestResolveSKU(t *testing.T) {
+	gin := ginVariants()
+	plain := Product{ID: "whisky", Price: 299.99}
+	tests := []struct {
+		name    string
+		product Product
+		sku     string
+		want    string
+		err     error
+	}{
+		{name: "variant", product: gin, sku: "GIN-1L", want: "GIN-1L"},
+		{name: "variant required", product: gin, err: ErrSKURequired},
+		{name: "unknown variant", product: gin, sku: "GIN-5L", err: ErrUnknownSKU},
+		{name: "no variants", product: plain},
+		{name: "sku for a product without variants", product: plain, sku: "GIN-70", err: ErrUnknownSKU},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := tt.product.resolveSKU(tt.sku)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("returned %v, want %v", err, tt.err)
+			}
+			var got string
+			if v != nil {
+				got = v.SKU
+			}
+			if got != tt.want {
+				t.Fatalf("resolved variant %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateProductVariants(t *testing.T) {
+	// Variants override whatever headline price and stock were sent
+	p := ginVariants()
+	p.Price, p.Stock = 1, 100
+	if err := ValidateProduct(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Price != 39.99 || p.Stock != 3 {
+		t.Fatalf("product has price %.2f and stock %d, want the from price 39.99 and 3", p.Price, p.Stock)
+	}
+
+	p = ginVariants()
+	p.Variants[1].SKU = "GIN-70"
+	if err := ValidateProduct(&p); err == nil || !strings.Contains(err.Error(), `duplicate sku "GIN-70"`) {
+		t.Fatalf("expected a duplicate sku error, got %v", err)
+	}
+	p = ginVariants()
+	p.Variants[0].Size = ""
+	if err := ValidateProduct(&p); err == nil || !strings.Contains(err.Error(), "Size") {
+		t.Fatalf("expected a missing size error, got %v", err)
+	}
+}
+
+func TestVariantStock(t *testing.T) {
+	newTestServer(t)
+	ctx := context.Background()
+	if err := store.Products.Save(ctx, ginVariants()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each size has its own stock even when the product total would cover it
+	if _, err := store.Products.AdjustStock(ctx, "gin", "GIN-1L", -2); !errors.Is(err, ErrInsufficientStock) {
+		t.Fatalf("overselling the 1L returned %v, want %v", err, ErrInsufficientStock)
+	}
+	if _, err := store.Products.AdjustStock(ctx, "gin", "", -1); !errors.Is(err, ErrSKURequired) {
+		t.Fatalf("adjusting without a size returned %v, want %v", err, ErrSKURequired)
+	}
+	p, err := store.Products.AdjustStock(ctx, "gin", "GIN-70", -2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := p.Variant("GIN-70"); v.Stock != 0 || p.Stock != 1 {
+		t.Fatalf("expected the 70cl to sell out leaving 1 in stock, got %+v", p)
+	}
+
+	// Products returned by the store do not share variants with it
+	p.Variants[0].Stock = 50
+	if stored, _ := store.Products.Get(ctx, "gin"); stored.Variants[0].Stock != 0 {
+		t.Fatal("changing a returned product changed the store")
+	}
+
+	taken := Product{ID: "gin-2", Name: "Gin", Variants: []Variant{{SKU: "GIN-1L", Size: "1L", Price: 45}}}
+	if err := store.Products.Save(ctx, taken); !errors.Is(err, ErrDuplicateSKU) {
+		t.Fatalf("reusing another product's sku returned %v, want %v", err, ErrDuplicateSKU)
+	}
+}
+
+func TestAdminVariants(t *testing.T) {
+	r := newAdminServer(t)
+	if err := store.Products.Save(context.Background(), ginVariants()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		code   int
+	}{
+		{"sku used by another product", http.MethodPost, "/api/v1/admin/products", map[string]interface{}{
+			"name": "Gin", "variants": []Variant{{SKU: "GIN-70", Size: "70cl", Price: 35}},
+		}, http.StatusConflict},
+		{"price on a product with variants", http.MethodPatch, "/api/v1/admin/products/gin", map[string]interface{}{"price": 45}, http.StatusBadRequest},
+		{"restock without a size", http.MethodPost, "/api/v1/admin/products/gin/restock", RestockRequest{Quantity: 6}, http.StatusBadRequest},
+		{"restock a size", http.MethodPost, "/api/v1/admin/products/gin/restock", RestockRequest{SKU: "GIN-1L", Quantity: 6}, http.StatusOK},
+	} {
+		code, err := do(r, "admin", tt.method, tt.path, tt.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	// Replacing the variants recomputes the headline price and stock
+	var updated Product
+	code, err := do(r, "admin", http.MethodPatch, "/api/v1/admin/products/gin", map[string]interface{}{
+		"variants": []Variant{{SKU: "GIN-1L", Size: "1L", Price: 44.99, Stock: 7}},
+	}, &updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || updated.Price != 44.99 || updated.Stock != 7 {
+		t.Fatalf("replacing variants returned %d: %+v", code, updated)
+	}
+}
+
+func TestCartAndOrderVariants(t *testing.T) {
+	r := newTestServer(t)
+	if err := store.Products.Save(context.Background(), ginVariants()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range []CartItem{
+		{ProductID: "gin", SKU: "GIN-70", Price: 39.99, Quantity: 1},
+		{ProductID: "gin", SKU: "GIN-1L", Price: 49.99, Quantity: 1},
+		{ProductID: "gin", SKU: "GIN-70", Price: 39.99, Quantity: 1},
+	} {
+		if _, err := do(r, "user-1", http.MethodPost, "/api/v1/cart/add", item, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var cart Cart
+	if _, err := do(r, "user-1", http.MethodDelete, "/api/v1/cart/gin?sku=GIN-1L", nil, &cart); err != nil {
+		t.Fatal(err)
+	}
+	if len(cart.Items) != 1 || cart.Items[0].SKU != "GIN-70" || cart.Items[0].Quantity != 2 {
+		t.Fatalf("expected the 70cl line to be left with 2 bottles, got %+v", cart.Items)
+	}
+
+	for sku, want := range map[string]int{
+		"":       http.StatusBadRequest,
+		"GIN-5L": http.StatusBadRequest,
+		"GIN-1L": http.StatusCreated,
+	} {
+		req := OrderRequest{
+			Items: []OrderItem{{ID: "gin", SKU: sku, Price: 49.99, Quantity: 1}},
+			DeliveryDetails: DeliveryDetails{
+				Name: "Test", Address: "1 Moi Avenue", City: "Nairobi", Phone: "0712345678",
+			},
+			PaymentMethod: "mpesa",
+			Total:         49.99,
+		}
+		code, err := do(r, "user-1", http.MethodPost, "/api/v1/orders", req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Errorf("ordering sku %q returned %d, want %d", sku, code, want)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ErrWishlistExists is returned when a user already has a list with the name
+var ErrWishlistExists = errors.New("you already have a wishlist with that name")
+
+// defaultWishlistName names the list created for users who have none
+const defaultWishlistName = "Wishlist"
+
+// Wishlist is a named list of products a customer has saved for later
+type Wishlist struct {
+	ID        string         `json:"id"`
+	UserID    string         `json:"user_id"`
+	Name      string         `json:"name"`
+	Items     []WishlistItem `json:"items"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// WishlistItem is a saved product SKU. Only the reference and when it was
+// added are stored; the remaining fields describe the product as it is now
+// and are filled in when the list is read.
+type WishlistItem struct {
+	ProductID string    `json:"product_id"`
+	SKU       string    `json:"sku,omitempty"`
+	AddedAt   time.Time `json:"added_at"`
+	Name      string    `json:"name"`
+	Image     string    `json:"image"`
+	Price     float64   `json:"price"`
+	SalePrice *float64  `json:"sale_price,omitempty"`
+	Stock     int       `json:"stock"`
+	InStock   bool      `json:"in_stock"`
+	// Available is false once the product is archived or the SKU is gone
+	Available bool `json:"available"`
+}
+
+// WishlistRequest names a new list or renames an existing one
+type WishlistRequest struct {
+	Name string `json:"name" binding:"required,max=50"`
+}
+
+// WishlistItemRequest saves a product to a list. SKU selects the variant of
+// products sold in several sizes.
+type WishlistItemRequest struct {
+	ProductID string `json:"product_id" binding:"required"`
+	SKU       string `json:"sku"`
+}
+
+// MoveToCartRequest moves a saved item into the cart
+type MoveToCartRequest struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity" binding:"gte=0"`
+}
+
+// name returns the trimmed list name, which must not be blank
+func (r WishlistRequest) name() (string, error) {
+	name := strings.TrimSpace(r.Name)
+	if name == "" {
+		return "", errors.New("name is required")
+	}
+	return name, nil
+}
+
+// index returns the position of the item for the product SKU, or -1
+func (w *Wishlist) index(productID, sku string) int {
+	for i, item := range w.Items {
+		if item.ProductID == productID && item.SKU == sku {
+			return i
+		}
+	}
+	return -1
+}
+
+// describe fills in an item's product details from p, which has had its
+// prices attached, or marks it unavailable when p is nil
+func (item *WishlistItem) describe(p *Product) {
+	if p == nil {
+		item.Available = false
+		return
+	}
+	item.Name, item.Image = p.Name, p.Image
+	v, err := p.resolveSKU(item.SKU)
+	switch {
+	case err != nil:
+		item.Available = false
+		return
+	case v != nil:
+		item.Price, item.Stock = v.Price, v.Stock
+		item.SalePrice = v.SalePrice
+	default:
+		item.Price, item.Stock = p.Price, p.Stock
+		item.SalePrice = p.SalePrice
+	}
+	item.Available = p.ArchivedAt == nil
+	item.InStock = item.Available && item.Stock > 0
+}
+
+// attachWishlistProducts fills in the current price and stock of every item
+func attachWishlistProducts(ctx context.Context, lists []Wishlist) error {
+	var products []Product
+	loaded := make(map[string]int)
+	for _, w := range lists {
+		for _, item := range w.Items {
+			if _, seen := loaded[item.ProductID]; seen {
+				continue
+			}
+			p, err := store.Products.Get(ctx, item.ProductID)
+			if errors.Is(err, ErrNotFound) {
+				loaded[item.ProductID] = -1
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			loaded[item.ProductID] = len(products)
+			products = append(products, p)
+		}
+	}
+	if err := attachPrices(ctx, products, time.Now()); err != nil {
+		return err
+	}
+
+	for i := range lists {
+		for j := range lists[i].Items {
+			item := &lists[i].Items[j]
+			if n := loaded[item.ProductID]; n >= 0 {
+				item.describe(&products[n])
+			} else {
+				item.describe(nil)
+			}
+		}
+	}
+	return nil
+}
+
+// loadWishlist fetches one of the current user's lists, writing an error
+// response and returning false if it cannot
+func loadWishlist(c *gin.Context) (Wishlist, bool) {
+	w, err := store.Wishlists.Get(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && w.UserID != GetUserFromContext(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return Wishlist{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load wishlist"})
+		return Wishlist{}, false
+	}
+	return w, true
+}
+
+// respondWishlist writes the result of a wishlist change
+func respondWishlist(c *gin.Context, status int, w Wishlist, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return
+	case errors.Is(err, ErrWishlistExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save wishlist"})
+		return
+	}
+
+	lists := []Wishlist{w}
+	if err := attachWishlistProducts(c.Request.Context(), lists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load products"})
+		return
+	}
+	c.JSON(status, lists[0])
+}
+
+// ListWishlists returns the user's wishlists, creating an empty default list
+// for users who have none
+func ListWishlists(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := GetUserFromContext(c)
+	lists, err := store.Wishlists.ListByUser(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load wishlists"})
+		return
+	}
+	if len(lists) == 0 {
+		now := time.Now()
+		w := Wishlist{ID: uuid.New().String(), UserID: userID, Name: defaultWishlistName,
+			Items: []WishlistItem{}, CreatedAt: now, UpdatedAt: now}
+		err := store.Wishlists.Create(ctx, w)
+		if errors.Is(err, ErrWishlistExists) {
+			// A concurrent request created it first
+			lists, err = store.Wishlists.ListByUser(ctx, userID)
+		} else if err == nil {
+			lists = []Wishlist{w}
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create wishlist"})
+			return
+		}
+	}
+
+	if err := attachWishlistProducts(ctx, lists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load products"})
+		return
+	}
+	c.JSON(http.StatusOK, lists)
+}
+
+// CreateWishlist adds a named list for the user
+func CreateWishlist(c *gin.Context) {
+	var req WishlistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name, err := req.name()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	w := Wishlist{
+		ID:        uuid.New().String(),
+		UserID:    GetUserFromContext(c),
+		Name:      name,
+		Items:     []WishlistItem{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	respondWishlist(c, http.StatusCreated, w, store.Wishlists.Create(c.Request.Context(), w))
+}
+
+// GetWishlist returns one of the user's lists with the current price and
+// stock of each item
+func GetWishlist(c *gin.Context) {
+	if w, ok := loadWishlist(c); ok {
+		respondWishlist(c, http.StatusOK, w, nil)
+	}
+}
+
+// RenameWishlist changes the name of one of the user's lists
+func RenameWishlist(c *gin.Context) {
+	var req WishlistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name, err := req.name()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := loadWishlist(c); !ok {
+		return
+	}
+
+	w, err := store.Wishlists.Update(c.Request.Context(), c.Param("id"), func(w *Wishlist) error {
+		w.Name = name
+		w.UpdatedAt = time.Now()
+		return nil
+	})
+	respondWishlist(c, http.StatusOK, w, err)
+}
+
+// DeleteWishlist removes one of the user's lists and everything saved on it
+func DeleteWishlist(c *gin.Context) {
+	if _, ok := loadWishlist(c); !ok {
+		return
+	}
+	err := store.Wishlists.Delete(c.Request.Context(), c.Param("id"))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete wishlist"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// AddWishlistItem saves a product to one of the user's lists. Saving an item
+// that is already on the list leaves it unchanged.
+func AddWishlistItem(c *gin.Context) {
+	var req WishlistItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := loadWishlist(c); !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	product, err := store.Products.Get(ctx, req.ProductID)
+	if errors.Is(err, ErrNotFound) || (err == nil && product.ArchivedAt != nil) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load product"})
+		return
+	}
+	if _, err := product.resolveSKU(req.SKU); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	w, err := store.Wishlists.Update(ctx, c.Param("id"), func(w *Wishlist) error {
+		if w.index(req.ProductID, req.SKU) < 0 {
+			w.Items = append(w.Items, WishlistItem{ProductID: req.ProductID, SKU: req.SKU, AddedAt: time.Now()})
+			w.UpdatedAt = time.Now()
+		}
+		return nil
+	})
+	respondWishlist(c, http.StatusOK, w, err)
+}
+
+// RemoveWishlistItem removes a product from one of the user's lists. The
+// optional sku query parameter removes a single variant; without it every
+// saved SKU of the product is removed.
+func RemoveWishlistItem(c *gin.Context) {
+	if _, ok := loadWishlist(c); !ok {
+		return
+	}
+
+	productID, sku := c.Param("product_id"), c.Query("sku")
+	w, err := store.Wishlists.Update(c.Request.Context(), c.Param("id"), func(w *Wishlist) error {
+		kept := []WishlistItem{}
+		for _, item := range w.Items {
+			if item.ProductID != productID || (sku != "" && item.SKU != sku) {
+				kept = append(kept, item)
+			}
+		}
+		w.Items = kept
+		w.UpdatedAt = time.Now()
+		return nil
+	})
+	respondWishlist(c, http.StatusOK, w, err)
+}
+
+// MoveWishlistItemToCart adds a saved item to the user's cart at its current
+// price and removes it from the list. Items that are unavailable or out of
+// stock stay on the list.
+func MoveWishlistItemToCart(c *gin.Context) {
+	var req MoveToCartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Quantity == 0 {
+		req.Quantity = 1
+	}
+	w, ok := loadWishlist(c)
+	if !ok {
+		return
+	}
+
+	productID := c.Param("product_id")
+	i := w.index(productID, req.SKU)
+	if i < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not on wishlist"})
+		return
+	}
+	lists := []Wishlist{w}
+	if err := attachWishlistProducts(c.Request.Context(), lists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load products"})
+		return
+	}
+	if !lists[0].Items[i].Available {
+		c.JSON(http.StatusConflict, gin.H{"error": "Product is no longer available"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	cart, err := updateCartLine(ctx, w.UserID, CartItemRequest{ProductID: productID, SKU: req.SKU, Quantity: req.Quantity}, true)
+	if err != nil {
+		respondCartError(c, err)
+		return
+	}
+
+	w, err = store.Wishlists.Update(ctx, w.ID, func(w *Wishlist) error {
+		if i := w.index(productID, req.SKU); i >= 0 {
+			w.Items = append(w.Items[:i], w.Items[i+1:]...)
+			w.UpdatedAt = time.Now()
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save wishlist"})
+		return
+	}
+
+	lists = []Wishlist{w}
+	if err := attachWishlistProducts(ctx, lists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load products"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"cart": cart, "wishlist": lists[0]})
+}
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newWishlistServer returns the test server with the gin, sold in two sizes,
+// in its store
+func newWishlistServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	r := newTestServer(t)
+	if err := store.Products.Save(context.Background(), ginVariants()); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// createWishlist adds a named list for the user and returns its ID
+func createWishlist(t *testing.T, r http.Handler, userID, name string) string {
+	t.Helper()
+	var w Wishlist
+	code, err := do(r, userID, http.MethodPost, "/api/v1/wishlists", WishlistRequest{Name: name}, &w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusCreated {
+		t.Fatalf("creating %q returned %d", name, code)
+	}
+	return w.ID
+}
+
+func TestDefaultWishlist(t *testing.T) {
+	r := newWishlistServer(t)
+
+	// The first visit creates the default list and later ones reuse it
+	var first, second []Wishlist
+	if _, err := do(r, "user-1", http.MethodGet, "/api/v1/wishlists", nil, &first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := do(r, "user-1", http.MethodGet, "/api/v1/wishlists", nil, &second); err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 1 || first[0].Name != defaultWishlistName || first[0].Items == nil {
+		t.Fatalf("expected an empty default list, got %+v", first)
+	}
+	if len(second) != 1 || second[0].ID != first[0].ID {
+		t.Fatalf("second visit returned %+v, want the same list", second)
+	}
+}
+
+func TestWishlistNamesAndOwnership(t *testing.T) {
+	r := newWishlistServer(t)
+	gifts := createWishlist(t, r, "user-1", "Gifts")
+	createWishlist(t, r, "user-1", "Party")
+	// Names are only unique per user
+	theirs := createWishlist(t, r, "user-2", "Gifts")
+
+	for _, tt := range []struct {
+		name   string
+		user   string
+		method string
+		path   string
+		body   interface{}
+		code   int
+	}{
+		{"same name in another case", "user-1", http.MethodPost, "/api/v1/wishlists", WishlistRequest{Name: "  gifts "}, http.StatusConflict},
+		{"blank name", "user-1", http.MethodPost, "/api/v1/wishlists", WishlistRequest{Name: "   "}, http.StatusBadRequest},
+		{"rename to a taken name", "user-1", http.MethodPatch, "/api/v1/wishlists/" + gifts, WishlistRequest{Name: "PARTY"}, http.StatusConflict},
+		{"rename to another case of its own name", "user-1", http.MethodPatch, "/api/v1/wishlists/" + gifts, WishlistRequest{Name: "GIFTS"}, http.StatusOK},
+		// Another customer's list is hidden rather than forbidden
+		{"read another user's list", "user-1", http.MethodGet, "/api/v1/wishlists/" + theirs, nil, http.StatusNotFound},
+		{"rename another user's list", "user-1", http.MethodPatch, "/api/v1/wishlists/" + theirs, WishlistRequest{Name: "Mine"}, http.StatusNotFound},
+		{"add to another user's list", "user-1", http.MethodPost, "/api/v1/wishlists/" + theirs + "/items", WishlistItemRequest{ProductID: "whisky"}, http.StatusNotFound},
+		{"delete another user's list", "user-1", http.MethodDelete, "/api/v1/wishlists/" + theirs, nil, http.StatusNotFound},
+		{"delete", "user-1", http.MethodDelete, "/api/v1/wishlists/" + gifts, nil, http.StatusNoContent},
+		{"read a deleted list", "user-1", http.MethodGet, "/api/v1/wishlists/" + gifts, nil, http.StatusNotFound},
+	} {
+		code, err := do(r, tt.user, tt.method, tt.path, tt.body, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	var lists []Wishlist
+	if _, err := do(r, "user-2", http.MethodGet, "/api/v1/wishlists", nil, &lists); err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 1 || lists[0].Name != "Gifts" {
+		t.Fatalf("user-2's lists are %+v", lists)
+	}
+}
+
+func TestWishlistItems(t *testing.T) {
+	r := newWishlistServer(t)
+	ctx := context.Background()
+	id := createWishlist(t, r, "user-1", "Gifts")
+	path := "/api/v1/wishlists/" + id
+
+	for _, tt := range []struct {
+		name string
+		item WishlistItemRequest
+		code int
+	}{
+		{"plain product", WishlistItemRequest{ProductID: "whisky"}, http.StatusOK},
+		{"saved twice", WishlistItemRequest{ProductID: "whisky"}, http.StatusOK},
+		{"one size", WishlistItemRequest{ProductID: "gin", SKU: "GIN-70"}, http.StatusOK},
+		{"another size", WishlistItemRequest{ProductID: "gin", SKU: "GIN-1L"}, http.StatusOK},
+		{"size required", WishlistItemRequest{ProductID: "gin"}, http.StatusBadRequest},
+		{"unknown size", WishlistItemRequest{ProductID: "gin", SKU: "GIN-5L"}, http.StatusBadRequest},
+		{"unknown product", WishlistItemRequest{ProductID: "rum"}, http.StatusNotFound},
+	} {
+		code, err := do(r, "user-1", http.MethodPost, path+"/items", tt.item, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	// Items show the product as it is now: on sale, sold out or withdrawn
+	now := time.Now()
+	err := store.Promotions.Create(ctx, Promotion{
+		ID: "summer", ProductID: "gin", SKU: "GIN-70", Type: DiscountPercent, Value: 10,
+		StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Products.AdjustStock(ctx, "gin", "GIN-1L", -1); err != nil {
+		t.Fatal(err)
+	}
+	archived := now
+	if _, err := store.Products.Update(ctx, "whisky", func(p *Product) error {
+		p.ArchivedAt = &archived
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var w Wishlist
+	if _, err := do(r, "user-1", http.MethodGet, path, nil, &w); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Items) != 3 {
+		t.Fatalf("expected 3 saved items, got %+v", w.Items)
+	}
+	whisky, gin70, gin1L := w.Items[0], w.Items[1], w.Items[2]
+	if whisky.Available || whisky.InStock || whisky.Name != "Macallan 18 Years" {
+		t.Errorf("archived whisky shown as %+v", whisky)
+	}
+	if !gin70.Available || gin70.Price != 39.99 || gin70.SalePrice == nil || *gin70.SalePrice != 35.99 {
+		t.Errorf("GIN-70 on sale shown as %+v", gin70)
+	}
+	if !gin1L.Available || gin1L.InStock || gin1L.Stock != 0 {
+		t.Errorf("sold-out GIN-1L shown as %+v", gin1L)
+	}
+
+	// A size the product no longer comes in stays on the list, unavailable
+	if _, err := store.Products.Update(ctx, "gin", func(p *Product) error {
+		p.Variants = p.Variants[:1]
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := do(r, "user-1", http.MethodGet, path, nil, &w); err != nil {
+		t.Fatal(err)
+	}
+	if w.Items[2].Available {
+		t.Errorf("removed size shown as %+v", w.Items[2])
+	}
+
+	// Removing one size leaves the other; without a sku every size goes
+	if _, err := do(r, "user-1", http.MethodDelete, path+"/items/gin?sku=GIN-1L", nil, &w); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Items) != 2 || w.Items[1].SKU != "GIN-70" {
+		t.Fatalf("removing GIN-1L left %+v", w.Items)
+	}
+	if _, err := do(r, "user-1", http.MethodDelete, path+"/items/gin", nil, &w); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Items) != 1 || w.Items[0].ProductID != "whisky" {
+		t.Fatalf("removing the gin left %+v", w.Items)
+	}
+}
+
+func TestMoveWishlistItemToCart(t *testing.T) {
+	r := newWishlistServer(t)
+	ctx := context.Background()
+	id := createWishlist(t, r, "user-1", "Gifts")
+	path := "/api/v1/wishlists/" + id + "/items"
+	for _, item := range []WishlistItemRequest{
+		{ProductID: "gin", SKU: "GIN-70"},
+		{ProductID: "gin", SKU: "GIN-1L"},
+		{ProductID: "whisky"},
+	} {
+		if _, err := do(r, "user-1", http.MethodPost, path, item, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	err := store.Promotions.Create(ctx, Promotion{
+		ID: "summer", ProductID: "gin", Type: DiscountPercent, Value: 10,
+		StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived := now
+	if _, err := store.Products.Update(ctx, "whisky", func(p *Product) error {
+		p.ArchivedAt = &archived
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Items that cannot be bought stay on the list
+	for _, tt := range []struct {
+		name    string
+		product string
+		req     MoveToCartRequest
+		code    int
+	}{
+		{"more than in stock", "gin", MoveToCartRequest{SKU: "GIN-1L", Quantity: 2}, http.StatusConflict},
+		{"archived product", "whisky", MoveToCartRequest{}, http.StatusConflict},
+		{"size not on the list", "gin", MoveToCartRequest{SKU: "GIN-5L"}, http.StatusNotFound},
+		{"negative quantity", "gin", MoveToCartRequest{SKU: "GIN-70", Quantity: -1}, http.StatusBadRequest},
+	} {
+		code, err := do(r, "user-1", http.MethodPost, path+"/"+tt.product+"/move-to-cart", tt.req, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("%s returned %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	// The item goes into the cart at its sale price, one bottle by default
+	var moved struct {
+		Cart     Cart     `json:"cart"`
+		Wishlist Wishlist `json:"wishlist"`
+	}
+	code, err := do(r, "user-1", http.MethodPost, path+"/gin/move-to-cart", MoveToCartRequest{SKU: "GIN-1L"}, &moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("move returned %d", code)
+	}
+	if len(moved.Cart.Items) != 1 || moved.Cart.Items[0].SKU != "GIN-1L" || moved.Cart.Items[0].Price != 44.99 ||
+		moved.Cart.Items[0].Quantity != 1 {
+		t.Fatalf("cart holds %+v, want one GIN-1L at 44.99", moved.Cart.Items)
+	}
+	if len(moved.Wishlist.Items) != 2 || moved.Wishlist.Items[0].SKU != "GIN-70" || moved.Wishlist.Items[1].ProductID != "whisky" {
+		t.Fatalf("list holds %+v after the move", moved.Wishlist.Items)
+	}
+	// The move does not reserve stock; that happens when the order is placed
+	gin, err := store.Products.Get(ctx, "gin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := gin.Variant("GIN-1L"); v.Stock != 1 {
+		t.Fatalf("GIN-1L stock changed to %d", v.Stock)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"ecommerce/api"
+)
+
+// runCatalog implements the "catalog" subcommand
+func runCatalog(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ecommerce catalog import [-dry-run] file.csv | export [-o file.csv]")
+	}
+	if os.Getenv("STORAGE_BACKEND") != "postgres" {
+		return fmt.Errorf("the catalog command needs STORAGE_BACKEND=postgres")
+	}
+
+	switch args[0] {
+	case "import":
+		flags := flag.NewFlagSet("catalog import", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "validate the file without saving anything")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: ecommerce catalog import [-dry-run] file.csv")
+		}
+		return importCatalog(flags.Arg(0), *dryRun)
+	case "export":
+		flags := flag.NewFlagSet("catalog export", flag.ExitOnError)
+		out := flags.String("o", "", "output file (default: stdout)")
+		flags.Parse(args[1:])
+		return exportCatalog(*out)
+	default:
+		return fmt.Errorf("unknown catalog command %q", args[0])
+	}
+}
+
+func importCatalog(file string, dryRun bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	ctx := api.WithMovement(context.Background(), api.MovementSource{
+		Actor:  "catalog",
+		Reason: "catalog import of " + file,
+	})
+	report, err := api.ImportProductsCSV(ctx, s, f, dryRun)
+	if err != nil {
+		return fmt.Errorf("importing %s: %w", file, err)
+	}
+
+	if len(report.Errors) > 0 {
+		for _, rowErr := range report.Errors {
+			log.Printf("line %d: %s", rowErr.Line, rowErr.Error)
+		}
+		return fmt.Errorf("%s: %d error(s), nothing imported", file, len(report.Errors))
+	}
+	if dryRun {
+		log.Printf("dry run of %s: %s", file, report)
+	} else {
+		log.Printf("imported %s: %s", file, report)
+	}
+	return nil
+}
+
+func exportCatalog(file string) error {
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return api.ExportProductsCSV(context.Background(), s, w)
+}
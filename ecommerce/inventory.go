@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"ecommerce/api"
+)
+
+// runInventory implements the "inventory" subcommand
+func runInventory(args []string) error {
+	if len(args) != 1 || args[0] != "reconcile" {
+		return fmt.Errorf("usage: ecommerce inventory reconcile")
+	}
+	if os.Getenv("STORAGE_BACKEND") != "postgres" {
+		return fmt.Errorf("the inventory command needs STORAGE_BACKEND=postgres")
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	mismatches, err := api.ReconcileStock(context.Background(), s)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mismatches {
+		sku := m.SKU
+		if sku == "" {
+			sku = "-"
+		}
+		log.Printf("%s (%s) sku %s: stock %d, ledger %d, off by %d",
+			m.ProductID, m.Name, sku, m.Stock, m.Ledger, m.Stock-m.Ledger)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d SKU(s) disagree with the stock ledger", len(mismatches))
+	}
+	log.Printf("stock matches the ledger")
+	return nil
+}
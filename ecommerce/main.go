@@ -1,70 +1,237 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"ecommerce/api"
+	"ecommerce/media"
+	"ecommerce/migrations"
+	"ecommerce/notify"
 
 	"github.com/gin-gonic/gin"
 )
 
 func setupRouter() *gin.Engine {
 	r := gin.Default()
-
-	// Serve static files
-	r.Static("/static", "./static")
 	r.LoadHTMLGlob("templates/*")
+	api.SetupRoutes(r)
+	return r
+}
+
+// openDatabase connects to the PostgreSQL database named by DATABASE_URL
+func openDatabase() (*sql.DB, error) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		return nil, fmt.Errorf("DATABASE_URL is required for the postgres backend")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+	return db, nil
+}
 
-	// Public routes
-	r.GET("/", func(c *gin.Context) {
-		c.HTML(200, "index.html", nil)
-	})
-
-	// Add frontend routes
-	r.GET("/login", func(c *gin.Context) {
-		c.HTML(200, "login.html", nil)
-	})
-	r.GET("/register", func(c *gin.Context) {
-		c.HTML(200, "register.html", nil)
-	})
-	r.GET("/cart", func(c *gin.Context) {
-		c.HTML(200, "cart.html", nil)
-	})
-	r.GET("/profile", func(c *gin.Context) {
-		c.HTML(200, "profile.html", nil)
-	})
-
-	// API routes
-	v1 := r.Group("/api/v1")
-	{
-		// Auth routes
-		v1.POST("/register", api.RegisterUser)
-		v1.POST("/login", api.LoginUser)
-
-		// Product routes
-		v1.GET("/products", api.GetProducts)
-		v1.GET("/products/:id", api.GetProduct)
-
-		// Protected routes
-		authorized := v1.Group("/")
-		authorized.Use(api.AuthMiddleware())
-		{
-			// Order routes
-			authorized.POST("/orders", api.CreateOrderHandler)
-			authorized.GET("/orders", api.GetOrders)
-			authorized.GET("/orders/:id", api.GetOrder)
-
-			// M-Pesa routes
-			authorized.POST("/mpesa/stkpush", api.HandleMpesaSTKPush)
-			authorized.POST("/mpesa/callback", api.HandleMpesaCallback)
-			authorized.GET("/mpesa/status/:id", api.GetMpesaTransactionStatus)
+// openStore builds the storage backend selected by the STORAGE_BACKEND
+// environment variable ("memory" or "postgres")
+func openStore() (*api.Store, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "memory":
+		return api.NewMemoryStore(), nil
+	case "postgres":
+		db, err := openDatabase()
+		if err != nil {
+			return nil, err
 		}
+		migrator, err := migrations.New(db)
+		if err != nil {
+			return nil, err
+		}
+		pending, err := migrator.Pending(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("checking migrations: %w", err)
+		}
+		if pending > 0 {
+			return nil, fmt.Errorf("%d pending migration(s), run \"ecommerce migrate up\" first", pending)
+		}
+		return api.NewPostgresStore(db), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
 	}
+}
 
-	return r
+// abandonedCartConfig reads the abandoned cart settings from the
+// environment, starting from the defaults: ABANDONED_CART_IDLE, ABANDONED_CART_EXPIRE and the
+// comma-separated ABANDONED_CART_REMINDERS are durations such as "24h", and
+// ABANDONED_CART_CHANNEL is email or sms
+func abandonedCartConfig() (api.AbandonedCartConfig, error) {
+	cfg := api.DefaultAbandonedCartConfig
+	var err error
+	if v := os.Getenv("ABANDONED_CART_IDLE"); v != "" {
+		if cfg.IdleAfter, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("ABANDONED_CART_IDLE: %w", err)
+		}
+	}
+	if v := os.Getenv("ABANDONED_CART_EXPIRE"); v != "" {
+		if cfg.ExpireAfter, err = time.ParseDuration(v); err != nil {
+			return cfg, fmt.Errorf("ABANDONED_CART_EXPIRE: %w", err)
+		}
+	}
+	if v := os.Getenv("ABANDONED_CART_REMINDERS"); v != "" {
+		cfg.Reminders = nil
+		for _, s := range strings.Split(v, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(s))
+			if err != nil {
+				return cfg, fmt.Errorf("ABANDONED_CART_REMINDERS: %w", err)
+			}
+			cfg.Reminders = append(cfg.Reminders, d)
+		}
+	}
+	if v := os.Getenv("ABANDONED_CART_CHANNEL"); v != "" {
+		cfg.Channel = v
+	}
+	return cfg, nil
 }
 
-func main() {
+// deliveryPricing reads the delivery fee from DELIVERY_FEE and the subtotal
+// from which delivery is free from FREE_DELIVERY_OVER. Both default to zero.
+func deliveryPricing() (api.DeliveryPricing, error) {
+	var p api.DeliveryPricing
+	var err error
+	if v := os.Getenv("DELIVERY_FEE"); v != "" {
+		if p.Fee, err = strconv.ParseFloat(v, 64); err != nil {
+			return p, fmt.Errorf("DELIVERY_FEE: %w", err)
+		}
+	}
+	if v := os.Getenv("FREE_DELIVERY_OVER"); v != "" {
+		if p.FreeOver, err = strconv.ParseFloat(v, 64); err != nil {
+			return p, fmt.Errorf("FREE_DELIVERY_OVER: %w", err)
+		}
+	}
+	return p, nil
+}
+
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	seedFile := flags.String("seed", "", "load a fixture file at startup (development only)")
+	demoUser := flags.Bool("seed-demo-user", false, "with -seed, also create the demo account with the password in SEED_DEMO_PASSWORD")
+	flags.Parse(args)
+
+	// Login and guest cart tokens are signed with JWT_SECRET; there is no
+	// default, so a deployment cannot run with a key anyone could read
+	if err := api.SetJWTSecret([]byte(os.Getenv("JWT_SECRET"))); err != nil {
+		return fmt.Errorf("JWT_SECRET: %w", err)
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	api.SetStore(s)
+	if dir := os.Getenv("MEDIA_DIR"); dir != "" {
+		api.SetMediaStorage(media.NewDiskStorage(dir))
+	}
+
+	// Guest carts are merged at login by summing quantities, capped at stock,
+	// unless configured otherwise
+	rules := api.CartMergeRules{Conflict: api.MergeSum, CapAtStock: os.Getenv("CART_MERGE_CAP_AT_STOCK") != "false"}
+	if v := os.Getenv("CART_MERGE"); v != "" {
+		rules.Conflict = v
+	}
+	if err := api.SetCartMergeRules(rules); err != nil {
+		return err
+	}
+
+	cartConfig, err := abandonedCartConfig()
+	if err != nil {
+		return err
+	}
+	if err := api.SetAbandonedCartConfig(cartConfig); err != nil {
+		return err
+	}
+
+	delivery, err := deliveryPricing()
+	if err != nil {
+		return err
+	}
+	if err := api.SetDeliveryPricing(delivery); err != nil {
+		return err
+	}
+
+	if *seedFile != "" {
+		if gin.Mode() == gin.ReleaseMode {
+			return fmt.Errorf("-seed is disabled in release mode, use \"ecommerce seed\" instead")
+		}
+		if err := loadSeed(s, *seedFile, "", *demoUser); err != nil {
+			return err
+		}
+	}
+
+	if dir := os.Getenv("NOTIFY_OUTBOX"); dir != "" {
+		var to []string
+		if v := os.Getenv("ALERT_EMAIL"); v != "" {
+			to = strings.Split(v, ",")
+		}
+		api.SetNotifier(notify.NewOutboxSender(dir, "alerts@thedot.com"), to...)
+		api.SetChannel(api.ChannelEmail, notify.NewOutboxSender(dir, "notifications@thedot.com"))
+		api.SetChannel(api.ChannelSMS, notify.NewSMSOutboxSender(dir))
+	}
+
+	go api.SweepReservations(context.Background(), time.Minute)
+	go api.WatchStockLevels(context.Background(), time.Minute)
+	go api.WatchPrices(context.Background(), time.Minute)
+	go api.WatchRecommendations(context.Background(), time.Hour)
+	go api.RunSubscriptionJobs(context.Background(), time.Minute)
+	go api.RunAbandonedCarts(context.Background(), time.Minute)
+
 	router := setupRouter()
-	log.Fatal(router.Run(":8080"))
+	return router.Run(":8080")
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: ecommerce [command]
+
+commands:
+  serve [-seed file]      start the web server (default)
+  migrate up|down|status  manage the database schema
+  seed -file path         load users, products and categories from a fixture
+  catalog import|export   bulk import or export products as CSV
+  inventory reconcile     check stock levels against the stock ledger`)
+}
+
+func main() {
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "serve":
+		err = serve(args)
+	case "migrate":
+		err = runMigrate(args)
+	case "seed":
+		err = runSeed(args)
+	case "catalog":
+		err = runCatalog(args)
+	case "inventory":
+		err = runInventory(args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
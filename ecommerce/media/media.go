@@ -0,0 +1,126 @@
+// Package media stores uploaded product images together with resized
+// renditions for the storefront. Files are addressed by a content hash, so a
+// stored name never changes meaning and can be cached indefinitely.
+package media
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"path"
+
+	// Register the decoders accepted for uploads
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+)
+
+// MaxUploadSize is the largest accepted upload in bytes
+const MaxUploadSize = 5 << 20
+
+// maxPixels bounds the decoded size of an upload so a small, highly
+// compressed file cannot exhaust memory
+const maxPixels = 40_000_000
+
+// ErrUnsupportedType is returned for uploads that are not JPEG, PNG or GIF images
+var ErrUnsupportedType = errors.New("unsupported image type, use JPEG, PNG or GIF")
+
+// ErrTooLarge is returned for uploads over MaxUploadSize or maxPixels
+var ErrTooLarge = errors.New("image too large")
+
+// Rendition sizes, as the length of the longest side in pixels
+const (
+	LargeSize = 1200
+	ThumbSize = 300
+)
+
+// extensions maps accepted content types to the extension of the stored original
+var extensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Image names the stored files for one upload
+type Image struct {
+	Original string
+	Large    string
+	Thumb    string
+}
+
+// Save validates an uploaded image, stores the original under prefix and
+// writes JPEG renditions for display and thumbnails
+func Save(ctx context.Context, s Storage, prefix string, data []byte) (Image, error) {
+	if len(data) > MaxUploadSize {
+		return Image{}, ErrTooLarge
+	}
+	ext, ok := extensions[http.DetectContentType(data)]
+	if !ok {
+		return Image{}, ErrUnsupportedType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, ErrUnsupportedType
+	}
+	if config.Width*config.Height > maxPixels {
+		return Image{}, ErrTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, fmt.Errorf("decoding image: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	base := path.Join(prefix, hex.EncodeToString(sum[:8]))
+	img := Image{Original: base + ext, Large: base + "_large.jpg", Thumb: base + "_thumb.jpg"}
+
+	if err := s.Put(ctx, img.Original, bytes.NewReader(data)); err != nil {
+		return Image{}, err
+	}
+	for name, size := range map[string]int{img.Large: LargeSize, img.Thumb: ThumbSize} {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, Resize(src, size), &jpeg.Options{Quality: 85}); err != nil {
+			return Image{}, err
+		}
+		if err := s.Put(ctx, name, &buf); err != nil {
+			return Image{}, err
+		}
+	}
+	return img, nil
+}
+
+// Resize scales src so its longest side is at most size pixels, keeping the
+// aspect ratio. Images are never enlarged. Transparent areas are flattened
+// onto white since renditions are stored as JPEG.
+func Resize(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/bounds.Dx())
+		} else {
+			w, h = max(1, w*size/bounds.Dy()), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,115 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encodePNG returns a blank PNG of the given size
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name         string
+		w, h, size   int
+		wantW, wantH int
+	}{
+		{"wide", 1600, 800, 300, 300, 150},
+		{"tall", 800, 1600, 300, 150, 300},
+		{"never enlarged", 200, 100, 300, 200, 100},
+		{"thin strip keeps a pixel", 3000, 2, 300, 300, 1},
+	}
+	for _, tt := range tests {
+		got := Resize(image.NewRGBA(image.Rect(0, 0, tt.w, tt.h)), tt.size).Bounds()
+		if got.Dx() != tt.wantW || got.Dy() != tt.wantH {
+			t.Errorf("%s: resized to %dx%d, want %dx%d", tt.name, got.Dx(), got.Dy(), tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestSave(t *testing.T) {
+	ctx := context.Background()
+	s := NewDiskStorage(t.TempDir())
+	data := encodePNG(t, 40, 20)
+
+	img, err := Save(ctx, s, "products/gin", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Names are derived from the content, so the same upload maps to the same files
+	again, err := Save(ctx, s, "products/gin", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img != again || filepath.Ext(img.Original) != ".png" {
+		t.Fatalf("saved as %+v then %+v", img, again)
+	}
+	f, err := s.Open(ctx, img.Original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatal("the original was not stored unchanged")
+	}
+
+	// A small file may still claim a huge image; its header is checked
+	// before anything is decoded
+	bomb := encodePNG(t, 1, 1)
+	binary.BigEndian.PutUint32(bomb[16:], 20000)
+	binary.BigEndian.PutUint32(bomb[20:], 20000)
+	binary.BigEndian.PutUint32(bomb[29:], crc32.ChecksumIEEE(bomb[12:29]))
+
+	for name, tt := range map[string]struct {
+		data []byte
+		err  error
+	}{
+		"text":            {[]byte("not an image"), ErrUnsupportedType},
+		"too many bytes":  {make([]byte, MaxUploadSize+1), ErrTooLarge},
+		"too many pixels": {bomb, ErrTooLarge},
+	} {
+		if _, err := Save(ctx, s, "products/gin", tt.data); !errors.Is(err, tt.err) {
+			t.Errorf("%s: returned %v, want %v", name, err, tt.err)
+		}
+	}
+}
+
+func TestDiskStorageStaysInRoot(t *testing.T) {
+	ctx := context.Background()
+	parent := t.TempDir()
+	root := filepath.Join(parent, "uploads")
+	s := NewDiskStorage(root)
+
+	if err := s.Put(ctx, "../escaped.txt", bytes.NewReader([]byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escaped.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("a relative name wrote outside the storage root")
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped.txt")); err != nil {
+		t.Fatalf("expected the file inside the root: %v", err)
+	}
+
+	for _, name := range []string{"", "/", "missing.jpg", `..\escaped.txt`} {
+		if _, err := s.Open(ctx, name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("opening %q returned %v, want %v", name, err, ErrNotFound)
+		}
+	}
+}
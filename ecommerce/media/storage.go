@@ -0,0 +1,87 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned when a stored file does not exist
+var ErrNotFound = errors.New("file not found")
+
+// Storage holds uploaded files addressed by slash-separated names such as
+// "products/42/9f86d081884c7d65.jpg"
+type Storage interface {
+	Put(ctx context.Context, name string, r io.Reader) error
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+// DiskStorage keeps files under a directory on the local filesystem
+type DiskStorage struct {
+	root string
+}
+
+// NewDiskStorage returns a Storage rooted at dir. The directory is created on
+// the first write.
+func NewDiskStorage(dir string) *DiskStorage {
+	return &DiskStorage{root: dir}
+}
+
+// path maps a storage name to a file below the root, rejecting names that
+// would escape it
+func (s *DiskStorage) path(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" || strings.Contains(name, `\`) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+// Put writes the file atomically so readers never see a partial image
+func (s *DiskStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	dst, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (s *DiskStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	src, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return f, nil
+}
@@ -0,0 +1,105 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// scripts returns a file system holding the given migration files
+func scripts(names ...string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for _, name := range names {
+		fsys[name] = &fstest.MapFile{Data: []byte("-- " + name + "\n")}
+	}
+	return fsys
+}
+
+func TestLoadEmbedded(t *testing.T) {
+	list, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) == 0 || list[0].Version != 1 || list[0].Name != "initial_schema" {
+		t.Fatalf("embedded migrations start with %+v", list[0])
+	}
+	for i, m := range list {
+		if m.Version != i+1 {
+			t.Fatalf("migration %d_%s is out of sequence at position %d", m.Version, m.Name, i+1)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	list, err := load(scripts(
+		"10_tenth.up.sql", "10_tenth.down.sql",
+		"2_second.down.sql", "2_second.up.sql",
+		"0001_first.up.sql", "0001_first.down.sql",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Versions sort as numbers, not as file names
+	var names []string
+	for _, m := range list {
+		names = append(names, m.Name)
+	}
+	if strings.Join(names, " ") != "first second tenth" {
+		t.Fatalf("loaded %v, want first second tenth", names)
+	}
+	if first := list[0]; first.Version != 1 || first.Up != "-- 0001_first.up.sql\n" || first.Down != "-- 0001_first.down.sql\n" {
+		t.Fatalf("first migration is %+v", first)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		files []string
+		err   string
+	}{
+		{"bad name", []string{"1_first.up.sql", "1_first.down.sql", "readme.md"}, "invalid migration file name"},
+		{"missing down", []string{"1_first.up.sql"}, "missing its up or down file"},
+		{"two names for a version", []string{"1_first.up.sql", "1_other.down.sql"}, "conflicting names"},
+		{"version written twice", []string{"1_first.up.sql", "01_first.up.sql", "1_first.down.sql"}, "more than one up file"},
+	} {
+		_, err := load(scripts(tt.files...))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: expected an error about %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	fsys := scripts("1_first.up.sql", "1_first.down.sql")
+	checksumOf := func() string {
+		t.Helper()
+		list, err := load(fsys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list[0].Checksum
+	}
+
+	original := checksumOf()
+	fsys["1_first.down.sql"].Data = []byte("DROP TABLE first;\n")
+	edited := checksumOf()
+	if edited == original {
+		t.Fatal("editing the down script left the checksum unchanged")
+	}
+	if checksum("ab", "c") == checksum("a", "bc") {
+		t.Fatal("moving text between the scripts left the checksum unchanged")
+	}
+
+	// A database that applied the original is told the migration changed
+	m := &Migrator{migrations: []Migration{{Version: 1, Name: "first", Checksum: edited}}}
+	if err := m.verify(map[int]appliedMigration{1: {checksum: edited}}); err != nil {
+		t.Fatalf("unchanged migration failed verification: %v", err)
+	}
+	err := m.verify(map[int]appliedMigration{1: {checksum: original}})
+	if err == nil || !strings.Contains(err.Error(), "1_first has been modified") {
+		t.Fatalf("edited migration returned %v", err)
+	}
+	err = m.verify(map[int]appliedMigration{1: {checksum: edited}, 2: {checksum: original}})
+	if err == nil || !strings.Contains(err.Error(), "does not know about") {
+		t.Fatalf("unknown applied migration returned %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+CREATE TABLE products (
+    id          TEXT PRIMARY KEY,
+    name        TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    price       NUMERIC(12,2) NOT NULL,
+    stock       INTEGER NOT NULL DEFAULT 0,
+    image       TEXT NOT NULL DEFAULT '',
+    category    TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE users (
+    id         TEXT PRIMARY KEY,
+    email      TEXT NOT NULL UNIQUE,
+    password   TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE orders (
+    id               TEXT PRIMARY KEY,
+    user_id          TEXT NOT NULL REFERENCES users(id),
+    delivery_name    TEXT NOT NULL,
+    delivery_address TEXT NOT NULL,
+    delivery_city    TEXT NOT NULL,
+    delivery_phone   TEXT NOT NULL,
+    payment_method   TEXT NOT NULL,
+    payment_phone    TEXT NOT NULL DEFAULT '',
+    total_amount     NUMERIC(12,2) NOT NULL,
+    status           TEXT NOT NULL,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE order_items (
+    order_id   TEXT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    position   INTEGER NOT NULL,
+    product_id TEXT NOT NULL,
+    name       TEXT NOT NULL,
+    price      NUMERIC(12,2) NOT NULL,
+    quantity   INTEGER NOT NULL,
+    PRIMARY KEY (order_id, position)
+);
+
+CREATE TABLE carts (
+    user_id    TEXT PRIMARY KEY,
+    total      NUMERIC(12,2) NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE cart_items (
+    user_id             TEXT NOT NULL REFERENCES carts(user_id) ON DELETE CASCADE,
+    position            INTEGER NOT NULL,
+    product_id          TEXT NOT NULL,
+    name                TEXT NOT NULL DEFAULT '',
+    price               NUMERIC(12,2) NOT NULL DEFAULT 0,
+    quantity            INTEGER NOT NULL,
+    product_image       TEXT NOT NULL DEFAULT '',
+    product_description TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (user_id, position)
+);
+
+CREATE TABLE mpesa_transactions (
+    order_id            TEXT PRIMARY KEY,
+    checkout_request_id TEXT NOT NULL DEFAULT '',
+    phone_number        TEXT NOT NULL,
+    amount              NUMERIC(12,2) NOT NULL,
+    status              TEXT NOT NULL,
+    result_code         TEXT NOT NULL DEFAULT '',
+    result_desc         TEXT NOT NULL DEFAULT '',
+    created_at          TIMESTAMPTZ NOT NULL DEFAULT now()
+);
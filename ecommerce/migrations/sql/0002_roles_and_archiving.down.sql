@@ -0,0 +1,3 @@
+ALTER TABLE products DROP COLUMN archived_at;
+
+ALTER TABLE users DROP COLUMN role;
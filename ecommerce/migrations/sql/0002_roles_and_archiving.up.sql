@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'customer';
+
+ALTER TABLE products ADD COLUMN archived_at TIMESTAMPTZ;
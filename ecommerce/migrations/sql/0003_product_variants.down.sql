@@ -0,0 +1,5 @@
+ALTER TABLE order_items DROP COLUMN sku;
+
+ALTER TABLE cart_items DROP COLUMN sku;
+
+DROP TABLE product_variants;
@@ -0,0 +1,15 @@
+CREATE TABLE product_variants (
+    sku        TEXT PRIMARY KEY,
+    product_id TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    position   INTEGER NOT NULL,
+    size       TEXT NOT NULL,
+    price      NUMERIC(12,2) NOT NULL,
+    stock      INTEGER NOT NULL DEFAULT 0,
+    barcode    TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX product_variants_product_id_idx ON product_variants (product_id);
+
+ALTER TABLE cart_items ADD COLUMN sku TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE order_items ADD COLUMN sku TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+DROP INDEX products_category_idx;
+
+UPDATE products p
+SET category = c.name
+FROM categories c
+WHERE p.category = c.slug;
+
+DROP TABLE categories;
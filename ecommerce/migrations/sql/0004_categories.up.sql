@@ -0,0 +1,28 @@
+CREATE TABLE categories (
+    slug       TEXT PRIMARY KEY,
+    name       TEXT NOT NULL,
+    parent     TEXT REFERENCES categories(slug) ON DELETE RESTRICT,
+    position   INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX categories_parent_idx ON categories (parent);
+
+-- Existing free-form categories become top-level categories and products
+-- switch to referencing them by slug
+INSERT INTO categories (slug, name)
+SELECT DISTINCT ON (slug) slug, name
+FROM (
+    SELECT trim(both '-' FROM regexp_replace(lower(category), '[^a-z0-9]+', '-', 'g')) AS slug,
+           category AS name
+    FROM products
+    WHERE category <> ''
+) existing
+WHERE slug <> ''
+ORDER BY slug, name;
+
+UPDATE products
+SET category = trim(both '-' FROM regexp_replace(lower(category), '[^a-z0-9]+', '-', 'g'))
+WHERE category <> '';
+
+CREATE INDEX products_category_idx ON products (category);
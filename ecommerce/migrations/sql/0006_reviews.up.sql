@@ -0,0 +1,13 @@
+CREATE TABLE reviews (
+    id         TEXT PRIMARY KEY,
+    product_id TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    user_id    TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    author     TEXT NOT NULL,
+    rating     SMALLINT NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    body       TEXT NOT NULL DEFAULT '',
+    hidden     BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (product_id, user_id)
+);
+
+CREATE INDEX reviews_product_id_idx ON reviews (product_id, created_at DESC);
@@ -0,0 +1,4 @@
+DROP INDEX orders_reservation_idx;
+
+ALTER TABLE orders DROP COLUMN reserved_until;
+ALTER TABLE orders DROP COLUMN reservation;
@@ -0,0 +1,4 @@
+ALTER TABLE orders ADD COLUMN reservation TEXT NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN reserved_until TIMESTAMPTZ;
+
+CREATE INDEX orders_reservation_idx ON orders (reservation, reserved_until);
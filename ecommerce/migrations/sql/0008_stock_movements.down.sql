@@ -0,0 +1,3 @@
+DROP TABLE stock_movements;
+
+DROP FUNCTION stock_movements_immutable();
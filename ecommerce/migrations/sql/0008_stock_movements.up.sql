@@ -0,0 +1,37 @@
+CREATE TABLE stock_movements (
+    id         TEXT PRIMARY KEY,
+    product_id TEXT NOT NULL REFERENCES products(id),
+    sku        TEXT NOT NULL DEFAULT '',
+    type       TEXT NOT NULL,
+    delta      INTEGER NOT NULL,
+    balance    INTEGER NOT NULL,
+    actor      TEXT NOT NULL,
+    reason     TEXT NOT NULL DEFAULT '',
+    reference  TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX stock_movements_product_id_idx ON stock_movements (product_id, created_at DESC);
+
+-- The ledger is append-only
+CREATE FUNCTION stock_movements_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'stock movements cannot be changed';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER stock_movements_immutable
+    BEFORE UPDATE OR DELETE ON stock_movements
+    FOR EACH ROW EXECUTE FUNCTION stock_movements_immutable();
+
+-- Open the ledger with the stock on hand
+INSERT INTO stock_movements (id, product_id, sku, type, delta, balance, actor, reason)
+SELECT 'opening-' || p.id, p.id, '', 'opening', p.stock, p.stock, 'system', 'ledger opened'
+FROM products p
+WHERE p.stock <> 0 AND NOT EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = p.id);
+
+INSERT INTO stock_movements (id, product_id, sku, type, delta, balance, actor, reason)
+SELECT 'opening-' || v.product_id || '-' || v.sku, v.product_id, v.sku, 'opening', v.stock, v.stock,
+    'system', 'ledger opened'
+FROM product_variants v
+WHERE v.stock <> 0;
@@ -0,0 +1,2 @@
+ALTER TABLE products DROP COLUMN low_stock_since;
+ALTER TABLE products DROP COLUMN reorder_level;
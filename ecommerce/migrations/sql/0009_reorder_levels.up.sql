@@ -0,0 +1,2 @@
+ALTER TABLE products ADD COLUMN reorder_level INTEGER NOT NULL DEFAULT 0 CHECK (reorder_level >= 0);
+ALTER TABLE products ADD COLUMN low_stock_since TIMESTAMPTZ;
@@ -0,0 +1,5 @@
+DROP TABLE price_history;
+
+DROP TABLE price_schedule;
+
+DROP TABLE promotions;
@@ -0,0 +1,51 @@
+CREATE TABLE promotions (
+    id         TEXT PRIMARY KEY,
+    product_id TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    sku        TEXT NOT NULL DEFAULT '',
+    name       TEXT NOT NULL DEFAULT '',
+    type       TEXT NOT NULL CHECK (type IN ('percent', 'fixed')),
+    value      NUMERIC(12,2) NOT NULL CHECK (value > 0),
+    starts_at  TIMESTAMPTZ NOT NULL,
+    ends_at    TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (ends_at > starts_at)
+);
+
+CREATE INDEX promotions_product_id_idx ON promotions (product_id, ends_at);
+
+CREATE TABLE price_schedule (
+    id           TEXT PRIMARY KEY,
+    product_id   TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    sku          TEXT NOT NULL DEFAULT '',
+    price        NUMERIC(12,2) NOT NULL CHECK (price > 0),
+    effective_at TIMESTAMPTZ NOT NULL,
+    applied_at   TIMESTAMPTZ,
+    created_by   TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX price_schedule_due_idx ON price_schedule (effective_at) WHERE applied_at IS NULL;
+
+CREATE TABLE price_history (
+    id         TEXT PRIMARY KEY,
+    product_id TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    sku        TEXT NOT NULL DEFAULT '',
+    old_price  NUMERIC(12,2) NOT NULL,
+    price      NUMERIC(12,2) NOT NULL,
+    actor      TEXT NOT NULL,
+    reason     TEXT NOT NULL DEFAULT '',
+    reference  TEXT NOT NULL DEFAULT '',
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX price_history_product_id_idx ON price_history (product_id, changed_at DESC);
+
+-- Start the history with the prices in effect today
+INSERT INTO price_history (id, product_id, sku, old_price, price, actor, reason)
+SELECT 'initial-' || p.id, p.id, '', 0, p.price, 'system', 'history started'
+FROM products p
+WHERE NOT EXISTS (SELECT 1 FROM product_variants v WHERE v.product_id = p.id);
+
+INSERT INTO price_history (id, product_id, sku, old_price, price, actor, reason)
+SELECT 'initial-' || v.product_id || '-' || v.sku, v.product_id, v.sku, 0, v.price, 'system', 'history started'
+FROM product_variants v;
@@ -0,0 +1,14 @@
+DROP INDEX products_vintage_idx;
+DROP INDEX products_country_idx;
+
+ALTER TABLE products DROP COLUMN style;
+ALTER TABLE products DROP COLUMN grape;
+ALTER TABLE products DROP COLUMN cask;
+ALTER TABLE products DROP COLUMN vintage;
+ALTER TABLE products DROP COLUMN age_years;
+ALTER TABLE products DROP COLUMN region;
+ALTER TABLE products DROP COLUMN country;
+ALTER TABLE products DROP COLUMN volume_ml;
+ALTER TABLE products DROP COLUMN abv;
+
+ALTER TABLE categories DROP COLUMN kind;
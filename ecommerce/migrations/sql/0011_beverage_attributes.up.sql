@@ -0,0 +1,15 @@
+ALTER TABLE categories ADD COLUMN kind TEXT NOT NULL DEFAULT ''
+    CHECK (kind IN ('', 'spirit', 'wine', 'beer'));
+
+ALTER TABLE products ADD COLUMN abv NUMERIC(4, 1) CHECK (abv BETWEEN 0 AND 100);
+ALTER TABLE products ADD COLUMN volume_ml INTEGER CHECK (volume_ml > 0);
+ALTER TABLE products ADD COLUMN country TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN region TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN age_years INTEGER CHECK (age_years > 0);
+ALTER TABLE products ADD COLUMN vintage INTEGER CHECK (vintage >= 1800);
+ALTER TABLE products ADD COLUMN cask TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN grape TEXT NOT NULL DEFAULT '';
+ALTER TABLE products ADD COLUMN style TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX products_country_idx ON products (lower(country));
+CREATE INDEX products_vintage_idx ON products (vintage);
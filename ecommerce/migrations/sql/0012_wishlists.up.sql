@@ -0,0 +1,17 @@
+CREATE TABLE wishlists (
+    id         TEXT PRIMARY KEY,
+    user_id    TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX wishlists_user_name_idx ON wishlists (user_id, lower(name));
+
+CREATE TABLE wishlist_items (
+    wishlist_id TEXT NOT NULL REFERENCES wishlists(id) ON DELETE CASCADE,
+    product_id  TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    sku         TEXT NOT NULL DEFAULT '',
+    added_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (wishlist_id, product_id, sku)
+);
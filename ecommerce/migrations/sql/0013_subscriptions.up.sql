@@ -0,0 +1,18 @@
+CREATE TABLE subscriptions (
+    id          TEXT PRIMARY KEY,
+    user_id     TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    product_id  TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    sku         TEXT NOT NULL DEFAULT '',
+    type        TEXT NOT NULL CHECK (type IN ('back_in_stock', 'price_drop')),
+    channel     TEXT NOT NULL CHECK (channel IN ('email', 'sms')),
+    destination TEXT NOT NULL,
+    price       NUMERIC(12,2) NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    notified_at TIMESTAMPTZ
+);
+
+-- One active alert of each type per user and product SKU
+CREATE UNIQUE INDEX subscriptions_active_idx ON subscriptions (user_id, product_id, sku, type)
+    WHERE notified_at IS NULL;
+
+CREATE INDEX subscriptions_product_id_idx ON subscriptions (product_id) WHERE notified_at IS NULL;
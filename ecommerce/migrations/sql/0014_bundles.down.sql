@@ -0,0 +1,3 @@
+DROP TABLE order_item_bundles;
+DROP FUNCTION bundle_stock(TEXT);
+DROP TABLE bundle_items;
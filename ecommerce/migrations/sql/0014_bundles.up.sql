@@ -0,0 +1,39 @@
+CREATE TABLE bundle_items (
+    bundle_id  TEXT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    position   INTEGER NOT NULL,
+    product_id TEXT NOT NULL REFERENCES products(id),
+    sku        TEXT NOT NULL DEFAULT '',
+    quantity   INTEGER NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (bundle_id, position)
+);
+
+CREATE INDEX bundle_items_product_id_idx ON bundle_items (product_id);
+
+-- bundle_stock returns how many of a bundle can be put together from its
+-- components' stock, or NULL for products that are not bundles. Archived
+-- components and SKUs the component no longer has count as out of stock.
+CREATE FUNCTION bundle_stock(bundle TEXT) RETURNS INTEGER AS $$
+    SELECT min(
+        CASE
+            WHEN p.archived_at IS NOT NULL THEN 0
+            WHEN i.sku = '' THEN CASE WHEN EXISTS (SELECT 1 FROM product_variants WHERE product_id = p.id)
+                THEN 0 ELSE p.stock END
+            ELSE COALESCE(v.stock, 0)
+        END / i.quantity)::INTEGER
+    FROM bundle_items i
+    JOIN products p ON p.id = i.product_id
+    LEFT JOIN product_variants v ON v.sku = i.sku AND v.product_id = i.product_id
+    WHERE i.bundle_id = bundle
+$$ LANGUAGE SQL STABLE;
+
+-- Contents of bundles as ordered, so cancellations restock the same components
+CREATE TABLE order_item_bundles (
+    order_id   TEXT NOT NULL,
+    position   INTEGER NOT NULL,
+    component  INTEGER NOT NULL,
+    product_id TEXT NOT NULL,
+    sku        TEXT NOT NULL DEFAULT '',
+    quantity   INTEGER NOT NULL,
+    PRIMARY KEY (order_id, position, component),
+    FOREIGN KEY (order_id, position) REFERENCES order_items (order_id, position) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+DROP INDEX carts_updated_at_idx;
+DROP TABLE abandoned_carts;
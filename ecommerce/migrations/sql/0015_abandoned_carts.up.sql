@@ -0,0 +1,18 @@
+-- One row per spell of idleness of a user's cart, identified by when the
+-- cart was last changed
+CREATE TABLE abandoned_carts (
+    id             TEXT PRIMARY KEY,
+    user_id        TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    abandoned_at   TIMESTAMPTZ NOT NULL,
+    items          INTEGER NOT NULL,
+    total          NUMERIC(12,2) NOT NULL,
+    reminders_sent INTEGER NOT NULL DEFAULT 0,
+    order_id       TEXT NOT NULL DEFAULT '',
+    recovered_at   TIMESTAMPTZ,
+    expired_at     TIMESTAMPTZ,
+    UNIQUE (user_id, abandoned_at)
+);
+
+CREATE INDEX abandoned_carts_abandoned_at_idx ON abandoned_carts (abandoned_at);
+
+CREATE INDEX carts_updated_at_idx ON carts (updated_at);
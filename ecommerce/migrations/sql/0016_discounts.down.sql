@@ -0,0 +1,5 @@
+ALTER TABLE carts DROP COLUMN coupon_code;
+ALTER TABLE orders DROP COLUMN coupon_code, DROP COLUMN delivery_fee, DROP COLUMN subtotal;
+DROP TABLE order_discounts;
+DROP TABLE discount_redemptions;
+DROP TABLE discounts;
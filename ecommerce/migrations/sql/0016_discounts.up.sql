@@ -0,0 +1,57 @@
+-- Coupons and automatic discounts. Coupon codes are unique among the
+-- discounts that have not been archived.
+CREATE TABLE discounts (
+    id             TEXT PRIMARY KEY,
+    name           TEXT NOT NULL,
+    code           TEXT NOT NULL DEFAULT '',
+    categories     TEXT[] NOT NULL DEFAULT '{}',
+    product_ids    TEXT[] NOT NULL DEFAULT '{}',
+    min_subtotal   NUMERIC(12,2) NOT NULL DEFAULT 0,
+    first_order    BOOLEAN NOT NULL DEFAULT false,
+    usage_limit    INTEGER NOT NULL DEFAULT 0,
+    per_user_limit INTEGER NOT NULL DEFAULT 0,
+    starts_at      TIMESTAMPTZ,
+    ends_at        TIMESTAMPTZ,
+    action         TEXT NOT NULL,
+    value          NUMERIC(12,2) NOT NULL DEFAULT 0,
+    buy_quantity   INTEGER NOT NULL DEFAULT 0,
+    get_quantity   INTEGER NOT NULL DEFAULT 0,
+    archived_at    TIMESTAMPTZ,
+    created_at     TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX discounts_code_idx ON discounts (code) WHERE code <> '' AND archived_at IS NULL;
+
+-- Redemptions are recorded before the order is saved, so order_id has no
+-- foreign key; cancelled and expired orders delete theirs
+CREATE TABLE discount_redemptions (
+    discount_id TEXT NOT NULL REFERENCES discounts(id),
+    order_id    TEXT NOT NULL,
+    user_id     TEXT NOT NULL,
+    redeemed_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (discount_id, order_id)
+);
+
+CREATE INDEX discount_redemptions_order_id_idx ON discount_redemptions (order_id);
+
+-- Discount lines as applied when the order was placed
+CREATE TABLE order_discounts (
+    order_id    TEXT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    position    INTEGER NOT NULL,
+    discount_id TEXT NOT NULL REFERENCES discounts(id),
+    name        TEXT NOT NULL,
+    code        TEXT NOT NULL DEFAULT '',
+    type        TEXT NOT NULL,
+    amount      NUMERIC(12,2) NOT NULL,
+    PRIMARY KEY (order_id, position)
+);
+
+-- Orders placed before discounts were paid their subtotal, with no delivery fee
+ALTER TABLE orders
+    ADD COLUMN subtotal     NUMERIC(12,2),
+    ADD COLUMN delivery_fee NUMERIC(12,2) NOT NULL DEFAULT 0,
+    ADD COLUMN coupon_code  TEXT NOT NULL DEFAULT '';
+UPDATE orders SET subtotal = total_amount;
+ALTER TABLE orders ALTER COLUMN subtotal SET NOT NULL;
+
+ALTER TABLE carts ADD COLUMN coupon_code TEXT NOT NULL DEFAULT '';
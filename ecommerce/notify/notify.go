@@ -0,0 +1,104 @@
+// Package notify delivers messages such as stock alerts to the shop's staff
+// and customers. Senders are pluggable; the ones here log messages or write
+// them to an outbox directory until real email and SMS providers are
+// configured.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text notification
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Sender delivers messages
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogSender writes messages to a logger instead of delivering them
+type LogSender struct {
+	logger *log.Logger
+}
+
+// NewLogSender returns a Sender that logs each message to logger
+func NewLogSender(logger *log.Logger) *LogSender {
+	return &LogSender{logger: logger}
+}
+
+func (s *LogSender) Send(ctx context.Context, msg Message) error {
+	s.logger.Printf("notification to %s: %s\n%s", strings.Join(msg.To, ", "), msg.Subject, msg.Body)
+	return nil
+}
+
+// OutboxSender stands in for email by writing each message to a file in a
+// directory, in a form that mail tools can open
+type OutboxSender struct {
+	dir  string
+	from string
+}
+
+// NewOutboxSender returns a Sender that writes messages from the given
+// address into dir. The directory is created on the first message.
+func NewOutboxSender(dir, from string) *OutboxSender {
+	return &OutboxSender{dir: dir, from: from}
+}
+
+func (s *OutboxSender) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	now := time.Now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return writeOutbox(s.dir, now, ".eml", b.String())
+}
+
+// SMSOutboxSender stands in for an SMS gateway by writing each message to a
+// text file in a directory. Subject and body are sent as one text.
+type SMSOutboxSender struct {
+	dir string
+}
+
+// NewSMSOutboxSender returns a Sender that writes text messages into dir.
+// The directory is created on the first message.
+func NewSMSOutboxSender(dir string) *SMSOutboxSender {
+	return &SMSOutboxSender{dir: dir}
+}
+
+func (s *SMSOutboxSender) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	now := time.Now()
+	text := fmt.Sprintf("To: %s\n\n%s\n%s\n", strings.Join(msg.To, ", "), msg.Subject, msg.Body)
+	return writeOutbox(s.dir, now, ".sms", text)
+}
+
+// writeOutbox writes one message to a new file in dir named after the time
+func writeOutbox(dir string, now time.Time, ext, content string) error {
+	f, err := os.CreateTemp(dir, now.Format("20060102T150405")+"-*"+ext)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
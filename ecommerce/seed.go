@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"ecommerce/api"
+	"ecommerce/seed"
+)
+
+// runSeed implements the "seed" subcommand
+func runSeed(args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	file := flags.String("file", "", "fixture file (.json, .yaml, .yml or .csv)")
+	kind := flags.String("kind", "", "record kind for CSV files: users, products or categories (default: file name)")
+	demoUser := flags.Bool("demo-user", false, "also create the "+seed.DemoUserEmail+" account with the password in SEED_DEMO_PASSWORD")
+	flags.Parse(args)
+
+	if *file == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if os.Getenv("STORAGE_BACKEND") != "postgres" {
+		return fmt.Errorf("seeding the in-memory backend has no lasting effect, use \"ecommerce serve -seed\" instead")
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	return loadSeed(s, *file, *kind, *demoUser)
+}
+
+// loadSeed applies a fixture file to the store and logs the outcome
+func loadSeed(s *api.Store, file, kind string, demoUser bool) error {
+	fixture, err := seed.LoadFile(file, kind)
+	if err != nil {
+		return err
+	}
+
+	opts := seed.Options{DemoUser: demoUser, DemoPassword: os.Getenv("SEED_DEMO_PASSWORD")}
+	report, err := seed.Apply(context.Background(), s, fixture, opts)
+	if errors.Is(err, seed.ErrDemoPasswordRequired) {
+		return fmt.Errorf("set SEED_DEMO_PASSWORD to create %s", seed.DemoUserEmail)
+	}
+	if err != nil {
+		return fmt.Errorf("seeding from %s: %w", file, err)
+	}
+
+	log.Printf("seeded %s: %s", file, report)
+	return nil
+}
@@ -0,0 +1,120 @@
+package seed
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadFile reads a fixture from a .json, .yaml/.yml or .csv file. A CSV file
+// holds a single kind of record ("users", "products" or "categories") with a
+// header row; when kind is empty it is taken from the file name, so
+// products.csv loads products.
+func LoadFile(path, kind string) (*Fixture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fixture := &Fixture{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(fixture)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(fixture)
+	case ".csv":
+		if kind == "" {
+			kind = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		err = decodeCSV(f, kind, fixture)
+	default:
+		return nil, fmt.Errorf("unsupported fixture format %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return fixture, nil
+}
+
+func decodeCSV(r io.Reader, kind string, fixture *Fixture) error {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	header := make(map[string]int, len(rows[0]))
+	for i, name := range rows[0] {
+		header[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	field := func(row []string, name string) string {
+		if i, ok := header[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	for n, row := range rows[1:] {
+		line := n + 2
+		switch kind {
+		case "categories":
+			position := 0
+			if v := field(row, "position"); v != "" {
+				var err error
+				if position, err = strconv.Atoi(v); err != nil {
+					return fmt.Errorf("line %d: invalid position: %w", line, err)
+				}
+			}
+			fixture.Categories = append(fixture.Categories, Category{
+				Slug:     field(row, "slug"),
+				Name:     field(row, "name"),
+				Parent:   field(row, "parent"),
+				Position: position,
+			})
+		case "users":
+			fixture.Users = append(fixture.Users, User{
+				ID:           field(row, "id"),
+				Email:        field(row, "email"),
+				Name:         field(row, "name"),
+				Password:     field(row, "password"),
+				PasswordHash: field(row, "password_hash"),
+				Role:         field(row, "role"),
+			})
+		case "products":
+			price, err := strconv.ParseFloat(field(row, "price"), 64)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid price: %w", line, err)
+			}
+			stock, err := strconv.Atoi(field(row, "stock"))
+			if err != nil {
+				return fmt.Errorf("line %d: invalid stock: %w", line, err)
+			}
+			fixture.Products = append(fixture.Products, Product{
+				ID:          field(row, "id"),
+				Name:        field(row, "name"),
+				Description: field(row, "description"),
+				Price:       price,
+				Stock:       stock,
+				Image:       field(row, "image"),
+				Category:    field(row, "category"),
+			})
+		default:
+			return fmt.Errorf("unknown CSV fixture kind %q, expected users, products or categories", kind)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,420 @@
+// Package seed loads users, products and categories from fixture files into
+// a store. Loading is idempotent: records are upserted by ID, so running the
+// same fixture twice leaves the store unchanged.
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"ecommerce/api"
+
+	"github.com/gin-gonic/gin/binding"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DemoUserEmail is the account created when Options.DemoUser is set
+const DemoUserEmail = "test@thedot.com"
+
+// ErrDemoPasswordRequired is returned when the demo account is requested
+// without a password for it
+var ErrDemoPasswordRequired = errors.New("the demo account requires a password")
+
+// Fixture is the content of a seed file
+type Fixture struct {
+	Categories []Category `json:"categories" yaml:"categories"`
+	Users      []User     `json:"users" yaml:"users"`
+	Products   []Product  `json:"products" yaml:"products"`
+}
+
+// Category is a node in the category tree. Slug defaults to one derived from
+// Name; Parent must name a category listed earlier in the fixture or already
+// in the store.
+type Category struct {
+	Slug     string `json:"slug" yaml:"slug"`
+	Name     string `json:"name" yaml:"name"`
+	Parent   string `json:"parent" yaml:"parent"`
+	Position int    `json:"position" yaml:"position"`
+	// Kind is spirit, wine or beer; empty inherits the parent's kind
+	Kind string `json:"kind" yaml:"kind"`
+}
+
+// User describes an account. Exactly one of Password (plain text, hashed on
+// load) or PasswordHash (bcrypt) must be set.
+type User struct {
+	ID           string `json:"id" yaml:"id"`
+	Email        string `json:"email" yaml:"email"`
+	Name         string `json:"name" yaml:"name"`
+	Password     string `json:"password" yaml:"password"`
+	PasswordHash string `json:"password_hash" yaml:"password_hash"`
+	// Role is "customer" (the default) or "admin"
+	Role string `json:"role" yaml:"role"`
+}
+
+// Product describes a catalog entry
+type Product struct {
+	ID          string  `json:"id" yaml:"id"`
+	Name        string  `json:"name" yaml:"name"`
+	Description string  `json:"description" yaml:"description"`
+	Price       float64 `json:"price" yaml:"price"`
+	Stock       int     `json:"stock" yaml:"stock"`
+	Image       string  `json:"image" yaml:"image"`
+	Category    string  `json:"category" yaml:"category"`
+	// ReorderLevel is the stock at which a low-stock alert is raised
+	ReorderLevel int `json:"reorder_level" yaml:"reorder_level"`
+	// Variants lists the sizes the product is sold in. Price and stock are
+	// derived from them when set.
+	Variants []Variant `json:"variants" yaml:"variants"`
+	// Attributes describe the drink and must suit the category's kind
+	Attributes Attributes `json:"attributes" yaml:"attributes"`
+}
+
+// Attributes are a product's beverage attributes; see api.Attributes
+type Attributes struct {
+	ABV      *float64 `json:"abv" yaml:"abv"`
+	VolumeML *int     `json:"volume_ml" yaml:"volume_ml"`
+	Country  string   `json:"country" yaml:"country"`
+	Region   string   `json:"region" yaml:"region"`
+	AgeYears *int     `json:"age_years" yaml:"age_years"`
+	Vintage  *int     `json:"vintage" yaml:"vintage"`
+	Cask     string   `json:"cask" yaml:"cask"`
+	Grape    string   `json:"grape" yaml:"grape"`
+	Style    string   `json:"style" yaml:"style"`
+}
+
+// Variant describes one size of a product
+type Variant struct {
+	SKU     string  `json:"sku" yaml:"sku"`
+	Size    string  `json:"size" yaml:"size"`
+	Price   float64 `json:"price" yaml:"price"`
+	Stock   int     `json:"stock" yaml:"stock"`
+	Barcode string  `json:"barcode" yaml:"barcode"`
+}
+
+// Options controls how a fixture is applied
+type Options struct {
+	// DemoUser creates the test@thedot.com account. It is never created
+	// unless explicitly requested.
+	DemoUser bool
+	// DemoPassword is the demo account's password, required with DemoUser.
+	// It is never generated, so it never has to be shown or logged.
+	DemoPassword string
+}
+
+// Report summarises what a seed run changed
+type Report struct {
+	CategoriesCreated int
+	CategoriesUpdated int
+	UsersCreated      int
+	UsersUpdated      int
+	ProductsCreated   int
+	ProductsUpdated   int
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("categories: %d created, %d updated; users: %d created, %d updated; products: %d created, %d updated",
+		r.CategoriesCreated, r.CategoriesUpdated, r.UsersCreated, r.UsersUpdated, r.ProductsCreated, r.ProductsUpdated)
+}
+
+// Apply validates the fixture and upserts its contents into s
+func Apply(ctx context.Context, s *api.Store, fixture *Fixture, opts Options) (Report, error) {
+	var report Report
+	ctx = api.WithMovement(ctx, api.MovementSource{Actor: "seed", Reason: "fixture"})
+
+	if opts.DemoUser {
+		if opts.DemoPassword == "" {
+			return report, ErrDemoPasswordRequired
+		}
+		fixture.Users = append(fixture.Users, User{
+			ID:       "demo-user",
+			Email:    DemoUserEmail,
+			Name:     "Test User",
+			Password: opts.DemoPassword,
+		})
+	}
+
+	if err := validate(fixture); err != nil {
+		return report, err
+	}
+	if err := checkStoreCategories(ctx, s, fixture); err != nil {
+		return report, err
+	}
+
+	for _, c := range fixture.Categories {
+		created, err := upsertCategory(ctx, s, c)
+		if err != nil {
+			return report, fmt.Errorf("category %s: %w", c.Slug, err)
+		}
+		if created {
+			report.CategoriesCreated++
+		} else {
+			report.CategoriesUpdated++
+		}
+	}
+
+	for _, u := range fixture.Users {
+		created, err := upsertUser(ctx, s, u)
+		if err != nil {
+			return report, fmt.Errorf("user %s: %w", u.ID, err)
+		}
+		if created {
+			report.UsersCreated++
+		} else {
+			report.UsersUpdated++
+		}
+	}
+
+	for _, p := range fixture.Products {
+		created, err := upsertProduct(ctx, s, p)
+		if err != nil {
+			return report, fmt.Errorf("product %s: %w", p.ID, err)
+		}
+		if created {
+			report.ProductsCreated++
+		} else {
+			report.ProductsUpdated++
+		}
+	}
+
+	return report, nil
+}
+
+// validate checks every record before anything is written so a bad fixture
+// never leaves the store half seeded
+func validate(fixture *Fixture) error {
+	categories := make(map[string]bool, len(fixture.Categories))
+	for i := range fixture.Categories {
+		c := &fixture.Categories[i]
+		if c.Name == "" {
+			return errors.New("category with empty name")
+		}
+		if c.Slug == "" {
+			c.Slug = api.Slugify(c.Name)
+		}
+		if c.Slug == "" || c.Slug != api.Slugify(c.Slug) {
+			return fmt.Errorf("category %s: invalid slug %q", c.Name, c.Slug)
+		}
+		if categories[c.Slug] {
+			return fmt.Errorf("category %s: duplicate slug", c.Slug)
+		}
+		if c.Parent != "" && c.Parent == c.Slug {
+			return fmt.Errorf("category %s: cannot be its own parent", c.Slug)
+		}
+		switch c.Kind {
+		case "", api.KindSpirit, api.KindWine, api.KindBeer:
+		default:
+			return fmt.Errorf("category %s: unknown kind %q", c.Slug, c.Kind)
+		}
+		categories[c.Slug] = true
+	}
+
+	seen := make(map[string]bool)
+	for _, u := range fixture.Users {
+		if u.ID == "" {
+			return fmt.Errorf("user %s: id is required", u.Email)
+		}
+		if seen["user:"+u.ID] {
+			return fmt.Errorf("user %s: duplicate id", u.ID)
+		}
+		seen["user:"+u.ID] = true
+
+		if (u.Password == "") == (u.PasswordHash == "") {
+			return fmt.Errorf("user %s: exactly one of password or password_hash is required", u.ID)
+		}
+		password := u.Password
+		if password == "" {
+			password = u.PasswordHash
+		}
+		candidate := api.User{ID: u.ID, Email: u.Email, Name: u.Name, Password: password}
+		if err := binding.Validator.ValidateStruct(candidate); err != nil {
+			return fmt.Errorf("user %s: %w", u.ID, err)
+		}
+		if u.Role != "" && u.Role != api.RoleCustomer && u.Role != api.RoleAdmin {
+			return fmt.Errorf("user %s: unknown role %q", u.ID, u.Role)
+		}
+	}
+
+	for _, p := range fixture.Products {
+		if p.ID == "" {
+			return fmt.Errorf("product %s: id is required", p.Name)
+		}
+		if seen["product:"+p.ID] {
+			return fmt.Errorf("product %s: duplicate id", p.ID)
+		}
+		seen["product:"+p.ID] = true
+
+		product := toProduct(p)
+		if err := api.ValidateProduct(&product); err != nil {
+			return fmt.Errorf("product %s: %w", p.ID, err)
+		}
+		for _, v := range p.Variants {
+			if seen["sku:"+v.SKU] {
+				return fmt.Errorf("product %s: sku %q used by another product", p.ID, v.SKU)
+			}
+			seen["sku:"+v.SKU] = true
+		}
+	}
+	return nil
+}
+
+// checkStoreCategories verifies that category parents and product categories
+// not defined in the fixture already exist in the store. Parents defined in
+// the fixture must come before their children.
+func checkStoreCategories(ctx context.Context, s *api.Store, fixture *Fixture) error {
+	defined := make(map[string]bool, len(fixture.Categories))
+	exists := func(slug string) error {
+		if defined[slug] {
+			return nil
+		}
+		_, err := s.Categories.Get(ctx, slug)
+		if errors.Is(err, api.ErrNotFound) {
+			return fmt.Errorf("unknown category %q", slug)
+		}
+		return err
+	}
+
+	for _, c := range fixture.Categories {
+		if c.Parent != "" {
+			if err := exists(c.Parent); err != nil {
+				return fmt.Errorf("category %s: parent: %w", c.Slug, err)
+			}
+		}
+		defined[c.Slug] = true
+	}
+	for _, p := range fixture.Products {
+		if p.Category != "" {
+			if err := exists(p.Category); err != nil {
+				return fmt.Errorf("product %s: %w", p.ID, err)
+			}
+		}
+	}
+	return checkAttributes(ctx, s, fixture)
+}
+
+// checkAttributes validates product attributes against the category kinds
+// the store will hold once the fixture's categories are applied
+func checkAttributes(ctx context.Context, s *api.Store, fixture *Fixture) error {
+	stored, err := s.Categories.List(ctx)
+	if err != nil {
+		return err
+	}
+	bySlug := make(map[string]api.Category, len(stored)+len(fixture.Categories))
+	for _, c := range stored {
+		bySlug[c.Slug] = c
+	}
+	for _, c := range fixture.Categories {
+		bySlug[c.Slug] = toCategory(c)
+	}
+	categories := make([]api.Category, 0, len(bySlug))
+	for _, c := range bySlug {
+		categories = append(categories, c)
+	}
+
+	for _, p := range fixture.Products {
+		if err := api.ValidateAttributes(categories, toProduct(p)); err != nil {
+			return fmt.Errorf("product %s: %w", p.ID, err)
+		}
+	}
+	return nil
+}
+
+func toCategory(c Category) api.Category {
+	return api.Category{Slug: c.Slug, Name: c.Name, Parent: c.Parent, Position: c.Position, Kind: c.Kind}
+}
+
+func toProduct(p Product) api.Product {
+	var variants []api.Variant
+	for _, v := range p.Variants {
+		variants = append(variants, api.Variant{
+			SKU: v.SKU, Size: v.Size, Price: v.Price, Stock: v.Stock, Barcode: v.Barcode,
+		})
+	}
+	return api.Product{
+		ID:           p.ID,
+		Name:         p.Name,
+		Description:  p.Description,
+		Price:        p.Price,
+		Stock:        p.Stock,
+		Image:        p.Image,
+		Category:     p.Category,
+		Variants:     variants,
+		ReorderLevel: p.ReorderLevel,
+		Attributes:   api.Attributes(p.Attributes),
+	}
+}
+
+func upsertCategory(ctx context.Context, s *api.Store, c Category) (bool, error) {
+	existing, err := s.Categories.Get(ctx, c.Slug)
+	created := errors.Is(err, api.ErrNotFound)
+	if err != nil && !created {
+		return false, err
+	}
+
+	category := toCategory(c)
+	category.CreatedAt = time.Now()
+	if !created {
+		category.CreatedAt = existing.CreatedAt
+	}
+	return created, s.Categories.Save(ctx, category)
+}
+
+func upsertUser(ctx context.Context, s *api.Store, u User) (bool, error) {
+	existing, err := s.Users.Get(ctx, u.ID)
+	created := errors.Is(err, api.ErrNotFound)
+	if err != nil && !created {
+		return false, err
+	}
+
+	user := api.User{ID: u.ID, Email: u.Email, Name: u.Name, Password: u.PasswordHash, Role: u.Role, CreatedAt: time.Now()}
+	if user.Role == "" {
+		user.Role = api.RoleCustomer
+	}
+	if !created {
+		user.CreatedAt = existing.CreatedAt
+	}
+	if u.Password != "" {
+		// Keep the stored hash when the password has not changed so repeated
+		// runs do not rewrite every account
+		if !created && bcrypt.CompareHashAndPassword([]byte(existing.Password), []byte(u.Password)) == nil {
+			user.Password = existing.Password
+		} else {
+			hash, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+			if err != nil {
+				return false, err
+			}
+			user.Password = string(hash)
+		}
+	}
+
+	return created, s.Users.Save(ctx, user)
+}
+
+func upsertProduct(ctx context.Context, s *api.Store, p Product) (bool, error) {
+	existing, err := s.Products.Get(ctx, p.ID)
+	created := errors.Is(err, api.ErrNotFound)
+	if err != nil && !created {
+		return false, err
+	}
+
+	product := toProduct(p)
+	if err := api.ValidateProduct(&product); err != nil {
+		return false, err
+	}
+	product.CreatedAt = time.Now()
+	if !created {
+		product.CreatedAt = existing.CreatedAt
+		product.ArchivedAt = existing.ArchivedAt
+		product.LowStockSince = existing.LowStockSince
+		// Keep uploaded images unless the fixture names a different one
+		if product.Image == "" || product.Image == existing.Image {
+			product.Image = existing.Image
+			product.Thumbnail = existing.Thumbnail
+		}
+	}
+	if product.Image == "" {
+		product.Image = api.DefaultProductImage
+	}
+	return created, s.Products.Save(ctx, product)
+}
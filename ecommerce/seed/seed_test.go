@@ -0,0 +1,323 @@
+package seed
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ecommerce/api"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const catalogYAML = `
+categories:
+  - name: Spirits
+  - name: Whisky
+    parent: spirits
+users:
+  - id: cust
+    email: c@thedot.com
+    name: Customer
+    password: password123
+products:
+  - id: macallan-18
+    name: Macallan 18 Years
+    price: 299.99
+    stock: 15
+    category: whisky
+  - id: glenfiddich
+    name: Glenfiddich
+    category: whisky
+    variants:
+      - {sku: GF-70, size: 70cl, price: 49.99, stock: 4}
+      - {sku: GF-1L, size: 1L, price: 64.99, stock: 2}
+`
+
+// writeFixture writes a fixture file into a temporary directory
+func writeFixture(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	s := api.NewMemoryStore()
+	path := writeFixture(t, "catalog.yaml", catalogYAML)
+
+	apply := func() Report {
+		t.Helper()
+		fixture, err := LoadFile(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := Apply(ctx, s, fixture, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	if report := apply(); report != (Report{CategoriesCreated: 2, UsersCreated: 1, ProductsCreated: 2}) {
+		t.Fatalf("first run: %v", report)
+	}
+	first, err := s.Users.Get(ctx, "cust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(first.Password), []byte("password123")) != nil {
+		t.Fatal("password was not stored as a bcrypt hash")
+	}
+
+	if report := apply(); report != (Report{CategoriesUpdated: 2, UsersUpdated: 1, ProductsUpdated: 2}) {
+		t.Fatalf("second run: %v", report)
+	}
+	// An unchanged password keeps its hash rather than being salted again
+	second, err := s.Users.Get(ctx, "cust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Password != first.Password || !second.CreatedAt.Equal(first.CreatedAt) {
+		t.Fatal("re-running the fixture rewrote the user")
+	}
+	products, err := s.Products.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 2 {
+		t.Fatalf("store holds %d products, want 2", len(products))
+	}
+	gf, err := s.Products.Get(ctx, "glenfiddich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gf.Price != 49.99 || gf.Stock != 6 {
+		t.Fatalf("variants give a price of %.2f and stock of %d, want 49.99 and 6", gf.Price, gf.Stock)
+	}
+}
+
+func TestApplyRejectsInvalidFixture(t *testing.T) {
+	fortified := 40.0
+	tests := []struct {
+		name    string
+		fixture Fixture
+		err     string
+	}{
+		{
+			name:    "negative price",
+			fixture: Fixture{Products: []Product{{ID: "gin", Name: "Gin", Price: -1}}},
+			err:     "product gin",
+		},
+		{
+			name:    "unknown category",
+			fixture: Fixture{Products: []Product{{ID: "gin", Name: "Gin", Price: 39.99, Stock: 1, Category: "gin"}}},
+			err:     `unknown category "gin"`,
+		},
+		{
+			name:    "parent listed after its child",
+			fixture: Fixture{Categories: []Category{{Name: "Single Malt", Parent: "malts"}, {Name: "Malts"}}},
+			err:     `parent: unknown category "malts"`,
+		},
+		{
+			name:    "user without a password",
+			fixture: Fixture{Users: []User{{ID: "u", Email: "u@example.com", Name: "U"}}},
+			err:     "exactly one of password or password_hash",
+		},
+		{
+			name:    "user with both passwords",
+			fixture: Fixture{Users: []User{{ID: "u", Email: "u@example.com", Name: "U", Password: "a", PasswordHash: "b"}}},
+			err:     "exactly one of password or password_hash",
+		},
+		{
+			name:    "unknown role",
+			fixture: Fixture{Users: []User{{ID: "u", Email: "u@example.com", Name: "U", Password: "password123", Role: "owner"}}},
+			err:     `unknown role "owner"`,
+		},
+		{
+			name: "duplicate product id",
+			fixture: Fixture{Products: []Product{
+				{ID: "gin", Name: "Gin", Price: 39.99, Stock: 1},
+				{ID: "gin", Name: "Gin", Price: 49.99, Stock: 1},
+			}},
+			err: "product gin: duplicate id",
+		},
+		{
+			name: "sku used by two products",
+			fixture: Fixture{Products: []Product{
+				{ID: "a", Name: "A", Variants: []Variant{{SKU: "X", Size: "70cl", Price: 10}}},
+				{ID: "b", Name: "B", Variants: []Variant{{SKU: "X", Size: "70cl", Price: 10}}},
+			}},
+			err: `sku "X" used by another product`,
+		},
+		{
+			name:    "unknown kind",
+			fixture: Fixture{Categories: []Category{{Name: "Cider", Kind: "cider"}}},
+			err:     `unknown kind "cider"`,
+		},
+		{
+			name: "attributes that do not suit the kind",
+			fixture: Fixture{
+				Categories: []Category{{Name: "Wine", Kind: api.KindWine}, {Name: "Red", Parent: "wine"}},
+				Products:   []Product{{ID: "merlot", Name: "Merlot", Price: 19.99, Stock: 1, Category: "red", Attributes: Attributes{ABV: &fortified}}},
+			},
+			err: "product merlot: abv for wine products must be between 5 and 23",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := api.NewMemoryStore()
+			// Valid records alongside the bad one must not be written either
+			tt.fixture.Categories = append([]Category{{Name: "Whisky"}}, tt.fixture.Categories...)
+			tt.fixture.Products = append([]Product{{ID: "whisky", Name: "Whisky", Price: 50, Stock: 5, Category: "whisky"}}, tt.fixture.Products...)
+
+			_, err := Apply(ctx, s, &tt.fixture, Options{})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error about %s, got %v", tt.err, err)
+			}
+			if _, err := s.Categories.Get(ctx, "whisky"); !errors.Is(err, api.ErrNotFound) {
+				t.Fatalf("rejected fixture still wrote a category: %v", err)
+			}
+			if _, err := s.Products.Get(ctx, "whisky"); !errors.Is(err, api.ErrNotFound) {
+				t.Fatalf("rejected fixture still wrote a product: %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyChecksAttributesAgainstStoredCategories(t *testing.T) {
+	ctx := context.Background()
+	s := api.NewMemoryStore()
+	if _, err := Apply(ctx, s, &Fixture{Categories: []Category{{Name: "Spirits", Kind: api.KindSpirit}}}, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Gin inherits the stored Spirits kind, which has no grapes
+	fixture := &Fixture{
+		Categories: []Category{{Name: "Gin", Parent: "spirits"}},
+		Products:   []Product{{ID: "gin", Name: "Gin", Price: 39.99, Stock: 1, Category: "gin", Attributes: Attributes{Grape: "Merlot"}}},
+	}
+	if _, err := Apply(ctx, s, fixture, Options{}); err == nil || !strings.Contains(err.Error(), "grape does not apply to spirit products") {
+		t.Fatalf("expected the grape to be rejected, got %v", err)
+	}
+
+	// Re-seeding Spirits as wine in the same fixture allows it
+	fixture.Categories = append([]Category{{Name: "Spirits", Kind: api.KindWine}}, fixture.Categories...)
+	if _, err := Apply(ctx, s, fixture, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	gin, err := s.Products.Get(ctx, "gin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gin.Attributes.Grape != "Merlot" {
+		t.Fatalf("attributes not stored: %+v", gin.Attributes)
+	}
+}
+
+func TestApplyDemoUser(t *testing.T) {
+	ctx := context.Background()
+	s := api.NewMemoryStore()
+
+	if _, err := Apply(ctx, s, &Fixture{}, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Users.GetByEmail(ctx, DemoUserEmail); !errors.Is(err, api.ErrNotFound) {
+		t.Fatalf("demo user created without being asked for: %v", err)
+	}
+
+	// A generated password would have to be shown to be of any use
+	if _, err := Apply(ctx, s, &Fixture{}, Options{DemoUser: true}); !errors.Is(err, ErrDemoPasswordRequired) {
+		t.Fatalf("demo user without a password returned %v, want %v", err, ErrDemoPasswordRequired)
+	}
+	if _, err := s.Users.GetByEmail(ctx, DemoUserEmail); !errors.Is(err, api.ErrNotFound) {
+		t.Fatalf("demo user created without a password: %v", err)
+	}
+
+	if _, err := Apply(ctx, s, &Fixture{}, Options{DemoUser: true, DemoPassword: "chosen-password"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.Users.GetByEmail(ctx, DemoUserEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("chosen-password")) != nil {
+		t.Fatal("the chosen password does not log in")
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	fixture, err := LoadFile(writeFixture(t, "products.csv", "id,name,price,stock\ngin,Gin,39.99,3\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixture.Products) != 1 || fixture.Products[0].Price != 39.99 || fixture.Products[0].Stock != 3 {
+		t.Fatalf("unexpected products %+v", fixture.Products)
+	}
+
+	// The kind flag overrides the file name
+	fixture, err = LoadFile(writeFixture(t, "export.csv", "name\nWhisky\nGin\n"), "categories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixture.Categories) != 2 || fixture.Categories[1].Name != "Gin" {
+		t.Fatalf("unexpected categories %+v", fixture.Categories)
+	}
+
+	for name, content := range map[string]string{
+		"products.csv": "id,name,price,stock\ngin,Gin,cheap,3\n",
+		"orders.csv":   "id\n1\n",
+		"catalog.json": `{"products": [], "orders": []}`,
+		"catalog.yaml": "products:\n  - id: gin\n    colour: clear\n",
+		"catalog.txt":  "",
+	} {
+		if _, err := LoadFile(writeFixture(t, name, content), ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	_, err = LoadFile(writeFixture(t, "products.csv", "id,name,price,stock\ngin,Gin,39.99,3\nrum,Rum,19.99,many\n"), "")
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("expected the bad row's line number, got %v", err)
+	}
+}
+
+func TestApplyKeepsUploadedImage(t *testing.T) {
+	ctx := context.Background()
+	s := api.NewMemoryStore()
+	fixture := func(image string) *Fixture {
+		return &Fixture{Products: []Product{{ID: "gin", Name: "Gin", Price: 39.99, Stock: 3, Image: image}}}
+	}
+
+	if _, err := Apply(ctx, s, fixture(""), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	gin, err := s.Products.Update(ctx, "gin", func(p *api.Product) error {
+		p.Image, p.Thumbnail = "/media/gin_large.jpg", "/media/gin_thumb.jpg"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Apply(ctx, s, fixture(""), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Products.Get(ctx, "gin"); got.Image != gin.Image || got.Thumbnail != gin.Thumbnail {
+		t.Fatalf("re-seeding replaced the uploaded image with %q", got.Image)
+	}
+
+	// A fixture naming its own image wins, without the old thumbnail
+	if _, err := Apply(ctx, s, fixture("/static/gin.jpg"), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Products.Get(ctx, "gin"); got.Image != "/static/gin.jpg" || got.Thumbnail != "" {
+		t.Fatalf("expected the fixture image without a thumbnail, got %q and %q", got.Image, got.Thumbnail)
+	}
+}
@@ -1,13 +1,10 @@
 // Global variables
-let cart = JSON.parse(localStorage.getItem('cart') || '[]');
+let cart = []; // items of the server cart, refreshed by fetchCart
+let cartPricing = null; // the server cart's subtotal, discounts, delivery fee and total
 let currentFilter = 'all';
 let searchQuery = '';
 let selectedPaymentMethod = null;
 
-// Constants
-const FREE_DELIVERY_THRESHOLD = 100;
-const DELIVERY_FEE = 10;
-
 // Auth State Management
 function checkAuthState() {
     const token = localStorage.getItem('token');
@@ -67,7 +64,7 @@ function setupAuthForms() {
                 const email = document.getElementById('email').value;
                 const password = document.getElementById('password').value;
 
-                const response = await fetch('/api/login', {
+                const response = await fetch('/api/v1/login', {
                     method: 'POST',
                     headers: {
                         'Content-Type': 'application/json',
@@ -79,14 +76,14 @@ function setupAuthForms() {
 
                 if (response.ok) {
                     localStorage.setItem('token', data.token);
-                    localStorage.setItem('userName', data.name);
+                    localStorage.setItem('userName', data.user.name);
                     
                     showNotification('Login successful!', 'success');
                     setTimeout(() => {
                         window.location.href = '/';
                     }, 1000);
                 } else {
-                    showNotification(data.message || 'Login failed. Please try again.');
+                    showNotification(data.error || 'Login failed. Please try again.');
                 }
             } catch (error) {
                 showNotification('An error occurred. Please try again.');
@@ -119,7 +116,7 @@ function setupAuthForms() {
                 submitBtn.disabled = true;
                 submitBtn.innerHTML = '<i class="fas fa-spinner fa-spin"></i> Creating account...';
 
-                const response = await fetch('/api/register', {
+                const response = await fetch('/api/v1/register', {
                     method: 'POST',
                     headers: {
                         'Content-Type': 'application/json',
@@ -135,7 +132,7 @@ function setupAuthForms() {
                         window.location.href = '/login';
                     }, 1000);
                 } else {
-                    showNotification(data.message || 'Registration failed. Please try again.');
+                    showNotification(data.error || 'Registration failed. Please try again.');
                 }
             } catch (error) {
                 showNotification('An error occurred. Please try again.');
@@ -179,7 +176,7 @@ document.addEventListener('DOMContentLoaded', () => {
     setupProfileFunctions();
     setupModalClosers();
     updateNavigation(!!localStorage.getItem('token'));
-    updateCartCount();
+    fetchCart().then(renderCart);
 
     // Set up form handlers
     const loginForm = document.getElementById('loginForm');
@@ -200,7 +197,6 @@ document.addEventListener('DOMContentLoaded', () => {
 
     // Initialize cart page
     if (window.location.pathname.includes('/cart')) {
-        renderCart();
         setupCartPage();
     }
 });
@@ -262,34 +258,10 @@ function setupCartFunctions() {
     if (checkoutForm) {
         checkoutForm.addEventListener('submit', handleCheckout);
     }
-
-    // Load cart on cart page
-    if (window.location.pathname === '/cart') {
-        loadCart();
-    }
 }
 
 function handleAddToCart(e) {
-    const productId = e.target.dataset.productId;
-    const productName = e.target.dataset.name;
-    const productPrice = parseFloat(e.target.dataset.price);
-
-    const cart = JSON.parse(localStorage.getItem('cart')) || [];
-    const existingItem = cart.find(item => item.id === productId);
-
-    if (existingItem) {
-        existingItem.quantity += 1;
-    } else {
-        cart.push({
-            id: productId,
-            name: productName,
-            price: productPrice,
-            quantity: 1
-        });
-    }
-
-    localStorage.setItem('cart', JSON.stringify(cart));
-    showNotification('Item added to cart!');
+    addToCart(e.target.dataset.productId);
 }
 
 // Profile Management Functions
@@ -307,7 +279,7 @@ async function loadProfileData() {
     if (!token) return;
 
     try {
-        const response = await fetch('/api/profile', {
+        const response = await fetch('/api/v1/profile', {
             headers: {
                 'Authorization': `Bearer ${token}`
             }
@@ -333,13 +305,13 @@ async function handleUpdateProfile(e) {
     const formData = new FormData(e.target);
     const data = {
         name: formData.get('name'),
-        currentPassword: formData.get('currentPassword'),
-        newPassword: formData.get('newPassword')
+        current_password: formData.get('currentPassword'),
+        new_password: formData.get('newPassword')
     };
 
     try {
-        const response = await fetch('/api/profile/update', {
-            method: 'POST',
+        const response = await fetch('/api/v1/profile', {
+            method: 'PATCH',
             headers: {
                 'Content-Type': 'application/json',
                 'Authorization': `Bearer ${token}`
@@ -353,7 +325,7 @@ async function handleUpdateProfile(e) {
             checkAuthState();
         } else {
             const error = await response.json();
-            showNotification(error.message || 'Failed to update profile');
+            showNotification(error.error || 'Failed to update profile');
         }
     } catch (error) {
         showNotification('An error occurred. Please try again.');
@@ -395,20 +367,28 @@ async function handleCheckout(e) {
     }
 
     const formData = new FormData(e.target);
-    const cart = JSON.parse(localStorage.getItem('cart')) || [];
+    const items = await fetchCart();
     
     const orderData = {
-        items: cart,
-        deliveryDetails: {
+        items: items.map(item => ({
+            id: item.product_id,
+            sku: item.sku,
+            name: item.name,
+            price: item.price,
+            quantity: item.quantity
+        })),
+        delivery_details: {
             name: formData.get('name'),
             address: formData.get('address'),
+            city: formData.get('city'),
             phone: formData.get('phone')
         },
-        paymentMethod: formData.get('paymentMethod')
+        payment_method: formData.get('paymentMethod'),
+        coupon_code: cartPricing ? cartPricing.coupon_code || '' : ''
     };
 
     try {
-        const response = await fetch('/api/orders/create', {
+        const response = await fetch('/api/v1/orders', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
@@ -418,12 +398,11 @@ async function handleCheckout(e) {
         });
 
         if (response.ok) {
-            const data = await response.json();
-            localStorage.removeItem('cart');
-            window.location.href = `/order-confirmation/${data.orderId}`;
+            await clearCart();
+            window.location.href = '/profile';
         } else {
             const error = await response.json();
-            showNotification(error.message || 'Failed to create order');
+            showNotification(error.error || 'Failed to create order');
         }
     } catch (error) {
         showNotification('An error occurred. Please try again.');
@@ -456,7 +435,6 @@ function updateNavigation(isAuthenticated) {
 function logout() {
     localStorage.removeItem('token');
     localStorage.removeItem('user');
-    localStorage.removeItem('cart');
     showNotification('Logged out successfully');
     window.location.href = '/';
 }
@@ -473,11 +451,15 @@ async function authenticatedFetch(url, options = {}) {
 }
 
 // Product Functions
-async function fetchProducts() {
+async function fetchProducts(page = 1) {
+    const params = new URLSearchParams({ page, paged: true });
+    if (currentFilter !== 'all') params.set('category', currentFilter);
+    if (searchQuery) params.set('q', searchQuery);
+
     try {
-        const response = await fetch('/api/v1/products');
-        const products = await response.json();
-        displayProducts(products);
+        const response = await fetch(`/api/v1/products?${params}`);
+        const data = await response.json();
+        displayProducts(data.products);
     } catch (error) {
         console.error('Error fetching products:', error);
         showNotification('Failed to load products', 'error');
@@ -498,7 +480,7 @@ function displayProducts(products) {
                 <h3>${product.Name}</h3>
                 <p>${product.Description}</p>
                 <div class="product-price">$${product.Price.toFixed(2)}</div>
-                <button onclick="addToCart('${product.ID}', '${product.Name}', ${product.Price})" class="btn-primary">
+                <button onclick="addToCart('${product.ID}')" class="btn-primary">
                     <i class="fas fa-cart-plus"></i> Add to Cart
                 </button>
             </div>
@@ -513,10 +495,7 @@ function setupProductButtons() {
     addToCartButtons.forEach(button => {
         button.addEventListener('click', (e) => {
             e.preventDefault();
-            const { productId, name, price } = e.target.dataset;
-            addToCart(productId, name, parseFloat(price));
-            showNotification(`${name} added to cart!`, 'success');
-            updateCartCount();
+            addToCart(e.target.dataset.productId);
         });
     });
 }
@@ -526,7 +505,21 @@ function setupCartPage() {
     const proceedToDeliveryBtn = document.getElementById('proceedToDelivery');
     const proceedToPaymentBtn = document.getElementById('proceedToPayment');
     const confirmPaymentBtn = document.getElementById('confirmPayment');
-    
+    const couponForm = document.getElementById('couponForm');
+    const removeCouponBtn = document.getElementById('removeCoupon');
+
+    if (couponForm) {
+        couponForm.addEventListener('submit', (e) => {
+            e.preventDefault();
+            const code = document.getElementById('couponCode').value.trim();
+            if (code) applyCoupon(code);
+        });
+    }
+
+    if (removeCouponBtn) {
+        removeCouponBtn.addEventListener('click', removeCoupon);
+    }
+
     if (proceedToDeliveryBtn) {
         proceedToDeliveryBtn.addEventListener('click', () => {
             if (getCart().length === 0) {
@@ -613,74 +606,111 @@ function validatePaymentMethod() {
     return isValid;
 }
 
-// Cart functions
+// Cart functions. The cart is kept on the server: visitors who are not
+// logged in get a guest cart through a cookie, which is merged into their
+// account's cart when they log in.
+async function fetchCart() {
+    try {
+        const response = await authenticatedFetch('/api/v1/cart');
+        if (response.ok) {
+            const data = await response.json();
+            cart = data.items;
+            cartPricing = data;
+        }
+    } catch (error) {
+        console.error('Error loading cart:', error);
+    }
+    updateCartCount();
+    return cart;
+}
+
 function getCart() {
-    const cartData = localStorage.getItem('cart');
-    return cartData ? JSON.parse(cartData) : [];
+    return cart;
 }
 
-function saveCart(cart) {
-    localStorage.setItem('cart', JSON.stringify(cart));
+// applyCartResponse shows the cart returned by a cart change, or its error
+async function applyCartResponse(response, message) {
+    const data = await response.json();
+    if (!response.ok) {
+        showNotification(data.error || 'Failed to update cart', 'error');
+        return;
+    }
+    cart = data.items;
+    cartPricing = data;
     updateCartCount();
+    renderCart();
+    if (message) showNotification(message, 'success');
 }
 
 function updateCartCount() {
     const cartCount = document.querySelector('.cart-count');
     if (cartCount) {
-        const cart = getCart();
         cartCount.textContent = cart.length;
     }
 }
 
-function addToCart(productId, name, price) {
-    const token = localStorage.getItem('token');
-    if (!token) {
-        showNotification('Please login to add items to cart', 'error');
-        setTimeout(() => {
-            window.location.href = '/login';
-        }, 1500);
-        return;
-    }
-
-    const cart = getCart();
-    const existingItem = cart.find(item => item.id === productId);
-
-    if (existingItem) {
-        existingItem.quantity += 1;
-    } else {
-        cart.push({
-            id: productId,
-            name: name,
-            price: price,
-            quantity: 1
-        });
-    }
+async function addToCart(productId, sku = '') {
+    const response = await authenticatedFetch('/api/v1/cart/add', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ product_id: productId, sku: sku, quantity: 1 })
+    });
+    await applyCartResponse(response, 'Item added to cart');
+}
 
-    saveCart(cart);
-    showNotification('Item added to cart', 'success');
+async function removeFromCart(productId, sku = '') {
+    const query = sku ? `?sku=${encodeURIComponent(sku)}` : '';
+    const response = await authenticatedFetch(`/api/v1/cart/${productId}${query}`, {
+        method: 'DELETE'
+    });
+    await applyCartResponse(response, 'Item removed from cart');
 }
 
-function removeFromCart(productId) {
-    const cart = getCart();
-    const updatedCart = cart.filter(item => item.id !== productId);
-    saveCart(updatedCart);
-    renderCart();
-    showNotification('Item removed from cart', 'success');
+// updateQuantity changes a line's quantity by delta; the server removes the
+// line at zero and refuses more than is in stock
+async function updateQuantity(productId, sku, delta) {
+    const item = cart.find(item => item.product_id === productId && item.sku === sku);
+    if (!item) return;
+
+    const response = await authenticatedFetch(`/api/v1/cart/${productId}`, {
+        method: 'PATCH',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ sku: sku, quantity: Math.max(0, item.quantity + delta) })
+    });
+    await applyCartResponse(response);
 }
 
-function updateQuantity(productId, delta) {
-    const cart = getCart();
-    const item = cart.find(item => item.id === productId);
-    
-    if (item) {
-        item.quantity = Math.max(1, item.quantity + delta);
-        saveCart(cart);
-        renderCart();
+async function clearCart() {
+    const response = await authenticatedFetch('/api/v1/cart', {
+        method: 'DELETE'
+    });
+    if (response.ok) {
+        cart = [];
+        updateCartCount();
     }
 }
 
-function calculateTotal(cart) {
-    return cart.reduce((total, item) => total + (item.price * item.quantity), 0);
+// applyCoupon puts a coupon on the cart; the server explains why one does not apply
+async function applyCoupon(code) {
+    const response = await authenticatedFetch('/api/v1/cart/coupon', {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({ code: code })
+    });
+    await applyCartResponse(response, 'Coupon applied');
+}
+
+async function removeCoupon() {
+    const response = await authenticatedFetch('/api/v1/cart/coupon', {
+        method: 'DELETE'
+    });
+    await applyCartResponse(response, 'Coupon removed');
 }
 
 async function confirmPayment() {
@@ -708,7 +738,8 @@ async function confirmPayment() {
             },
             body: JSON.stringify({
                 items: cart.map(item => ({
-                    id: item.id,
+                    id: item.product_id,
+                    sku: item.sku,
                     name: item.name,
                     price: item.price,
                     quantity: item.quantity
@@ -721,7 +752,8 @@ async function confirmPayment() {
                     instructions: deliveryDetails.instructions || ''
                 },
                 payment_method: paymentMethod.value,
-                total: calculateTotal(cart) + DELIVERY_FEE
+                coupon_code: cartPricing.coupon_code || '',
+                total: cartPricing.total
             })
         });
 
@@ -730,8 +762,7 @@ async function confirmPayment() {
             throw new Error(error.error || 'Failed to create order');
         }
 
-        localStorage.removeItem('cart');
-        updateCartCount();
+        await clearCart();
         showNotification('Order placed successfully!', 'success');
         
         setTimeout(() => {
@@ -744,14 +775,13 @@ async function confirmPayment() {
 
 function renderCart() {
     const cartContainer = document.getElementById('cartItems');
-    const totalElement = document.getElementById('cartTotal');
-    const cart = getCart();
+    const cartSummary = document.getElementById('cartSummary');
 
     if (!cartContainer) return;
 
     if (cart.length === 0) {
-        cartContainer.innerHTML = '<p class="empty-cart">Your cart is empty</p>';
-        if (totalElement) totalElement.textContent = '$0.00';
+        cartContainer.innerHTML = '<p class="text-center">Your cart is empty</p>';
+        if (cartSummary) cartSummary.style.display = 'none';
         return;
     }
 
@@ -761,26 +791,44 @@ function renderCart() {
                 <h3>${item.name}</h3>
                 <p class="price">$${(item.price * item.quantity).toFixed(2)}</p>
             </div>
-            <div class="quantity-controls">
-                <button onclick="updateQuantity('${item.id}', -1)" class="btn-quantity">-</button>
+            <div class="item-quantity">
+                <button onclick="updateQuantity('${item.product_id}', '${item.sku}', -1)" class="quantity-btn">
+                    <i class="fas fa-minus"></i>
+                </button>
                 <span>${item.quantity}</span>
-                <button onclick="updateQuantity('${item.id}', 1)" class="btn-quantity">+</button>
+                <button onclick="updateQuantity('${item.product_id}', '${item.sku}', 1)" class="quantity-btn">
+                    <i class="fas fa-plus"></i>
+                </button>
             </div>
-            <button onclick="removeFromCart('${item.id}')" class="btn-remove">
+            <button onclick="removeFromCart('${item.product_id}', '${item.sku}')" class="remove-btn">
                 <i class="fas fa-trash"></i>
             </button>
         </div>
     `).join('');
 
-    if (totalElement) {
-        const subtotal = calculateTotal(cart);
-        const total = subtotal + DELIVERY_FEE;
-        totalElement.innerHTML = `
-            <div class="subtotal">Subtotal: $${subtotal.toFixed(2)}</div>
-            <div class="delivery-fee">Delivery Fee: $${DELIVERY_FEE.toFixed(2)}</div>
-            <div class="total">Total: $${total.toFixed(2)}</div>
-        `;
+    // Totals come from the server, which applies discounts and the delivery fee
+    const setText = (id, text) => {
+        const element = document.getElementById(id);
+        if (element) element.textContent = text;
+    };
+    setText('subtotal', `$${cartPricing.subtotal.toFixed(2)}`);
+    setText('deliveryFee', `$${cartPricing.delivery_fee.toFixed(2)}`);
+    setText('total', `$${cartPricing.total.toFixed(2)}`);
+
+    const discounts = document.getElementById('cartDiscounts');
+    if (discounts) {
+        discounts.innerHTML = cartPricing.discounts.map(discount => `
+            <div class="summary-item discount">
+                <span>${discount.name}${discount.code ? ` (${discount.code})` : ''}:</span>
+                <span>-$${discount.amount.toFixed(2)}</span>
+            </div>
+        `).join('');
     }
+    const couponCode = document.getElementById('couponCode');
+    const removeCouponBtn = document.getElementById('removeCoupon');
+    if (couponCode) couponCode.value = cartPricing.coupon_code || '';
+    if (removeCouponBtn) removeCouponBtn.style.display = cartPricing.coupon_code ? 'inline-block' : 'none';
+    if (cartSummary) cartSummary.style.display = 'block';
 }
 
 // Checkout Process